@@ -1,246 +1,1164 @@
-package main
-
-/* Implementation of Secure Indexes in Go. This script extracts keywords and builds a secure index for a file.            *
- * Given a document file (txt, pdf et...), extract text and keywords and builds a secure index file for the document      *
- * Optionally encrypts the document using AES (GCM cipher mode), or user can simply encrypt their own document seperately *
- * Encrypted document and index can then be uploaded to a server or repository.                                           *
- * Source ref: crypto.stanford.edu/~eujin/papers/secureindex/secureindex.pdf                                              */
-
-import (
-	"encoding/csv" // Import std. packages
-	"encoding/hex"
-	"fmt"
-	"io"
-	"os"
-	"path"
-	"path/filepath"
-	"strings"
-	"secureindex/bloomFilter" // Import custom packages
-	"secureindex/cryptoUtils"
-	"secureindex/textExtract"
-)
-
-const (
-	S_F = 1.5  // Scaling factor to allow for document updates
-	F_P = 0.01 // Probability of false positives found in Bloom Filter
-)
-
-/* Error handling */
-func errorCheck(msg string, err error) {
-	if err != nil {
-		fmt.Fprintf(os.Stderr, msg+"\n")
-		os.Exit(1)
-	}
-}
-
-/* Write data to a CSV file */
-func writeToCSV(filepath string, data []string) error {
-
-	// Create new file for writing out secure index
-	file, err := os.Create(filepath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	// Create file stream
-	w := csv.NewWriter(file)
-	defer w.Flush()
-
-	// Write data to file
-	wErr := w.Write(data)
-	if wErr != nil {
-		return err
-	}
-
-	return nil
-}
-
-/* Write k hash keys to file */
-func writeKeyFile(filepath string, hashKeys [][]byte) error {
-
-	// Encode k hash keys from bytes to strings.
-	var outputKeys []string
-	for x, _ := range hashKeys {
-		keyStr := hex.EncodeToString(hashKeys[x])
-		outputKeys = append(outputKeys, keyStr)
-	}
-
-	err := writeToCSV(filepath+".sindex.private", outputKeys)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-/* Read a series of k pre-saved hashkeys from a keyfile */
-func readKeyfile(filepath string) ([][]byte, error) {
-
-	// Store k private keys in array slice
-	keys := make([][]byte, 0, 0)
-
-	// Read k hash keys from CSV file
-	file, err := os.Open(filepath)
-	if err != nil {
-		return nil, err
-	}
-
-	r := csv.NewReader(file)
-
-	for {
-		record, rErr := r.Read()
-		if rErr == io.EOF {
-			break
-		}
-		if rErr != nil {
-			return nil, rErr
-		}
-
-		for r, _ := range record {
-			key, hErr := hex.DecodeString(record[r])
-			if hErr != nil {
-				return nil, hErr
-			}
-			keys = append(keys, key)
-		}
-	}
-
-	return keys, nil
-}
-
-/* Write the secure index to a CSV file */
-func writeSecureIndexFile(filepath string, indexArray []bool) error {
-
-	// Format bool array (secure index) for writing to file
-	var outputArray []string
-	for _, v := range indexArray {
-		if v {
-			outputArray = append(outputArray, "1")
-		} else {
-			outputArray = append(outputArray, "0")
-		}
-	}
-	// Write secure index to CSV file
-	err := writeToCSV(filepath+".sindex", outputArray)
-
-	return err
-}
-
-/* Takes a directory path containing files to be indexed and encrypted.					 					   *
- * User chooses to encrypt files using this script and/or build a secure index for files 					   *
- * Outputs symmetric encryption keys (for file encryption) and k cryptographic hash keys (for secure indexing) */
-func main() {
-
-	// Get directory path as user input
-	var dirpath string
-	fmt.Printf("Enter path to directory for indexing: ")
-	fmt.Scanf("%s\n", &dirpath)
-
-	// Check if user wishes to encrypt files after indexing (or user will encrypt themselves)
-	var fileEncrypt string
-	fmt.Printf("Encrypt files after index build? [y/N]: ")
-	fmt.Scanf("%s\n", &fileEncrypt)
-
-	// Load in user-specified keyfile, else generate k random hash keys
-	var keyFilepath string
-	fmt.Printf("Enter path for private index keys [leave blank to generate new keys]: ")
-	fmt.Scanf("%s\n", &keyFilepath)
-
-	hashKeys := make([][]byte, 0, 0)
-
-	// Read hash keys from file otherwise generate new set of k hash keys
-	if len(keyFilepath) == 0 {
-		hashKeys = cryptoUtils.GenerateHashKeys(F_P)
-
-		// Write new hash keys to file
-		fmt.Printf("Enter path to save new private index keys: ")
-		fmt.Scanf("%s\n", &keyFilepath)
-		_, fn := path.Split(dirpath)
-		err := writeKeyFile(keyFilepath+"/"+fn, hashKeys)
-		errorCheck("ERROR: unable to write hash keys to file.", err)
-	} else {
-		// Read hash keys from file
-		var err error
-		hashKeys, err = readKeyfile(keyFilepath)
-		errorCheck("ERROR: unable to read hash keys from file.", err)
-	}
-
-	// Walk through the directory structure and search any secure indexes found
-	files := make([]string, 0, 0)
-	sErr := filepath.Walk(dirpath, func(path string, f os.FileInfo, err error) error {
-		files = append(files, path)
-		return nil
-	})
-	errorCheck("ERROR: unable to traverse directory.", sErr)
-
-	// List all files in directory
-	//files, err := ioutil.ReadDir(dirpath)
-	//errorCheck("ERROR: unable to find directory.", err)
-
-	fmt.Printf("\n Building index for files in %s\n", dirpath)
-	fmt.Printf(" ----------------------------------\n\n")
-
-	filetypes := []string{".txt", ".csv", ".rtf", ".pdf"} //".odt", ".docx"}
-
-	// Loop over and index each file in directory
-	for _, file := range files {
-
-		indexFlag := false
-
-		for _, ft := range filetypes {
-			if strings.Contains(file, ft) {
-				indexFlag = true
-				break
-			}
-		}
-
-		if indexFlag {
-			fmt.Printf("  indexing %s\n", file)
-
-			// Extract raw text for file, extract keywords from text
-			text := textExtract.Text{file, "", make([]string, 0, 0)}
-			text.ExtractText()
-			text.ExtractKeywords()
-
-			// Create a Bloom Filter structure
-			filter := bloomFilter.BloomFilter{make([]bool, 0, 0)}
-			filter.Create(len(text.Keywords), len(hashKeys), S_F)
-
-			// Create a Secure Index structure
-			sIndex := cryptoUtils.SecureIndex{make([][]byte, 0, 0), make([][]byte, 0, 0), &filter}
-
-			var sep string
-
-			// Split filepath and obain file name
-			if strings.Contains(file, "\\") {
-				sep = "\\"
-			} else {
-				sep = "/"
-			}
-			splitName := strings.Split(file, sep)
-			fname := splitName[len(splitName)-1]
-
-			// Create trapdoors and codewords for each keyword, add to the Secure Index
-			for _, keyword := range text.Keywords {
-				sIndex.Build(fname, keyword, hashKeys)
-				sIndex.Index.Add(sIndex.Codewords)
-			}
-
-			// Perform index blinding
-			sIndex.Blind(len(text.Keywords), len(text.RawText), len(hashKeys))
-
-			// Write secure index to file
-			err := writeSecureIndexFile(file, sIndex.Index.BitArray)
-			errorCheck("ERROR: unable to write secure index to file.", err)
-
-			// Encrypt document file (if user chose to)
-			if fileEncrypt == "Y" || fileEncrypt == "y" {
-                keyFiledir, _ := path.Split(keyFilepath)
-				cryptoUtils.Encrypt(file, keyFiledir+fname)
-			}
-		}
-	}
-
-	fmt.Printf("\n Secure index builds complete.\n\n")
-}
+package main
+
+/* Implementation of Secure Indexes in Go. This script extracts keywords and builds a secure index for a file.            *
+ * Given a document file (txt, pdf et...), extract text and keywords and builds a secure index file for the document      *
+ * Optionally encrypts the document using AES (GCM cipher mode), or user can simply encrypt their own document seperately *
+ * Encrypted document and index can then be uploaded to a server or repository.                                           *
+ * Source ref: crypto.stanford.edu/~eujin/papers/secureindex/secureindex.pdf                                              */
+
+import (
+	"bytes" // Import std. packages
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+	"secureindex/bloomFilter" // Import custom packages
+	"secureindex/cryptoUtils"
+	"secureindex/indexMeta"
+	"secureindex/keywordUtils"
+	"secureindex/textExtract"
+)
+
+const (
+	S_F = 1.5  // Scaling factor to allow for document updates
+	F_P = 0.01 // Probability of false positives found in Bloom Filter
+
+	VERSION = "0.3.0" // Build tool version, recorded in the build log
+
+	CALIBRATION_PROBES = 1000 // Random non-indexed terms probed per index when calibrating
+	CALIBRATION_MARGIN = 2.0  // Warn if the measured false positive rate exceeds the target by this factor
+
+	STAGING_SUFFIX = ".building" // Outputs are written under this suffix until their build completes
+
+	MAX_ABANDONED = 8 // Most timed out builds left running in background before further files are refused
+)
+
+/* Declare custom structure for a build log entry, recording the (non-secret) keyfile *
+ * fingerprint and parameters used so a build can later be reproduced and audited     */
+type buildLogEntry struct {
+	Timestamp      string  `json:"timestamp"`
+	Version        string  `json:"version"`
+	Directory      string  `json:"directory"`
+	Keyfile        string  `json:"keyfile"`
+	KeyFingerprint string  `json:"key_fingerprint"`
+	Keys           int     `json:"keys"`
+	FalsePositive  float64 `json:"fp"`
+	Scale          float64 `json:"scale"`
+	Algorithm      string  `json:"algorithm"`
+	Filter         string  `json:"filter"`
+	Deterministic  bool    `json:"deterministic"`
+	FoldAccents    bool    `json:"fold_accents"`
+	Stem           bool    `json:"stem"`
+	MinLength      int     `json:"min_length"`
+	MaxLength      int     `json:"max_length"`
+	Hyphens        string  `json:"hyphens"`
+	Language       string  `json:"language"`
+	Stopwords      string  `json:"stopwords,omitempty"`
+	Tags           string  `json:"tags"`
+	Window         int     `json:"window,omitempty"`
+	Stride         int     `json:"stride,omitempty"`
+	MaxKeywords    int     `json:"max_keywords,omitempty"`
+	NGrams         int     `json:"ngrams,omitempty"`
+	Indexed        int     `json:"indexed"`
+	UpToDate       int     `json:"up_to_date"`
+	Skipped        int     `json:"skipped"`
+	Failed         int     `json:"failed"`
+}
+
+/* Error handling */
+func errorCheck(msg string, err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, msg)
+		os.Exit(1)
+	}
+}
+
+/* Append an entry to the build log as a line of JSON */
+func writeBuildLog(filepath string, entry buildLogEntry) error {
+
+	file, err := os.OpenFile(filepath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return json.NewEncoder(file).Encode(entry)
+}
+
+/* Write k hash keys to file, naming their HMAC hash if it isn't the default */
+func writeKeyFile(filepath string, hashKeys [][]byte, hashFunc cryptoUtils.HMACHash) error {
+	return cryptoUtils.WriteKeyFile(filepath+".sindex.private", hashKeys, hashFunc)
+}
+
+/* Declare custom structure for a file build's outputs, written to temporary files and only moved *
+ * into place once the whole build has finished, so an abandoned build leaves no partial output  */
+type stagedOutputs struct {
+	paths []string // Final paths of the outputs written, in the order they're moved into place
+}
+
+/* Write an output to a temporary file beside its final path */
+func (s *stagedOutputs) write(path string, data []byte, perm os.FileMode) error {
+
+	if err := ioutil.WriteFile(path+STAGING_SUFFIX, data, perm); err != nil {
+		os.Remove(path + STAGING_SUFFIX)
+		return err
+	}
+	s.paths = append(s.paths, path)
+
+	return nil
+}
+
+/* Reserve a temporary path beside an output's final path, for an output written elsewhere */
+func (s *stagedOutputs) stage(path string) string {
+
+	s.paths = append(s.paths, path)
+
+	return path + STAGING_SUFFIX
+}
+
+/* Move the outputs into place, in the order they were written */
+func (s *stagedOutputs) commit() error {
+
+	for i, path := range s.paths {
+		if err := os.Rename(path+STAGING_SUFFIX, path); err != nil {
+			s.paths = s.paths[i:]
+			s.discard()
+			return err
+		}
+	}
+	s.paths = nil
+
+	return nil
+}
+
+/* Remove any outputs not yet moved into place */
+func (s *stagedOutputs) discard() {
+
+	for _, path := range s.paths {
+		os.Remove(path + STAGING_SUFFIX)
+	}
+	s.paths = nil
+}
+
+/* Declare custom structure deciding whether a file's build commits its outputs or is abandoned *
+ * at its time limit, so a build reported as timed out never leaves any output behind          */
+type buildGate struct {
+	mu        sync.Mutex
+	committed bool
+	finished  bool
+	abandoned bool
+
+	outstanding *abandonedBuilds // Counts the build while it runs on after being abandoned, if set
+}
+
+/* Declare custom structure counting abandoned builds still running in background, as each *
+ * holds a goroutine (and whatever its extraction is stuck on) until it finishes, if ever   */
+type abandonedBuilds struct {
+	mu    sync.Mutex
+	count int
+	limit int
+}
+
+// Abandoned builds of this run still running in background
+var abandoned = &abandonedBuilds{limit: MAX_ABANDONED}
+
+/* Check whether as many abandoned builds as allowed are still running */
+func (a *abandonedBuilds) full() bool {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.count >= a.limit
+}
+
+/* Add to (or with -1 remove from) the count of abandoned builds still running */
+func (a *abandonedBuilds) add(n int) {
+
+	a.mu.Lock()
+	a.count += n
+	a.mu.Unlock()
+}
+
+/* Move a build's staged outputs into place, unless its context has expired */
+func (g *buildGate) commit(ctx context.Context, staged *stagedOutputs) error {
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		staged.discard()
+		return err
+	}
+	g.committed = true
+
+	return staged.commit()
+}
+
+/* Abandon a build once its context has expired, returning false if it had already begun *
+ * committing its outputs (and so must be waited for)                                   */
+func (g *buildGate) abandon() bool {
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.committed {
+		return false
+	}
+	if !g.finished && !g.abandoned && g.outstanding != nil {
+		g.outstanding.add(1)
+	}
+	g.abandoned = true
+
+	return true
+}
+
+/* Record that a build has returned, no longer counting it if it had been abandoned */
+func (g *buildGate) finish() {
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.abandoned && !g.finished && g.outstanding != nil {
+		g.outstanding.add(-1)
+	}
+	g.finished = true
+}
+
+/* Read a single line from an unbuffered reader, leaving any further input (e.g. answers *
+ * to later prompts) unread                                                             */
+func readLine(r io.Reader) (string, error) {
+
+	line := make([]byte, 0, 0)
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n > 0 {
+			if b[0] == '\n' {
+				return strings.TrimSuffix(string(line), "\r"), nil
+			}
+			line = append(line, b[0])
+		}
+		if err == io.EOF && len(line) > 0 {
+			return strings.TrimSuffix(string(line), "\r"), nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+/* Prompt for an answer on stdin, reading the whole line so answers (e.g. paths) may contain spaces */
+func prompt(question string) string {
+
+	fmt.Printf("%s", question)
+	line, _ := readLine(os.Stdin)
+
+	return strings.TrimSpace(line)
+}
+
+/* Read a list of document paths, one per line, from a file or from stdin ("-"). A list *
+ * read from stdin ends at a blank line so the remaining prompts can still be answered  */
+func readFileList(listPath string) ([]string, error) {
+
+	files := make([]string, 0, 0)
+
+	if listPath == "-" {
+		for {
+			line, err := readLine(os.Stdin)
+			if err == io.EOF || (err == nil && len(strings.TrimSpace(line)) == 0) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, strings.TrimSpace(line))
+		}
+		return files, nil
+	}
+
+	data, err := ioutil.ReadFile(listPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			files = append(files, line)
+		}
+	}
+
+	return files, nil
+}
+
+// Returned when a file has no usable text to index (the reason has already been reported)
+var errNoText = errors.New("no text content to index")
+
+// Returned for files not started while too many timed out builds are still running in background
+var errTooManyAbandoned = fmt.Errorf("%d timed out builds are still running, not starting another", MAX_ABANDONED)
+
+// Returned when no keywords were extracted from some text
+var errNoKeywords = errors.New("no keywords to index")
+
+/* Declare custom structure for the options used to build each file's secure index */
+type buildOptions struct {
+	deterministic bool
+	blocked       bool
+	scale         float64
+	foldAccents   bool
+	stem          bool
+	minLength     int
+	maxLength     int
+	encrypt       bool
+	cipher        cryptoUtils.Cipher
+	keySize       int
+	keyDir        string // Directory documents' encryption keys are written under, mirroring the directory indexed
+	calibrate     bool
+	fp            float64
+	window        int
+	stride        int
+	headings      bool
+	entities      bool
+	hyphens       string
+	language      string
+	stopwordFile  string
+	tags          []string
+	maxKeywords   int
+	ngrams        int
+	signKey       ed25519.PrivateKey
+	hash          cryptoUtils.HMACHash
+	keywordKey    []byte
+	stableID      bool
+	root          string
+	extractor     textExtract.KeywordExtractor // Defaults to the text's ProseExtractor when nil
+}
+
+/* Fingerprint the build options affecting a secure index's contents, recorded in its metadata *
+ * so an index built with different options isn't mistaken for being up to date               */
+func (opts buildOptions) fingerprint() string {
+
+	settings := struct {
+		Deterministic bool
+		Blocked       bool
+		Scale         float64
+		FoldAccents   bool
+		Stem          bool
+		MinLength     int
+		MaxLength     int
+		Headings      bool
+		Entities      bool
+		Hyphens       string
+		Language      string
+		Stopwords     string
+		Tags          []string
+		MaxKeywords   int
+		NGrams        int
+		Hash          cryptoUtils.HMACHash
+		StableID      bool
+		Signed        bool
+		KeywordCache  bool
+	}{opts.deterministic, opts.blocked, opts.scale, opts.foldAccents, opts.stem, opts.minLength, opts.maxLength, opts.headings,
+		opts.entities, opts.hyphens, opts.language, opts.stopwordFile, opts.tags, opts.maxKeywords, opts.ngrams, opts.hash,
+		opts.stableID, opts.signKey != nil, opts.keywordKey != nil}
+
+	data, _ := json.Marshal(settings)
+	digest := sha256.Sum256(data)
+
+	return hex.EncodeToString(digest[:16])
+}
+
+/* Build the secure index for a single file, optionally encrypting the file. With a *
+ * window size, a sub-index is built for each sliding window of the file's words    *
+ * instead. Outputs are only moved into place if the gate commits them before the   *
+ * context expires                                                                  */
+func indexFile(ctx context.Context, gate *buildGate, file string, hashKeys [][]byte, opts buildOptions) error {
+
+	// Extract raw text for file
+	text := textExtract.Text{Filepath: file, Keywords: make([]string, 0, 0), IncludeHeadings: opts.headings, IncludeEntities: opts.entities}
+	text.ExtractText()
+	if len(text.RawText) == 0 {
+		return errNoText
+	}
+	if len(strings.TrimSpace(text.RawText)) == 0 {
+		fmt.Println("INFO: only whitespace found in ", file, " (skipping file)")
+		return errNoText
+	}
+
+	ext := strings.ToLower(filepath.Ext(file))
+	if len(ext) == 0 {
+		ext = sniffType(file)
+	}
+
+	// Bind codewords to the document's path within the directory indexed, so same-named documents in
+	// different folders get distinct codewords, or to a stable identifier of the document's contents
+	docID := documentPath(opts.root, file)
+	if opts.stableID {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		docID = cryptoUtils.DocumentID(hashKeys, content)
+	}
+
+	staged := new(stagedOutputs)
+	defer staged.discard()
+
+	if opts.window > 0 {
+		// Name each window's sub-index with its range of words, e.g. "report.pdf#w0-200"
+		built := 0
+		for _, w := range text.Windows(opts.window, opts.stride) {
+			suffix := fmt.Sprintf("#w%d-%d", w.Start, w.End)
+			err := buildIndex(ctx, staged, file+suffix, docID+suffix, ext, w.Text, inWindow(text.Headings, w.Text), inWindow(text.Entities, w.Text), hashKeys, opts)
+			if err == errNoKeywords {
+				fmt.Println("INFO: no keywords found in ", file+suffix, " (skipping window)")
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			built++
+		}
+		if built == 0 {
+			return errNoText
+		}
+	} else {
+		err := buildIndex(ctx, staged, file, docID, ext, text.RawText, text.Headings, text.Entities, hashKeys, opts)
+		if err == errNoKeywords {
+			fmt.Println("INFO: no keywords found in ", file, " (skipping file)")
+			return errNoText
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Encrypt document file (if user chose to), bound to its index's document identifier. The
+	// encrypted copy and its key are staged like the indexes, so those of an earlier build stay
+	// in place unless this one completes. Encryption stops if the context expires
+	if opts.encrypt {
+		keyPath := documentKeyPath(opts.keyDir, opts.root, file) + ".encrypted.private"
+		if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+			return err
+		}
+		encryptOpts := cryptoUtils.EncryptOptions{Cipher: opts.cipher, KeySize: opts.keySize, AssociatedData: []byte(docID)}
+		if err := cryptoUtils.EncryptToWithOptions(ctx, file, staged.stage(file+".encrypted.data"), staged.stage(keyPath), encryptOpts); err != nil {
+			return err
+		}
+	}
+
+	// Move the outputs into place only if the file hasn't been abandoned in the meantime
+	return gate.commit(ctx, staged)
+}
+
+/* Identify a document by its path relative to the root directory being indexed, e.g.  *
+ * "reports/2019/summary.pdf", with forward slashes whatever the platform              */
+func documentPath(root string, file string) string {
+
+	rel, err := relativePath(root, file)
+	if err != nil {
+		return filepath.Base(file)
+	}
+
+	return filepath.ToSlash(rel)
+}
+
+/* Path of a file relative to a directory, comparing their absolute paths so either may *
+ * be given relative to the working directory                                          */
+func relativePath(root string, file string) (string, error) {
+
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	absFile, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Rel(absRoot, absFile)
+}
+
+/* Check a file lies within the root directory being indexed, so it is identified by a *
+ * path the server accepts rather than one climbing out of the root (e.g. "../a.pdf")  */
+func withinRoot(root string, file string) bool {
+
+	rel, err := relativePath(root, file)
+
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+/* Path of a document's encryption key (without its ".encrypted.private" suffix): the document's *
+ * path within the root directory, under the key directory, so same-named documents in different *
+ * folders (e.g. "a/report.pdf" and "b/report.pdf") keep separate keys                           */
+func documentKeyPath(keyDir string, root string, file string) string {
+	return filepath.Join(keyDir, filepath.FromSlash(documentPath(root, file)))
+}
+
+/* Check whether a file is a supported document type, by its name or, for files *
+ * without an extension (e.g. in content-addressed stores), by its content      */
+func indexable(file string) bool {
+
+	filetypes := []string{".txt", ".csv", ".rtf", ".pdf"} //".odt", ".docx"}
+
+	// Match the extension alone, so the build's own outputs (e.g. "report.txt.sindex") aren't indexed
+	for _, ft := range filetypes {
+		if strings.ToLower(filepath.Ext(file)) == ft {
+			return true
+		}
+	}
+
+	return len(filepath.Ext(file)) == 0 && len(sniffType(file)) > 0
+}
+
+/* Walk a directory tree, collecting the supported documents to index at any depth. *
+ * Directories are skipped, even those named like a document (e.g. "notes.txt.d")   */
+func collectDocuments(dirpath string) ([]string, error) {
+
+	files := make([]string, 0, 0)
+	err := filepath.Walk(dirpath, func(path string, f os.FileInfo, err error) error {
+		if err == nil && !f.IsDir() && indexable(path) {
+			files = append(files, path)
+		}
+		return nil
+	})
+
+	return files, err
+}
+
+/* Identify an indexable document type from a file's content, for files without an *
+ * extension, returning the type's usual extension (e.g. ".pdf") or "" if unknown   */
+func sniffType(file string) string {
+
+	f, err := os.Open(file)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	// Content sniffing only considers the first 512 bytes
+	head := make([]byte, 512)
+	n, _ := f.Read(head)
+	if n == 0 {
+		return ""
+	}
+	head = head[:n]
+
+	// RTF isn't among the types recognised by http.DetectContentType
+	if bytes.HasPrefix(head, []byte("{\\rtf")) {
+		return ".rtf"
+	}
+
+	mime := http.DetectContentType(head)
+	switch {
+	case mime == "application/pdf":
+		return ".pdf"
+	case strings.HasPrefix(mime, "text/plain"):
+		return ".txt"
+	}
+
+	return ""
+}
+
+/* Select the headings or entities whose words appear within a window's text */
+func inWindow(phrases []string, windowText string) []string {
+
+	selected := make([]string, 0, 0)
+	for _, phrase := range phrases {
+		if strings.Contains(windowText, strings.Join(strings.Fields(phrase), " ")) {
+			selected = append(selected, phrase)
+		}
+	}
+
+	return selected
+}
+
+/* Build a secure index for some text, staging it to be written to indexPath + ".sindex". The *
+ * document ID binds codewords to this index and is recorded in its metadata for searches     */
+func buildIndex(ctx context.Context, staged *stagedOutputs, indexPath string, docID string, ext string, rawText string, headings []string, entities []string, hashKeys [][]byte, opts buildOptions) error {
+
+	// Extract keywords from text
+	text := textExtract.Text{Filepath: indexPath, RawText: rawText, Keywords: make([]string, 0, 0), Headings: headings, Entities: entities, MaxKeywords: opts.maxKeywords, NGrams: opts.ngrams, Tags: opts.tags}
+	text.Normalization = keywordUtils.Options{FoldAccents: opts.foldAccents, Hyphens: opts.hyphens, Stem: opts.stem, MinLength: opts.minLength, MaxLength: opts.maxLength}
+	text.Language, text.StopwordFile = opts.language, opts.stopwordFile
+	text.Extractor = opts.extractor
+	if err := text.ExtractKeywords(); err != nil {
+		return err
+	}
+
+	// An index without keywords would be degenerate (a zero length filter)
+	if len(text.Keywords) == 0 {
+		return errNoKeywords
+	}
+
+	// Create a Bloom Filter structure
+	filter := bloomFilter.BloomFilter{Variant: bloomFilter.STANDARD}
+	if opts.blocked {
+		filter.Variant = bloomFilter.BLOCKED
+	}
+	// With a fixed keyword count every index is sized alike, however few keywords it has
+	capacity := len(text.Keywords)
+	if opts.maxKeywords > 0 {
+		capacity = opts.maxKeywords
+	}
+	filter.Create(len(hashKeys), capacity, opts.scale)
+
+	// Create a Secure Index structure
+	meta := indexMeta.Metadata{Extension: ext, Filter: filter.Variant, KeyFingerprint: cryptoUtils.KeyFingerprint(hashKeys), DocumentID: docID, BuildOptions: opts.fingerprint()}
+	if opts.hash != cryptoUtils.HMAC_SHA256 {
+		meta.HMAC = string(opts.hash)
+	}
+	sIndex := cryptoUtils.SecureIndex{Trapdoors: make([][]byte, 0, 0), Codewords: make([][]byte, 0, 0), Index: &filter, Meta: &meta, Hash: opts.hash}
+
+	// Create trapdoors and codewords for each keyword, add to the Secure Index
+	for _, keyword := range text.Keywords {
+		sIndex.Build(docID, keyword, hashKeys)
+		sIndex.Index.Add(sIndex.Codewords)
+	}
+
+	// Perform index blinding, optionally deriving the randomness from the keys and document ID
+	var err error
+	if opts.deterministic {
+		err = sIndex.BlindFrom(cryptoUtils.DeterministicBlinding(hashKeys, docID), capacity, len(text.RawText), len(hashKeys))
+	} else {
+		err = sIndex.Blind(capacity, len(text.RawText), len(hashKeys))
+	}
+	if err != nil {
+		return err
+	}
+
+	// Optionally measure the index's actual false positive rate against the target
+	if opts.calibrate {
+		rate, err := cryptoUtils.MeasureFalsePositivesWith(opts.hash, sIndex.Index, docID, hashKeys, CALIBRATION_PROBES)
+		if err != nil {
+			return err
+		}
+		if rate > opts.fp*CALIBRATION_MARGIN {
+			fmt.Fprintf(os.Stderr, "WARNING: %s measured false positive rate %.4f exceeds target %v.\n", indexPath, rate, opts.fp)
+		}
+	} else if estimate := sIndex.Index.FalsePositiveRate(); estimate > opts.fp*CALIBRATION_MARGIN {
+		// Otherwise estimate it from how saturated keyword insertion and blinding left the filter
+		fmt.Fprintf(os.Stderr, "WARNING: %s estimated false positive rate %.4f exceeds target %v.\n", indexPath, estimate, opts.fp)
+	}
+
+	// Don't write any output for a file that has been abandoned
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Encode the secure index in the Bloom Filter's compact binary format
+	data, err := sIndex.Index.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	// Sign the index and its metadata so servers can verify they haven't been tampered with
+	if opts.signKey != nil {
+		if err := cryptoUtils.SignIndex(opts.signKey, data, sIndex.Meta); err != nil {
+			return err
+		}
+	}
+
+	// Stage the metadata (recording the source document's type) and keyword cache ahead of the
+	// index, so they are in place by the time the index is
+	metaData, err := indexMeta.Marshal(sIndex.Meta)
+	if err != nil {
+		return err
+	}
+	if err := staged.write(indexPath+".sindex"+indexMeta.FILE_SUFFIX, metaData, 0644); err != nil {
+		return err
+	}
+
+	// Optionally retain the keywords, encrypted, so the index can be rekeyed without the document
+	if opts.keywordKey != nil {
+		cache := cryptoUtils.KeywordCache{DocumentID: docID, Keywords: text.Keywords, Capacity: capacity, DocSize: len(text.RawText), Scale: opts.scale}
+		sealed, err := cryptoUtils.SealKeywordCache(opts.keywordKey, &cache)
+		if err != nil {
+			return err
+		}
+		if err := staged.write(indexPath+".sindex"+cryptoUtils.KEYWORD_CACHE_SUFFIX, sealed, 0600); err != nil {
+			return err
+		}
+	}
+
+	return staged.write(indexPath+".sindex", data, 0644)
+}
+
+/* Build the secure index for a file within a time limit. A file whose extraction  *
+ * hangs can't be interrupted, so it is abandoned and left to finish in background *
+ * without writing any output, returning context.DeadlineExceeded. A build already *
+ * moving its outputs into place at the time limit is allowed to finish. Once      *
+ * MAX_ABANDONED builds are left running, further files are refused until they end *
+ * rather than leaving ever more goroutines stuck                                  */
+func indexFileWithTimeout(file string, hashKeys [][]byte, opts buildOptions, timeout time.Duration) error {
+
+	if abandoned.full() {
+		return errTooManyAbandoned
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	gate := &buildGate{outstanding: abandoned}
+	done := make(chan error, 1)
+	go func() {
+		err := indexFile(ctx, gate, file, hashKeys, opts)
+		gate.finish()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if gate.abandon() {
+			return ctx.Err()
+		}
+		return <-done
+	}
+}
+
+/* Check whether a file's secure index is up to date: newer than the file, built with the *
+ * same keys and options and bound to the document's current path. Windowed builds write  *
+ * an index per window, so are never up to date                                           */
+func upToDate(file string, fingerprint string, opts buildOptions) bool {
+
+	source, err := os.Stat(file)
+	if err != nil {
+		return false
+	}
+	index, err := os.Stat(file + ".sindex")
+	if err != nil || index.ModTime().Before(source.ModTime()) {
+		return false
+	}
+
+	meta, err := indexMeta.Read(file + ".sindex")
+	if err != nil || meta.KeyFingerprint != fingerprint || meta.BuildOptions != opts.fingerprint() {
+		return false
+	}
+
+	// Documents moved within the directory indexed are bound to their new path
+	return opts.stableID || meta.DocumentID == documentPath(opts.root, file)
+}
+
+/* Declare custom structure for the outcome of a file's index build */
+type buildOutcome struct {
+	file string
+	err  error
+}
+
+/* Build the secure indexes for files concurrently with a pool of workers, passing each *
+ * file's outcome to report as it completes. Files are independent, each build writing  *
+ * only its own outputs, and outcomes are reported from the calling goroutine alone      */
+func indexFiles(files []string, hashKeys [][]byte, opts buildOptions, timeout time.Duration, workers int, report func(buildOutcome)) {
+
+	jobs := make(chan string)
+	done := make(chan buildOutcome)
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			for file := range jobs {
+				// Listed files may no longer exist
+				if _, err := os.Stat(file); err != nil {
+					done <- buildOutcome{file, err}
+					continue
+				}
+				done <- buildOutcome{file, indexFileWithTimeout(file, hashKeys, opts, timeout)}
+			}
+		}()
+	}
+
+	go func() {
+		for _, file := range files {
+			jobs <- file
+		}
+		close(jobs)
+	}()
+
+	for range files {
+		report(<-done)
+	}
+}
+
+/* Takes a directory path containing files to be indexed and encrypted.					 					   *
+ * User chooses to encrypt files using this script and/or build a secure index for files 					   *
+ * Outputs symmetric encryption keys (for file encryption) and k cryptographic hash keys (for secure indexing) */
+func main() {
+
+	// Get user-specified build options
+	deterministic := flag.Bool("deterministic", false, "derive index blinding from the hash keys so identical inputs give identical indexes")
+	blocked := flag.Bool("blocked", false, "build cache-friendly blocked Bloom Filters (slightly higher false positive rate)")
+	fp := flag.Float64("fp", F_P, "target probability of false positives, determines the number of hash keys")
+	scale := flag.Float64("scale", S_F, "Bloom Filter scaling factor allowing for document updates")
+	buildLog := flag.String("buildlog", "", "file to append the build log to (default: sindex-build.log in the indexed directory)")
+	force := flag.Bool("force", false, "rebuild every file's index, even those newer than their file and built with the same keys")
+	concurrency := flag.Int("concurrency", runtime.GOMAXPROCS(0), "number of files to index concurrently")
+	timeout := flag.Duration("timeout", 5*time.Minute, "abandon a file if building its index takes longer than this (0 for no limit)")
+	calibrateFP := flag.Bool("calibrate", false, "after building each index, measure its false positive rate with random terms and warn if it exceeds -fp (slower)")
+	fileList := flag.String("filelist", "", "index the documents listed in this file, one path per line, instead of a directory (\"-\" reads the list from stdin up to a blank line)")
+	rootFlag := flag.String("root", ".", "with -filelist, directory listed documents are identified relative to, documents outside it are skipped")
+	window := flag.Int("window", 0, "build a sub-index for each window of this many words instead of one per file (0 to disable)")
+	stride := flag.Int("stride", 0, "words between the starts of consecutive windows, less than -window to overlap them (default: -window)")
+	headings := flag.Bool("headings", false, "detect headings (all caps, markdown or numbered lines) and always index their terms")
+	entities := flag.Bool("entities", false, "detect named entities (people, organisations, places) and index each, multi-word entities joined by \""+keywordUtils.PHRASE_SEPARATOR+"\" (slower)")
+	tags := flag.String("tags", strings.Join(textExtract.NOUN_TAGS, ","), "comma separated part-of-speech tags of the words kept as keywords, a trailing * matching any tag it prefixes, e.g. NN,NNS,NNP,NNPS for nouns including proper nouns, or NN*,VB*,JJ* for nouns, verbs and adjectives")
+	ngrams := flag.Int("ngrams", 1, "also index phrases of 2 up to this many adjacent nouns, e.g. \"machine learning\" (1 for single words only)")
+	maxKeywords := flag.Int("keywords", 0, "index only this many of each document's most frequent keywords, sizing every index for this many so indexes look alike (0 for all)")
+	stableID := flag.Bool("stableid", false, "bind each index to an identifier of its document's contents instead of its path, so a document keeps its identifier wherever it is rebuilt")
+	signKeyFile := flag.String("signkey", "", "sign each index with this Ed25519 key (created with its \".pub\" public key if missing) for servers to verify")
+	language := flag.String("language", textExtract.LANGUAGE_EN, "language of the documents, selecting the stopwords removed before keyword extraction: en, es, fr or de")
+	stopwordFile := flag.String("stopwords", "", "file of stopwords to remove instead of -language's, one per line")
+	hyphens := flag.String("hyphens", keywordUtils.HYPHENS_WHOLE, "hyphenated keyword handling: whole, split or both (the search client must use the same setting)")
+	foldAccents := flag.Bool("foldaccents", false, "accent- and case-insensitive keywords (the search client must use the same setting)")
+	minLength := flag.Int("minlength", keywordUtils.MIN_LENGTH, "drop keywords shorter than this many characters (the search client must use the same setting)")
+	maxLength := flag.Int("maxlength", keywordUtils.MAX_LENGTH, "drop keywords with a word longer than this many characters, e.g. PDF extraction artefacts (the search client must use the same setting)")
+	stem := flag.Bool("stem", false, "index the English stems of keywords, e.g. \"run\" for \"running\" and \"runs\" (the search client must use the same setting)")
+	keywordKeyFile := flag.String("keywordkey", "", "keep each index's keywords in a \".keywords\" file encrypted with this 32 byte key (created if missing), so siRekeyIndex can rebuild indexes under new hash keys")
+	hmacName := flag.String("hmac", string(cryptoUtils.HMAC_SHA256), "hash for the HMACs building trapdoors and codewords of new keyfiles: sha256, sha512 or blake2b (existing keyfiles record their own)")
+	cipherName := flag.String("cipher", cryptoUtils.AES_GCM.String(), "cipher for encrypting documents: aes-gcm, chacha20-poly1305 for machines without AES hardware support, or aes-ctr-hmac (encrypt-then-MAC)")
+	keyBits := flag.Int("keybits", 256, "document encryption key size: 256, or 128 for AES-128 (not with chacha20-poly1305)")
+	dirFlag := flag.String("dir", "", "directory of documents to index; settings not given by flags then take their defaults rather than being prompted for")
+	encryptFlag := flag.Bool("encrypt", false, "encrypt documents after indexing them")
+	keyfileFlag := flag.String("keyfile", "", "private index keys to build with (default: generate new keys)")
+	keyOut := flag.String("keyout", "", "directory to save newly generated private index keys in, as <directory name>.sindex.private")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: siBuildIndex [options]\n\n")
+		fmt.Fprintf(os.Stderr, "Builds a secure index for each document in a directory (-dir) or list of files (-filelist).\n")
+		fmt.Fprintf(os.Stderr, "Without -dir, prompts for the directory and for any of -encrypt, -keyfile and -keyout not given.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// Settings given on the command line aren't prompted for, nor is anything once -dir is given
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	interactive := len(*dirFlag) == 0
+	if len(*dirFlag) > 0 && len(*fileList) > 0 {
+		fmt.Println("ERROR: give either -dir or -filelist, not both.")
+		return
+	}
+	if given["root"] && len(*fileList) == 0 {
+		fmt.Println("ERROR: -root applies to -filelist, documents in a -dir are identified relative to it.")
+		return
+	}
+
+	if *minLength < 1 || *maxLength < *minLength {
+		fmt.Println("ERROR: -minlength must be at least 1 and -maxlength at least -minlength.")
+		return
+	}
+	if *ngrams < 1 {
+		fmt.Println("ERROR: -ngrams must be at least 1.")
+		return
+	}
+	posTags := make([]string, 0, 0)
+	for _, tag := range strings.Split(*tags, ",") {
+		if tag = strings.ToUpper(strings.TrimSpace(tag)); len(tag) > 0 {
+			posTags = append(posTags, tag)
+		}
+	}
+	if len(posTags) == 0 {
+		fmt.Println("ERROR: -tags must name at least one part-of-speech tag, e.g. NN.")
+		return
+	}
+	if !textExtract.ValidLanguage(*language) {
+		fmt.Println("ERROR: -language must be en, es, fr or de.")
+		return
+	}
+	if len(*stopwordFile) > 0 {
+		if _, err := os.Stat(*stopwordFile); err != nil {
+			fmt.Printf("ERROR: unable to find stopword file %s.\n", *stopwordFile)
+			return
+		}
+	}
+	if !keywordUtils.ValidHyphens(*hyphens) {
+		fmt.Println("ERROR: -hyphens must be whole, split or both.")
+		return
+	}
+	fileCipher, err := cryptoUtils.ParseCipher(*cipherName)
+	if err != nil {
+		fmt.Println("ERROR: -cipher must be aes-gcm, chacha20-poly1305 or aes-ctr-hmac.")
+		return
+	}
+	if *keyBits != 128 && *keyBits != 256 || *keyBits == 128 && fileCipher == cryptoUtils.CHACHA20_POLY1305 {
+		fmt.Println("ERROR: -keybits must be 128 or 256, and 256 with chacha20-poly1305.")
+		return
+	}
+	if *concurrency < 1 {
+		fmt.Println("ERROR: -concurrency must be at least 1.")
+		return
+	}
+	hashFunc, err := cryptoUtils.ParseHMACHash(*hmacName)
+	if err != nil {
+		fmt.Println("ERROR: -hmac must be sha256, sha512 or blake2b.")
+		return
+	}
+
+	// Read an explicit list of documents to index, else get directory path as user input
+	var dirpath string
+	files := make([]string, 0, 0)
+	if len(*fileList) > 0 {
+		listed, err := readFileList(*fileList)
+		errorCheck("ERROR: unable to read list of files to index.", err)
+		dirpath = *rootFlag
+		if info, err := os.Stat(dirpath); err != nil || !info.IsDir() {
+			fmt.Printf("ERROR: -root %q is not a directory.\n", dirpath)
+			os.Exit(1)
+		}
+
+		// Skip listed files that aren't supported documents, or lie outside the root so
+		// couldn't be identified by a path within it
+		for _, file := range listed {
+			if !withinRoot(dirpath, file) {
+				fmt.Println("INFO: ", file, " is outside -root ", dirpath, " (skipping file)")
+				continue
+			}
+			if indexable(file) {
+				files = append(files, file)
+			}
+		}
+	} else {
+		dirpath = *dirFlag
+		if interactive {
+			dirpath = prompt("Enter path to directory for indexing: ")
+		}
+
+		// Check the directory before generating keys or building anything
+		if info, err := os.Stat(dirpath); err != nil || !info.IsDir() {
+			fmt.Printf("ERROR: %q is not a directory.\n", dirpath)
+			os.Exit(1)
+		}
+	}
+
+	// Check if user wishes to encrypt files after indexing (or user will encrypt themselves)
+	encrypt := *encryptFlag
+	if interactive && !given["encrypt"] {
+		answer := prompt("Encrypt files after index build? [y/N]: ")
+		encrypt = answer == "Y" || answer == "y"
+	}
+
+	if !interactive && len(*keyfileFlag) == 0 && len(*keyOut) == 0 {
+		fmt.Println("ERROR: give -keyout to save new private index keys in, or -keyfile to use existing keys.")
+		os.Exit(1)
+	}
+
+	// Load in user-specified keyfile, else generate k random hash keys
+	keyFilepath := *keyfileFlag
+	if interactive && !given["keyfile"] && !given["keyout"] {
+		keyFilepath = prompt("Enter path for private index keys [leave blank to generate new keys]: ")
+	}
+
+	hashKeys := make([][]byte, 0, 0)
+	keyfileUsed := keyFilepath
+
+	// Read hash keys from file otherwise generate new set of k hash keys
+	if len(keyFilepath) == 0 {
+		var err error
+		hashKeys, err = cryptoUtils.GenerateHashKeys(*fp)
+		errorCheck("ERROR: unable to generate index keys.", err)
+
+		// Write new hash keys to file, named after the indexed directory
+		keyFilepath = *keyOut
+		if interactive && !given["keyout"] {
+			keyFilepath = prompt("Enter path to save new private index keys: ")
+		}
+		if len(keyFilepath) == 0 {
+			fmt.Println("ERROR: give -keyout to save new private index keys in, or -keyfile to use existing keys.")
+			os.Exit(1)
+		}
+		absDir, err := filepath.Abs(dirpath)
+		errorCheck("ERROR: unable to find directory for indexing.", err)
+		fn := filepath.Base(absDir)
+		err = writeKeyFile(filepath.Join(keyFilepath, fn), hashKeys, hashFunc)
+		errorCheck("ERROR: unable to write hash keys to file.", err)
+		keyfileUsed = filepath.Join(keyFilepath, fn) + ".sindex.private"
+	} else {
+		// Read hash keys from file, always using the HMAC hash the keyfile records
+		var err error
+		var keyfileHash cryptoUtils.HMACHash
+		hashKeys, keyfileHash, err = cryptoUtils.ReadKeyFileHash(keyFilepath)
+		errorCheck("ERROR: unable to read hash keys from file.", err)
+		if keyfileHash != hashFunc && hashFunc != cryptoUtils.HMAC_SHA256 {
+			fmt.Printf("WARNING: keyfile is used with %s HMACs, ignoring -hmac %s.\n", keyfileHash, hashFunc)
+		}
+		hashFunc = keyfileHash
+
+		// Warn if the keyfile was generated for a different false positive rate than requested,
+		// allowing for the extra key earlier versions generated
+		expected := cryptoUtils.NumHashKeys(*fp)
+		if len(hashKeys) == expected+1 {
+			fmt.Printf("NOTE: keyfile contains %d hash keys, as generated for -fp %v by earlier versions. It remains usable, with indexes and searches using all %d keys.\n", len(hashKeys), *fp, len(hashKeys))
+		} else if len(hashKeys) != expected {
+			fmt.Printf("WARNING: keyfile contains %d hash keys but -fp %v implies %d.\n", len(hashKeys), *fp, expected)
+			if !interactive {
+				fmt.Println("Index build aborted, give the -fp the keyfile was generated for.")
+				os.Exit(1)
+			}
+			proceed := prompt(fmt.Sprintf("Proceed using the keyfile's %d hash keys? [y/N]: ", len(hashKeys)))
+			if proceed != "Y" && proceed != "y" {
+				fmt.Println("Index build aborted.")
+				return
+			}
+		}
+	}
+
+	// Walk through the directory structure, collecting only the supported documents to index
+	if len(*fileList) == 0 {
+		var sErr error
+		files, sErr = collectDocuments(dirpath)
+		errorCheck("ERROR: unable to traverse directory.", sErr)
+	}
+
+	// List all files in directory
+	//files, err := ioutil.ReadDir(dirpath)
+	//errorCheck("ERROR: unable to find directory.", err)
+
+	if len(*fileList) > 0 {
+		fmt.Printf("\n Building index for files listed in %s\n", *fileList)
+	} else {
+		fmt.Printf("\n Building index for files in %s\n", dirpath)
+	}
+	fmt.Printf(" ----------------------------------\n\n")
+
+	// Counts of files indexed, skipped (nothing to index) and failed during this run
+	indexed, skipped, failed := 0, 0, 0
+
+	// Collect options used to build each file's secure index
+	opts := buildOptions{
+		deterministic: *deterministic,
+		blocked:       *blocked,
+		scale:         *scale,
+		foldAccents:   *foldAccents,
+		stem:          *stem,
+		minLength:     *minLength,
+		maxLength:     *maxLength,
+		encrypt:       encrypt,
+		cipher:        fileCipher,
+		keySize:       *keyBits / 8,
+		hash:          hashFunc,
+		keyDir:        filepath.Dir(keyfileUsed),
+		calibrate:     *calibrateFP,
+		fp:            *fp,
+		window:        *window,
+		stride:        *stride,
+		headings:      *headings,
+		entities:      *entities,
+		maxKeywords:   *maxKeywords,
+		ngrams:        *ngrams,
+		tags:          posTags,
+		stableID:      *stableID,
+		root:          dirpath,
+		hyphens:       *hyphens,
+		language:      *language,
+		stopwordFile:  *stopwordFile,
+	}
+	if len(*signKeyFile) > 0 {
+		key, err := cryptoUtils.LoadSigningKey(*signKeyFile)
+		errorCheck("ERROR: unable to load signing key.", err)
+		opts.signKey = key
+	}
+	if len(*keywordKeyFile) > 0 {
+		key, err := cryptoUtils.LoadKeywordKey(*keywordKeyFile)
+		errorCheck("ERROR: unable to load keyword key.", err)
+		opts.keywordKey = key
+	}
+	if opts.stride <= 0 {
+		opts.stride = opts.window
+	}
+
+	// Leave files whose indexes are up to date, so repeated runs only index new or changed files.
+	// Encrypting builds always run, as an up to date index says nothing of the document's encryption
+	current := 0
+	if !*force && opts.window == 0 && !opts.encrypt {
+		fingerprint := cryptoUtils.KeyFingerprint(hashKeys)
+		stale := make([]string, 0, len(files))
+		for _, file := range files {
+			if upToDate(file, fingerprint, opts) {
+				current++
+			} else {
+				stale = append(stale, file)
+			}
+		}
+		files = stale
+	}
+
+	// Index each file in directory, a file failing (or whose index build hangs, e.g. malformed
+	// PDFs, and is abandoned) doesn't stop the others
+	indexFiles(files, hashKeys, opts, *timeout, *concurrency, func(outcome buildOutcome) {
+		switch {
+		case outcome.err == nil:
+			fmt.Printf(" -%s\n", outcome.file)
+			indexed++
+		case outcome.err == errNoText:
+			skipped++
+		case os.IsNotExist(outcome.err):
+			fmt.Println("INFO: unable to find ", outcome.file, " (skipping file)")
+			skipped++
+		case outcome.err == context.DeadlineExceeded:
+			fmt.Fprintf(os.Stderr, "ERROR: indexing %s timed out after %v (skipping file)\n", outcome.file, *timeout)
+			failed++
+		default:
+			fmt.Fprintf(os.Stderr, "ERROR: unable to build secure index for %s: %v (skipping file)\n", outcome.file, outcome.err)
+			failed++
+		}
+	})
+
+	// Record the keyfile fingerprint and parameters used for this build
+	if len(*buildLog) == 0 {
+		*buildLog = filepath.Join(dirpath, "sindex-build.log")
+	}
+	entry := buildLogEntry{
+		Timestamp:      time.Now().UTC().Format(time.RFC3339),
+		Version:        VERSION,
+		Directory:      dirpath,
+		Keyfile:        keyfileUsed,
+		KeyFingerprint: cryptoUtils.KeyFingerprint(hashKeys),
+		Keys:           len(hashKeys),
+		FalsePositive:  *fp,
+		Scale:          *scale,
+		Algorithm:      opts.hash.Algorithm(),
+		Filter:         bloomFilter.STANDARD,
+		Deterministic:  *deterministic,
+		FoldAccents:    *foldAccents,
+		Stem:           *stem,
+		MinLength:      *minLength,
+		MaxLength:      *maxLength,
+		Hyphens:        *hyphens,
+		Language:       *language,
+		Stopwords:      *stopwordFile,
+		Tags:           strings.Join(opts.tags, ","),
+		Window:         opts.window,
+		Stride:         opts.stride,
+		MaxKeywords:    opts.maxKeywords,
+		NGrams:         opts.ngrams,
+		Indexed:        indexed,
+		UpToDate:       current,
+		Skipped:        skipped,
+		Failed:         failed,
+	}
+	if *blocked {
+		entry.Filter = bloomFilter.BLOCKED
+	}
+	err = writeBuildLog(*buildLog, entry)
+	errorCheck("ERROR: unable to write build log.", err)
+
+	fmt.Printf("\n Secure index builds complete: %d indexed, %d already up to date, %d skipped, %d failed.\n\n", indexed, current, skipped, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
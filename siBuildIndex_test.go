@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes" // Standard packages
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"secureindex/cryptoUtils" // Custom packages
+)
+
+/* Declare custom structure for a keyword extractor that stalls on text mentioning a tortoise, *
+ * standing in for an extraction that hangs                                                   */
+type slowExtractor struct {
+	delay time.Duration
+}
+
+func (e slowExtractor) Extract(text string) ([]string, error) {
+
+	if strings.Contains(text, "tortoise") {
+		time.Sleep(e.delay)
+	}
+
+	return strings.Fields(text), nil
+}
+
+/* Write documents to a directory, returning their paths */
+func writeDocuments(t *testing.T, dir string, docs map[string]string) []string {
+
+	files := make([]string, 0, 0)
+	for name, text := range docs {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(text), 0600); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+
+	return files
+}
+
+/* List a directory's file names */
+func listDir(t *testing.T, dir string) []string {
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, 0)
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	return names
+}
+
+func TestSlowExtractionTimesOutWithoutOutputs(t *testing.T) {
+
+	dir := t.TempDir()
+	// Only the hare's story mentions the tortoise, stalling its extraction
+	files := writeDocuments(t, dir, map[string]string{
+		"hare.txt":        "the hare ran swiftly past the sleeping tortoise",
+		"rabbit.txt":      "the white rabbit checked his pocket watch",
+		"caterpillar.txt": "the caterpillar sat on a mushroom smoking a hookah",
+	})
+
+	keys, err := cryptoUtils.GenerateHashKeys(F_P)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delay := 2 * time.Second
+	opts := buildOptions{scale: S_F, fp: F_P, hash: cryptoUtils.HMAC_SHA256, root: dir, encrypt: true, cipher: cryptoUtils.AES_GCM,
+		keyDir: dir, extractor: slowExtractor{delay}}
+
+	outcomes := make(map[string]error)
+	indexFiles(files, keys, opts, 500*time.Millisecond, 2, func(outcome buildOutcome) {
+		outcomes[filepath.Base(outcome.file)] = outcome.err
+	})
+
+	if err := outcomes["hare.txt"]; err != context.DeadlineExceeded {
+		t.Errorf("slow file's build returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	for _, name := range []string{"rabbit.txt", "caterpillar.txt"} {
+		if err := outcomes[name]; err != nil {
+			t.Errorf("%s: build failed: %v", name, err)
+		}
+		for _, output := range []string{name + ".sindex", name + ".sindex.meta", name + ".encrypted.data", name + ".encrypted.private"} {
+			if _, err := os.Stat(filepath.Join(dir, output)); err != nil {
+				t.Errorf("%s: output missing: %v", name, err)
+			}
+		}
+	}
+
+	// Once the abandoned build has finished in background, it has left nothing behind
+	time.Sleep(delay + time.Second)
+	for _, name := range listDir(t, dir) {
+		if (strings.HasPrefix(name, "hare.txt") && name != "hare.txt") || strings.HasSuffix(name, STAGING_SUFFIX) {
+			t.Errorf("abandoned or completed builds left output %s", name)
+		}
+	}
+}
+
+func TestAbandonedBuildsBounded(t *testing.T) {
+
+	dir := t.TempDir()
+	files := writeDocuments(t, dir, map[string]string{
+		"hare.txt":   "the hare ran swiftly past the sleeping tortoise",
+		"rabbit.txt": "the white rabbit checked his pocket watch",
+	})
+	if filepath.Base(files[0]) != "hare.txt" {
+		files[0], files[1] = files[1], files[0]
+	}
+	keys, err := cryptoUtils.GenerateHashKeys(F_P)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delay := time.Second
+	opts := buildOptions{scale: S_F, fp: F_P, hash: cryptoUtils.HMAC_SHA256, root: dir, extractor: slowExtractor{delay}}
+
+	saved := abandoned
+	abandoned = &abandonedBuilds{limit: 1}
+	defer func() { abandoned = saved }()
+
+	// With the one abandoned build allowed still running, further files are refused
+	if err := indexFileWithTimeout(files[0], keys, opts, 100*time.Millisecond); err != context.DeadlineExceeded {
+		t.Fatalf("slow file's build returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := indexFileWithTimeout(files[1], keys, opts, time.Minute); err != errTooManyAbandoned {
+		t.Errorf("build alongside an abandoned build returned %v, want %v", err, errTooManyAbandoned)
+	}
+
+	// Once it has finished in background, files are built again
+	time.Sleep(delay + 500*time.Millisecond)
+	if abandoned.full() {
+		t.Fatalf("%d abandoned builds counted after they finished", abandoned.count)
+	}
+	if err := indexFileWithTimeout(files[1], keys, opts, time.Minute); err != nil {
+		t.Errorf("build after the abandoned build finished failed: %v", err)
+	}
+}
+
+/* Declare custom structure for a context that expires once a file exists, standing in for a *
+ * build timing out partway through writing an output                                         */
+type expireOnFile struct {
+	context.Context
+	path    string
+	expired bool
+}
+
+func (c *expireOnFile) Err() error {
+
+	if _, err := os.Stat(c.path); err == nil {
+		c.expired = true
+	}
+	if c.expired {
+		return context.DeadlineExceeded
+	}
+
+	return nil
+}
+
+func TestTimedOutRebuildKeepsEarlierOutputs(t *testing.T) {
+
+	dir := t.TempDir()
+	files := writeDocuments(t, dir, map[string]string{"hare.txt": "the hare ran swiftly past the sleeping tortoise"})
+	keys, err := cryptoUtils.GenerateHashKeys(F_P)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := buildOptions{scale: S_F, fp: F_P, hash: cryptoUtils.HMAC_SHA256, root: dir, encrypt: true, cipher: cryptoUtils.AES_GCM,
+		keyDir: dir, extractor: slowExtractor{}}
+	if err := indexFileWithTimeout(files[0], keys, opts, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	outputs := []string{"hare.txt.sindex", "hare.txt.sindex.meta", "hare.txt.encrypted.data", "hare.txt.encrypted.private"}
+	built := make(map[string][]byte)
+	for _, output := range outputs {
+		if built[output], err = ioutil.ReadFile(filepath.Join(dir, output)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A rebuild timing out while encrypting the document leaves the earlier build's outputs alone
+	ctx := &expireOnFile{Context: context.Background(), path: filepath.Join(dir, "hare.txt.encrypted.data"+STAGING_SUFFIX)}
+	if err := indexFile(ctx, new(buildGate), files[0], keys, opts); err != context.DeadlineExceeded {
+		t.Fatalf("rebuild returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	for _, output := range outputs {
+		if data, err := ioutil.ReadFile(filepath.Join(dir, output)); err != nil || string(data) != string(built[output]) {
+			t.Errorf("%s changed or removed by the timed out rebuild: %v", output, err)
+		}
+	}
+	for _, name := range listDir(t, dir) {
+		if strings.HasSuffix(name, STAGING_SUFFIX) {
+			t.Errorf("timed out rebuild left output %s", name)
+		}
+	}
+}
+
+func TestBuildGate(t *testing.T) {
+
+	dir := t.TempDir()
+	stage := func() *stagedOutputs {
+		staged := new(stagedOutputs)
+		for _, name := range []string{"alice.txt.sindex.meta", "alice.txt.sindex"} {
+			if err := staged.write(filepath.Join(dir, name), []byte("{}"), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return staged
+	}
+
+	// Outputs staged by a build that has expired are discarded, not moved into place
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	gate := new(buildGate)
+	if err := gate.commit(ctx, stage()); err != context.Canceled {
+		t.Errorf("commit after expiry returned %v, want %v", err, context.Canceled)
+	}
+	if names := listDir(t, dir); len(names) != 0 {
+		t.Errorf("expired build left outputs %v", names)
+	}
+	if !gate.abandon() {
+		t.Error("an uncommitted build couldn't be abandoned")
+	}
+
+	// Once committed, a build's outputs are all in place and it can't be abandoned
+	gate = new(buildGate)
+	if err := gate.commit(context.Background(), stage()); err != nil {
+		t.Fatal(err)
+	}
+	if names := listDir(t, dir); len(names) != 2 || names[0] != "alice.txt.sindex" || names[1] != "alice.txt.sindex.meta" {
+		t.Errorf("committed build left outputs %v", names)
+	}
+	if gate.abandon() {
+		t.Error("a committed build was abandoned")
+	}
+}
+
+func TestUpToDateComparesOptions(t *testing.T) {
+
+	dir := t.TempDir()
+	file := writeDocuments(t, dir, map[string]string{"alice.txt": "the white rabbit checked his pocket watch"})[0]
+	keys, err := cryptoUtils.GenerateHashKeys(F_P)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := cryptoUtils.KeyFingerprint(keys)
+	opts := buildOptions{scale: S_F, fp: F_P, hash: cryptoUtils.HMAC_SHA256, root: dir, minLength: 3, tags: []string{"NN", "NNS"}, extractor: slowExtractor{}}
+	if err := indexFile(context.Background(), new(buildGate), file, keys, opts); err != nil {
+		t.Fatal(err)
+	}
+	if !upToDate(file, fingerprint, opts) {
+		t.Fatal("index just built with the same options isn't up to date")
+	}
+
+	// Any option changing the index's contents calls for a rebuild
+	changes := map[string]func(*buildOptions){
+		"-stem":        func(o *buildOptions) { o.stem = true },
+		"-foldaccents": func(o *buildOptions) { o.foldAccents = true },
+		"-hmac":        func(o *buildOptions) { o.hash = cryptoUtils.HMAC_SHA512 },
+		"-minlength":   func(o *buildOptions) { o.minLength = 4 },
+		"-maxlength":   func(o *buildOptions) { o.maxLength = 20 },
+		"-tags":        func(o *buildOptions) { o.tags = []string{"NN", "NNS", "NNP"} },
+		"-hyphens":     func(o *buildOptions) { o.hyphens = "split" },
+		"-language":    func(o *buildOptions) { o.language = "fr" },
+		"-ngrams":      func(o *buildOptions) { o.ngrams = 2 },
+		"-scale":       func(o *buildOptions) { o.scale = 2 },
+		"-blocked":     func(o *buildOptions) { o.blocked = true },
+		"-keywordkey":  func(o *buildOptions) { o.keywordKey = make([]byte, 32) },
+		"-stableid":    func(o *buildOptions) { o.stableID = true },
+		"moved root":   func(o *buildOptions) { o.root = filepath.Dir(dir) },
+	}
+	for name, change := range changes {
+		changed := opts
+		change(&changed)
+		if upToDate(file, fingerprint, changed) {
+			t.Errorf("%s: index built without it is up to date", name)
+		}
+	}
+
+	// Options that don't affect the index, such as the calibration target, leave it up to date
+	changed := opts
+	changed.fp, changed.calibrate = 0.001, true
+	if !upToDate(file, fingerprint, changed) {
+		t.Error("changing -fp made the index out of date")
+	}
+
+	other, err := cryptoUtils.GenerateHashKeys(F_P)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upToDate(file, cryptoUtils.KeyFingerprint(other), opts) {
+		t.Error("index built with other keys is up to date")
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if upToDate(file, fingerprint, opts) {
+		t.Error("index older than its document is up to date")
+	}
+}
+
+func TestDeterministicBuildsAreIdentical(t *testing.T) {
+
+	keys, err := cryptoUtils.GenerateHashKeys(F_P)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Build the same document, at the same path within its root, twice
+	build := func(deterministic bool) [][]byte {
+		indexes := make([][]byte, 0, 2)
+		for i := 0; i < 2; i++ {
+			dir := t.TempDir()
+			file := writeDocuments(t, dir, map[string]string{"alice.txt": "the white rabbit checked his pocket watch"})[0]
+			opts := buildOptions{scale: S_F, fp: F_P, hash: cryptoUtils.HMAC_SHA256, root: dir, deterministic: deterministic, extractor: slowExtractor{}}
+			if err := indexFile(context.Background(), new(buildGate), file, keys, opts); err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadFile(file + ".sindex")
+			if err != nil {
+				t.Fatal(err)
+			}
+			indexes = append(indexes, data)
+		}
+		return indexes
+	}
+
+	if indexes := build(true); !bytes.Equal(indexes[0], indexes[1]) {
+		t.Error("deterministic builds of the same input produced different indexes")
+	}
+	if indexes := build(false); bytes.Equal(indexes[0], indexes[1]) {
+		t.Error("randomly blinded builds of the same input produced identical indexes")
+	}
+}
+
+func TestSameNamedDocumentsKeepSeparateKeys(t *testing.T) {
+
+	dir, keyDir := t.TempDir(), t.TempDir()
+	docs := map[string]string{"a": "the white rabbit checked his pocket watch", "b": "the caterpillar sat on a mushroom"}
+	files := make([]string, 0, 0)
+	for folder, text := range docs {
+		if err := os.Mkdir(filepath.Join(dir, folder), 0700); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, writeDocuments(t, filepath.Join(dir, folder), map[string]string{"report.txt": text})...)
+	}
+
+	keys, err := cryptoUtils.GenerateHashKeys(F_P)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := buildOptions{scale: S_F, fp: F_P, hash: cryptoUtils.HMAC_SHA256, root: dir, encrypt: true, cipher: cryptoUtils.AES_GCM,
+		keyDir: keyDir, extractor: slowExtractor{}}
+	indexFiles(files, keys, opts, time.Minute, 2, func(outcome buildOutcome) {
+		if outcome.err != nil {
+			t.Errorf("%s: build failed: %v", outcome.file, outcome.err)
+		}
+	})
+
+	// Each document's key mirrors its path within the directory indexed, and decrypts it
+	for folder, text := range docs {
+		document := filepath.Join(dir, folder, "report.txt")
+		key := filepath.Join(keyDir, folder, "report.txt.encrypted.private")
+		out := filepath.Join(t.TempDir(), "report.txt")
+		decryptOpts := cryptoUtils.DecryptOptions{AssociatedData: []byte(folder + "/report.txt")}
+		if err := cryptoUtils.DecryptWithOptions(context.Background(), document+".encrypted.data", key, out, decryptOpts); err != nil {
+			t.Errorf("%s/report.txt: unable to decrypt with its key: %v", folder, err)
+			continue
+		}
+		if data, err := ioutil.ReadFile(out); err != nil || string(data) != text {
+			t.Errorf("%s/report.txt decrypted to %q, want %q", folder, data, text)
+		}
+	}
+}
+
+func TestCollectNestedDocuments(t *testing.T) {
+
+	dir := t.TempDir()
+	for _, sub := range []string{filepath.Join("a", "b", "c"), "notes.txt", "x.pdf.d"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeDocuments(t, dir, map[string]string{
+		"top.txt":                                "rabbit",
+		filepath.Join("a", "middle.csv"):         "rabbit,hatter",
+		filepath.Join("a", "b", "c", "deep.rtf"): "{\\rtf1 rabbit}",
+		filepath.Join("x.pdf.d", "inside.txt"):   "rabbit",
+		filepath.Join("a", "b", "image.png"):     "not a document",
+		filepath.Join("a", "top.txt.sindex"):     "an earlier build's output",
+	})
+
+	files, err := collectDocuments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0, 0)
+	for _, file := range files {
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, filepath.ToSlash(rel))
+	}
+	sort.Strings(got)
+
+	// Documents at every depth, but neither directories named like documents nor other files
+	want := []string{"a/b/c/deep.rtf", "a/middle.csv", "top.txt", "x.pdf.d/inside.txt"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("collected %q, want %q", got, want)
+	}
+}
+
+func TestListedDocumentsWithinRoot(t *testing.T) {
+
+	dir := t.TempDir()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		root   string
+		file   string
+		within bool
+		docID  string
+	}{
+		{dir, filepath.Join(dir, "a", "report.pdf"), true, "a/report.pdf"},
+		{".", filepath.Join("a", "report.pdf"), true, "a/report.pdf"},
+		{".", filepath.Join(cwd, "a", "report.pdf"), true, "a/report.pdf"},
+		{cwd, filepath.Join("a", "report.pdf"), true, "a/report.pdf"},
+		{".", filepath.Join("..", "docs", "report.pdf"), false, ""},
+		{dir, filepath.Join(dir, "..", "report.pdf"), false, ""},
+		{filepath.Join(dir, "a"), filepath.Join(dir, "ab", "report.pdf"), false, ""},
+	}
+
+	for _, test := range tests {
+		if got := withinRoot(test.root, test.file); got != test.within {
+			t.Errorf("withinRoot(%q, %q) = %v, want %v", test.root, test.file, got, test.within)
+		}
+		if got := documentPath(test.root, test.file); test.within && got != test.docID {
+			t.Errorf("documentPath(%q, %q) = %q, want %q", test.root, test.file, got, test.docID)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+/* Implementation of Secure Indexes in Go. This script decrypts documents encrypted by siBuildIndex.                    *
+ * Given a document's ".encrypted.data" file and its ".encrypted.private" key, recovers the original document. Given a *
+ * directory, decrypts every ".encrypted.data" file under it with the matching keys from a key directory. Documents   *
+ * are bound to their secure index's document identifier, which is read from the index's metadata where recorded.     *
+ * Source ref: crypto.stanford.edu/~eujin/papers/secureindex/secureindex.pdf                                           */
+
+import (
+	"context" // Import std. packages
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"secureindex/cryptoUtils" // Import custom packages
+	"secureindex/indexMeta"
+)
+
+// Suffixes of the encrypted document and key files written by siBuildIndex
+const (
+	DATA_SUFFIX = ".encrypted.data"
+	KEY_SUFFIX  = ".encrypted.private"
+)
+
+/* Error handling */
+func errorCheck(msg string, err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, msg)
+		os.Exit(1)
+	}
+}
+
+/* Identifier an encrypted document was bound to: the document ID recorded in its secure *
+ * index's metadata (built with -stableid), else the document's file name                */
+func documentID(original string) string {
+
+	if meta, err := indexMeta.Read(original + ".sindex"); err == nil && len(meta.DocumentID) > 0 {
+		return meta.DocumentID
+	}
+	return filepath.Base(original)
+}
+
+/* Decrypt a single document, refusing to overwrite an existing file unless forced */
+func decryptFile(dataPath string, keyPath string, outPath string, docID string, force bool) error {
+
+	if _, err := os.Stat(outPath); err == nil && !force {
+		return fmt.Errorf("%s already exists (use -force to overwrite)", outPath)
+	}
+
+	err := cryptoUtils.DecryptWithOptions(context.Background(), dataPath, keyPath, outPath, cryptoUtils.DecryptOptions{AssociatedData: []byte(docID)})
+	if err != cryptoUtils.ErrTampered {
+		return err
+	}
+
+	// Documents encrypted before they were bound to their index authenticate without an identifier
+	if cryptoUtils.Decrypt(dataPath, keyPath, outPath) != nil {
+		return fmt.Errorf("authentication failed, the file, key or document identifier %q is wrong, or the file has been tampered with", docID)
+	}
+
+	return nil
+}
+
+/* Takes an encrypted document and its key, or a directory of encrypted documents and their *
+ * key directory. Outputs the decrypted documents                                          */
+func main() {
+
+	keyPath := flag.String("key", "", "the document's .encrypted.private key (default: alongside it, or in -keydir)")
+	keyDir := flag.String("keydir", "", "directory holding the .encrypted.private keys, i.e. the keyfile's directory at build time (default: alongside each document)")
+	root := flag.String("root", "", "directory indexed at build time, under which -keydir mirrors each document's path (default: the directory given, or the file's own directory)")
+	outPath := flag.String("out", "", "file, or in directory mode directory, to write decrypted documents to (default: alongside each document, without its suffix)")
+	docID := flag.String("docid", "", "identifier the document was bound to (default: from its index metadata, else its file name)")
+	force := flag.Bool("force", false, "overwrite existing output files")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: siDecrypt [options] <.encrypted.data file or directory>\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	target := flag.Arg(0)
+
+	info, err := os.Stat(target)
+	errorCheck("ERROR: unable to find "+target+".", err)
+
+	// Locate the key and output for an encrypted document. Keys in a key directory are found
+	// by the document's path within the directory indexed, as siBuildIndex writes them
+	paths := func(dataPath string, dir string) (string, string) {
+		original := strings.TrimSuffix(dataPath, DATA_SUFFIX)
+		key := original + KEY_SUFFIX
+		if len(*keyDir) > 0 {
+			indexRoot := dir
+			if len(*root) > 0 {
+				indexRoot = *root
+			}
+			rel, err := filepath.Rel(indexRoot, original)
+			if err != nil {
+				rel = filepath.Base(original)
+			}
+			key = filepath.Join(*keyDir, rel+KEY_SUFFIX)
+		}
+		out := original
+		if len(*outPath) > 0 {
+			rel, _ := filepath.Rel(dir, original)
+			out = filepath.Join(*outPath, rel)
+		}
+		return key, out
+	}
+
+	if !info.IsDir() {
+		if !strings.HasSuffix(target, DATA_SUFFIX) {
+			fmt.Printf("ERROR: %s is not a %s file.\n", target, DATA_SUFFIX)
+			return
+		}
+		key, out := paths(target, filepath.Dir(target))
+		if len(*keyPath) > 0 {
+			key = *keyPath
+		}
+		if len(*outPath) > 0 {
+			out = *outPath
+		}
+		id := *docID
+		if len(id) == 0 {
+			id = documentID(strings.TrimSuffix(target, DATA_SUFFIX))
+		}
+
+		if err := decryptFile(target, key, out, id, *force); err != nil {
+			fmt.Printf("ERROR: unable to decrypt %s: %v.\n", target, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Decrypted %s to %s.\n", target, out)
+		return
+	}
+
+	if len(*keyPath) > 0 || len(*docID) > 0 {
+		fmt.Println("ERROR: -key and -docid apply to a single file, use -keydir for a directory.")
+		return
+	}
+
+	decrypted, failed := 0, 0
+	err = filepath.Walk(target, func(path string, f os.FileInfo, err error) error {
+		if err != nil || f.IsDir() || !strings.HasSuffix(path, DATA_SUFFIX) {
+			return err
+		}
+
+		key, out := paths(path, target)
+		if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+			return err
+		}
+		if err := decryptFile(path, key, out, documentID(strings.TrimSuffix(path, DATA_SUFFIX)), *force); err != nil {
+			fmt.Printf("FAILED: %s (%v)\n", path, err)
+			failed++
+			return nil
+		}
+		fmt.Printf(" -%s\n", out)
+		decrypted++
+		return nil
+	})
+	errorCheck("ERROR: unable to traverse directory.", err)
+
+	fmt.Printf("\n Decrypted %d documents, %d failed.\n\n", decrypted, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
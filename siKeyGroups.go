@@ -0,0 +1,120 @@
+package main
+
+/* Implementation of Secure Indexes in Go. This script groups a corpus of secure indexes by the keyfile they were built with.  *
+ * Indexes built with different keyfiles can't be merged (different keys produce different trapdoors), so a single search     *
+ * only matches indexes sharing its keyfile. Given a directory of secure indexes and any candidate keyfiles, report each      *
+ * group of indexes sharing a keyfile and which of the candidate keyfiles (if any) is needed to search it.                    *
+ * Source ref: crypto.stanford.edu/~eujin/papers/secureindex/secureindex.pdf                                                  */
+
+import (
+	"flag" // Import std. packages
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"secureindex/cryptoUtils" // Import custom packages
+	"secureindex/indexMeta"
+)
+
+// Group key for indexes whose metadata doesn't record a keyfile fingerprint
+const UNKNOWN_KEY = "unknown"
+
+/* Error handling */
+func errorCheck(msg string, err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, msg)
+		os.Exit(1)
+	}
+}
+
+/* Group the secure indexes under a directory by the fingerprint of their keyfile */
+func groupIndexes(dirpath string) (map[string][]string, error) {
+
+	groups := make(map[string][]string)
+
+	err := filepath.Walk(dirpath, func(path string, f os.FileInfo, err error) error {
+		if err != nil || f.IsDir() || !strings.HasSuffix(path, ".sindex") {
+			return err
+		}
+
+		// Indexes built before fingerprints were recorded can't be attributed to a keyfile
+		fingerprint := UNKNOWN_KEY
+		if meta, err := indexMeta.Read(path); err == nil && len(meta.KeyFingerprint) > 0 {
+			fingerprint = meta.KeyFingerprint
+		}
+		groups[fingerprint] = append(groups[fingerprint], path)
+
+		return nil
+	})
+
+	return groups, err
+}
+
+/* Takes a directory of secure indexes followed by any number of candidate keyfiles. *
+ * Outputs the indexes grouped by keyfile and the keyfile each group needs         */
+func main() {
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: siKeyGroups <index directory> [keyfile ...]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	dirpath := flag.Arg(0)
+
+	// Fingerprint each candidate keyfile
+	keyfiles := make(map[string][]string)
+	for _, keyfile := range flag.Args()[1:] {
+		keys, err := cryptoUtils.ReadKeyFile(keyfile)
+		errorCheck("ERROR: unable to read keyfile "+keyfile+".", err)
+
+		fingerprint := cryptoUtils.KeyFingerprint(keys)
+		keyfiles[fingerprint] = append(keyfiles[fingerprint], keyfile)
+	}
+
+	groups, err := groupIndexes(dirpath)
+	errorCheck("ERROR: unable to traverse directory.", err)
+
+	if len(groups) == 0 {
+		fmt.Printf("\n No secure indexes found in %s.\n\n", dirpath)
+		return
+	}
+
+	// Report groups in a stable order
+	fingerprints := make([]string, 0, len(groups))
+	for fingerprint := range groups {
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	sort.Strings(fingerprints)
+
+	fmt.Printf("\n Secure indexes in %s use %d keyfile group(s)\n", dirpath, len(groups))
+	fmt.Printf(" ----------------------------------\n")
+
+	for _, fingerprint := range fingerprints {
+		fmt.Printf("\n Key fingerprint: %s\n", fingerprint)
+
+		if fingerprint == UNKNOWN_KEY {
+			fmt.Printf(" Keyfile: not recorded (rebuild these indexes to record it)\n")
+		} else if matches, ok := keyfiles[fingerprint]; ok {
+			fmt.Printf(" Keyfile: %s\n", strings.Join(matches, ", "))
+		} else {
+			fmt.Printf(" Keyfile: none of the given keyfiles match\n")
+		}
+
+		sort.Strings(groups[fingerprint])
+		for _, index := range groups[fingerprint] {
+			fmt.Printf(" -%s\n", index)
+		}
+	}
+
+	if len(groups) > 1 {
+		fmt.Printf("\n WARNING: a single search only matches indexes built with its keyfile.\n")
+	}
+	fmt.Printf("\n")
+}
@@ -0,0 +1,223 @@
+package main
+
+/* Implementation of Secure Indexes in Go. This script rebuilds secure indexes under new hash keys, e.g. after a keyfile   *
+ * is compromised. Trapdoors are one-way, so an index can't be rekeyed from its bits alone: each index must have been    *
+ * built with siBuildIndex -keywordkey, which keeps its keywords alongside it in a ".keywords" file encrypted under a     *
+ * separate key. Given a directory of such indexes, the old and new keyfiles and the keyword key, rewrites each index.   *
+ * Indexes the server encrypts at rest are encrypted again under its index key (-indexkey), so it can keep serving them. *
+ * Source ref: crypto.stanford.edu/~eujin/papers/secureindex/secureindex.pdf                                             */
+
+import (
+	"crypto/ed25519" // Import std. packages
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"secureindex/cryptoUtils" // Import custom packages
+	"secureindex/indexMeta"
+)
+
+/* Error handling */
+func errorCheck(msg string, err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, msg)
+		os.Exit(1)
+	}
+}
+
+/* Declare custom structure for the keys used to rekey indexes */
+type rekeyKeys struct {
+	oldKeys    [][]byte
+	newKeys    [][]byte
+	newHash    cryptoUtils.HMACHash
+	keywordKey []byte
+	signKey    ed25519.PrivateKey
+	indexKey   []byte // Key of indexes encrypted at rest, nil if none are
+}
+
+/* Read the new hash keys and their HMAC hash, generating as many keys as the old *
+ * keyfile holds, for the same hash, if the file doesn't exist                    */
+func loadNewKeys(keyfile string, count int, hashFunc cryptoUtils.HMACHash) ([][]byte, cryptoUtils.HMACHash, error) {
+
+	if _, err := os.Stat(keyfile); !os.IsNotExist(err) {
+		return cryptoUtils.ReadKeyFileHash(keyfile)
+	}
+
+	keys := make([][]byte, 0, 0)
+	for k := 0; k < count; k++ {
+		key, err := cryptoUtils.GenerateRandomBytes(16)
+		if err != nil {
+			return nil, "", err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, hashFunc, cryptoUtils.WriteKeyFile(keyfile, keys, hashFunc)
+}
+
+/* Read the 32 byte key secure indexes are encrypted at rest with (siSearchServer -indexkey) */
+func loadIndexKey(keyFile string) ([]byte, error) {
+
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("index key %s must be 32 bytes", keyFile)
+	}
+
+	return key, nil
+}
+
+/* Replace a file via a temporary file, so it is never left half written */
+func replaceFile(path string, data []byte, perm os.FileMode) error {
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, perm); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+/* Rebuild a single secure index under the new keys from its keyword cache, returning *
+ * whether the index replaced was encrypted at rest, which the rebuilt index is too   */
+func rekeyIndex(path string, keys rekeyKeys) (bool, error) {
+
+	// Never replace an index encrypted at rest with a plaintext one the server would refuse
+	old, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	sealed := cryptoUtils.IsSealed(old)
+	if sealed {
+		if keys.indexKey == nil {
+			return true, errors.New("index is encrypted at rest, give -indexkey")
+		}
+		if _, err := cryptoUtils.Open(keys.indexKey, old); err != nil {
+			return true, fmt.Errorf("unable to decrypt index with -indexkey: %v", err)
+		}
+	}
+
+	cache, err := cryptoUtils.ReadKeywordCache(path, keys.keywordKey)
+	if err != nil {
+		return sealed, err
+	}
+
+	// Indexes without metadata predate it and were built with standard filters
+	meta, err := indexMeta.Read(path)
+	if err != nil {
+		meta = &indexMeta.Metadata{}
+	}
+
+	sIndex := cryptoUtils.SecureIndex{Trapdoors: make([][]byte, 0, 0), Codewords: make([][]byte, 0, 0), Meta: meta, Hash: keys.newHash}
+	if err := cryptoUtils.RekeyIndex(&sIndex, cache, keys.oldKeys, keys.newKeys); err != nil {
+		return sealed, err
+	}
+
+	data, err := sIndex.Index.MarshalBinary()
+	if err != nil {
+		return sealed, err
+	}
+
+	// Re-sign the index, as its old signature no longer matches. Signatures cover the plaintext
+	// index, which is what the server verifies once it has decrypted an index
+	if keys.signKey != nil {
+		if err := cryptoUtils.SignIndex(keys.signKey, data, sIndex.Meta); err != nil {
+			return sealed, err
+		}
+	}
+	metaData, err := indexMeta.Marshal(sIndex.Meta)
+	if err != nil {
+		return sealed, err
+	}
+
+	if sealed {
+		if data, err = cryptoUtils.Seal(keys.indexKey, data); err != nil {
+			return sealed, err
+		}
+	}
+	if err := replaceFile(path, data, 0644); err != nil {
+		return sealed, err
+	}
+
+	return sealed, replaceFile(path+indexMeta.FILE_SUFFIX, metaData, 0644)
+}
+
+/* Takes a directory of secure indexes built with a keyword key. Outputs the indexes *
+ * rebuilt under the new hash keys, in place                                          */
+func main() {
+
+	oldKeyfile := flag.String("oldkeys", "", "keyfile the indexes were built with")
+	newKeyfile := flag.String("newkeys", "", "keyfile to rebuild the indexes with (generated if it doesn't exist)")
+	keywordKeyFile := flag.String("keywordkey", "", "key the indexes' keywords were kept with (siBuildIndex -keywordkey)")
+	signKeyFile := flag.String("signkey", "", "re-sign each rebuilt index with this Ed25519 key")
+	indexKeyFile := flag.String("indexkey", "", "key the server encrypts indexes at rest with (siSearchServer -indexkey), required to rekey such indexes")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: siRekeyIndex -oldkeys <keyfile> -newkeys <keyfile> -keywordkey <key> [options] <index directory>\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 || len(*oldKeyfile) == 0 || len(*newKeyfile) == 0 || len(*keywordKeyFile) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	dirpath := flag.Arg(0)
+
+	var keys rekeyKeys
+	var err error
+	var oldHash cryptoUtils.HMACHash
+	keys.oldKeys, oldHash, err = cryptoUtils.ReadKeyFileHash(*oldKeyfile)
+	errorCheck("ERROR: unable to read old keyfile.", err)
+	keys.newKeys, keys.newHash, err = loadNewKeys(*newKeyfile, len(keys.oldKeys), oldHash)
+	errorCheck("ERROR: unable to load new keyfile.", err)
+
+	// Never create a keyword key here, a new one couldn't decrypt any keyword cache
+	keys.keywordKey, err = ioutil.ReadFile(*keywordKeyFile)
+	errorCheck("ERROR: unable to read keyword key.", err)
+
+	if len(*signKeyFile) > 0 {
+		key, err := cryptoUtils.LoadSigningKey(*signKeyFile)
+		errorCheck("ERROR: unable to load signing key.", err)
+		keys.signKey = key
+	}
+
+	if len(*indexKeyFile) > 0 {
+		keys.indexKey, err = loadIndexKey(*indexKeyFile)
+		errorCheck("ERROR: unable to read index key.", err)
+	}
+
+	if cryptoUtils.KeyFingerprint(keys.oldKeys) == cryptoUtils.KeyFingerprint(keys.newKeys) {
+		fmt.Println("ERROR: the old and new keyfiles hold the same keys.")
+		return
+	}
+
+	rekeyed, skipped, sealed := 0, 0, 0
+	err = filepath.Walk(dirpath, func(path string, f os.FileInfo, err error) error {
+		if err != nil || f.IsDir() || !strings.HasSuffix(path, ".sindex") {
+			return err
+		}
+
+		wasSealed, err := rekeyIndex(path, keys)
+		if err != nil {
+			fmt.Printf("SKIPPED: %s (%v)\n", path, err)
+			skipped++
+			return nil
+		}
+		if wasSealed {
+			sealed++
+		}
+		rekeyed++
+		return nil
+	})
+	errorCheck("ERROR: unable to traverse directory.", err)
+
+	fmt.Printf("\n Rekeyed %d secure indexes (%d encrypted at rest), skipped %d.\n", rekeyed, sealed, skipped)
+	fmt.Printf(" New key fingerprint: %s\n\n", cryptoUtils.KeyFingerprint(keys.newKeys))
+}
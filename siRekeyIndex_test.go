@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/ed25519" // Standard packages
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"secureindex/bloomFilter" // Custom packages
+	"secureindex/cryptoUtils"
+	"secureindex/indexMeta"
+)
+
+/* Write a secure index holding keywords with its metadata and keyword cache, encrypting it at *
+ * rest if given an index key                                                                  */
+func writeRekeyableIndex(t *testing.T, path string, keywords []string, keys [][]byte, keywordKey []byte, indexKey []byte) {
+
+	cache := cryptoUtils.KeywordCache{DocumentID: "docs/alice.txt", Keywords: keywords, Capacity: len(keywords), DocSize: 100, Scale: 1.5}
+	filter := &bloomFilter.BloomFilter{Variant: bloomFilter.STANDARD}
+	filter.Create(len(keys), cache.Capacity, cache.Scale)
+	sIndex := cryptoUtils.SecureIndex{Index: filter, Meta: &indexMeta.Metadata{Extension: ".txt", KeyFingerprint: cryptoUtils.KeyFingerprint(keys), DocumentID: cache.DocumentID}}
+	for _, keyword := range keywords {
+		sIndex.Build(cache.DocumentID, keyword, keys)
+		sIndex.Index.Add(sIndex.Codewords)
+	}
+
+	data, err := sIndex.Index.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexKey != nil {
+		if data, err = cryptoUtils.Seal(indexKey, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexMeta.Write(path, sIndex.Meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := cryptoUtils.WriteKeywordCache(path, keywordKey, &cache); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/* Read a secure index as the server does, decrypting it if encrypted at rest */
+func readRekeyedIndex(t *testing.T, path string, indexKey []byte) *bloomFilter.BloomFilter {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cryptoUtils.IsSealed(data) != (indexKey != nil) {
+		t.Fatalf("index encrypted at rest = %v, want %v", cryptoUtils.IsSealed(data), indexKey != nil)
+	}
+	if indexKey != nil {
+		if data, err = cryptoUtils.Open(indexKey, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filter := new(bloomFilter.BloomFilter)
+	if err := filter.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	return filter
+}
+
+func TestRekeyIndex(t *testing.T) {
+
+	oldKeys, err := cryptoUtils.GenerateHashKeys(0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKeys, err := cryptoUtils.GenerateHashKeys(0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keywordKey, err := cryptoUtils.GenerateRandomBytes(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexKey, err := cryptoUtils.GenerateRandomBytes(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signKey, err := cryptoUtils.LoadSigningKey(filepath.Join(t.TempDir(), "sign.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keywords := []string{"rabbit", "watch", "hatter"}
+	keys := rekeyKeys{oldKeys: oldKeys, newKeys: newKeys, newHash: cryptoUtils.HMAC_SHA256, keywordKey: keywordKey, signKey: signKey, indexKey: indexKey}
+
+	for _, atRest := range [][]byte{nil, indexKey} {
+		path := filepath.Join(t.TempDir(), "alice.txt.sindex")
+		writeRekeyableIndex(t, path, keywords, oldKeys, keywordKey, atRest)
+
+		sealed, err := rekeyIndex(path, keys)
+		if err != nil {
+			t.Fatalf("sealed %v: rekeyIndex failed: %v", atRest != nil, err)
+		}
+		if sealed != (atRest != nil) {
+			t.Errorf("rekeyIndex reported sealed %v, want %v", sealed, atRest != nil)
+		}
+
+		// The rebuilt index is encrypted at rest as the old one was, holds the keywords under
+		// the new keys only and is signed afresh
+		filter := readRekeyedIndex(t, path, atRest)
+		for _, keyword := range keywords {
+			if !filter.Search(cryptoUtils.BuildCodewords("docs/alice.txt", cryptoUtils.BuildTrapdoors(keyword, newKeys))) {
+				t.Errorf("sealed %v: %q not found under the new keys", atRest != nil, keyword)
+			}
+		}
+		meta, err := indexMeta.Read(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.KeyFingerprint != cryptoUtils.KeyFingerprint(newKeys) {
+			t.Errorf("sealed %v: metadata records key fingerprint %s, not the new keys'", atRest != nil, meta.KeyFingerprint)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if atRest != nil {
+			data, _ = cryptoUtils.Open(atRest, data)
+		}
+		if err := cryptoUtils.VerifyIndex(signKey.Public().(ed25519.PublicKey), data, meta); err != nil {
+			t.Errorf("sealed %v: rekeyed index signature doesn't verify: %v", atRest != nil, err)
+		}
+	}
+
+	// Indexes encrypted at rest are left alone without the index key, or with the wrong one
+	path := filepath.Join(t.TempDir(), "alice.txt.sindex")
+	writeRekeyableIndex(t, path, keywords, oldKeys, keywordKey, indexKey)
+	before, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongKey := make([]byte, 32)
+	for _, key := range [][]byte{nil, wrongKey} {
+		withKey := keys
+		withKey.indexKey = key
+		if _, err := rekeyIndex(path, withKey); err == nil {
+			t.Errorf("rekeyIndex of an index encrypted at rest succeeded with index key %x", key)
+		}
+		if after, err := ioutil.ReadFile(path); err != nil || string(after) != string(before) {
+			t.Errorf("failed rekeyIndex with index key %x replaced the index", key)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+/* Implementation of Secure Indexes in Go. This script removes a document from the searchable set. Given a document, or   *
+ * its secure index, deletes the index and the artifacts siBuildIndex wrote alongside it (the index's metadata, keyword  *
+ * cache and any per-window sub-indexes, the encrypted copy of the document and its key), reporting each file removed.   *
+ * The document itself is left in place, and nothing outside the index root but the document's key is removed.          *
+ * Source ref: crypto.stanford.edu/~eujin/papers/secureindex/secureindex.pdf                                             */
+
+import (
+	"flag" // Import std. packages
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"secureindex/cryptoUtils" // Import custom packages
+	"secureindex/indexMeta"
+)
+
+// Suffixes of the files siBuildIndex writes for a document
+const (
+	INDEX_SUFFIX = ".sindex"
+	DATA_SUFFIX  = ".encrypted.data"
+	KEY_SUFFIX   = ".encrypted.private"
+)
+
+/* Error handling */
+func errorCheck(msg string, err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, msg)
+		os.Exit(1)
+	}
+}
+
+/* Clean a path and ensure it stays within the index root (after resolving any *
+ * symlinks), rejecting anything that escapes such as "../" components          */
+func resolveWithinRoot(root string, path string) (string, error) {
+
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	absPath, err := filepath.Abs(filepath.Clean(path))
+	if err != nil {
+		return "", err
+	}
+
+	// Compare real locations where the paths exist, so symlinks can't escape the root
+	if realRoot, err := filepath.EvalSymlinks(absRoot); err == nil {
+		absRoot = realRoot
+	}
+	if realPath, err := filepath.EvalSymlinks(absPath); err == nil {
+		absPath = realPath
+	}
+
+	rel, err := filepath.Rel(absRoot, absPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %s escapes the index root", path)
+	}
+
+	return filepath.Join(root, rel), nil
+}
+
+/* Find the index artifacts of a document: its secure index with metadata and keyword *
+ * cache, the sub-indexes of a windowed build (e.g. "report.pdf#w0-200.sindex") and   *
+ * its encrypted copy                                                                   */
+func indexArtifacts(document string) ([]string, error) {
+
+	artifacts := make([]string, 0, 0)
+	for _, suffix := range []string{INDEX_SUFFIX, INDEX_SUFFIX + indexMeta.FILE_SUFFIX, INDEX_SUFFIX + cryptoUtils.KEYWORD_CACHE_SUFFIX, DATA_SUFFIX} {
+		artifacts = append(artifacts, document+suffix)
+	}
+
+	files, err := ioutil.ReadDir(filepath.Dir(document))
+	if err != nil {
+		return nil, err
+	}
+	window := filepath.Base(document) + "#w"
+	for _, f := range files {
+		if !f.IsDir() && strings.HasPrefix(f.Name(), window) && strings.Contains(f.Name(), INDEX_SUFFIX) {
+			artifacts = append(artifacts, filepath.Join(filepath.Dir(document), f.Name()))
+		}
+	}
+
+	return artifacts, nil
+}
+
+/* Remove (or if dryRun, list) the index artifacts and encrypted document key of a document, *
+ * its secure index or its encrypted copy, returning how many files were removed and failed  */
+func removeIndex(root string, keyDir string, target string, dryRun bool) (int, int) {
+
+	// Accept the document, its secure index or its encrypted copy
+	document := target
+	for _, suffix := range []string{INDEX_SUFFIX + indexMeta.FILE_SUFFIX, INDEX_SUFFIX, DATA_SUFFIX} {
+		if strings.HasSuffix(document, suffix) {
+			document = strings.TrimSuffix(document, suffix)
+			break
+		}
+	}
+
+	document, err := resolveWithinRoot(root, document)
+	if err != nil {
+		fmt.Printf("REFUSED: %s (%v)\n", target, err)
+		return 0, 1
+	}
+
+	artifacts, err := indexArtifacts(document)
+	if err != nil {
+		fmt.Printf("FAILED: %s (%v)\n", target, err)
+		return 0, 1
+	}
+	// Keys in a key directory mirror the document's path within the index root
+	key := document + KEY_SUFFIX
+	if len(keyDir) > 0 {
+		rel, err := filepath.Rel(root, document)
+		if err != nil {
+			rel = filepath.Base(document)
+		}
+		key = filepath.Join(keyDir, rel+KEY_SUFFIX)
+	}
+	artifacts = append(artifacts, key)
+
+	removed, failed, found := 0, 0, 0
+	for _, artifact := range artifacts {
+		if _, err := os.Lstat(artifact); err != nil {
+			continue
+		}
+		found++
+
+		if dryRun {
+			fmt.Printf(" -would remove %s\n", artifact)
+			continue
+		}
+		if err := os.Remove(artifact); err != nil {
+			fmt.Printf("FAILED: %s (%v)\n", artifact, err)
+			failed++
+			continue
+		}
+		fmt.Printf(" -removed %s\n", artifact)
+		removed++
+	}
+	if found == 0 {
+		fmt.Printf("INFO: no index artifacts found for %s\n", target)
+	}
+
+	return removed, failed
+}
+
+/* Takes documents, or their secure indexes, within an index root. Removes (or with *
+ * -dry-run lists) each document's index artifacts and encrypted document key        */
+func main() {
+
+	root := flag.String("root", ".", "index root, nothing outside it (other than keys in -keydir) is removed")
+	keyDir := flag.String("keydir", "", "directory holding the .encrypted.private keys, i.e. the keyfile's directory at build time (default: alongside each document)")
+	dryRun := flag.Bool("dry-run", false, "list the files that would be removed without removing them")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: siRemoveIndex [options] <document or .sindex file> ...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	info, err := os.Stat(*root)
+	errorCheck("ERROR: unable to find index root "+*root+".", err)
+	if !info.IsDir() {
+		fmt.Printf("ERROR: index root %s is not a directory.\n", *root)
+		os.Exit(1)
+	}
+
+	removed, failed := 0, 0
+	for _, target := range flag.Args() {
+		r, f := removeIndex(*root, *keyDir, target, *dryRun)
+		removed += r
+		failed += f
+	}
+
+	if *dryRun {
+		fmt.Printf("\n Dry run, nothing removed.\n\n")
+	} else {
+		fmt.Printf("\n Removed %d files, %d failed.\n\n", removed, failed)
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io/ioutil" // Standard packages
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"secureindex/cryptoUtils" // Custom packages
+	"secureindex/indexMeta"
+)
+
+/* Write empty files, creating their directories */
+func touchFiles(t *testing.T, files ...string) {
+
+	for _, file := range files {
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte("SIBF"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+/* List the files under a directory, relative to it */
+func listFiles(t *testing.T, dir string) []string {
+
+	files := make([]string, 0, 0)
+	err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil || f.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		files = append(files, filepath.ToSlash(rel))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+
+	return files
+}
+
+func TestResolveWithinRoot(t *testing.T) {
+
+	// An index root beside a directory outside it that a symlink points into
+	dir := t.TempDir()
+	root := filepath.Join(dir, "indexes")
+	outside := filepath.Join(dir, "outside")
+	touchFiles(t, filepath.Join(root, "sub", "alice.txt"), filepath.Join(outside, "secret.txt"))
+	symlinks := os.Symlink(outside, filepath.Join(root, "escape")) == nil
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string // Resolved path, relative to the root, if within it
+		symlink bool   // Needs symlinks, which may be unavailable (e.g. on Windows without privileges)
+	}{
+		{"document in a sub-directory", filepath.Join(root, "sub", "alice.txt"), "sub/alice.txt", false},
+		{"missing document within the root", filepath.Join(root, "bob.txt"), "bob.txt", false},
+		{"dot-dot staying within the root", root + "/sub/../sub/alice.txt", "sub/alice.txt", false},
+		{"dot-dot component", root + "/../outside/secret.txt", "", false},
+		{"parent directory", filepath.Join(root, ".."), "", false},
+		{"absolute path outside the root", filepath.Join(outside, "secret.txt"), "", false},
+		{"symlinked directory escaping the root", filepath.Join(root, "escape", "secret.txt"), "", true},
+	}
+
+	for _, test := range tests {
+		if test.symlink && !symlinks {
+			t.Logf("%s: skipped, unable to create symlinks", test.name)
+			continue
+		}
+
+		resolved, err := resolveWithinRoot(root, test.path)
+		if len(test.want) == 0 {
+			if err == nil {
+				t.Errorf("%s: resolveWithinRoot(%q) = %q, want an error", test.name, test.path, resolved)
+			}
+			continue
+		}
+		if want := filepath.Join(root, filepath.FromSlash(test.want)); err != nil || resolved != want {
+			t.Errorf("%s: resolveWithinRoot(%q) = %q (%v), want %q", test.name, test.path, resolved, err, want)
+		}
+	}
+}
+
+func TestRemoveIndex(t *testing.T) {
+
+	// A document's artifacts, its key in a key directory mirroring the root and a neighbour's index
+	dir := t.TempDir()
+	root := filepath.Join(dir, "docs")
+	keyDir := filepath.Join(dir, "keys")
+	document := filepath.Join(root, "a", "report.pdf")
+	touchFiles(t,
+		document,
+		document+INDEX_SUFFIX,
+		document+INDEX_SUFFIX+indexMeta.FILE_SUFFIX,
+		document+INDEX_SUFFIX+cryptoUtils.KEYWORD_CACHE_SUFFIX,
+		filepath.Join(root, "a", "report.pdf#w0-200"+INDEX_SUFFIX),
+		document+DATA_SUFFIX,
+		filepath.Join(keyDir, "a", "report.pdf"+KEY_SUFFIX),
+		filepath.Join(root, "a", "report.pdf2"+INDEX_SUFFIX),
+		filepath.Join(root, "report.pdf"+INDEX_SUFFIX),
+		filepath.Join(dir, "outside.pdf"+INDEX_SUFFIX),
+	)
+	before := listFiles(t, dir)
+
+	// Nothing outside the index root is removed, however it's named
+	for _, target := range []string{filepath.Join(root, "..", "outside.pdf"+INDEX_SUFFIX), filepath.Join(dir, "outside.pdf")} {
+		if removed, failed := removeIndex(root, keyDir, target, false); removed != 0 || failed != 1 {
+			t.Errorf("removeIndex(%q) removed %d and failed %d, want it refused", target, removed, failed)
+		}
+	}
+
+	// A dry run finds the artifacts without removing any of them
+	if removed, failed := removeIndex(root, keyDir, document+INDEX_SUFFIX, true); removed != 0 || failed != 0 {
+		t.Errorf("dry run removed %d and failed %d, want neither", removed, failed)
+	}
+	if after := listFiles(t, dir); strings.Join(after, ",") != strings.Join(before, ",") {
+		t.Errorf("files %q left after refusals and a dry run, want %q", after, before)
+	}
+
+	// Removal takes the index artifacts and key, leaving the document and other indexes
+	if removed, failed := removeIndex(root, keyDir, document+INDEX_SUFFIX, false); removed != 6 || failed != 0 {
+		t.Errorf("removeIndex removed %d and failed %d, want 6 removed", removed, failed)
+	}
+	want := []string{"docs/a/report.pdf", "docs/a/report.pdf2.sindex", "docs/report.pdf.sindex", "outside.pdf.sindex"}
+	if after := listFiles(t, dir); strings.Join(after, ",") != strings.Join(want, ",") {
+		t.Errorf("files %q left after removal, want %q", after, want)
+	}
+}
@@ -5,125 +5,575 @@ package main
  * Source ref: crypto.stanford.edu/~eujin/papers/secureindex/secureindex.pdf                                                    */
 
 import (
-	"encoding/csv"
-	"encoding/hex"	
+    "bufio"
+    "context"
+    "crypto/tls"
+    "crypto/x509"
     "encoding/json"
+    "flag"
     "fmt"
-	"io"
 	"os"
-    "bufio"
     "strings"
-    "crypto/tls"
+    "time"
     "secureindex/cryptoUtils" // Cryptographic functions package
+    "secureindex/keywordUtils" // Keyword normalisation shared with the index build
+    "secureindex/searchProtocol" // Client-server message types
+    "secureindex/siclient" // Client API for searching the server's secure indexes
+    "secureindex/tlsProfile" // TLS security profiles shared with the server
 )
 
+// Exit statuses, so scripts can tell a search without matches from one that failed
+const (
+    EXIT_MATCHES    = 0 // The search found matches (or the interactive session ended normally)
+    EXIT_NO_MATCHES = 1 // The search completed without matches
+    EXIT_ERROR      = 2 // The search couldn't be completed
+)
+
+// Interactive input, read a line at a time so answers may contain spaces (e.g. phrases)
+var stdin = bufio.NewReader(os.Stdin)
+
 /* Error handling */
 func errorCheck(msg string, err error) {
 	if err != nil {
-		fmt.Fprintf(os.Stderr, msg+"\n")
-		os.Exit(1)
+		fmt.Fprintln(os.Stderr, msg)
+		os.Exit(EXIT_ERROR)
 	}
 }
 
-/* Function to read k private keys from key file *
- * Return k private keys as 2d slice of bytes    */
-func readKeys(keyFile string) [][]byte {
-	// Store k private keys in array slice
-	hashKeys := make([][]byte, 0, 0)
-
-	// Read k hash keys from CSV file
-	file, _ := os.Open(keyFile)
-	r := csv.NewReader(file)
-	for {
-		record, err := r.Read()
-		if err == io.EOF {
-			break
-		}
-		 errorCheck("ERROR: unable to read from keyfile.", err)
-
-        // Read keys from file and decode from hex
-		for r, _ := range record {
-			key, err := hex.DecodeString(record[r])
-		    errorCheck("ERROR: unable to read from keyfile.", err)
-			hashKeys = append(hashKeys, key)
-		}
-	}
-    return hashKeys
+/* Declare custom structure for a search recorded in the results output file */
+type resultRecord struct {
+    Time    string   `json:"time"`
+    Keyword string   `json:"keyword"`
+    Types   []string `json:"types,omitempty"`
+    Index   string   `json:"index,omitempty"`
+    Matches []string `json:"matches"`
+    Error   string   `json:"error,omitempty"`
+}
+
+/* Print a single match, optionally with its approximate confidence, the number of keywords *
+ * it matched and its modification time                                                    */
+func printMatch(match searchProtocol.Match, confidence bool) {
+
+    fmt.Printf(" -%s", match.Name)
+    if confidence {
+        fmt.Printf(" (confidence %.4f)", match.Confidence)
+    }
+    if match.Keywords > 0 {
+        fmt.Printf(" (keywords matched: %d, score %d/%d)", match.Keywords, match.Score, match.MaxScore)
+    }
+    if len(match.Modified) > 0 {
+        fmt.Printf(" (modified %s)", match.Modified)
+    }
+    fmt.Printf("\n")
+}
+
+/* Warn of indexes the server skipped for being built with a different keyfile */
+func printMismatched(mismatched int) {
+
+    if mismatched > 0 {
+        fmt.Printf("\n WARNING: %d indexes were built with a different number of hash keys than this keyfile and weren't searched.\n", mismatched)
+    }
+}
+
+/* Print a JSON search response in the same style as the server's text responses */
+func printResponse(response searchProtocol.Response, confidence bool) {
+
+    if len(response.Error) > 0 {
+        fmt.Printf("\n Search failed: %s.\n", response.Error)
+    } else {
+        fmt.Printf("\n Checked %d indexes.\n", response.Scanned)
+        printMismatched(response.Mismatched)
+        fmt.Printf("\n Keyword matches found:\n ----------------------\n")
+        if len(response.Matches) > 0 {
+            for _, match := range response.Matches {
+                printMatch(match, confidence)
+            }
+        } else {
+            fmt.Printf(" -No matches found.\n")
+        }
+    }
+}
+
+/* Read a list of keywords, one per line, from a file or from stdin if the path is "-" */
+func readKeywords(path string) ([]string, error) {
+
+    in := os.Stdin
+    if path != "-" {
+        f, err := os.Open(path)
+        if err != nil {
+            return nil, err
+        }
+        defer f.Close()
+        in = f
+    }
+
+    keywords := make([]string, 0, 0)
+    scanner := bufio.NewScanner(in)
+    for scanner.Scan() {
+        if keyword := strings.TrimSpace(scanner.Text()); len(keyword) > 0 {
+            keywords = append(keywords, keyword)
+        }
+    }
+
+    return keywords, scanner.Err()
+}
+
+/* Read a line of interactive input, returning io.EOF once input has ended */
+func readInput() (string, error) {
+
+    line, err := stdin.ReadString('\n')
+    if err != nil && len(line) == 0 {
+        return "", err
+    }
+
+    return strings.TrimRight(line, "\r\n"), nil
+}
+
+/* Split keywords separated by commas, keeping commas within quoted phrases */
+func splitKeywords(list string) []string {
+
+    keywords := make([]string, 0, 0)
+    quoted := false
+    start := 0
+    for i, r := range list {
+        switch {
+        case r == '"' || r == '“' || r == '”':
+            quoted = !quoted
+        case r == ',' && !quoted:
+            keywords = append(keywords, list[start:i])
+            start = i + 1
+        }
+    }
+
+    return append(keywords, list[start:])
+}
+
+/* Drop keywords outside the index build's keyword length limits, as they're never indexed */
+func keepTerms(terms []string, opts keywordUtils.Options) []string {
+
+    kept := make([]string, 0, len(terms))
+    for _, term := range terms {
+        if keywordUtils.KeepKeyword(term, opts) {
+            kept = append(kept, term)
+        } else {
+            fmt.Printf("NOTE: %s is too short or too long to have been indexed (skipping keyword)\n", term)
+        }
+    }
+
+    return kept
+}
+
+/* Search the server for the terms, streaming matches as they're found if requested. Searches *
+ * the server couldn't complete are returned with its error rather than ending the session    */
+func runSearch(ctx context.Context, client *siclient.Client, terms []string, stream bool, confidence bool) searchProtocol.Response {
+
+    var results siclient.Results
+    var err error
+    if stream {
+        // Print each match as it arrives, followed by the totals once the stream ends
+        fmt.Printf("\n Keyword matches found:\n ----------------------\n")
+        results, err = client.SearchStream(ctx, terms, func(match searchProtocol.Match) {
+            printMatch(match, confidence)
+        })
+    } else {
+        results, err = client.Search(ctx, terms)
+    }
+
+    response := searchProtocol.Response{Matches: results.Matches, Scanned: results.Scanned, Mismatched: results.Mismatched}
+    if serverErr, ok := err.(*siclient.ServerError); ok {
+        response.Error = serverErr.Message
+    } else {
+        errorCheck("ERROR: unable to search secure indexes on server.", err)
+    }
+
+    return response
+}
+
+/* Print a search's response as JSON, formatted, or having streamed its matches, only its totals */
+func printResults(response searchProtocol.Response, stream bool, jsonOut bool, confidence bool) {
+
+    if stream {
+        if len(response.Error) > 0 {
+            fmt.Printf("\n Search failed: %s.\n", response.Error)
+        } else if len(response.Matches) == 0 {
+            fmt.Printf(" -No matches found.\n")
+        }
+        fmt.Printf("\n Checked %d indexes.\n", response.Scanned)
+        printMismatched(response.Mismatched)
+    } else if jsonOut {
+        data, err := json.Marshal(response)
+        errorCheck("ERROR: unable to encode search response.", err)
+        fmt.Printf("\n%s\n", data)
+    } else {
+        printResponse(response, confidence)
+    }
+}
+
+/* Record a search and its matches in the results file */
+func writeRecord(encoder *json.Encoder, keyword string, docTypes string, index string, response searchProtocol.Response) {
+
+    record := resultRecord{Time: time.Now().UTC().Format(time.RFC3339), Keyword: keyword, Index: index, Matches: make([]string, 0, 0), Error: response.Error}
+    for _, t := range strings.Split(docTypes, ",") {
+        if len(strings.TrimSpace(t)) > 0 {
+            record.Types = append(record.Types, searchProtocol.NormaliseType(t))
+        }
+    }
+    for _, match := range response.Matches {
+        record.Matches = append(record.Matches, match.Name)
+    }
+    err := encoder.Encode(record)
+    errorCheck("ERROR: unable to write results to output file.", err)
 }
 
 /* Takes a single keyword and file containing k cryptographic hash keys *
  * to build a trapdoor for seaching a secure index. Outputs a trapdoor  */
 func main() {
 
-    arguments := os.Args
-    if len(arguments) == 1 {
+    // Get user-specified options and server address
+    insecure := flag.Bool("insecure", false, "skip verification of the server's TLS certificate (testing only)")
+    indexName := flag.String("index", "", "search only this secure index file on the server, e.g. docs/report.pdf.sindex")
+    outPath := flag.String("out", "", "append each query and its matches to this file as JSON lines")
+    fuzzy := flag.Int("fuzzy", 0, "also search variants of the keyword within this edit distance (each variant adds false positives)")
+    padding := flag.Int("pad", 0, "pad each query with dummy keyword sets up to this many sets, hiding the keyword count")
+    foldAccents := flag.Bool("foldaccents", false, "accent- and case-insensitive keywords (must match the index build setting)")
+    stem := flag.Bool("stem", false, "search for the stems of keywords (must match the index build setting)")
+    minLength := flag.Int("minlength", keywordUtils.MIN_LENGTH, "skip keywords shorter than this many characters (must match the index build setting)")
+    maxLength := flag.Int("maxlength", keywordUtils.MAX_LENGTH, "skip keywords with a word longer than this many characters (must match the index build setting)")
+    hyphens := flag.String("hyphens", keywordUtils.HYPHENS_WHOLE, "hyphenated keyword handling: whole, split or both (must match the index build setting)")
+    sortMtime := flag.Bool("recent", false, "list the most recently modified matching documents first")
+    compress := flag.Bool("compress", false, "compress messages exchanged with the server (useful for large padded or fuzzy queries)")
+    confidence := flag.Bool("confidence", false, "show each match's approximate confidence, from the index positions it matched, that it isn't coincidental")
+    feedback := flag.Bool("feedback", false, "after each search, report any matches found to be false positives to the server")
+    trapdoorFile := flag.String("trapdoorfile", "", "search with trapdoors precomputed by siTrapdoors instead of a keyfile, keeping the keyfile off this machine")
+    matchAll := flag.Bool("all", false, "match documents containing every one of the comma separated keywords searched for, e.g. holmes,moriarty, rather than any of them")
+    stream := flag.Bool("stream", false, "display matches as the server finds them rather than once the search completes")
+    keywordList := flag.String("keywords", "", "search once for these comma separated keywords and exit, rather than prompting for keywords (requires -keyfile or -trapdoorfile)")
+    flag.StringVar(keywordList, "keyword", "", "same as -keywords, e.g. for a single keyword")
+    mode := flag.String("mode", "or", "how several keywords are combined: or (any may match) or and (all must match, as -all)")
+    serverAddr := flag.String("server", "", "host:port of the search server, instead of giving it as the first argument")
+    keywordFile := flag.String("keywordfile", "", "search once for the keywords listed in this file, one per line (\"-\" reads them from stdin), and exit")
+    keyfile := flag.String("keyfile", "", "private search keys to use, rather than prompting for them on the first search")
+    askKeys := flag.Bool("askkeys", false, "prompt for the private search keys before every search, rather than once per session")
+    jsonOut := flag.Bool("json", false, "print each search's response as a single line JSON object (searchProtocol.Response) rather than formatted text")
+    devMode := flag.Bool("dev", false, "development mode: relax TLS safety checks, implies -insecure (NOT for production)")
+    caFile := flag.String("ca", "", "verify the server's certificate against the CAs in this PEM file rather than the system's")
+    flag.StringVar(caFile, "cafile", "", "same as -ca")
+    serverName := flag.String("servername", "", "host name to verify the server's certificate for and send for SNI (default: the host in host:port)")
+    certFile := flag.String("cert", "", "client certificate to present to servers requiring one (mutual TLS), with -certkey")
+    certKeyFile := flag.String("certkey", "", "private key of the -cert client certificate")
+    profile := flag.String("tlsprofile", tlsProfile.INTERMEDIATE, "TLS security profile: modern (TLS 1.3 only), intermediate or legacy; must be compatible with the peer's")
+    flag.Parse()
+
+    server := *serverAddr
+    if len(server) == 0 && flag.NArg() > 0 {
+        server = flag.Arg(0)
+    }
+    if len(server) == 0 {
         fmt.Println("ERROR: provide host:port for client to connect to.")
+        os.Exit(EXIT_ERROR)
+    }
+
+    switch *mode {
+    case "and":
+        *matchAll = true
+    case "or":
+    default:
+        fmt.Println("ERROR: -mode must be and or or.")
+        os.Exit(EXIT_ERROR)
+    }
+
+    if *devMode {
+        fmt.Fprintf(os.Stderr, "\n *** WARNING: running in DEVELOPMENT mode, TLS safety checks are relaxed. ***\n\n")
+        *insecure = true
+    }
+    if *fuzzy > 1 {
+        fmt.Fprintf(os.Stderr, "WARNING: fuzzy edit distance %d generates a very large number of variant trapdoors.\n", *fuzzy)
+    }
+    if *insecure {
+        fmt.Fprintf(os.Stderr, "WARNING: server certificate verification is disabled, connection is open to interception.\n")
+    }
+
+    if *jsonOut && *stream {
+        fmt.Println("ERROR: -json and -stream can't be combined.")
+        os.Exit(EXIT_ERROR)
+    }
+    batch := len(*keywordList) > 0 || len(*keywordFile) > 0
+    if batch && len(*keyfile) == 0 && len(*trapdoorFile) == 0 {
+        fmt.Println("ERROR: -keywords and -keywordfile require -keyfile or -trapdoorfile.")
+        os.Exit(EXIT_ERROR)
+    }
+
+    if !keywordUtils.ValidHyphens(*hyphens) {
+        fmt.Println("ERROR: -hyphens must be whole, split or both.")
         return
     }
+    if *minLength < 1 || *maxLength < *minLength {
+        fmt.Println("ERROR: -minlength must be at least 1 and -maxlength at least -minlength.")
+        return
+    }
+    lengths := keywordUtils.Options{MinLength: *minLength, MaxLength: *maxLength}
 
-    // Set secure configuration settings for establishing TLS connections with server
-    config := &tls.Config{
-        InsecureSkipVerify: true,
-        MinVersion: tls.VersionTLS12,
-        CurvePreferences: []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
-        PreferServerCipherSuites: true,
-        CipherSuites: []uint16{
-            tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-            tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
-            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-        },
+    // Check the TLS profile before connecting to report a mistyped name clearly
+    _, err := tlsProfile.Config(*profile)
+    errorCheck("ERROR: unknown TLS profile "+*profile+".", err)
+
+    // Load the CAs to verify the server against and the certificate to authenticate this client with
+    var rootCAs *x509.CertPool
+    if len(*caFile) > 0 {
+        rootCAs, err = tlsProfile.LoadCAPool(*caFile)
+        errorCheck("ERROR: unable to load CA certificates from "+*caFile+".", err)
+    }
+    var certificates []tls.Certificate
+    if len(*certFile) > 0 || len(*certKeyFile) > 0 {
+        cert, err := tls.LoadX509KeyPair(*certFile, *certKeyFile)
+        errorCheck("ERROR: unable to load client certificate and key (-cert and -certkey).", err)
+        certificates = append(certificates, cert)
     }
 
     // Open client connection to tcp server
-    server := arguments[1]
-    connection, err := tls.Dial("tcp", server, config)
-    errorCheck("ERROR: unable to establish connection.", err)
-    //defer connection.Close()
+    sortOrder := ""
+    if *sortMtime {
+        sortOrder = searchProtocol.SORT_MTIME
+    }
+
+    // Precomputed trapdoors replace the keyfile entirely
+    var trapdoors map[string][][]byte
+    if len(*trapdoorFile) > 0 {
+        trapdoors, err = cryptoUtils.ReadTrapdoorFile(*trapdoorFile)
+        errorCheck("ERROR: unable to read trapdoor file.", err)
+    }
+
+    client, err := siclient.New(server, siclient.Options{
+        Trapdoors: trapdoors,
+        TLSProfile: *profile,
+        Insecure: *insecure,
+        RootCAs: rootCAs,
+        ServerName: *serverName,
+        Certificates: certificates,
+        Index: *indexName,
+        Fuzzy: *fuzzy,
+        Pad: *padding,
+        FoldAccents: *foldAccents,
+        Stem: *stem,
+        MinLength: *minLength,
+        MaxLength: *maxLength,
+        Hyphens: *hyphens,
+        Confidence: *confidence,
+        Compress: *compress,
+        Sort: sortOrder,
+        MatchAll: *matchAll,
+    })
+    if err != nil {
+        // Report why, e.g. a certificate that doesn't verify for the server's name
+        fmt.Fprintf(os.Stderr, "ERROR: unable to establish connection: %v\n", err)
+        os.Exit(EXIT_ERROR)
+    }
+    ctx := context.Background()
+
+    // Use the same private keys for every search if given
+    if len(*keyfile) > 0 && trapdoors == nil {
+        hashKeys, hashFunc, err := cryptoUtils.ReadKeyFileHash(*keyfile)
+        errorCheck("ERROR: unable to read from keyfile.", err)
+        client.SetKeys(hashKeys)
+        client.SetHash(hashFunc)
+    }
+
+    // Open results file for appending, structured responses are needed to record matches
+    var resultsEncoder *json.Encoder
+    if len(*outPath) > 0 {
+        outFile, err := os.OpenFile(*outPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+        errorCheck("ERROR: unable to open results output file.", err)
+        defer outFile.Close()
+        resultsEncoder = json.NewEncoder(outFile)
+    }
 
-    // Instantiate new JSON encoder and String Reader objects
-    jsonEncoder := json.NewEncoder(connection)
-    stringReader := bufio.NewReader(connection)
+    // Search for a batch of keywords in a single query and exit, rather than prompting for keywords,
+    // with an exit status telling whether there were matches
+    if batch {
+        keywords := splitKeywords(*keywordList)
+        if len(*keywordFile) > 0 {
+            listed, err := readKeywords(*keywordFile)
+            errorCheck("ERROR: unable to read keywords from "+*keywordFile+".", err)
+            keywords = append(keywords, listed...)
+        }
 
-    fmt.Println("Search secure indexes on file server. Key 'x' to close connection.")
+        terms := make([]string, 0, 0)
+        for _, term := range keywords {
+            if term = keywordUtils.NormalizeKeyword(term, keywordUtils.Options{FoldAccents: *foldAccents}); len(term) > 0 {
+                terms = append(terms, term)
+            }
+        }
+        terms = keepTerms(terms, lengths)
+        if len(terms) == 0 {
+            fmt.Println("ERROR: no keywords to search for.")
+            os.Exit(EXIT_ERROR)
+        }
+
+        // Only keywords in the trapdoor file can be searched
+        if _, err := client.Query(terms); err != nil {
+            if missing, ok := err.(*siclient.MissingTrapdoorsError); ok {
+                fmt.Printf("ERROR: keyword %s is not in the trapdoor file.\n", missing.Term)
+                os.Exit(EXIT_ERROR)
+            }
+            errorCheck("ERROR: unable to build query.", err)
+        }
+
+        response := runSearch(ctx, client, terms, *stream, *confidence)
+        printResults(response, *stream, *jsonOut, *confidence)
+        if resultsEncoder != nil {
+            writeRecord(resultsEncoder, strings.Join(terms, ","), "", *indexName, response)
+        }
+
+        err := client.Close()
+        errorCheck("ERROR: unable to close connection to server.", err)
+        if len(response.Error) > 0 {
+            os.Exit(EXIT_ERROR)
+        }
+        if len(response.Matches) == 0 {
+            os.Exit(EXIT_NO_MATCHES)
+        }
+        os.Exit(EXIT_MATCHES)
+    }
+
+    // Prompt for a keyfile and use its private keys for subsequent searches
+    loadKeys := func() error {
+        fmt.Printf(">Enter local filepath for private search keys: ")
+        keyFilepath, _ := readInput()
+        keyFilepath = strings.TrimSpace(keyFilepath)
+
+        hashKeys, hashFunc, err := cryptoUtils.ReadKeyFileHash(keyFilepath)
+        if err != nil {
+            return err
+        }
+        client.SetKeys(hashKeys)
+        client.SetHash(hashFunc)
+        return nil
+    }
+
+    // Private keys are read once and kept for the session, unless asked for before every search
+    keysLoaded := len(*keyfile) > 0
+
+    fmt.Println("Search secure indexes on file server. Key 'x' to close connection, 'k' to switch keyfile.")
     fmt.Printf(">")
 
     for {
-        // Get a keyword as user input
-    	var keyword string
-    	fmt.Printf("Enter a single keyword to search: ")
-	    fmt.Scanf("%s\n", &keyword)
-        keyword = strings.ToLower(strings.TrimSpace(keyword))
+        // Get keywords as user input, separated by commas, matching any (or with -all, all) of them.
+        // Phrases may be quoted, e.g. "machine learning"
+        if *matchAll {
+            fmt.Printf("Enter keywords to search, separated by commas (all must match): ")
+        } else {
+    	    fmt.Printf("Enter keywords to search, separated by commas (any may match): ")
+        }
+        keyword, err := readInput()
+        if err != nil {
+            // Input has ended, close the connection as if the user had entered 'x'
+            keyword = "x"
+        }
+        terms := make([]string, 0, 0)
+        for _, term := range splitKeywords(keyword) {
+            if term = keywordUtils.NormalizeKeyword(term, keywordUtils.Options{FoldAccents: *foldAccents}); len(term) > 0 {
+                terms = append(terms, term)
+            }
+        }
+        keyword = strings.Join(terms, ",")
 
         // Handle closing of tcp connection if user enters the trigger
         if keyword == "x" {
-            // Send empty trapdoor trigger closing connection on server-side
-            err := jsonEncoder.Encode(nil)
-            //err := jsonEncoder.Encode(make([][]byte, 0, 0))
-            errorCheck("ERROR: unable to create trapdoors to send to server.", err)
-            
-            // Close client connection to tcp server
-            connection.Close()
+            // Close client connection to tcp server, triggering the server to close its side
+            err := client.Close()
+            errorCheck("ERROR: unable to close connection to server.", err)
             return
         }
 
-        // Get filepath containing k hash keys as user input
-	    var keyFilepath string
-	    fmt.Printf(">Enter local filepath for private search keys: ")
-	    fmt.Scanf("%s\n", &keyFilepath)
+        // Ask again if no keyword was entered
+        if len(keyword) == 0 {
+            fmt.Printf(">")
+            continue
+        }
+
+        // Switch to another keyfile for subsequent searches
+        if keyword == "k" {
+            if trapdoors != nil {
+                fmt.Printf("\n Searching with precomputed trapdoors, no keyfile is used.\n\n>")
+                continue
+            }
+            if err := loadKeys(); err != nil {
+                fmt.Printf("\n Unable to read keyfile: %v.\n\n>", err)
+                continue
+            }
+            keysLoaded = true
+            fmt.Printf("\n Keyfile loaded.\n\n>")
+            continue
+        }
+
+        // Ask again if every keyword is too short or too long to have been indexed
+        if terms = keepTerms(terms, lengths); len(terms) == 0 {
+            fmt.Printf(">")
+            continue
+        }
 
-        // Read k private keys from user's keyfile
-        hashKeys := readKeys(keyFilepath)
+        if trapdoors != nil {
+            // Only keywords in the trapdoor file can be searched
+            if _, err := client.Query(terms); err != nil {
+                if _, missing := err.(*siclient.MissingTrapdoorsError); missing {
+                    fmt.Printf("\n Keyword %s is not in the trapdoor file.\n\n>", keyword)
+                    continue
+                }
+                errorCheck("ERROR: unable to build query.", err)
+            }
+        } else if !keysLoaded || *askKeys {
+            // Read k private keys from the user's keyfile
+            if err := loadKeys(); err != nil {
+                fmt.Printf("\n Unable to read keyfile: %v.\n\n>", err)
+                continue
+            }
+            keysLoaded = true
+        }
 
-	    // Create search trapdoor based on user's keyword
-	    trapdoors := cryptoUtils.BuildTrapdoors(keyword, hashKeys)
+        // Optionally restrict the search to certain document types
+        fmt.Printf(">Restrict search to document types, e.g. pdf,txt [leave blank for all]: ")
+        docTypes, _ := readInput()
+        docTypes = strings.Replace(docTypes, " ", "", -1)
+        client.SetTypes(strings.Split(docTypes, ","))
 
-        // Send trapdoor to the tcp server for searching against secure indexes
-        err := jsonEncoder.Encode(trapdoors)
-        errorCheck("ERROR: unable to create trapdoors to send to server.", err)
+        // Without a structured response, display the server's text response as is
+        if !*stream && resultsEncoder == nil && !*feedback && !*jsonOut {
+            text, err := client.SearchText(ctx, terms)
+            errorCheck("ERROR: unable to search secure indexes on server.", err)
+            fmt.Print(text)
+            continue
+        }
+
+        response := runSearch(ctx, client, terms, *stream, *confidence)
+        printResults(response, *stream, *jsonOut, *confidence)
+        fmt.Printf("\n>")
+
+        // Optionally report matches found to be false positives, helping the server track index quality
+        if *feedback && len(response.Matches) > 0 {
+            fmt.Printf("Mark matches as false positives, e.g. a.pdf,b.txt [leave blank for none]: ")
+            wrong, _ := readInput()
+
+            names := make([]string, 0, 0)
+            for _, name := range strings.Split(wrong, ",") {
+                if name = strings.TrimSpace(name); len(name) > 0 {
+                    names = append(names, name)
+                }
+            }
+
+            err := client.Feedback(ctx, names)
+            if serverErr, ok := err.(*siclient.ServerError); ok {
+                fmt.Printf(" Feedback not recorded: %s.\n", serverErr.Message)
+            } else {
+                errorCheck("ERROR: unable to send feedback to server.", err)
+            }
+            fmt.Printf(">")
+        }
+
+        if resultsEncoder == nil {
+            continue
+        }
 
-        // Get search matches by reading repsonse from tcp server
-        response, _ := stringReader.ReadString('>')
-        fmt.Printf(response)
+        // Record the query and its matches in the results file
+        writeRecord(resultsEncoder, keyword, docTypes, *indexName, response)
     }
 }
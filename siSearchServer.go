@@ -5,36 +5,117 @@ package main
  * Source ref: crypto.stanford.edu/~eujin/papers/secureindex/secureindex.pdf                                           */
 
 import (
+	"bytes"
 	"encoding/csv"
 	"encoding/json"
+    "flag"
     "fmt"
+    "math/big"
     "net"
 	"io"
+	"io/ioutil"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+    "crypto/ed25519"
+    "crypto/rand"
+    "crypto/rsa"
     "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
     "path/filepath"
+    "runtime"
+	"github.com/fsnotify/fsnotify" // File system notifications, for -watch
 	"secureindex/bloomFilter"   // Bloom Filter package
 	"secureindex/cryptoUtils"   // Cryptographic functions package
+	"secureindex/indexMeta"     // Secure index metadata package
+	"secureindex/searchAudit"    // Audit log of answered queries
+	"secureindex/searchProtocol" // Client-server message types
+	"secureindex/searchStats"    // Per-document match statistics
+	"secureindex/tlsProfile"     // TLS security profiles shared with the client
 )
 
 /* Error handling */
 func errorCheck(msg string, err error) {
 	if err != nil {
-		fmt.Fprintf(os.Stderr, msg+"\n")
+		fmt.Fprintln(os.Stderr, msg)
 		os.Exit(1)
 	}
 }
 
-/* Read a secure index file */
-func ReadSecureIndexFile(filepath string) ([]bool, error) {
+// Levels of secure index signature verification (-verify)
+const (
+    VERIFY_WARN     = "warn"     // Log unsigned or tampered indexes but still search them
+    VERIFY_TAMPERED = "tampered" // Exclude indexes with invalid signatures, log unsigned ones
+    VERIFY_STRICT   = "strict"   // Exclude any index without a valid signature
+)
+
+// Backoff after failing to accept a connection, doubling with each further failure up to the maximum
+const (
+    ACCEPT_BACKOFF     = 5 * time.Millisecond
+    MAX_ACCEPT_BACKOFF = time.Second
+)
+
+/* Key verifying secure index signatures (nil unless enabled with -verifykey) and the verification level */
+var verifyKey ed25519.PublicKey
+var verifyLevel = VERIFY_STRICT
+
+/* Per-document match statistics (nil unless enabled with -matchstats) */
+var stats *searchStats.Stats
+
+/* How long a client may take to send its next query before it's disconnected (-readtimeout, 0 for no limit) */
+var readTimeout = 5 * time.Minute
+
+/* Number of secure indexes each query searches concurrently (-workers) */
+var workers = runtime.GOMAXPROCS(0)
+
+/* Audit log of answered queries (nil unless enabled with -auditlog) */
+var audit *searchAudit.Log
+
+/* Key for secure indexes encrypted at rest (nil when indexes are stored in plaintext) */
+var indexKey []byte
+
+/* Read a secure index file's contents, decrypting them in memory if encrypted at rest */
+func readIndexData(filepath string) ([]byte, error) {
+
+	// Read the secure index from file stored in binary (CSV) format
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Indexes encrypted at rest are only ever decrypted in memory
+	if cryptoUtils.IsSealed(data) {
+		if indexKey == nil {
+			return nil, fmt.Errorf("%s is encrypted at rest but no index key was given", filepath)
+		}
+		data, err = cryptoUtils.Open(indexKey, data)
+		if err != nil {
+			return nil, err
+		}
+	} else if indexKey != nil {
+		return nil, fmt.Errorf("%s is not encrypted at rest", filepath)
+	}
+
+	return data, nil
+}
+
+/* Parse a secure index's (plaintext) contents into a Bloom Filter, in its binary format *
+ * or the CSV format of "0"/"1" fields written by earlier builds                        */
+func parseIndexData(data []byte) (*bloomFilter.BloomFilter, error) {
+
+    if bloomFilter.IsBinary(data) {
+        filter := new(bloomFilter.BloomFilter)
+        return filter, filter.UnmarshalBinary(data)
+    }
 
 	// Creat bool slice for the secure index
 	si := make([]bool, 0, 0)
 
-	// Read the secure index from file stored in binary (CSV) format
-	file, _ := os.Open(filepath)
-	r := csv.NewReader(file)
+	r := csv.NewReader(bytes.NewReader(data))
 
 	for {
 		record, err := r.Read()
@@ -55,78 +136,1076 @@ func ReadSecureIndexFile(filepath string) ([]bool, error) {
 		}
 	}
 
-    // Return the secure index in the form of a bool slice
-    return si, nil
+    // Pack the secure index's bits into a Bloom Filter
+    filter := bloomFilter.New(len(si), bloomFilter.STANDARD)
+    for i, bit := range si {
+        if bit {
+            filter.SetBit(i)
+        }
+    }
+    return filter, nil
+}
+
+/* Read the server's index key from file, generating and saving a new key if allowed */
+func loadIndexKey(keyFile string, generate bool) ([]byte, error) {
+
+    key, err := ioutil.ReadFile(keyFile)
+    if os.IsNotExist(err) && generate {
+        key, err = cryptoUtils.GenerateRandomBytes(32)
+        if err != nil {
+            return nil, err
+        }
+        return key, ioutil.WriteFile(keyFile, key, 0600)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    if len(key) != 32 {
+        return nil, fmt.Errorf("index key %s must be 32 bytes", keyFile)
+    }
+    return key, nil
+}
+
+/* Encrypt any plaintext secure indexes under the index root at rest, in place */
+func sealIndexFiles(root string, key []byte) (int, error) {
+
+    sealed := 0
+    err := filepath.Walk(root, func(path string, f os.FileInfo, err error) error {
+        if err != nil || f.IsDir() || !strings.HasSuffix(path, ".sindex") {
+            return err
+        }
+
+        data, err := ioutil.ReadFile(path)
+        if err != nil || cryptoUtils.IsSealed(data) {
+            return err
+        }
+
+        ciphertext, err := cryptoUtils.Seal(key, data)
+        if err != nil {
+            return err
+        }
+
+        // Replace the plaintext index via a temporary file so it is never left half written
+        tmp := path + ".tmp"
+        if err := ioutil.WriteFile(tmp, ciphertext, f.Mode()); err != nil {
+            return err
+        }
+        sealed++
+        return os.Rename(tmp, path)
+    })
+    return sealed, err
+}
+
+/* Determine the source document type for a secure index, preferring the index *
+ * metadata and falling back to the extension preserved in the index filename   */
+func indexDocumentType(indexPath string) string {
+
+	meta, err := indexMeta.Read(indexPath)
+	if err == nil && len(meta.Extension) > 0 {
+		return meta.Extension
+	}
+
+	return filepath.Ext(strings.TrimSuffix(indexPath, ".sindex"))
+}
+
+/* Obtain the document name from a secure index's file path */
+func indexDocumentName(file string) string {
+
+	// Split filepath and obtain file name
+	var sep string
+	if strings.Contains(file, "\\") {
+		sep = "\\"
+	} else {
+		sep = "/"
+	}
+	splitName := strings.Split(file, sep)
+	fname := splitName[len(splitName)-1]
+
+	return strings.Replace(fname, ".sindex", "", -1)
+}
+
+/* Obtain the name a secure index's document is matched and recorded by: its path relative to *
+ * the index root with forward slashes, e.g. "reports/2019/summary.pdf", so same-named        *
+ * documents in different folders are told apart                                              */
+func indexDocumentPath(root string, file string) string {
+
+	rel, err := filepath.Rel(root, file)
+	if err != nil {
+		rel = file
+	}
+
+	return strings.TrimSuffix(filepath.ToSlash(rel), ".sindex")
+}
+
+/* Clean a path and ensure it stays within the index root (after resolving any *
+ * symlinks), rejecting anything that escapes such as "../" components          */
+func resolveWithinRoot(root string, path string) (string, error) {
+
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	absPath, err := filepath.Abs(filepath.Clean(path))
+	if err != nil {
+		return "", err
+	}
+
+	// Compare real locations where the paths exist, so symlinks can't escape the root
+	if realRoot, err := filepath.EvalSymlinks(absRoot); err == nil {
+		absRoot = realRoot
+	}
+	if realPath, err := filepath.EvalSymlinks(absPath); err == nil {
+		absPath = realPath
+	}
+
+	rel, err := filepath.Rel(absRoot, absPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %s escapes the index root", path)
+	}
+
+	return filepath.Join(root, rel), nil
+}
+
+/* Check a document name returned to clients, or named in their feedback, is a relative path *
+ * within the index root with forward slashes, e.g. "reports/summary.pdf"                     */
+func validDocumentName(name string) bool {
+
+	if len(name) == 0 || strings.ContainsRune(name, '\\') || strings.HasPrefix(name, "/") || len(filepath.VolumeName(name)) > 0 {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+
+	return true
+}
+
+/* Declare custom error for a secure index excluded from searches by signature verification */
+type untrustedIndexError struct {
+    file string
+    err  error
+}
+
+func (e untrustedIndexError) Error() string {
+    return fmt.Sprintf("%s: %v", e.file, e.err)
+}
+
+/* Declare custom error for a secure index built with a different number of hash keys (k) *
+ * than a query's trapdoors, which can never match it                                     */
+type keyCountError struct {
+    file  string
+    index int
+    query int
+}
+
+func (e keyCountError) Error() string {
+    return fmt.Sprintf("%s was built with %d hash keys but the query's keyfile has %d", e.file, e.index, e.query)
+}
+
+/* Verify a secure index's signature if the server has a verify key, logging any index *
+ * that fails. Returns an untrustedIndexError if the -verify level excludes the index  */
+func verifyIndexFile(file string, data []byte) error {
+
+    if verifyKey == nil {
+        return nil
+    }
+
+    // Indexes without metadata are unsigned, unparseable metadata can't be trusted
+    meta, err := indexMeta.Read(file)
+    if os.IsNotExist(err) {
+        err = cryptoUtils.ErrUnsigned
+    } else if err != nil {
+        err = cryptoUtils.ErrBadSignature
+    } else {
+        err = cryptoUtils.VerifyIndex(verifyKey, data, meta)
+    }
+    if err == nil {
+        return nil
+    }
+
+    if verifyLevel == VERIFY_WARN || (verifyLevel == VERIFY_TAMPERED && err == cryptoUtils.ErrUnsigned) {
+        fmt.Fprintf(os.Stderr, "WARNING: %s: %v (searching anyway)\n", file, err)
+        return nil
+    }
+    fmt.Fprintf(os.Stderr, "WARNING: %s: %v (excluded)\n", file, err)
+    return untrustedIndexError{file, err}
+}
+
+/* Verify every secure index under the index root, returning how many were *
+ * verified and how many are excluded from searches                        */
+func verifyIndexes(root string) (int, int) {
+
+    verified, excluded := 0, 0
+    filepath.Walk(root, func(path string, f os.FileInfo, err error) error {
+        if err != nil || f.IsDir() || !strings.HasSuffix(path, ".sindex") {
+            return nil
+        }
+
+        data, err := readIndexData(path)
+        if err == nil {
+            err = verifyIndexFile(path, data)
+        }
+        if err != nil {
+            excluded++
+        } else {
+            verified++
+        }
+        return nil
+    })
+
+    return verified, excluded
+}
+
+/* Declare custom structure for a secure index parsed into memory, with the state of its *
+ * files when parsed and the document identifier and HMAC hash it was built with        */
+type cachedIndex struct {
+    modTime  time.Time
+    size     int64
+    metaTime time.Time // Zero if the index has no metadata
+    filter   *bloomFilter.BloomFilter
+    docID    string
+    hashFunc cryptoUtils.HMACHash
+}
+
+/* Declare custom structure for the secure indexes parsed so far, shared by every connection, *
+ * so each index is only read and parsed again once its files are modified                  */
+type indexCache struct {
+    mu      sync.RWMutex
+    indexes map[string]*cachedIndex
+}
+
+/* Parsed secure indexes, by path */
+var indexes = &indexCache{indexes: make(map[string]*cachedIndex)}
+
+/* Read, verify and parse a secure index file and its metadata */
+func loadIndexFile(file string) (*cachedIndex, error) {
+
+	// Read and verify the secure index, then create a Bloom Filter structure
+	data, err := readIndexData(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyIndexFile(file, data); err != nil {
+		return nil, err
+	}
+	filter, err := parseIndexData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Use the same Bloom Filter variant, document identifier and HMAC hash the index was built with.
+	// Builds record the document's path relative to the directory indexed, so same-named documents
+	// in different folders are told apart; older indexes recorded none and are bound to the name
+	index := &cachedIndex{filter: filter, docID: indexDocumentName(file), hashFunc: cryptoUtils.HMAC_SHA256}
+	if meta, err := indexMeta.Read(file); err == nil {
+		if len(meta.Filter) > 0 {
+			filter.Variant = meta.Filter
+		}
+		if len(meta.DocumentID) > 0 {
+			index.docID = meta.DocumentID
+		}
+		if index.hashFunc, err = cryptoUtils.ParseHMACHash(meta.HMAC); err != nil {
+			return nil, err
+		}
+	}
+
+	// Codeword positions are taken modulo the filter's size (or number of blocks), so the variant
+	// the metadata records must suit it, and empty or truncated indexes can't be searched
+	if err := filter.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	return index, nil
+}
+
+/* Get a secure index, parsing it only if it isn't cached or its index or metadata file *
+ * has been modified since. Cached indexes are shared, so must not be modified          */
+func (c *indexCache) get(file string) (*cachedIndex, error) {
+
+    info, err := os.Stat(file)
+    if err != nil {
+        c.forget(file)
+        return nil, err
+    }
+    metaTime := time.Time{}
+    if metaInfo, err := os.Stat(file + indexMeta.FILE_SUFFIX); err == nil {
+        metaTime = metaInfo.ModTime()
+    }
+
+    c.mu.RLock()
+    index, ok := c.indexes[file]
+    c.mu.RUnlock()
+    if ok && index.modTime.Equal(info.ModTime()) && index.size == info.Size() && index.metaTime.Equal(metaTime) {
+        return index, nil
+    }
+
+    // Indexes failing to load (e.g. failing verification) are read again by every search
+    index, err = loadIndexFile(file)
+    if err != nil {
+        c.forget(file)
+        return nil, err
+    }
+    index.modTime, index.size, index.metaTime = info.ModTime(), info.Size(), metaTime
+
+    c.mu.Lock()
+    c.indexes[file] = index
+    c.mu.Unlock()
+
+    return index, nil
+}
+
+/* Drop a secure index from the cache */
+func (c *indexCache) forget(file string) {
+    c.mu.Lock()
+    delete(c.indexes, file)
+    c.mu.Unlock()
+}
+
+/* Drop every secure index under a directory from the cache */
+func (c *indexCache) forgetUnder(dir string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    prefix := dir + string(filepath.Separator)
+    for file := range c.indexes {
+        if strings.HasPrefix(file, prefix) {
+            delete(c.indexes, file)
+        }
+    }
+}
+
+/* Drop every secure index from the cache */
+func (c *indexCache) reset() {
+    c.mu.Lock()
+    c.indexes = make(map[string]*cachedIndex)
+    c.mu.Unlock()
+}
+
+/* Watch a directory and those under it, returning how many are watched. Directories that *
+ * can't be watched (e.g. beyond the system's limit on watches) are counted and skipped   */
+func addWatches(watcher *fsnotify.Watcher, dir string) (int, int) {
+
+    watched, failed := 0, 0
+    filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+        if err != nil || !f.IsDir() {
+            return nil
+        }
+        if err := watcher.Add(path); err != nil {
+            if failed == 0 {
+                fmt.Fprintf(os.Stderr, "WARNING: unable to watch %s for index changes: %v\n", path, err)
+            }
+            failed++
+            return nil
+        }
+        watched++
+        return nil
+    })
+
+    return watched, failed
+}
+
+/* Watch the index root, dropping cached secure indexes as soon as their index or metadata files *
+ * are created, modified, renamed or deleted. This catches changes the cache's modification time *
+ * checks can't, such as indexes copied in with their original times (e.g. rsync -t). Changes    *
+ * the watcher misses (unwatched directories, network filesystems) still rely on those checks    */
+func watchIndexes(root string) (int, int, error) {
+
+    watcher, err := fsnotify.NewWatcher()
+    if err != nil {
+        return 0, 0, err
+    }
+    watched, failed := addWatches(watcher, root)
+
+    go func() {
+        for {
+            select {
+            case event, ok := <-watcher.Events:
+                if !ok {
+                    return
+                }
+
+                // Watch new directories, e.g. a tree of indexes moved into the root
+                if event.Op&fsnotify.Create != 0 {
+                    if f, err := os.Stat(event.Name); err == nil && f.IsDir() {
+                        addWatches(watcher, event.Name)
+                    }
+                }
+
+                indexPath := strings.TrimSuffix(event.Name, indexMeta.FILE_SUFFIX)
+                if strings.HasSuffix(indexPath, ".sindex") {
+                    indexes.forget(indexPath)
+                } else if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+                    indexes.forgetUnder(event.Name)
+                }
+
+            case err, ok := <-watcher.Errors:
+                if !ok {
+                    return
+                }
+                // Events may have been lost (e.g. the event queue overflowed), so start afresh
+                fmt.Fprintf(os.Stderr, "WARNING: watching for index changes: %v (clearing index cache)\n", err)
+                indexes.reset()
+            }
+        }
+    }()
+
+    return watched, failed, nil
+}
+
+/* Declare custom structure for the result of searching a single secure index */
+type indexResult struct {
+    matched    int     // Number of the query's terms matched, 0 if the index doesn't match
+    score      int     // Codeword positions set, summed over the terms (see searchProtocol.Match)
+    confidence float64 // Approximate confidence of a match, from its terms' BloomFilter.ChanceMatch
+}
+
+/* Search a single secure index file, matching if any of the terms' keywords match, or *
+ * with all set, if every term has a matching keyword. Returns a keyCountError if the  *
+ * index records a different number of keys than k                                      */
+func searchIndexFile(file string, terms [][]searchProtocol.TrapdoorSet, all bool, k int) (indexResult, error) {
+
+	// Get the secure index's Bloom Filter, parsed from file only if it's changed since last searched
+	index, err := indexes.get(file)
+	if err != nil {
+		return indexResult{}, err
+	}
+	filter, docID, hashFunc := index.filter, index.docID, index.hashFunc
+
+	// Trapdoors from a keyfile with a different number of keys can't match (indexes in
+	// the earlier CSV format don't record theirs)
+	if filter.Hashes > 0 && filter.Hashes != k {
+		return indexResult{}, keyCountError{file, filter.Hashes, k}
+	}
+
+	// Most codeword positions set in the secure index by any of a term's keywords (its variants),
+	// all k of them meaning the term matches, and the chance a matching keyword's positions are
+	// all set coincidentally
+	termScore := func(keywords []searchProtocol.TrapdoorSet) (int, float64) {
+		best, chance := 0, 1.0
+		for _, set := range keywords {
+			// Trapdoors built with a different hash (their length differs) can't match
+			if len(set.Trapdoors) > 0 && len(set.Trapdoors[0]) != hashFunc.Size() {
+				continue
+			}
+
+			// Create codewords from document identifier (its name unless stable) and trapdoors
+			codewords := cryptoUtils.BuildCodewordsWith(hashFunc, docID, set.Trapdoors)
+			if count := filter.Count(codewords); count > best {
+				best = count
+			}
+			if best == k {
+				chance = filter.ChanceMatch(codewords)
+				break
+			}
+		}
+		return best, chance
+	}
+
+	// Count and score the terms matched, stopping at the first unmatched term if every term must match.
+	// A match is coincidental if every term matched is (any), or if any term is (all)
+	result := indexResult{}
+	allCoincidental, noneCoincidental := 1.0, 1.0
+	for _, keywords := range terms {
+		score, chance := termScore(keywords)
+		if score == k {
+			result.matched++
+			allCoincidental *= chance
+			noneCoincidental *= 1 - chance
+		} else if all {
+			return indexResult{}, nil
+		}
+		result.score += score
+	}
+	if result.matched == 0 {
+		return indexResult{}, nil
+	}
+	if all {
+		result.confidence = noneCoincidental
+	} else {
+		result.confidence = 1 - allCoincidental
+	}
+
+	return result, nil
+}
+
+/* Declare custom structure for the outcome of searching a single secure index file */
+type searchOutcome struct {
+    result indexResult
+    err    error
+}
+
+/* Search secure index files with a pool of workers, returning each file's outcome in the files' *
+ * order. If found isn't nil, it's called with each matching file's position and result as soon *
+ * as it's found, from the calling goroutine                                                     */
+func searchIndexFiles(files []string, terms [][]searchProtocol.TrapdoorSet, all bool, k int, found func(int, indexResult)) []searchOutcome {
+
+    outcomes := make([]searchOutcome, len(files))
+    poolSize := workers
+    if poolSize > len(files) {
+        poolSize = len(files)
+    }
+
+    // Each worker searches the files whose positions it receives, reporting each as it completes
+    jobs := make(chan int)
+    done := make(chan int)
+    for w := 0; w < poolSize; w++ {
+        go func() {
+            for i := range jobs {
+                outcomes[i].result, outcomes[i].err = searchIndexFile(files[i], terms, all, k)
+                done <- i
+            }
+        }()
+    }
+    go func() {
+        for i := range files {
+            jobs <- i
+        }
+        close(jobs)
+    }()
+
+    for range files {
+        i := <-done
+        if found != nil && outcomes[i].err == nil && outcomes[i].result.matched > 0 {
+            found(i, outcomes[i].result)
+        }
+    }
+
+    return outcomes
+}
+
+/* Create a match for a secure index's document, named by its path within the index root and *
+ * including its confidence and modification time only if the query asked for them          */
+func newMatch(query *searchProtocol.Query, root string, indexPath string, result indexResult, k int) searchProtocol.Match {
+
+    name := indexDocumentPath(root, indexPath)
+    if stats != nil {
+        stats.RecordMatch(name)
+    }
+
+    terms := len(query.Terms())
+    match := searchProtocol.Match{Name: name, Score: result.score, MaxScore: k * terms}
+    if terms > 1 {
+        match.Keywords = result.matched
+    }
+    if query.Confidence {
+        match.Confidence = result.confidence
+    }
+    if query.Sort == searchProtocol.SORT_MTIME {
+        match.Modified = documentModTime(indexPath).UTC().Format(time.RFC3339)
+    }
+    return match
+}
+
+/* Modification time of a secure index's source document, which may be stored in plaintext *
+ * or encrypted alongside the index, falling back to the time the index was written        */
+func documentModTime(indexPath string) time.Time {
+
+    document := strings.TrimSuffix(indexPath, ".sindex")
+    for _, path := range []string{document, document + ".encrypted.data", indexPath} {
+        if info, err := os.Stat(path); err == nil {
+            return info.ModTime()
+        }
+    }
+
+    return time.Time{}
+}
+
+/* Declare custom structure tracking open client connections and whether each is handling a query, *
+ * so the server can drain in-flight queries when shutting down                                   */
+type connTracker struct {
+    mu      sync.Mutex
+    conns   map[net.Conn]bool // True while the connection is handling a query
+    closing bool
+    done    sync.WaitGroup
+}
+
+/* Open client connections */
+var connections = &connTracker{conns: make(map[net.Conn]bool)}
+
+/* Start tracking a new connection, returning false if the server is shutting down */
+func (t *connTracker) add(conn net.Conn) bool {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    if t.closing {
+        return false
+    }
+    t.conns[conn] = false
+    t.done.Add(1)
+    return true
+}
+
+/* Stop tracking a connection once its handler has returned */
+func (t *connTracker) remove(conn net.Conn) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    delete(t.conns, conn)
+    t.done.Done()
+}
+
+/* Mark a connection as handling a query or waiting for one, returning false if *
+ * the server is shutting down and the connection should close instead          */
+func (t *connTracker) setBusy(conn net.Conn, busy bool) bool {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    if t.closing {
+        return false
+    }
+    t.conns[conn] = busy
+    return true
+}
+
+/* Stop accepting queries, as the server is shutting down */
+func (t *connTracker) close() {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    t.closing = true
+}
+
+/* Check whether the server is shutting down */
+func (t *connTracker) isClosing() bool {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    return t.closing
+}
+
+/* Close idle connections and wait up to the grace period for in-flight queries to complete, *
+ * then forcibly close any connections left, logging how the drain went                     */
+func (t *connTracker) drain(grace time.Duration) {
+
+    start := time.Now()
+
+    // Idle connections are waiting for a query, so can be closed straight away
+    t.mu.Lock()
+    inFlight, idle := 0, 0
+    for conn, busy := range t.conns {
+        if busy {
+            inFlight++
+        } else {
+            idle++
+            conn.Close()
+        }
+    }
+    t.mu.Unlock()
+    fmt.Printf("Shutting down: %d queries in flight, %d idle connections closed, waiting up to %v.\n", inFlight, idle, grace)
+
+    drained := make(chan struct{})
+    go func() {
+        t.done.Wait()
+        close(drained)
+    }()
+
+    select {
+    case <-drained:
+    case <-time.After(grace):
+    }
+
+    // Forcibly close connections whose queries outlasted the grace period
+    t.mu.Lock()
+    forced := 0
+    for conn, busy := range t.conns {
+        if busy {
+            forced++
+        }
+        conn.Close()
+    }
+    t.mu.Unlock()
+
+    fmt.Printf("Shutdown complete in %v: %d in-flight queries completed, %d forcibly closed.\n", time.Since(start).Round(time.Millisecond), inFlight-forced, forced)
+}
+
+/* Declare custom structure for a client connection whose messages may be compressed */
+type protocolConn struct {
+    net.Conn
+    reader io.Reader
+    writer io.Writer
+}
+
+func (c *protocolConn) Read(p []byte) (int, error) {
+    return c.reader.Read(p)
+}
+
+func (c *protocolConn) Write(p []byte) (int, error) {
+    return c.writer.Write(p)
+}
+
+/* Record a client's false positive feedback in the match statistics and acknowledge it */
+func handleFeedback(conn net.Conn, query *searchProtocol.Query) {
+
+    response := searchProtocol.Response{Matches: make([]searchProtocol.Match, 0, 0)}
+    if stats == nil {
+        response.Error = "match statistics are not enabled"
+    } else {
+        for _, name := range query.FalsePositives {
+            if validDocumentName(name) {
+                stats.RecordFalsePositive(name)
+            }
+        }
+    }
+
+    switch query.Format {
+    case searchProtocol.FORMAT_JSON:
+        json.NewEncoder(conn).Encode(response)
+    case searchProtocol.FORMAT_STREAM:
+        json.NewEncoder(conn).Encode(searchProtocol.StreamMessage{End: true, Error: response.Error})
+    default:
+        if len(response.Error) > 0 {
+            io.WriteString(conn, fmt.Sprintf("\n Feedback not recorded: %s.\n\n>", response.Error))
+        } else {
+            io.WriteString(conn, "\n Feedback recorded.\n\n>")
+        }
+    }
+}
+
+/* Reply to a query that can't be searched with an error, in the query's response format */
+func writeQueryError(conn net.Conn, query *searchProtocol.Query, message string) {
+
+    switch query.Format {
+    case searchProtocol.FORMAT_JSON:
+        json.NewEncoder(conn).Encode(searchProtocol.Response{Matches: make([]searchProtocol.Match, 0, 0), Error: message})
+    case searchProtocol.FORMAT_STREAM:
+        json.NewEncoder(conn).Encode(searchProtocol.StreamMessage{End: true, Error: message})
+    default:
+        io.WriteString(conn, fmt.Sprintf("\n Search failed: %s.\n\n>", message))
+    }
+}
+
+/* Record an answered query in the audit log, if enabled, before its reply is sent so clients    *
+ * that don't read replies are still logged. Only the client and counts are logged, never the   *
+ * query's trapdoors or the names of indexes searched, which could leak its keywords             */
+func auditQuery(netConn net.Conn, query *searchProtocol.Query, response *searchProtocol.Response, message string) {
+
+    if audit == nil {
+        return
+    }
+
+    entry := searchAudit.Entry{Client: netConn.RemoteAddr().String(), Sets: len(query.Keywords), Error: message}
+    if response != nil {
+        entry.Scanned = response.Scanned
+        entry.Matches = len(response.Matches)
+        entry.Mismatched = response.Mismatched
+    }
+    if tlsConn, ok := netConn.(*tls.Conn); ok {
+        if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+            entry.Identity = certs[0].Subject.CommonName
+        }
+    }
+
+    if err := audit.Record(entry); err != nil {
+        fmt.Fprintf(os.Stderr, "WARNING: unable to write audit log: %v\n", err)
+    }
+}
+
+/* Periodically write the match statistics to file */
+func writeStats(statsFile string, interval time.Duration) {
+
+    for range time.Tick(interval) {
+        if err := stats.WriteFile(statsFile); err != nil {
+            fmt.Fprintf(os.Stderr, "WARNING: unable to write match statistics: %v\n", err)
+        }
+    }
+}
+
+/* Drain in-flight queries, then write the match statistics gathered since they were *
+ * last written, rather than lose them                                               */
+func shutdown(grace time.Duration, statsFile string) {
+
+    connections.drain(grace)
+
+    if stats != nil {
+        if err := stats.WriteFile(statsFile); err != nil {
+            fmt.Fprintf(os.Stderr, "WARNING: unable to write match statistics: %v\n", err)
+        }
+    }
+}
+
+/* Walk a directory tree, collecting the secure index files (identified by their ".sindex" *
+ * extension) at any depth. Directories are skipped, even those named like an index        */
+func collectIndexes(dirpath string) ([]string, error) {
+
+    files := make([]string, 0, 0)
+    err := filepath.Walk(dirpath, func(path string, f os.FileInfo, err error) error {
+        // Log and skip unreadable entries (e.g. permission denied) rather than abandon the search
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "WARNING: unable to read %s (skipping): %v\n", path, err)
+            if f != nil && f.IsDir() {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+        if !f.IsDir() && strings.HasSuffix(path, ".sindex") {
+            files = append(files, path)
+        }
+        return nil
+    })
+
+    return files, err
 }
 
 /* Function to handle the processing of keyword trapdoors received from tcp client *
  * */
-func handleConnection(conn net.Conn) {
-    defer conn.Close()
+func handleConnection(netConn net.Conn, root string) {
+    defer netConn.Close()
+
+    // Messages are read and written through conn, which switches to compression if negotiated
+    conn := &protocolConn{Conn: netConn, reader: netConn, writer: netConn}
+
+    // Response format for queries not naming their own, FORMAT_TEXT unless negotiated
+    sessionFormat := ""
     
     for {
-        // Read trapdoors sent from TCP client as serialised JSON object
-	    trapdoors := make([][]byte, 0, 0)
-        err := json.NewDecoder(conn).Decode(&trapdoors)
-        errorCheck("ERROR: unable to read data sent from TCP client.", err)
+        // Wait for the next query, unless the server is shutting down
+        if !connections.setBusy(netConn, false) {
+            return
+        }
+
+        // Read query (trapdoors and filters) sent from TCP client as serialised JSON object,
+        // disconnecting clients that stall or stay idle for longer than the read timeout
+        if readTimeout > 0 {
+            netConn.SetReadDeadline(time.Now().Add(readTimeout))
+        }
+        var query *searchProtocol.Query
+        err := json.NewDecoder(conn).Decode(&query)
+
+        // A client failing to send a query only ends its own connection
+        if err != nil {
+            if connections.isClosing() || err == io.EOF {
+                return
+            }
+            if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+                fmt.Fprintf(os.Stderr, "WARNING: closing connection with %s, no query received within %v\n", netConn.RemoteAddr(), readTimeout)
+            } else {
+                fmt.Fprintf(os.Stderr, "WARNING: unable to read query from %s, closing connection: %v\n", netConn.RemoteAddr(), err)
+            }
+            return
+        }
+
+        // Queries arriving once shutdown has started aren't handled
+        if !connections.setBusy(netConn, true) {
+            return
+        }
      
-        // Trigger closing the connection if empty trapdoor received
-        if trapdoors == nil {
+        // Trigger closing the connection if empty query received
+        if query == nil {
             return
         }
 
-        // Hard coded root test directory for storing secure index-document pairs
-        dirpath := "test/"
+        // Negotiate the session's options, switching to compression if the client offered it
+        if query.Hello != nil {
+            reply := searchProtocol.Hello{}
+            if scheme := query.Hello.Choose(); len(scheme) > 0 {
+                reply.Compression = []string{scheme}
+            }
+            if searchProtocol.ValidFormat(query.Hello.Format) {
+                sessionFormat = query.Hello.Format
+            }
+            reply.Format = sessionFormat
+            json.NewEncoder(conn).Encode(reply)
 
-	    // Walk through the directory structure and search any secure indexes
-	    files := make([]string, 0, 0)
-	    sErr := filepath.Walk(dirpath, func(path string, f os.FileInfo, err error) error {
-		    files = append(files, path)
-		    return nil
-    	})
-	    errorCheck("ERROR: unable to traverse directory.", sErr)
+            if len(reply.Compression) > 0 {
+                conn.reader = searchProtocol.NewCompressedReader(netConn)
+                conn.writer = searchProtocol.NewCompressedWriter(netConn)
+            }
+            continue
+        }
 
-        //Store matches (document filenames) from keyword search
-	    results := make([]string, 0, 0)
-        io.WriteString(conn, "\n Checked the following indexes:\n -------------------------------\n")
+        if len(query.Format) == 0 {
+            query.Format = sessionFormat
+        }
+
+        // Record matches the client reports as false positives
+        if query.IsFeedback() {
+            handleFeedback(conn, query)
+            continue
+        }
+
+        // Group the keywords by search term, ignoring any dummy keyword sets used to pad the query
+        terms := query.Terms()
+        if len(query.Match) > 0 && query.Match != searchProtocol.MATCH_ANY && !query.MatchAll() {
+            auditQuery(netConn, query, nil, "unknown match mode")
+            writeQueryError(conn, query, fmt.Sprintf("unknown match mode %q", query.Match))
+            continue
+        }
 
-	    for _, file := range files {
-            // Secure index files identified using the ".sindex" file extension
-		    if strings.HasSuffix(file, ".sindex") {
-			    io.WriteString(conn, fmt.Sprintf(" -%s\n", file))
-
-			    // Create a Bloom Filter structure
-			    si, err := ReadSecureIndexFile(file)
-			    errorCheck("ERROR: unable to read secure index file.", err)
-			    filter := bloomFilter.BloomFilter{si}
-
-			    // Split filepath and obtain file name
-			    var sep string
-			    if strings.Contains(file, "\\") {
-				    sep = "\\"
-			    } else {
-				    sep = "/"
-			    }
-			    splitName := strings.Split(file, sep)
-			    fname := splitName[len(splitName)-1]
-
-			    // Create codewords from file name and trapdoors
-			    codewords := cryptoUtils.BuildCodewords(strings.Replace(fname, ".sindex", "", -1), trapdoors)
-
-		        // Find matching codewords in the secure index, save file name in results if match found
-			    match := filter.Search(codewords)
-			    if match {
-				    results = append(results, fmt.Sprintf(" -%s\n", strings.Replace(fname, ".sindex", "", -1)))
-                } 
-		    }
+        // Every keyword set must hold one trapdoor for each of the query's keys
+        k, err := query.KeyCount()
+        if err != nil {
+            auditQuery(netConn, query, nil, err.Error())
+            writeQueryError(conn, query, err.Error())
+            continue
+        }
+
+        // Root directory storing secure index-document pairs
+        dirpath := root
+
+        // Store matches (document filenames) from keyword search
+        response := searchProtocol.Response{Matches: make([]searchProtocol.Match, 0, 0)}
+
+        // Search a single named secure index directly, without walking the directory
+        if len(query.Index) > 0 {
+            indexName := query.Index
+            if !strings.HasSuffix(indexName, ".sindex") {
+                indexName += ".sindex"
+            }
+
+            // Reject index names attempting to traverse outside the index root
+            indexPath, err := resolveWithinRoot(dirpath, filepath.Join(dirpath, indexName))
+            result, auditError := indexResult{}, ""
+            if err == nil {
+                result, err = searchIndexFile(indexPath, terms, query.MatchAll(), k)
+            }
+            if mismatch, ok := err.(keyCountError); ok {
+                mismatch.file = indexName
+                response.Error = mismatch.Error()
+                response.Mismatched = 1
+            } else if err != nil {
+                response.Error = fmt.Sprintf("unable to search index %s", indexName)
+                auditError = "unable to search the named index"
+            } else {
+                response.Scanned = 1
+                if result.matched > 0 && validDocumentName(indexDocumentPath(dirpath, indexPath)) {
+                    response.Matches = append(response.Matches, newMatch(query, dirpath, indexPath, result, k))
+                }
+            }
+            auditQuery(netConn, query, &response, auditError)
+
+            if query.Format == searchProtocol.FORMAT_JSON {
+                json.NewEncoder(conn).Encode(response)
+            } else if query.Format == searchProtocol.FORMAT_STREAM {
+                encoder := json.NewEncoder(conn)
+                for i := range response.Matches {
+                    encoder.Encode(searchProtocol.StreamMessage{Match: &response.Matches[i]})
+                }
+                encoder.Encode(searchProtocol.StreamMessage{End: true, Scanned: response.Scanned, Error: response.Error, Mismatched: response.Mismatched})
+            } else if response.Mismatched > 0 {
+                io.WriteString(conn, fmt.Sprintf("\n Unable to search: %s.\n\n>", response.Error))
+            } else if err != nil {
+                io.WriteString(conn, fmt.Sprintf("\n Unable to search index %s.\n\n>", indexName))
+            } else if result.matched > 0 && query.Confidence {
+                io.WriteString(conn, fmt.Sprintf("\n Index %s: match found (confidence %.4f).\n\n>", indexName, result.confidence))
+            } else if result.matched > 0 {
+                io.WriteString(conn, fmt.Sprintf("\n Index %s: match found.\n\n>", indexName))
+            } else {
+                io.WriteString(conn, fmt.Sprintf("\n Index %s: no match found.\n\n>", indexName))
+            }
+            continue
+        }
+
+	    // Walk through the directory structure, collecting the secure index files to search
+	    files, sErr := collectIndexes(dirpath)
+	    if sErr != nil {
+		    fmt.Fprintf(os.Stderr, "WARNING: unable to traverse %s for %s, closing connection: %v\n", dirpath, netConn.RemoteAddr(), sErr)
+		    auditQuery(netConn, query, nil, "unable to search secure indexes")
+		    writeQueryError(conn, query, "unable to search secure indexes")
+		    return
 	    }
 
+        // Secure index files to search
+        candidates := make([]string, 0, 0)
+        for _, file := range files {
+            // Skip index files resolving outside the index root or with unsafe names
+            safeFile, err := resolveWithinRoot(dirpath, file)
+            if err != nil || !validDocumentName(indexDocumentPath(dirpath, safeFile)) {
+                fmt.Fprintf(os.Stderr, "WARNING: skipping unsafe secure index path %s\n", file)
+                continue
+            }
+
+            // Exclude documents not matching the query's type filter before searching
+            if query.AcceptsType(indexDocumentType(safeFile)) {
+                candidates = append(candidates, safeFile)
+            }
+        }
+
+        // Streamed responses send each match to the client as soon as it's found
+        stream := query.Format == searchProtocol.FORMAT_STREAM
+        streamEncoder := json.NewEncoder(conn)
+        var found func(int, indexResult)
+        if stream {
+            found = func(i int, result indexResult) {
+                response.Matches = append(response.Matches, newMatch(query, dirpath, candidates[i], result, k))
+                streamEncoder.Encode(searchProtocol.StreamMessage{Match: &response.Matches[len(response.Matches)-1]})
+            }
+        }
+
+        // Search the secure indexes concurrently for the query's keywords
+        outcomes := searchIndexFiles(candidates, terms, query.MatchAll(), k, found)
+
+        // Store secure indexes checked during the search, in the walk's (lexical) order
+        checked := make([]string, 0, 0)
+        for i, outcome := range outcomes {
+            // Skip untrusted indexes, those built with a different number of keys and any that can't be read
+            if _, untrusted := outcome.err.(untrustedIndexError); untrusted {
+                continue
+            }
+            if _, mismatched := outcome.err.(keyCountError); mismatched {
+                response.Mismatched++
+                continue
+            }
+            if outcome.err != nil {
+                fmt.Fprintf(os.Stderr, "WARNING: unable to search %s (skipping): %v\n", candidates[i], outcome.err)
+                continue
+            }
+            checked = append(checked, candidates[i])
+
+            // Save file name in results if match found (streamed matches already are)
+            if outcome.result.matched > 0 && !stream {
+                response.Matches = append(response.Matches, newMatch(query, dirpath, candidates[i], outcome.result, k))
+            }
+        }
+        response.Scanned = len(checked)
+        auditQuery(netConn, query, &response, "")
+
+        // Mark the end of a streamed response (streamed matches are sent unsorted, as found)
+        if stream {
+            streamEncoder.Encode(searchProtocol.StreamMessage{End: true, Scanned: response.Scanned, Mismatched: response.Mismatched})
+            continue
+        }
+
+        // Most recently modified documents first if requested, else the highest scoring
+        if query.Sort == searchProtocol.SORT_MTIME {
+            searchProtocol.SortByModified(response.Matches)
+        } else {
+            searchProtocol.SortByScore(response.Matches)
+        }
+
+        // Send search results to TCP client as JSON if requested
+        if query.Format == searchProtocol.FORMAT_JSON {
+            json.NewEncoder(conn).Encode(response)
+            continue
+        }
+
+        io.WriteString(conn, "\n Checked the following indexes:\n -------------------------------\n")
+        for _, file := range checked {
+            io.WriteString(conn, fmt.Sprintf(" -%s\n", file))
+        }
+
+        if response.Mismatched > 0 {
+            io.WriteString(conn, fmt.Sprintf("\n WARNING: skipped %d indexes built with a different number of hash keys than the query's %d, search them with their own keyfile.\n", response.Mismatched, k))
+        }
+
         io.WriteString(conn, "\n Keyword matches found:\n ----------------------\n")
 
 	    // Send search results to TCP client
-	    if len(results) > 0 {
-		    for _, res := range results {
-                io.WriteString(conn, res)
+	    if len(response.Matches) > 0 {
+		    for _, res := range response.Matches {
+                io.WriteString(conn, " -"+res.Name)
+                if query.Confidence {
+                    io.WriteString(conn, fmt.Sprintf(" (confidence %.4f)", res.Confidence))
+                }
+                if res.Keywords > 0 {
+                    io.WriteString(conn, fmt.Sprintf(" (%d of %d keywords, score %d/%d)", res.Keywords, len(terms), res.Score, res.MaxScore))
+                }
+                if len(res.Modified) > 0 {
+                    io.WriteString(conn, fmt.Sprintf(" (modified %s)", res.Modified))
+                }
+                io.WriteString(conn, "\n")
             }
 	    } else {
             io.WriteString(conn, " -No matches found.\n")
@@ -136,53 +1215,346 @@ func handleConnection(conn net.Conn) {
     }
 }
 
+/* Check whether a certificate is self-signed (issued by and signed with its own key) */
+func isSelfSigned(cert *x509.Certificate) bool {
+    if !bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+        return false
+    }
+    return cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
+
+/* Generate an ephemeral, in-memory self-signed certificate for local development only */
+func generateDevCertificate() (tls.Certificate, error) {
+
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        return tls.Certificate{}, err
+    }
+
+    serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+    if err != nil {
+        return tls.Certificate{}, err
+    }
+
+    template := x509.Certificate{
+        SerialNumber: serial,
+        Subject: pkix.Name{CommonName: "secureindex development server"},
+        NotBefore: time.Now(),
+        NotAfter: time.Now().Add(24 * time.Hour),
+        KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+        ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+        DNSNames: []string{"localhost"},
+        IPAddresses: []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+    }
+
+    der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+    if err != nil {
+        return tls.Certificate{}, err
+    }
+
+    return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+/* Load the server's X509 certificate keypair, refusing to run with missing or *
+ * self-signed certificates unless acknowledged (or relaxed in dev mode)       */
+func loadCertificate(certFile string, keyFile string, allowSelfSigned bool, devMode bool) (tls.Certificate, error) {
+
+    cer, err := tls.LoadX509KeyPair(certFile, keyFile)
+    if err != nil {
+        if devMode {
+            fmt.Fprintf(os.Stderr, "WARNING: unable to load %s/%s, using an ephemeral self-signed certificate.\n", certFile, keyFile)
+            return generateDevCertificate()
+        }
+        return cer, fmt.Errorf("unable to load TLS certificate and key (%s, %s): %v", certFile, keyFile, err)
+    }
+
+    leaf, err := x509.ParseCertificate(cer.Certificate[0])
+    if err != nil {
+        return cer, fmt.Errorf("unable to parse TLS certificate %s: %v", certFile, err)
+    }
+
+    if isSelfSigned(leaf) && !allowSelfSigned && !devMode {
+        return cer, fmt.Errorf("TLS certificate %s is self-signed, use -selfsigned to acknowledge this", certFile)
+    }
+
+    return cer, nil
+}
+
+/* Check the index root is an existing, readable directory */
+func checkIndexRoot(root string) error {
+
+    info, err := os.Stat(root)
+    if err != nil {
+        return fmt.Errorf("index root %s: %v", root, err)
+    }
+    if !info.IsDir() {
+        return fmt.Errorf("index root %s is not a directory", root)
+    }
+    if _, err := ioutil.ReadDir(root); err != nil {
+        return fmt.Errorf("index root %s is not readable: %v", root, err)
+    }
+
+    return nil
+}
+
+/* Verify the index root exists and is readable, and summarise it and the loaded      *
+ * certificate before listening, so a misconfigured server fails at startup rather *
+ * than on its first query                                                          */
+func preflight(root string, cer tls.Certificate) error {
+
+    if err := checkIndexRoot(root); err != nil {
+        return err
+    }
+
+    // Count the secure indexes available to search, noting any unreadable entries
+    indexes, unreadable := 0, 0
+    filepath.Walk(root, func(path string, f os.FileInfo, err error) error {
+        if err != nil {
+            unreadable++
+            if f != nil && f.IsDir() {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+        if strings.HasSuffix(path, ".sindex") {
+            indexes++
+        }
+        return nil
+    })
+
+    if len(cer.Certificate) == 0 {
+        return fmt.Errorf("no TLS certificate loaded")
+    }
+    leaf, err := x509.ParseCertificate(cer.Certificate[0])
+    if err != nil {
+        return fmt.Errorf("unable to parse TLS certificate: %v", err)
+    }
+
+    fmt.Printf("Pre-flight checks passed:\n")
+    fmt.Printf(" -index root: %s (%d secure indexes)\n", root, indexes)
+    fmt.Printf(" -certificate: %s, expires %s\n", leaf.Subject.CommonName, leaf.NotAfter.UTC().Format(time.RFC3339))
+    if indexes == 0 {
+        fmt.Fprintf(os.Stderr, "WARNING: no secure indexes found in %s, searches will find no matches.\n", root)
+    }
+    if unreadable > 0 {
+        fmt.Fprintf(os.Stderr, "WARNING: %d entries in %s are unreadable and will be skipped.\n", unreadable, root)
+    }
+    if time.Now().After(leaf.NotAfter) {
+        fmt.Fprintf(os.Stderr, "WARNING: the TLS certificate expired on %s.\n", leaf.NotAfter.UTC().Format(time.RFC3339))
+    }
+
+    return nil
+}
+
+/* Accept client connections on a TLS listener until the server is shutting down, handling  *
+ * each concurrently. Errors accepting a connection are logged and retried after a backoff   */
+func serve(listener net.Listener, root string) {
+
+    var backoff time.Duration
+
+    for {
+        // Accept incoming connections from TCP clients
+        connection, err := listener.Accept()
+        if err != nil {
+            if connections.isClosing() {
+                return
+            }
+
+            // Failing to accept one connection (e.g. running out of file descriptors) mustn't
+            // stop the server, so back off before trying again rather than spin
+            if backoff == 0 {
+                backoff = ACCEPT_BACKOFF
+            } else if backoff *= 2; backoff > MAX_ACCEPT_BACKOFF {
+                backoff = MAX_ACCEPT_BACKOFF
+            }
+            fmt.Fprintf(os.Stderr, "WARNING: unable to accept connection, retrying in %v: %v\n", backoff, err)
+            time.Sleep(backoff)
+            continue
+        }
+        backoff = 0
+
+        if !connections.add(connection) {
+            connection.Close()
+            continue
+        }
+        // Concurrently handle incoming TCP connections, completing the TLS handshake first so
+        // clients without an acceptable certificate are turned away before any query is read
+        go func() {
+            defer connections.remove(connection)
+
+            // Clients must also complete the handshake within the read timeout
+            if readTimeout > 0 {
+                connection.SetDeadline(time.Now().Add(readTimeout))
+            }
+            if err := connection.(*tls.Conn).Handshake(); err != nil {
+                fmt.Fprintf(os.Stderr, "WARNING: TLS handshake with %s failed: %v\n", connection.RemoteAddr(), err)
+                connection.Close()
+                return
+            }
+            connection.SetDeadline(time.Time{})
+            if certs := connection.(*tls.Conn).ConnectionState().PeerCertificates; len(certs) > 0 {
+                fmt.Printf("TLS connection established with: %s (client %s)\n", connection.RemoteAddr(), certs[0].Subject.CommonName)
+            } else {
+                fmt.Printf("TLS connection established with: %s\n", connection.RemoteAddr())
+            }
+
+            handleConnection(connection, root)
+        }()
+    }
+}
+
 /* Main */
 func main() {
 
-    // Get user-specified port number
-    arguments := os.Args
-    if len(arguments) == 1 {
+    // Get user-specified options and port number
+    certFile := flag.String("cert", "server.crt", "path to the server's TLS certificate")
+    keyFile := flag.String("key", "server.key", "path to the server's TLS private key")
+    allowSelfSigned := flag.Bool("selfsigned", false, "acknowledge use of a self-signed TLS certificate")
+    devMode := flag.Bool("dev", false, "development mode: relax TLS safety checks (NOT for production)")
+    profile := flag.String("tlsprofile", tlsProfile.INTERMEDIATE, "TLS security profile: modern (TLS 1.3 only), intermediate or legacy; must be compatible with the peer's")
+    indexKeyFile := flag.String("indexkey", "", "path to a 32 byte key for secure indexes encrypted at rest")
+    statsFile := flag.String("matchstats", "", "track per-document match counts and client-reported false positives, writing them to this JSON file")
+    statsInterval := flag.Duration("statsinterval", time.Minute, "how often to write -matchstats")
+    verifyKeyFile := flag.String("verifykey", "", "verify secure index signatures with this Ed25519 public key (see siBuildIndex -signkey)")
+    verify := flag.String("verify", VERIFY_STRICT, "with -verifykey, indexes to exclude: strict (any without a valid signature), tampered (invalid signatures only) or warn (none, only log)")
+    grace := flag.Duration("grace", 30*time.Second, "on SIGINT/SIGTERM, how long to wait for in-flight queries to complete before closing their connections")
+    seal := flag.Bool("seal", false, "encrypt plaintext secure indexes at rest with -indexkey (created if missing) before serving")
+    indexRoot := flag.String("indexdir", ".", "root directory of the secure index-document pairs to search")
+    clientCA := flag.String("clientca", "", "require clients to present a certificate signed by a CA in this PEM file (mutual TLS)")
+    timeout := flag.Duration("readtimeout", readTimeout, "disconnect clients not completing the TLS handshake or sending their next query within this time (0 for no limit)")
+    watch := flag.Bool("watch", false, "watch the index root for changed secure indexes, dropping them from the index cache as soon as they change")
+    poolSize := flag.Int("workers", runtime.GOMAXPROCS(0), "number of secure indexes each query searches concurrently")
+    auditFile := flag.String("auditlog", "", "append a JSON line recording each query's client and result counts to this file, or - for standard output")
+    flag.Parse()
+
+    if flag.NArg() < 1 {
         fmt.Println("ERROR: provide port number for server to listen on.")
         return
     }
 
+    if *poolSize < 1 {
+        fmt.Println("ERROR: -workers must be at least 1.")
+        return
+    }
+    workers = *poolSize
+    readTimeout = *timeout
+
+    // Fail fast on a missing index root, before loading or encrypting anything
+    if err := checkIndexRoot(*indexRoot); err != nil {
+        fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+        os.Exit(1)
+    }
+
+    if *devMode {
+        fmt.Fprintf(os.Stderr, "\n *** WARNING: running in DEVELOPMENT mode, TLS safety checks are relaxed. ***\n")
+        fmt.Fprintf(os.Stderr, " *** Do not use -dev for production deployments.                          ***\n\n")
+    }
+
+    // Load the key for secure indexes encrypted at rest, optionally encrypting existing indexes
+    if len(*indexKeyFile) > 0 {
+        key, err := loadIndexKey(*indexKeyFile, *seal)
+        errorCheck("ERROR: unable to load index key.", err)
+        indexKey = key
+
+        if *seal {
+            sealed, err := sealIndexFiles(*indexRoot, indexKey)
+            errorCheck("ERROR: unable to encrypt secure indexes at rest.", err)
+            fmt.Printf("Encrypted %d secure indexes at rest.\n", sealed)
+        }
+    } else if *seal {
+        fmt.Println("ERROR: -seal requires -indexkey.")
+        return
+    }
+
+    // Track per-document match statistics for monitoring index quality
+    if len(*statsFile) > 0 {
+        stats = searchStats.New()
+        go writeStats(*statsFile, *statsInterval)
+    }
+
+    // Audit every query answered, without recording its trapdoors
+    if len(*auditFile) > 0 {
+        auditLog, err := searchAudit.Open(*auditFile)
+        errorCheck("ERROR: unable to open audit log "+*auditFile+".", err)
+        audit = auditLog
+        defer audit.Close()
+    }
+
     // Load X509 certificate keypair for establishing TLS connections
-    cer, err := tls.LoadX509KeyPair("server.crt", "server.key")
+    cer, err := loadCertificate(*certFile, *keyFile, *allowSelfSigned, *devMode)
     if err != nil {
-        fmt.Println("ERROR", err)
-        return
+        fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+        os.Exit(1)
+    }
+
+    // Check the server's prerequisites before accepting any connections
+    err = preflight(*indexRoot, cer)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "ERROR: pre-flight check failed: %v\n", err)
+        os.Exit(1)
+    }
+
+    // Verify every secure index's signature up front, reporting any that will be excluded
+    if len(*verifyKeyFile) > 0 {
+        if *verify != VERIFY_STRICT && *verify != VERIFY_TAMPERED && *verify != VERIFY_WARN {
+            fmt.Println("ERROR: -verify must be strict, tampered or warn.")
+            return
+        }
+        verifyLevel = *verify
+
+        key, err := cryptoUtils.ReadVerifyKey(*verifyKeyFile)
+        errorCheck("ERROR: unable to read verify key.", err)
+        verifyKey = key
+
+        verified, excluded := verifyIndexes(*indexRoot)
+        fmt.Printf(" -signatures: %d secure indexes searchable, %d excluded (-verify %s)\n", verified, excluded, verifyLevel)
+    }
+
+    // Drop cached secure indexes as soon as their files change
+    if *watch {
+        watched, failed, err := watchIndexes(*indexRoot)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "WARNING: unable to watch for index changes: %v (relying on modification times)\n", err)
+        } else if failed > 0 {
+            fmt.Printf(" -watching: %d directories for index changes, %d unwatched (relying on modification times)\n", watched, failed)
+        } else {
+            fmt.Printf(" -watching: %d directories for index changes\n", watched)
+        }
     }
 
     // Set secure configuration settings for TLS server
-    config := &tls.Config{
-        Certificates: []tls.Certificate{cer},
-        MinVersion: tls.VersionTLS12,
-        CurvePreferences: []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
-        PreferServerCipherSuites: true,
-        CipherSuites: []uint16{
-            tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-            tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
-            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-        },
+    config, err := tlsProfile.Config(*profile)
+    errorCheck("ERROR: unknown TLS profile "+*profile+".", err)
+    config.Certificates = []tls.Certificate{cer}
+
+    // Only accept clients presenting a certificate issued by the client CA
+    if len(*clientCA) > 0 {
+        pool, err := tlsProfile.LoadCAPool(*clientCA)
+        errorCheck("ERROR: unable to load client CA certificates from "+*clientCA+".", err)
+        config.ClientCAs = pool
+        config.ClientAuth = tls.RequireAndVerifyClientCert
+        fmt.Printf(" -client certificates: required, issued by a CA in %s\n", *clientCA)
     }
 
     // Create listener on specified port
-    port := ":" + arguments[1]
+    port := ":" + flag.Arg(0)
     listener, err := tls.Listen("tcp", port, config)
     errorCheck("ERROR: unable to listen on given port.\n", err)
     defer listener.Close()
 
     fmt.Printf("Listening on port%s...\n", port)
 
-    for {
-        // Accept incoming connections from TCP clients
-        connection, err := listener.Accept()
-        errorCheck("ERROR: unable to establish TLS connection with client.", err)
+    // Stop accepting connections on SIGINT/SIGTERM, then drain in-flight queries
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+    go func() {
+        sig := <-signals
+        fmt.Printf("Received %v, no longer accepting connections.\n", sig)
+        connections.close()
+        listener.Close()
+    }()
 
-        fmt.Printf("TLS connection established with: %s\n", connection.RemoteAddr())
+    serve(listener, *indexRoot)
 
-        // Concurrently handle incoming TCP connections
-        go handleConnection(connection)
-    }
+    shutdown(*grace, *statsFile)
 }
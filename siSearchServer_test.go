@@ -0,0 +1,1220 @@
+package main
+
+import (
+	"bytes" // Standard packages
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"secureindex/bloomFilter" // Custom packages
+	"secureindex/cryptoUtils"
+	"secureindex/indexMeta"
+	"secureindex/searchAudit"
+	"secureindex/searchProtocol"
+	"secureindex/searchStats"
+	"secureindex/siclient"
+)
+
+func TestResolveWithinRoot(t *testing.T) {
+
+	// An index root holding an index, beside a directory outside it that a symlink points into
+	dir := t.TempDir()
+	root := filepath.Join(dir, "indexes")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{filepath.Join(root, "sub"), outside} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{filepath.Join(root, "sub", "alice.txt.sindex"), filepath.Join(outside, "secret.txt.sindex")} {
+		if err := ioutil.WriteFile(f, []byte("SIBF"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	symlinks := true
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		symlinks = false
+	} else if err := os.Symlink(filepath.Join(outside, "secret.txt.sindex"), filepath.Join(root, "secret.txt.sindex")); err != nil {
+		symlinks = false
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		ok      bool
+		symlink bool // Needs symlinks, which may be unavailable (e.g. on Windows without privileges)
+		windows bool // Backslashes only separate paths on Windows
+	}{
+		{"index in a sub-directory", filepath.Join(root, "sub", "alice.txt.sindex"), true, false, false},
+		{"missing index within the root", filepath.Join(root, "bob.txt.sindex"), true, false, false},
+		{"root itself", root, true, false, false},
+		{"parent directory", filepath.Join(root, ".."), false, false, false},
+		{"dot-dot component", root + "/../outside/secret.txt.sindex", false, false, false},
+		{"dot-dot through a sub-directory", root + "/sub/../../outside/secret.txt.sindex", false, false, false},
+		{"dot-dot staying within the root", root + "/sub/../sub/alice.txt.sindex", true, false, false},
+		{"absolute path outside the root", filepath.Join(outside, "secret.txt.sindex"), false, false, false},
+		{"relative path outside the root", "secret.txt.sindex", false, false, false},
+		{"symlinked directory escaping the root", filepath.Join(root, "escape", "secret.txt.sindex"), false, true, false},
+		{"symlinked index escaping the root", filepath.Join(root, "secret.txt.sindex"), false, true, false},
+		{"backslash dot-dot component", root + `\..\outside\secret.txt.sindex`, false, false, true},
+	}
+
+	for _, test := range tests {
+		if test.symlink && !symlinks {
+			t.Logf("%s: skipped, unable to create symlinks", test.name)
+			continue
+		}
+		if test.windows && runtime.GOOS != "windows" {
+			continue
+		}
+
+		resolved, err := resolveWithinRoot(root, test.path)
+		if test.ok && err != nil {
+			t.Errorf("%s: resolveWithinRoot(%q) failed: %v", test.name, test.path, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: resolveWithinRoot(%q) = %q, want an error", test.name, test.path, resolved)
+		}
+	}
+}
+
+func TestValidDocumentName(t *testing.T) {
+
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"alice.txt", true},
+		{"notes v2.pdf", true},
+		{"a/report.pdf", true},
+		{"reports/2019/summary.pdf", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../secret.txt", false},
+		{"a/../../secret.txt", false},
+		{"a/./report.pdf", false},
+		{"a//report.pdf", false},
+		{"a/", false},
+		{"/etc/passwd", false},
+		{`a\report.pdf`, false},
+		{`..\secret.txt`, false},
+		{`C:\secret.txt`, false},
+	}
+
+	for _, test := range tests {
+		if got := validDocumentName(test.name); got != test.ok {
+			t.Errorf("validDocumentName(%q) = %v, want %v", test.name, got, test.ok)
+		}
+	}
+}
+
+/* Declare custom structure for a listener whose first few Accepts fail, as they might when *
+ * the server runs out of file descriptors                                                */
+type faultyListener struct {
+	net.Listener
+	mu       sync.Mutex
+	failures int
+}
+
+func (l *faultyListener) Accept() (net.Conn, error) {
+
+	l.mu.Lock()
+	if l.failures > 0 {
+		l.failures--
+		l.mu.Unlock()
+		return nil, errors.New("accept: too many open files")
+	}
+	l.mu.Unlock()
+
+	return l.Listener.Accept()
+}
+
+/* Complete a TLS handshake and Hello exchange with the server, as a client would */
+func sayHello(t *testing.T, addr string) error {
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if err := json.NewEncoder(conn).Encode(searchProtocol.Query{Hello: &searchProtocol.Hello{}}); err != nil {
+		return err
+	}
+	var reply searchProtocol.Hello
+	return json.NewDecoder(conn).Decode(&reply)
+}
+
+func TestServeSurvivesBadConnections(t *testing.T) {
+
+	cer, err := generateDevCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := tls.NewListener(&faultyListener{Listener: inner, failures: 3}, &tls.Config{Certificates: []tls.Certificate{cer}})
+
+	saved := connections
+	connections = &connTracker{conns: make(map[net.Conn]bool)}
+	served := make(chan struct{})
+	go func() {
+		serve(listener, t.TempDir())
+		close(served)
+	}()
+	defer func() {
+		connections.close()
+		listener.Close()
+		<-served
+		connections = saved
+	}()
+
+	// The failed Accepts are retried rather than ending the server
+	if err := sayHello(t, inner.Addr().String()); err != nil {
+		t.Fatalf("client not served after failed accepts: %v", err)
+	}
+
+	// Garbage in place of a TLS handshake only ends its own connection
+	conn, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("GET / HTTP/1.0\r\n\r\n\x00\xff\x16\x03"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	ioutil.ReadAll(conn)
+	conn.Close()
+
+	if err := sayHello(t, inner.Addr().String()); err != nil {
+		t.Errorf("client not served after a connection sent garbage: %v", err)
+	}
+}
+
+/* Write a certificate and its key to PEM files, returning their paths */
+func writeCertificate(t *testing.T, dir string, cer tls.Certificate) (string, string) {
+
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	key, err := x509.MarshalPKCS8PrivateKey(cer.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cer.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestLoadCertificateRefusesInsecureSetups(t *testing.T) {
+
+	dir := t.TempDir()
+	cer, err := generateDevCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := writeCertificate(t, dir, cer)
+	missing := filepath.Join(dir, "missing.crt")
+
+	tests := []struct {
+		name       string
+		certFile   string
+		selfSigned bool
+		dev        bool
+		ok         bool
+	}{
+		{"missing certificate", missing, false, false, false},
+		{"missing certificate acknowledged self-signed", missing, true, false, false},
+		{"missing certificate in dev mode", missing, false, true, true},
+		{"self-signed certificate", certFile, false, false, false},
+		{"self-signed certificate acknowledged", certFile, true, false, true},
+		{"self-signed certificate in dev mode", certFile, false, true, true},
+	}
+
+	for _, test := range tests {
+		loaded, err := loadCertificate(test.certFile, keyFile, test.selfSigned, test.dev)
+		if test.ok && (err != nil || len(loaded.Certificate) == 0) {
+			t.Errorf("%s: loadCertificate failed: %v", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: loadCertificate accepted an insecure setup", test.name)
+		}
+	}
+}
+
+/* Write a secure index of keywords for the document at a path within an index root, *
+ * recording its relative path as the document ID as builds do                       */
+func writeTestIndex(t testing.TB, root string, docID string, keywords []string, keys [][]byte) {
+
+	si := cryptoUtils.SecureIndex{Index: new(bloomFilter.BloomFilter), Meta: &indexMeta.Metadata{Extension: filepath.Ext(docID), DocumentID: docID}}
+	si.Index.Create(len(keys), len(keywords), 10)
+	for _, keyword := range keywords {
+		si.Build(docID, keyword, keys)
+		si.Index.Add(si.Codewords)
+	}
+	data, err := si.Index.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	indexPath := filepath.Join(root, filepath.FromSlash(docID)) + ".sindex"
+	if err := os.MkdirAll(filepath.Dir(indexPath), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(indexPath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexMeta.Write(indexPath, si.Meta); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/* Send a query to a connection handler and decode its JSON response */
+func exchange(t *testing.T, conn net.Conn, query searchProtocol.Query) searchProtocol.Response {
+
+	query.Format = searchProtocol.FORMAT_JSON
+	if err := json.NewEncoder(conn).Encode(query); err != nil {
+		t.Fatal(err)
+	}
+	var response searchProtocol.Response
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+
+	return response
+}
+
+func TestSiblingFoldersMatchedSeparately(t *testing.T) {
+
+	keys, err := cryptoUtils.GenerateHashKeys(0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	writeTestIndex(t, root, "a/report.pdf", []string{"rabbit", "watch"}, keys)
+	writeTestIndex(t, root, "b/report.pdf", []string{"hatter", "teapot"}, keys)
+
+	savedStats, savedConnections := stats, connections
+	stats, connections = searchStats.New(), &connTracker{conns: make(map[net.Conn]bool)}
+	defer func() { stats, connections = savedStats, savedConnections }()
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	connections.add(server)
+	go func() {
+		defer connections.remove(server)
+		handleConnection(server, root)
+		close(done)
+	}()
+	defer func() {
+		client.Close()
+		<-done
+	}()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// Each document is matched, and named, by its own path
+	for keyword, want := range map[string]string{"rabbit": "a/report.pdf", "hatter": "b/report.pdf"} {
+		query := searchProtocol.Query{Keywords: []searchProtocol.TrapdoorSet{{Trapdoors: cryptoUtils.BuildTrapdoors(keyword, keys)}}}
+		response := exchange(t, client, query)
+		if response.Scanned != 2 || len(response.Matches) != 1 || response.Matches[0].Name != want {
+			t.Errorf("search for %q scanned %d and matched %+v, want only %s", keyword, response.Scanned, response.Matches, want)
+		}
+	}
+
+	// Feedback on one sibling doesn't count against the other, and paths escaping the root are ignored
+	exchange(t, client, searchProtocol.Query{FalsePositives: []string{"a/report.pdf", "../report.pdf", "report.pdf"}})
+	snapshot := stats.Snapshot()
+	if doc := snapshot["a/report.pdf"]; doc.Matches != 1 || doc.FalsePositives != 1 {
+		t.Errorf("a/report.pdf has %d matches, %d false positives, want 1 and 1", doc.Matches, doc.FalsePositives)
+	}
+	if doc := snapshot["b/report.pdf"]; doc.Matches != 1 || doc.FalsePositives != 0 {
+		t.Errorf("b/report.pdf has %d matches, %d false positives, want 1 and 0", doc.Matches, doc.FalsePositives)
+	}
+	if len(snapshot) != 2 {
+		t.Errorf("statistics recorded for %d documents, want 2: %v", len(snapshot), snapshot)
+	}
+}
+
+/* Declare custom structure for a buffer safe to read while the server writes to it */
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+/* Serve a connection to an index root from a connection handler, returning the client's *
+ * end, which is closed (and the handler waited for) at the end of the test             */
+func serveTestConnection(t *testing.T, root string) net.Conn {
+
+	savedStats, savedConnections := stats, connections
+	stats, connections = searchStats.New(), &connTracker{conns: make(map[net.Conn]bool)}
+	t.Cleanup(func() { stats, connections = savedStats, savedConnections })
+
+	return connectTestClient(t, root)
+}
+
+/* Open a further client connection to the server started by serveTestConnection */
+func connectTestClient(t *testing.T, root string) net.Conn {
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	connections.add(server)
+	go func() {
+		defer connections.remove(server)
+		handleConnection(server, root)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+
+	return client
+}
+
+func TestStreamedMatchesArriveAsFound(t *testing.T) {
+
+	keys, err := cryptoUtils.GenerateHashKeys(0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	for _, name := range []string{"a.pdf", "b.pdf", "c.pdf"} {
+		writeTestIndex(t, root, name, []string{"rabbit"}, keys)
+	}
+	writeTestIndex(t, root, "d.pdf", []string{"violin"}, keys)
+
+	// The audit log is written once a search completes
+	savedAudit, savedWorkers := audit, workers
+	log := &lockedBuffer{}
+	audit, workers = searchAudit.New(log), 1
+	defer func() { audit, workers = savedAudit, savedWorkers }()
+
+	conn := serveTestConnection(t, root)
+	query := searchProtocol.Query{Keywords: []searchProtocol.TrapdoorSet{{Trapdoors: cryptoUtils.BuildTrapdoors("rabbit", keys)}}, Format: searchProtocol.FORMAT_STREAM}
+	if err := json.NewEncoder(conn).Encode(query); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first match arrives while the search is still going, held up sending the next
+	decoder := json.NewDecoder(conn)
+	var first searchProtocol.StreamMessage
+	if err := decoder.Decode(&first); err != nil {
+		t.Fatal(err)
+	}
+	if first.Match == nil || first.End {
+		t.Fatalf("first streamed message %+v, want a match", first)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if len(log.String()) > 0 {
+		t.Error("search completed before its first match was read")
+	}
+
+	// The rest follow one message each, ending with the totals
+	names := []string{first.Match.Name}
+	for {
+		var message searchProtocol.StreamMessage
+		if err := decoder.Decode(&message); err != nil {
+			t.Fatal(err)
+		}
+		if message.End {
+			if message.Scanned != 4 || message.Match != nil || len(message.Error) > 0 {
+				t.Errorf("end of stream %+v, want 4 scanned and no match or error", message)
+			}
+			break
+		}
+		if message.Match == nil {
+			t.Fatalf("streamed message %+v neither a match nor the end", message)
+		}
+		names = append(names, message.Match.Name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "a.pdf,b.pdf,c.pdf" {
+		t.Errorf("streamed matches %q, want a.pdf, b.pdf and c.pdf", names)
+	}
+	if entries := strings.Count(log.String(), "\n"); entries != 1 {
+		t.Errorf("%d audit entries after the stream ended, want 1", entries)
+	}
+
+	// The stream ended cleanly, leaving the connection ready for the next query
+	query.Keywords = []searchProtocol.TrapdoorSet{{Trapdoors: cryptoUtils.BuildTrapdoors("violin", keys)}}
+	if response := exchange(t, conn, query); len(response.Matches) != 1 || response.Matches[0].Name != "d.pdf" {
+		t.Errorf("query after a stream matched %+v, want d.pdf", response.Matches)
+	}
+}
+
+/* Declare custom structure for a connection counting the bytes written to and read from it */
+type countingConn struct {
+	net.Conn
+	mu            sync.Mutex
+	written, read int
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.mu.Lock()
+	c.written += n
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.mu.Lock()
+	c.read += n
+	c.mu.Unlock()
+	return n, err
+}
+
+func TestCompressedSearchRoundTrip(t *testing.T) {
+
+	keys, err := cryptoUtils.GenerateHashKeys(0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	for i := 0; i < 200; i++ {
+		writeTestIndex(t, root, fmt.Sprintf("reports/2019/quarterly-summary-%03d.pdf", i), []string{"rabbit"}, keys)
+	}
+
+	// A large padded query and its large response, sent plain and compressed
+	written, read := make(map[bool]int), make(map[bool]int)
+	conns := map[bool]net.Conn{false: serveTestConnection(t, root)}
+	conns[true] = connectTestClient(t, root)
+	for _, compress := range []bool{false, true} {
+		conn := &countingConn{Conn: conns[compress]}
+		client, err := siclient.NewFromConn(conn, siclient.Options{Keys: keys, Compress: compress, Pad: 500})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, stream := range []bool{false, true} {
+			var results siclient.Results
+			if stream {
+				results, err = client.SearchStream(context.Background(), []string{"rabbit"}, nil)
+			} else {
+				results, err = client.Search(context.Background(), []string{"rabbit"})
+			}
+			if err != nil || len(results.Matches) != 200 || results.Scanned != 200 {
+				t.Errorf("compress %v, stream %v: search matched %d of %d scanned, %v, want all 200", compress, stream, len(results.Matches), results.Scanned, err)
+			}
+		}
+		client.Close()
+		written[compress], read[compress] = conn.written, conn.read
+	}
+
+	// Both directions are smaller, though random (e.g. padding) trapdoors hardly compress
+	if written[true] >= written[false] || read[true] >= read[false] {
+		t.Errorf("compressed searches sent %d and received %d bytes, plain ones %d and %d", written[true], read[true], written[false], read[false])
+	}
+}
+
+/* Sign a secure index written by writeTestIndex, recording the signature in its metadata */
+func signTestIndex(t *testing.T, indexPath string, key ed25519.PrivateKey) {
+
+	data, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := indexMeta.Read(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cryptoUtils.SignIndex(key, data, meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexMeta.Write(indexPath, meta); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/* Run fn, returning what it writes to the given output stream (os.Stdout or os.Stderr) */
+func captureOutput(t *testing.T, stream **os.File, fn func()) string {
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := *stream
+	*stream = w
+	output := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		output <- string(data)
+	}()
+
+	fn()
+	*stream = saved
+	w.Close()
+
+	return <-output
+}
+
+func TestVerifyLevels(t *testing.T) {
+
+	keys, err := cryptoUtils.GenerateHashKeys(0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A signed index, one tampered with after signing and one never signed
+	root := t.TempDir()
+	for _, name := range []string{"signed.pdf", "tampered.pdf", "unsigned.pdf"} {
+		writeTestIndex(t, root, name, []string{"rabbit"}, keys)
+	}
+	signTestIndex(t, filepath.Join(root, "signed.pdf.sindex"), private)
+	tampered := filepath.Join(root, "tampered.pdf.sindex")
+	signTestIndex(t, tampered, private)
+	data, err := ioutil.ReadFile(tampered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Set an unset bit of the filter, breaking the signature while the index still matches its keywords
+	filter := new(bloomFilter.BloomFilter)
+	if err := filter.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < filter.Len(); i++ {
+		if !filter.Bit(i) {
+			filter.SetBit(i)
+			break
+		}
+	}
+	if data, err = filter.MarshalBinary(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(tampered, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	savedKey, savedLevel := verifyKey, verifyLevel
+	defer func() {
+		verifyKey, verifyLevel = savedKey, savedLevel
+		indexes.reset()
+	}()
+	verifyKey = public
+
+	tests := []struct {
+		level    string
+		searched string // Indexes searched, the rest excluded
+	}{
+		{VERIFY_WARN, "signed.pdf,tampered.pdf,unsigned.pdf"},
+		{VERIFY_TAMPERED, "signed.pdf,unsigned.pdf"},
+		{VERIFY_STRICT, "signed.pdf"},
+	}
+	terms := [][]searchProtocol.TrapdoorSet{{{Trapdoors: cryptoUtils.BuildTrapdoors("rabbit", keys)}}}
+
+	for _, test := range tests {
+		verifyLevel = test.level
+		indexes.reset()
+
+		var verified, excluded int
+		logged := captureOutput(t, &os.Stderr, func() {
+			verified, excluded = verifyIndexes(root)
+		})
+		want := strings.Split(test.searched, ",")
+		if verified != len(want) || excluded != 3-len(want) {
+			t.Errorf("%s: %d indexes verified and %d excluded, want %d and %d", test.level, verified, excluded, len(want), 3-len(want))
+		}
+
+		// Indexes failing verification are logged, and excluded from searches unless the level allows them
+		searched := make([]string, 0, 0)
+		for _, name := range []string{"signed.pdf", "tampered.pdf", "unsigned.pdf"} {
+			var result indexResult
+			var err error
+			captureOutput(t, &os.Stderr, func() {
+				result, err = searchIndexFile(filepath.Join(root, name+".sindex"), terms, false, len(keys))
+			})
+			if _, untrusted := err.(untrustedIndexError); err != nil && !untrusted {
+				t.Errorf("%s: searching %s failed: %v", test.level, name, err)
+			}
+			if err == nil && result.matched == 1 {
+				searched = append(searched, name)
+			}
+			if name != "signed.pdf" && !strings.Contains(logged, name) {
+				t.Errorf("%s: %s not logged: %q", test.level, name, logged)
+			}
+		}
+		if strings.Join(searched, ",") != test.searched {
+			t.Errorf("%s: searched %q, want %q", test.level, searched, test.searched)
+		}
+		if strings.Contains(logged, filepath.Join(root, "signed.pdf.sindex")+":") {
+			t.Errorf("%s: validly signed index logged: %q", test.level, logged)
+		}
+	}
+}
+
+func TestSearchIndexesEncryptedAtRest(t *testing.T) {
+
+	keys, err := cryptoUtils.GenerateHashKeys(0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	writeTestIndex(t, root, "alice.pdf", []string{"rabbit", "watch"}, keys)
+	writeTestIndex(t, root, "b/holmes.pdf", []string{"violin"}, keys)
+	files := []string{filepath.Join(root, "alice.pdf.sindex"), filepath.Join(root, "b", "holmes.pdf.sindex")}
+
+	// A key is generated once, then read back
+	keyFile := filepath.Join(t.TempDir(), "index.key")
+	key, err := loadIndexKey(keyFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := loadIndexKey(keyFile, false); err != nil || !bytes.Equal(again, key) {
+		t.Fatalf("index key read back as %x, %v", again, err)
+	}
+
+	// Every plaintext index is sealed in place, and only once
+	if sealed, err := sealIndexFiles(root, key); err != nil || sealed != 2 {
+		t.Fatalf("sealIndexFiles sealed %d indexes, %v, want 2", sealed, err)
+	}
+	if sealed, err := sealIndexFiles(root, key); err != nil || sealed != 0 {
+		t.Errorf("sealIndexFiles sealed %d already sealed indexes, %v", sealed, err)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cryptoUtils.IsSealed(data) || bloomFilter.IsBinary(data) {
+			t.Errorf("%s not encrypted at rest", file)
+		}
+	}
+
+	saved := indexKey
+	defer func() {
+		indexKey = saved
+		indexes.reset()
+	}()
+	search := func(file string, keyword string) (indexResult, error) {
+		indexes.reset()
+		terms := [][]searchProtocol.TrapdoorSet{{{Trapdoors: cryptoUtils.BuildTrapdoors(keyword, keys)}}}
+		return searchIndexFile(file, terms, false, len(keys))
+	}
+
+	// Sealed indexes are searched with the index key, decrypted only in memory
+	indexKey = key
+	for file, keyword := range map[string]string{files[0]: "rabbit", files[1]: "violin"} {
+		if result, err := search(file, keyword); err != nil || result.matched != 1 {
+			t.Errorf("%s: search for %q matched %d terms, %v", file, keyword, result.matched, err)
+		}
+	}
+	if result, err := search(files[0], "violin"); err != nil || result.matched != 0 {
+		t.Errorf("search for an absent keyword matched %d terms, %v", result.matched, err)
+	}
+
+	// Without the right key they can't be searched
+	wrongKey, err := cryptoUtils.GenerateRandomBytes(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, key := range map[string][]byte{"no key": nil, "wrong key": wrongKey} {
+		indexKey = key
+		if _, err := search(files[0], "rabbit"); err == nil {
+			t.Errorf("%s: sealed index searched", name)
+		}
+	}
+
+	// Nor can a plaintext index be slipped in alongside them
+	writeTestIndex(t, root, "c/moriarty.pdf", []string{"rabbit"}, keys)
+	indexKey = key
+	if _, err := search(filepath.Join(root, "c", "moriarty.pdf.sindex"), "rabbit"); err == nil {
+		t.Error("plaintext index searched with an index key set")
+	}
+}
+
+func TestSearchFiltersByType(t *testing.T) {
+
+	keys, err := cryptoUtils.GenerateHashKeys(0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	writeTestIndex(t, root, "alice.pdf", []string{"rabbit", "watch"}, keys)
+	writeTestIndex(t, root, "alice.txt", []string{"rabbit", "watch"}, keys)
+
+	savedStats, savedConnections := stats, connections
+	stats, connections = searchStats.New(), &connTracker{conns: make(map[net.Conn]bool)}
+	defer func() { stats, connections = savedStats, savedConnections }()
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	connections.add(server)
+	go func() {
+		defer connections.remove(server)
+		handleConnection(server, root)
+		close(done)
+	}()
+	defer func() {
+		client.Close()
+		<-done
+	}()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// Documents of other types are excluded, however the type is written
+	tests := []struct {
+		types []string
+		want  []string
+	}{
+		{nil, []string{"alice.pdf", "alice.txt"}},
+		{[]string{"pdf"}, []string{"alice.pdf"}},
+		{[]string{".PDF"}, []string{"alice.pdf"}},
+		{[]string{"txt", "docx"}, []string{"alice.txt"}},
+		{[]string{"docx"}, nil},
+	}
+	for _, test := range tests {
+		query := searchProtocol.Query{Keywords: []searchProtocol.TrapdoorSet{{Trapdoors: cryptoUtils.BuildTrapdoors("rabbit", keys)}}, Types: test.types}
+		response := exchange(t, client, query)
+		names := make([]string, 0, 0)
+		for _, match := range response.Matches {
+			names = append(names, match.Name)
+		}
+		sort.Strings(names)
+		if strings.Join(names, ",") != strings.Join(test.want, ",") {
+			t.Errorf("types %q: matched %q, want %q", test.types, names, test.want)
+		}
+	}
+}
+
+func TestSearchMatchModes(t *testing.T) {
+
+	keys, err := cryptoUtils.GenerateHashKeys(0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	writeTestIndex(t, root, "alice.pdf", []string{"rabbit", "watch", "queen"}, keys)
+	writeTestIndex(t, root, "holmes.pdf", []string{"rabbit", "violin"}, keys)
+
+	savedStats, savedConnections := stats, connections
+	stats, connections = searchStats.New(), &connTracker{conns: make(map[net.Conn]bool)}
+	defer func() { stats, connections = savedStats, savedConnections }()
+
+	tests := []struct {
+		name  string
+		all   bool
+		terms []string
+		want  map[string]int // Documents matched, with the number of terms each matched
+	}{
+		{"any of one term", false, []string{"rabbit"}, map[string]int{"alice.pdf": 0, "holmes.pdf": 0}},
+		{"any of several terms", false, []string{"rabbit", "watch"}, map[string]int{"alice.pdf": 2, "holmes.pdf": 1}},
+		{"any of unshared terms", false, []string{"queen", "violin"}, map[string]int{"alice.pdf": 1, "holmes.pdf": 1}},
+		{"all of one term", true, []string{"rabbit"}, map[string]int{"alice.pdf": 0, "holmes.pdf": 0}},
+		{"all narrows matches", true, []string{"rabbit", "watch"}, map[string]int{"alice.pdf": 2}},
+		{"all of unshared terms", true, []string{"queen", "violin"}, map[string]int{}},
+	}
+
+	for _, test := range tests {
+		conn, server := net.Pipe()
+		done := make(chan struct{})
+		connections.add(server)
+		go func() {
+			defer connections.remove(server)
+			handleConnection(server, root)
+			close(done)
+		}()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+		client, err := siclient.NewFromConn(conn, siclient.Options{Keys: keys, MatchAll: test.all})
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := client.Search(context.Background(), test.terms)
+		client.Close()
+		<-done
+		if err != nil {
+			t.Errorf("%s: search failed: %v", test.name, err)
+			continue
+		}
+
+		// Each document is listed once, with the count of terms it matched if several were searched for
+		got := make(map[string]int)
+		for _, match := range results.Matches {
+			if _, ok := got[match.Name]; ok {
+				t.Errorf("%s: %s matched more than once", test.name, match.Name)
+			}
+			got[match.Name] = match.Keywords
+		}
+		if results.Scanned != 2 || len(got) != len(test.want) {
+			t.Errorf("%s: scanned %d and matched %v, want 2 and %v", test.name, results.Scanned, got, test.want)
+			continue
+		}
+		for name, keywords := range test.want {
+			if n, ok := got[name]; !ok || n != keywords {
+				t.Errorf("%s: matched %v, want %v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestAuditEntries(t *testing.T) {
+
+	keys, err := cryptoUtils.GenerateHashKeys(0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	writeTestIndex(t, root, "alice.pdf", []string{"rabbit"}, keys)
+	writeTestIndex(t, root, "hatter.pdf", []string{"rabbit", "teapot"}, keys)
+	writeTestIndex(t, root, "holmes.pdf", []string{"violin"}, keys)
+
+	savedAudit := audit
+	log := &lockedBuffer{}
+	audit = searchAudit.New(log)
+	defer func() { audit = savedAudit }()
+
+	rabbit := cryptoUtils.BuildTrapdoors("rabbit", keys)
+	dummy := cryptoUtils.BuildTrapdoors("padding", keys)
+	tests := []struct {
+		name  string
+		query searchProtocol.Query
+		want  searchAudit.Entry
+	}{
+		{"search", searchProtocol.Query{Keywords: []searchProtocol.TrapdoorSet{{Trapdoors: rabbit}, {Dummy: 1, Trapdoors: dummy}}}, searchAudit.Entry{Sets: 2, Scanned: 3, Matches: 2}},
+		{"named index", searchProtocol.Query{Keywords: []searchProtocol.TrapdoorSet{{Trapdoors: rabbit}}, Index: "hatter.pdf"}, searchAudit.Entry{Sets: 1, Scanned: 1, Matches: 1}},
+		{"missing index", searchProtocol.Query{Keywords: []searchProtocol.TrapdoorSet{{Trapdoors: rabbit}}, Index: "secret-plans.pdf"}, searchAudit.Entry{Sets: 1, Error: "unable to search the named index"}},
+		{"bad match mode", searchProtocol.Query{Keywords: []searchProtocol.TrapdoorSet{{Trapdoors: rabbit}}, Match: "most"}, searchAudit.Entry{Sets: 1, Error: "unknown match mode"}},
+	}
+
+	conn := serveTestConnection(t, root)
+	for i, test := range tests {
+		test.query.Format = searchProtocol.FORMAT_JSON
+		before := time.Now().UTC().Add(-time.Second)
+		exchange(t, conn, test.query)
+
+		// Every query is recorded by the time it's answered, rejected ones included
+		lines := strings.Split(strings.TrimSuffix(log.String(), "\n"), "\n")
+		if len(lines) != i+1 {
+			t.Fatalf("%s: %d audit entries, want one per query (%d)", test.name, len(lines), i+1)
+		}
+		line := lines[i]
+		var entry searchAudit.Entry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("%s: audit entry %q isn't JSON: %v", test.name, line, err)
+		}
+
+		// Each entry records who searched and when, with the counts of what was found
+		logged, err := time.Parse(time.RFC3339Nano, entry.Time)
+		if err != nil || logged.Before(before) || logged.After(time.Now().UTC()) {
+			t.Errorf("%s: audit entry time %q (%v), want the time of the query", test.name, entry.Time, err)
+		}
+		if entry.Client != conn.RemoteAddr().String() {
+			t.Errorf("%s: audit entry client %q, want %q", test.name, entry.Client, conn.RemoteAddr())
+		}
+		entry.Time, entry.Client = "", ""
+		if entry != test.want {
+			t.Errorf("%s: audit entry %+v, want %+v", test.name, entry, test.want)
+		}
+
+		// But never the trapdoors sought or the names of the indexes searched
+		for _, secret := range []string{base64.StdEncoding.EncodeToString(rabbit[0]), base64.StdEncoding.EncodeToString(dummy[0]), "alice", "hatter", "holmes", "secret-plans", ".sindex"} {
+			if strings.Contains(line, secret) {
+				t.Errorf("%s: audit entry %q leaks %q", test.name, line, secret)
+			}
+		}
+	}
+}
+
+func TestCollectNestedIndexes(t *testing.T) {
+
+	keys, err := cryptoUtils.GenerateHashKeys(0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	for _, docID := range []string{"top.pdf", "a/middle.pdf", "a/b/c/deep.pdf", "x.sindex.d/inside.pdf"} {
+		writeTestIndex(t, root, docID, []string{"rabbit"}, keys)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "a", "b", "decoy.sindex"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "a", "b", "notes.txt"), []byte("rabbit"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := collectIndexes(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0, 0)
+	for _, file := range files {
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, filepath.ToSlash(rel))
+	}
+	sort.Strings(got)
+
+	// Indexes at every depth, but neither directories named like indexes nor other files
+	want := []string{"a/b/c/deep.pdf.sindex", "a/middle.pdf.sindex", "top.pdf.sindex", "x.sindex.d/inside.pdf.sindex"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("collected %q, want %q", got, want)
+	}
+
+	// A search scans, and matches, each of them
+	conn := serveTestConnection(t, root)
+	response := exchange(t, conn, searchProtocol.Query{Keywords: []searchProtocol.TrapdoorSet{{Trapdoors: cryptoUtils.BuildTrapdoors("rabbit", keys)}}})
+	if response.Scanned != len(want) || len(response.Matches) != len(want) {
+		t.Errorf("search scanned %d indexes and matched %d, want %d of each", response.Scanned, len(response.Matches), len(want))
+	}
+}
+
+/* Send a streamed query and read its first match, leaving the search held up in flight */
+func startStreamedQuery(t *testing.T, conn net.Conn, trapdoors [][]byte) *json.Decoder {
+
+	query := searchProtocol.Query{Keywords: []searchProtocol.TrapdoorSet{{Trapdoors: trapdoors}}, Format: searchProtocol.FORMAT_STREAM}
+	if err := json.NewEncoder(conn).Encode(query); err != nil {
+		t.Fatal(err)
+	}
+	decoder := json.NewDecoder(conn)
+	var first searchProtocol.StreamMessage
+	if err := decoder.Decode(&first); err != nil || first.Match == nil {
+		t.Fatalf("first streamed message %+v (%v), want a match", first, err)
+	}
+	return decoder
+}
+
+func TestDrainOnShutdown(t *testing.T) {
+
+	keys, err := cryptoUtils.GenerateHashKeys(0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	for _, name := range []string{"a.pdf", "b.pdf", "c.pdf"} {
+		writeTestIndex(t, root, name, []string{"rabbit"}, keys)
+	}
+
+	savedWorkers := workers
+	workers = 1
+	defer func() { workers = savedWorkers }()
+
+	// One idle connection, one query that completes within the grace period and one that doesn't
+	idle := serveTestConnection(t, root)
+	completing := connectTestClient(t, root)
+	stuck := connectTestClient(t, root)
+	completingStream := startStreamedQuery(t, completing, cryptoUtils.BuildTrapdoors("rabbit", keys))
+	startStreamedQuery(t, stuck, cryptoUtils.BuildTrapdoors("rabbit", keys))
+
+	grace := 500 * time.Millisecond
+	start := time.Now()
+	logged := captureOutput(t, &os.Stdout, func() {
+		connections.close()
+		drained := make(chan struct{})
+		go func() {
+			connections.drain(grace)
+			close(drained)
+		}()
+
+		// Let the completing query finish once the drain has started
+		time.Sleep(100 * time.Millisecond)
+		for {
+			var message searchProtocol.StreamMessage
+			if err := completingStream.Decode(&message); err != nil {
+				t.Errorf("in-flight query cut short by the drain: %v", err)
+				break
+			}
+			if message.End {
+				break
+			}
+		}
+		<-drained
+	})
+	elapsed := time.Since(start)
+
+	if !strings.Contains(logged, "2 queries in flight, 1 idle connections closed") {
+		t.Errorf("drain logged %q, want 2 queries in flight and 1 idle connection closed", logged)
+	}
+	if !strings.Contains(logged, "1 in-flight queries completed, 1 forcibly closed") {
+		t.Errorf("drain logged %q, want 1 query completed and 1 forcibly closed", logged)
+	}
+	if elapsed < grace || elapsed > 5*grace {
+		t.Errorf("drain took %v, want about the %v grace period", elapsed, grace)
+	}
+
+	// Every connection has been closed, and no new ones are accepted
+	for name, conn := range map[string]net.Conn{"idle": idle, "completing": completing, "stuck": stuck} {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := ioutil.ReadAll(conn); err != nil {
+			t.Errorf("%s connection left open after the drain: %v", name, err)
+		}
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	if connections.add(server) {
+		t.Error("connection accepted after shutdown started")
+	}
+}
+
+func TestShutdownWritesFinalStats(t *testing.T) {
+
+	keys, err := cryptoUtils.GenerateHashKeys(0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	for _, name := range []string{"a.pdf", "b.pdf", "c.pdf"} {
+		writeTestIndex(t, root, name, []string{"rabbit"}, keys)
+	}
+
+	savedWorkers := workers
+	workers = 1
+	defer func() { workers = savedWorkers }()
+
+	conn := serveTestConnection(t, root)
+	stream := startStreamedQuery(t, conn, cryptoUtils.BuildTrapdoors("rabbit", keys))
+
+	// The rest of the query's matches are found while the server shuts down
+	statsFile := filepath.Join(t.TempDir(), "stats.json")
+	captureOutput(t, &os.Stdout, func() {
+		connections.close()
+		stopped := make(chan struct{})
+		go func() {
+			shutdown(5*time.Second, statsFile)
+			close(stopped)
+		}()
+
+		for {
+			var message searchProtocol.StreamMessage
+			if err := stream.Decode(&message); err != nil {
+				t.Errorf("in-flight query cut short by shutdown: %v", err)
+				break
+			}
+			if message.End {
+				break
+			}
+		}
+		<-stopped
+	})
+
+	data, err := ioutil.ReadFile(statsFile)
+	if err != nil {
+		t.Fatalf("match statistics not written on shutdown: %v", err)
+	}
+	var written map[string]searchStats.DocumentStats
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.pdf", "b.pdf", "c.pdf"} {
+		if written[name].Matches != 1 {
+			t.Errorf("statistics written on shutdown record %d matches of %s, want 1", written[name].Matches, name)
+		}
+	}
+}
+
+/* Write a corpus of secure indexes of random keywords, returning their paths and the keys */
+func writeTestCorpus(b *testing.B, root string, documents int, keywords int) ([]string, [][]byte) {
+
+	keys, err := cryptoUtils.GenerateHashKeys(0.01)
+	if err != nil {
+		b.Fatal(err)
+	}
+	files := make([]string, 0, documents)
+	for i := 0; i < documents; i++ {
+		docID := fmt.Sprintf("doc%04d.pdf", i)
+		words := make([]string, 0, keywords)
+		for j := 0; j < keywords; j++ {
+			words = append(words, fmt.Sprintf("word%d", (i*7+j)%(5*keywords)))
+		}
+		writeTestIndex(b, root, docID, words, keys)
+		files = append(files, filepath.Join(root, docID+".sindex"))
+	}
+
+	return files, keys
+}
+
+/* Benchmark searching a corpus with every index parsed from disk (cold) and with the *
+ * indexes already cached (warm), as repeated searches find them                      */
+func BenchmarkIndexCache(b *testing.B) {
+
+	files, keys := writeTestCorpus(b, b.TempDir(), 200, 500)
+	terms := [][]searchProtocol.TrapdoorSet{{{Trapdoors: cryptoUtils.BuildTrapdoors("word42", keys)}}}
+
+	search := func() {
+		for _, file := range files {
+			if _, err := searchIndexFile(file, terms, false, len(keys)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("cold", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			indexes.reset()
+			search()
+		}
+	})
+	b.Run("warm", func(b *testing.B) {
+		indexes.reset()
+		search()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			search()
+		}
+	})
+	indexes.reset()
+}
+
+/* Benchmark searching a corpus serially and with pools of workers, parsing every index *
+ * from disk as a first search of the corpus does                                       */
+func BenchmarkSearchIndexFiles(b *testing.B) {
+
+	files, keys := writeTestCorpus(b, b.TempDir(), 200, 500)
+	terms := [][]searchProtocol.TrapdoorSet{{{Trapdoors: cryptoUtils.BuildTrapdoors("word42", keys)}}}
+
+	saved := workers
+	defer func() { workers = saved }()
+	for _, pool := range []int{1, 4, 16} {
+		workers = pool
+		b.Run(fmt.Sprintf("workers=%d", pool), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				indexes.reset()
+				for _, outcome := range searchIndexFiles(files, terms, false, len(keys), nil) {
+					if outcome.err != nil {
+						b.Fatal(outcome.err)
+					}
+				}
+			}
+		})
+	}
+	indexes.reset()
+}
@@ -0,0 +1,90 @@
+package main
+
+/* Implementation of Secure Indexes in Go. This script precomputes search trapdoors offline for a list of keywords.  *
+ * Given a file of keywords (one per line) and the private index keys, outputs the trapdoors for each keyword as     *
+ * JSON, mapping each normalised keyword to its list of base64 encoded trapdoors, ready to send with a custom client *
+ * Source ref: crypto.stanford.edu/~eujin/papers/secureindex/secureindex.pdf                                         */
+
+import (
+	"bufio" // Import std. packages
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"secureindex/cryptoUtils" // Import custom packages
+	"secureindex/keywordUtils"
+)
+
+/* Error handling */
+func errorCheck(msg string, err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, msg)
+		os.Exit(1)
+	}
+}
+
+/* Read keywords, one per line, normalising them as the index build does */
+func readTerms(r io.Reader, opts keywordUtils.Options) ([]string, error) {
+
+	terms := make([]string, 0, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if term := keywordUtils.NormalizeKeyword(scanner.Text(), opts); len(term) > 0 && keywordUtils.KeepKeyword(term, opts) {
+			terms = append(terms, term)
+		}
+	}
+
+	return terms, scanner.Err()
+}
+
+/* Takes a file of keywords and a keyfile, outputs the keywords' trapdoors as JSON */
+func main() {
+
+	keyfile := flag.String("keyfile", "", "path to the private index keys the searched indexes were built with")
+	termsPath := flag.String("terms", "-", "file of keywords to build trapdoors for, one per line (\"-\" for stdin)")
+	outPath := flag.String("out", "-", "file to write the trapdoors to as JSON (\"-\" for stdout)")
+	foldAccents := flag.Bool("foldaccents", false, "accent- and case-insensitive keywords (must match the index build setting)")
+	stem := flag.Bool("stem", false, "build trapdoors for the stems of keywords (must match the index build setting)")
+	minLength := flag.Int("minlength", keywordUtils.MIN_LENGTH, "skip keywords shorter than this many characters (must match the index build setting)")
+	maxLength := flag.Int("maxlength", keywordUtils.MAX_LENGTH, "skip keywords with a word longer than this many characters (must match the index build setting)")
+	flag.Parse()
+
+	if len(*keyfile) == 0 {
+		fmt.Println("ERROR: provide the private index keys with -keyfile.")
+		return
+	}
+
+	// Read the keywords to build trapdoors for
+	in := io.Reader(os.Stdin)
+	if *termsPath != "-" {
+		file, err := os.Open(*termsPath)
+		errorCheck("ERROR: unable to open keywords file.", err)
+		defer file.Close()
+		in = file
+	}
+	terms, err := readTerms(in, keywordUtils.Options{FoldAccents: *foldAccents, Stem: *stem, MinLength: *minLength, MaxLength: *maxLength})
+	errorCheck("ERROR: unable to read keywords.", err)
+
+	trapdoors, err := cryptoUtils.BulkTrapdoors(terms, *keyfile)
+	errorCheck("ERROR: unable to build trapdoors from keyfile.", err)
+
+	// Write the trapdoors as JSON
+	out := io.Writer(os.Stdout)
+	if *outPath != "-" {
+		file, err := os.OpenFile(*outPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		errorCheck("ERROR: unable to open output file.", err)
+		defer file.Close()
+		out = file
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(trapdoors)
+	errorCheck("ERROR: unable to write trapdoors.", err)
+
+	if *outPath != "-" {
+		fmt.Fprintf(os.Stderr, "Wrote trapdoors for %d keywords to %s.\n", len(trapdoors), *outPath)
+	}
+}
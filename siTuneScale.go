@@ -0,0 +1,206 @@
+package main
+
+/* Implementation of Secure Indexes in Go. This script measures the effect of the S_F scaling factor on secure indexes.   *
+ * The scaling factor leaves headroom in each Bloom Filter for document updates, at the cost of larger indexes. Given a  *
+ * representative set of documents, builds their indexes in memory for each of a range of scaling factors and reports   *
+ * the resulting index sizes and measured false positive rates, recommending the smallest factor meeting a target rate.  *
+ * Source ref: crypto.stanford.edu/~eujin/papers/secureindex/secureindex.pdf                                             */
+
+import (
+	"flag" // Import std. packages
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"secureindex/bloomFilter" // Import custom packages
+	"secureindex/cryptoUtils"
+	"secureindex/indexMeta"
+	"secureindex/textExtract"
+)
+
+const (
+	F_P    = 0.01                 // Default target probability of false positives, as used by the build
+	SCALES = "1,1.25,1.5,2,2.5,3" // Default scaling factors to sweep
+)
+
+/* Error handling */
+func errorCheck(msg string, err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, msg)
+		os.Exit(1)
+	}
+}
+
+/* Declare custom structure for a document's extracted keywords */
+type document struct {
+	name     string
+	keywords []string
+	size     int
+}
+
+/* Declare custom structure for the measurements at one scaling factor */
+type sweepResult struct {
+	scale    float64
+	meanBits float64
+	meanFP   float64
+	maxFP    float64
+}
+
+/* Parse a comma separated list of scaling factors */
+func parseScales(list string) ([]float64, error) {
+
+	scales := make([]float64, 0, 0)
+	for _, field := range strings.Split(list, ",") {
+		scale, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || scale <= 0 {
+			return nil, fmt.Errorf("invalid scaling factor %q", field)
+		}
+		scales = append(scales, scale)
+	}
+
+	return scales, nil
+}
+
+/* Extract the keywords of each supported document under a directory */
+func readDocuments(dirpath string) ([]document, error) {
+
+	filetypes := map[string]bool{".txt": true, ".csv": true, ".rtf": true, ".pdf": true}
+	documents := make([]document, 0, 0)
+
+	err := filepath.Walk(dirpath, func(path string, f os.FileInfo, err error) error {
+		if err != nil || f.IsDir() || !filetypes[strings.ToLower(filepath.Ext(path))] {
+			return err
+		}
+
+		text := textExtract.Text{Filepath: path, Keywords: make([]string, 0, 0)}
+		text.ExtractText()
+		if len(strings.TrimSpace(text.RawText)) == 0 {
+			return nil
+		}
+		if err := text.ExtractKeywords(); err != nil {
+			return err
+		}
+		if len(text.Keywords) > 0 {
+			documents = append(documents, document{filepath.Base(path), text.Keywords, len(text.RawText)})
+		}
+		return nil
+	})
+
+	return documents, err
+}
+
+/* Build each document's secure index in memory with a scaling factor, as the build *
+ * tool does, measuring the indexes' sizes and false positive rates                 */
+func measureScale(documents []document, hashKeys [][]byte, hashFunc cryptoUtils.HMACHash, scale float64, blocked bool, probes int) (sweepResult, error) {
+
+	result := sweepResult{scale: scale}
+	for _, doc := range documents {
+		filter := bloomFilter.BloomFilter{Variant: bloomFilter.STANDARD}
+		if blocked {
+			filter.Variant = bloomFilter.BLOCKED
+		}
+		filter.Create(len(hashKeys), len(doc.keywords), scale)
+
+		meta := indexMeta.Metadata{Filter: filter.Variant}
+		sIndex := cryptoUtils.SecureIndex{Trapdoors: make([][]byte, 0, 0), Codewords: make([][]byte, 0, 0), Index: &filter, Meta: &meta, Hash: hashFunc}
+		for _, keyword := range doc.keywords {
+			sIndex.Build(doc.name, keyword, hashKeys)
+			sIndex.Index.Add(sIndex.Codewords)
+		}
+		if err := sIndex.Blind(len(doc.keywords), doc.size, len(hashKeys)); err != nil {
+			return result, err
+		}
+
+		rate, err := cryptoUtils.MeasureFalsePositivesWith(hashFunc, sIndex.Index, doc.name, hashKeys, probes)
+		if err != nil {
+			return result, err
+		}
+
+		result.meanBits += float64(filter.Len())
+		result.meanFP += rate
+		if rate > result.maxFP {
+			result.maxFP = rate
+		}
+	}
+
+	result.meanBits /= float64(len(documents))
+	result.meanFP /= float64(len(documents))
+	return result, nil
+}
+
+/* Takes a directory of representative documents, outputs index sizes and false positive *
+ * rates for each scaling factor and recommends one for the target false positive rate  */
+func main() {
+
+	fp := flag.Float64("fp", F_P, "target false positive rate")
+	scaleList := flag.String("scales", SCALES, "comma separated scaling factors to sweep")
+	probes := flag.Int("probes", 1000, "random non-indexed terms probed per index to measure its false positive rate")
+	keyfile := flag.String("keyfile", "", "hash keys to build with (default: fresh keys for -fp)")
+	blocked := flag.Bool("blocked", false, "use blocked Bloom Filters, as with siBuildIndex -blocked")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: siTuneScale [options] <document directory>\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	dirpath := flag.Arg(0)
+
+	scales, err := parseScales(*scaleList)
+	if err != nil {
+		fmt.Printf("ERROR: %v.\n", err)
+		return
+	}
+
+	// Build with the given keys, else keys as the build tool would generate for the target rate
+	var hashKeys [][]byte
+	hashFunc := cryptoUtils.HMAC_SHA256
+	if len(*keyfile) > 0 {
+		hashKeys, hashFunc, err = cryptoUtils.ReadKeyFileHash(*keyfile)
+		errorCheck("ERROR: unable to read keyfile.", err)
+	} else {
+		hashKeys, err = cryptoUtils.GenerateHashKeys(*fp)
+		errorCheck("ERROR: unable to generate keys.", err)
+	}
+
+	documents, err := readDocuments(dirpath)
+	errorCheck("ERROR: unable to read documents.", err)
+	if len(documents) == 0 {
+		fmt.Printf("\n No documents with keywords found in %s.\n\n", dirpath)
+		return
+	}
+
+	// Smallest possible unblinded, unscaled filters for comparison
+	minBits := 0.0
+	for _, doc := range documents {
+		minBits += float64(bloomFilter.MinSizeFor(len(doc.keywords), *fp))
+	}
+	minBits /= float64(len(documents))
+
+	fmt.Printf("\n Scaling factor sweep over %d documents (%d keys, target fp %v)\n", len(documents), len(hashKeys), *fp)
+	fmt.Printf(" -----------------------------------------------------------\n")
+	fmt.Printf(" %8s %12s %10s %10s\n", "S_F", "mean bits", "mean fp", "max fp")
+
+	recommended := 0.0
+	for _, scale := range scales {
+		result, err := measureScale(documents, hashKeys, hashFunc, scale, *blocked, *probes)
+		errorCheck("ERROR: unable to measure false positive rate.", err)
+
+		fmt.Printf(" %8.2f %12.0f %10.4f %10.4f\n", result.scale, result.meanBits, result.meanFP, result.maxFP)
+		if result.meanFP <= *fp && (recommended == 0 || scale < recommended) {
+			recommended = scale
+		}
+	}
+
+	fmt.Printf("\n Minimum mean bits for fp %v without scaling or blinding: %.0f\n", *fp, minBits)
+	if recommended > 0 {
+		fmt.Printf(" Recommended S_F: %.2f (smallest swept factor meeting the target)\n\n", recommended)
+	} else {
+		fmt.Printf(" No swept factor met the target, try larger factors or a larger -fp.\n\n")
+	}
+}
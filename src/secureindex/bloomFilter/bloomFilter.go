@@ -4,25 +4,123 @@ package bloomFilter
  * Source ref: crypto.stanford.edu/~eujin/papers/secureindex/secureindex.pdf                */
 
 import (
-	"encoding/binary" // Standard packages
+	"bytes" // Standard packages
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"math"
+	"math/bits"
+	"sync"
 )
 
+// Bloom Filter variants, recorded in index metadata so searches use the same variant
+const (
+	STANDARD = "standard" // k positions scattered across the whole bit array
+	BLOCKED  = "blocked"  // k positions confined to a single cache-line sized block
+)
+
+// Number of bits in each block of a blocked Bloom Filter (one 64 byte cache line)
+const BLOCK_BITS = 512
+
+// Binary format written by MarshalBinary: magic, version, variant, k and bit length, then packed bits
+const (
+	BINARY_MAGIC   = "SIBF"
+	BINARY_VERSION = 1
+	binaryHeader   = len(BINARY_MAGIC) + 1 + 1 + 2 + 8
+)
+
+// Largest number of bits a filter read in its binary format may have (512MB of bits)
+const MAX_BITS = 1 << 32
+
 /* Declare custom type for a bit array used to construct Bloom Filter */
 type BloomFilter struct {
-	BitArray []bool
+	Bits    []byte // Bit array packed eight bits to a byte, bit i is bit i%8 of Bits[i/8]
+	Size    int    // Number of bits in the bit array
+	Variant string // STANDARD if empty
+	Hashes  int    // Number of hash keys (k) the filter was created for, 0 if unknown
+}
+
+/* Create an empty Bloom Filter of a given number of bits, e.g. to load a secure index into */
+func New(size int, variant string) *BloomFilter {
+	return &BloomFilter{Bits: make([]byte, (size+7)/8), Size: size, Variant: variant}
+}
+
+/* Number of bits in the filter's bit array */
+func (filter *BloomFilter) Len() int {
+	return filter.Size
+}
+
+/* Check whether bit i of the filter's bit array is set */
+func (filter *BloomFilter) Bit(i int) bool {
+	return filter.Bits[i/8]&(1<<uint(i%8)) != 0
 }
 
-/* Build a Bloom Filter data structure, estimate the filter's optimal parameters *
- * m = (n * k) / ln(2), where n is the number of unique words in document        *
- * s = represents a recommended scaling factor allowing for document updates     */
+/* Set bit i of the filter's bit array */
+func (filter *BloomFilter) SetBit(i int) {
+	filter.Bits[i/8] |= 1 << uint(i%8)
+}
+
+/* Optimal size parameter for a Bloom Filter, m = (n * k * s) / ln(2)        *
+ * n = represents the number of unique words in document                    *
+ * s = represents a recommended scaling factor allowing for document updates */
+func OptimalBits(keywords int, hashes int, scaling float64) int {
+	return int(math.Round(optimalSize(keywords, hashes, scaling)))
+}
+
+/* Unrounded optimal size, which blocked filters round up to whole blocks */
+func optimalSize(keywords int, hashes int, scaling float64) float64 {
+	return (float64(keywords) * scaling * float64(hashes)) / math.Log(2)
+}
+
+/* Optimal number of k hashes for a Bloom Filter, k = -log2(p), *
+ * where p is the probability of false positives               */
+func OptimalHashes(fp float64) int {
+	return int(math.Round(math.Abs(-(math.Log2(fp)))))
+}
+
+/* Build a Bloom Filter data structure with the optimal size for its keywords */
 func (filter *BloomFilter) Create(hashes int, keywords int, scaling float64) {
 
-	// Determine optimal size parameter for the Bloom Filter
-	m := (float64(keywords) * scaling * float64(hashes)) / math.Log(2)
+	// Blocked filters are rounded up to a whole number of blocks
+	size := OptimalBits(keywords, hashes, scaling)
+	if filter.Variant == BLOCKED {
+		size = int(math.Ceil(optimalSize(keywords, hashes, scaling)/BLOCK_BITS)) * BLOCK_BITS
+		if size == 0 {
+			size = BLOCK_BITS
+		}
+	}
 
-	// Create the filter's bit array and pointer, zero initialised
-	filter.BitArray = make([]bool, int(math.Round(m)))
+	// Create the filter's packed bit array, zero initialised
+	filter.Bits = make([]byte, (size+7)/8)
+	filter.Size = size
+	filter.Hashes = hashes
+}
+
+/* Minimum bit array length achieving a false positive rate fp for n keywords, ignoring *
+ * scaling and blinding: m = -(n * ln(p)) / ln(2)^2, with k = (m / n) * ln(2) hashes     */
+func MinSizeFor(numKeywords int, fp float64) int {
+
+	if numKeywords <= 0 || fp <= 0 || fp >= 1 {
+		return 0
+	}
+
+	return int(math.Ceil(-(float64(numKeywords) * math.Log(fp)) / (math.Ln2 * math.Ln2)))
+}
+
+/* Map a codeword to an unsigned integer used to derive filter positions, folding every *
+ * byte of the codeword (XOR of its big-endian 8 byte words) so none of its entropy is  *
+ * lost. Indexes built with an earlier mapping must be rebuilt to be searched           */
+func codewordValue(codeword []byte) uint64 {
+
+	var x uint64
+	for i := 0; i < len(codeword); i += 8 {
+		var word [8]byte
+		copy(word[:], codeword[i:])
+		x ^= binary.BigEndian.Uint64(word[:])
+	}
+
+	return x
 }
 
 /* Map a set of codewords to corresponding positions in Bloom Filter */
@@ -31,21 +129,64 @@ func findPositions(codewords [][]byte, filterSize int) []uint64 {
 	indexPositions := make([]uint64, 0, 0)
 
 	for codeword := range codewords {
-		x, _ := binary.Uvarint(codewords[codeword])
+		x := codewordValue(codewords[codeword])
 		indexPositions = append(indexPositions, x%uint64(filterSize))
 	}
 
 	return indexPositions
 }
 
+/* Map a set of codewords to positions within a single block of a blocked Bloom Filter. *
+ * The first codeword selects the block, each codeword then selects a bit in the block  */
+func findBlockedPositions(codewords [][]byte, filterSize int) []uint64 {
+
+	indexPositions := make([]uint64, 0, 0)
+	if len(codewords) == 0 {
+		return indexPositions
+	}
+
+	numBlocks := uint64(filterSize / BLOCK_BITS)
+	block := (codewordValue(codewords[0]) / BLOCK_BITS) % numBlocks
+
+	for codeword := range codewords {
+		x := codewordValue(codewords[codeword])
+		indexPositions = append(indexPositions, block*BLOCK_BITS+x%BLOCK_BITS)
+	}
+
+	return indexPositions
+}
+
+/* Map a set of codewords to positions according to the filter's variant */
+func (filter *BloomFilter) positions(codewords [][]byte) []uint64 {
+
+	if filter.Variant == BLOCKED {
+		return findBlockedPositions(codewords, filter.Size)
+	}
+
+	return findPositions(codewords, filter.Size)
+}
+
 /* Add a set of k codewords to a Bloom Filter */
 func (filter *BloomFilter) Add(codewords [][]byte) {
 
-	indexPositions := findPositions(codewords, len(filter.BitArray))
+	indexPositions := filter.positions(codewords)
 
 	for _, i := range indexPositions {
-		filter.BitArray[i] = true
+		filter.SetBit(int(i))
+	}
+}
+
+/* Count how many of a set of k codewords' positions are set in the Bloom Filter, *
+ * k meaning the codewords are held (as Search reports)                           */
+func (filter *BloomFilter) Count(codewords [][]byte) int {
+
+	set := 0
+	for _, i := range filter.positions(codewords) {
+		if filter.Bit(int(i)) {
+			set++
+		}
 	}
+	return set
 }
 
 /* Check if a set of k codewords is held in the Bloom Filter */
@@ -53,13 +194,362 @@ func (filter *BloomFilter) Search(codewords [][]byte) bool {
 
 	exists := true // return boolean match
 
-	indexPositions := findPositions(codewords, len(filter.BitArray))
+	indexPositions := filter.positions(codewords)
 
 	// Map set of codewords to corresponding positions in Bloom Filter
 	for _, i := range indexPositions {
-		if filter.BitArray[i] == false {
+		if !filter.Bit(int(i)) {
 			exists = false
 		}
 	}
 	return exists
 }
+
+/* Bloom Filter safe for concurrent use, so keywords can be added from several goroutines. *
+ * Plain BloomFilters are unsynchronised so single-threaded builds don't pay for locking   */
+type SyncBloomFilter struct {
+	mu     sync.RWMutex
+	filter *BloomFilter
+}
+
+/* Wrap a Bloom Filter for concurrent use, the filter shouldn't be used directly meanwhile */
+func NewSync(filter *BloomFilter) *SyncBloomFilter {
+	return &SyncBloomFilter{filter: filter}
+}
+
+/* Add a set of k codewords, positions are found before locking as they only read the size */
+func (s *SyncBloomFilter) Add(codewords [][]byte) {
+
+	indexPositions := s.filter.positions(codewords)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, i := range indexPositions {
+		s.filter.SetBit(int(i))
+	}
+}
+
+/* Check if a set of k codewords is held in the Bloom Filter */
+func (s *SyncBloomFilter) Search(codewords [][]byte) bool {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.filter.Search(codewords)
+}
+
+/* The underlying Bloom Filter, once concurrent additions are complete */
+func (s *SyncBloomFilter) Filter() *BloomFilter {
+	return s.filter
+}
+
+/* Merge another Bloom Filter into this one, so it holds the keywords of both. Positions *
+ * depend on the filter's length and variant, so only matching filters can be merged     */
+func (filter *BloomFilter) Union(other *BloomFilter) error {
+
+	if filter.Size != other.Size {
+		return fmt.Errorf("bloom filter lengths differ (%d and %d bits)", filter.Size, other.Size)
+	}
+	if filter.Variant != other.Variant {
+		return fmt.Errorf("bloom filter variants differ (%s and %s)", filter.Variant, other.Variant)
+	}
+	if filter.Hashes > 0 && other.Hashes > 0 && filter.Hashes != other.Hashes {
+		return fmt.Errorf("bloom filter hash counts differ (%d and %d)", filter.Hashes, other.Hashes)
+	}
+
+	for i, b := range other.Bits {
+		filter.Bits[i] |= b
+	}
+	if filter.Hashes == 0 {
+		filter.Hashes = other.Hashes
+	}
+
+	return nil
+}
+
+/* Fraction of the filter's bits that are set */
+func (filter *BloomFilter) FillRatio() float64 {
+
+	if filter.Size == 0 {
+		return 0
+	}
+
+	set := 0
+	for _, b := range filter.Bits {
+		set += bits.OnesCount8(b)
+	}
+
+	return float64(set) / float64(filter.Size)
+}
+
+/* Estimated false positive rate of the filter as it stands, (1 - e^(-k*n/m))^k, where the *
+ * fill ratio measures 1 - e^(-k*n/m) directly so blinding and scaling are accounted for.  *
+ * Uses the filter's Hashes as k, so is 1 (every search may match) if k is unknown         */
+func (filter *BloomFilter) FalsePositiveRate() float64 {
+	return math.Pow(filter.FillRatio(), float64(filter.Hashes))
+}
+
+/* Fraction of the bits set in the block of BLOCK_BITS bits holding bit i (the filter's *
+ * last block may be shorter)                                                          */
+func (filter *BloomFilter) blockFill(i int) float64 {
+
+	start := i - i%BLOCK_BITS
+	end := start + BLOCK_BITS
+	if end > filter.Size {
+		end = filter.Size
+	}
+
+	set := 0
+	for j := start; j < end; j++ {
+		if filter.Bit(j) {
+			set++
+		}
+	}
+
+	return float64(set) / float64(end-start)
+}
+
+/* Approximate probability that a set of codewords' positions are all set by chance, by     *
+ * other keywords or blinding, rather than because the codewords were added. Codewords      *
+ * mapping to the same position support a match only once, so only distinct positions      *
+ * count, and each is taken to be set by chance with the fill ratio of the block of        *
+ * BLOCK_BITS bits around it. Matches relying on fewer distinct positions, or on positions *
+ * in densely filled parts of the filter, are so more likely to be coincidental. Bits      *
+ * aren't truly set independently, so this is an approximation. 1 if any position is unset */
+func (filter *BloomFilter) ChanceMatch(codewords [][]byte) float64 {
+
+	chance := 1.0
+	seen := make(map[uint64]bool)
+	for _, i := range filter.positions(codewords) {
+		if !filter.Bit(int(i)) {
+			return 1
+		}
+		if !seen[i] {
+			seen[i] = true
+			chance *= filter.blockFill(int(i))
+		}
+	}
+
+	return chance
+}
+
+/* Approximate confidence that a match on a set of codewords is genuine rather than *
+ * coincidental, 1 - ChanceMatch, so 0 if the codewords aren't held at all          */
+func (filter *BloomFilter) MatchConfidence(codewords [][]byte) float64 {
+	return 1 - filter.ChanceMatch(codewords)
+}
+
+/* Check the filter's length suits its variant, so codeword positions can be found: a standard *
+ * filter needs at least one bit and a blocked filter a whole number of BLOCK_BITS bit blocks   */
+func (filter *BloomFilter) Validate() error {
+
+	switch {
+	case filter.Size <= 0 || len(filter.Bits) != (filter.Size+7)/8:
+		return errors.New("bloom filter is empty or truncated")
+	case filter.Variant == BLOCKED && filter.Size%BLOCK_BITS != 0:
+		return fmt.Errorf("blocked bloom filter length %d isn't a whole number of %d bit blocks", filter.Size, BLOCK_BITS)
+	}
+
+	return nil
+}
+
+/* Serialise the filter in its compact binary format, implements encoding.BinaryMarshaler. *
+ * The header is the magic "SIBF", a version byte, a variant byte (0 standard, 1 blocked), *
+ * k as a big-endian uint16 and the number of bits as a big-endian uint64                 */
+func (filter *BloomFilter) MarshalBinary() ([]byte, error) {
+
+	if filter.Hashes < 0 || filter.Hashes > math.MaxUint16 {
+		return nil, errors.New("bloom filter has too many hashes")
+	}
+
+	data := make([]byte, binaryHeader, binaryHeader+len(filter.Bits))
+	copy(data, BINARY_MAGIC)
+	data[4] = BINARY_VERSION
+	if filter.Variant == BLOCKED {
+		data[5] = 1
+	}
+	binary.BigEndian.PutUint16(data[6:], uint16(filter.Hashes))
+	binary.BigEndian.PutUint64(data[8:], uint64(filter.Size))
+
+	return append(data, filter.Bits...), nil
+}
+
+/* Restore a filter from its binary format, implements encoding.BinaryUnmarshaler. Filters *
+ * that can't be searched (see Validate) are rejected, leaving the filter unchanged        */
+func (filter *BloomFilter) UnmarshalBinary(data []byte) error {
+
+	if !IsBinary(data) {
+		return errors.New("not a binary bloom filter")
+	}
+	if len(data) < binaryHeader {
+		return errors.New("bloom filter header is truncated")
+	}
+	if data[4] != BINARY_VERSION {
+		return fmt.Errorf("unsupported bloom filter format version %d", data[4])
+	}
+
+	variant := STANDARD
+	switch data[5] {
+	case 0:
+	case 1:
+		variant = BLOCKED
+	default:
+		return fmt.Errorf("unknown bloom filter variant %d", data[5])
+	}
+
+	size := binary.BigEndian.Uint64(data[8:])
+	if size > MAX_BITS || uint64(len(data)-binaryHeader) != (size+7)/8 {
+		return errors.New("bloom filter length doesn't match its bits")
+	}
+
+	restored := BloomFilter{Bits: append([]byte(nil), data[binaryHeader:]...), Size: int(size), Variant: variant, Hashes: int(binary.BigEndian.Uint16(data[6:]))}
+	if err := restored.Validate(); err != nil {
+		return err
+	}
+	*filter = restored
+
+	return nil
+}
+
+/* Check whether data is a filter in the binary format written by MarshalBinary */
+func IsBinary(data []byte) bool {
+	return len(data) >= len(BINARY_MAGIC) && string(data[:len(BINARY_MAGIC)]) == BINARY_MAGIC
+}
+
+/* Write the filter to a stream in its binary format (see MarshalBinary), implements io.WriterTo */
+func (filter *BloomFilter) WriteTo(w io.Writer) (int64, error) {
+
+	data, err := filter.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(data)
+
+	return int64(n), err
+}
+
+/* Read a filter in its binary format from a stream, reading no further than its bits, *
+ * implements io.ReaderFrom                                                            */
+func (filter *BloomFilter) ReadFrom(r io.Reader) (int64, error) {
+
+	// The header gives the number of bits that follow it
+	data := make([]byte, binaryHeader)
+	n, err := io.ReadFull(r, data)
+	if err != nil {
+		return int64(n), err
+	}
+	if !IsBinary(data) {
+		return int64(n), errors.New("not a binary bloom filter")
+	}
+	size := binary.BigEndian.Uint64(data[8:])
+	if size > MAX_BITS {
+		return int64(n), errors.New("bloom filter size is too large")
+	}
+
+	// Buffer the bits as they're read rather than allocating for the length the header claims,
+	// so a crafted header can't allocate more memory than the stream holds
+	buf := bytes.NewBuffer(data)
+	m, err := buf.ReadFrom(io.LimitReader(r, int64((size+7)/8)))
+	if err != nil {
+		return int64(n) + m, err
+	}
+	if m != int64((size+7)/8) {
+		return int64(n) + m, io.ErrUnexpectedEOF
+	}
+
+	return int64(n) + m, filter.UnmarshalBinary(buf.Bytes())
+}
+
+// Largest count a counting Bloom Filter's counter holds, counters reaching it stay saturated
+const MAX_COUNT = math.MaxUint8
+
+/* Declare custom type for a counting Bloom Filter, whose counters allow keywords to be  *
+ * removed as well as added. A secure index built with document updates enabled can use *
+ * this in place of BloomFilter, converting it with Filter() when the index is written  */
+type CountingBloomFilter struct {
+	Counters []uint8
+	Variant  string // STANDARD if empty
+	Hashes   int    // Number of hash keys (k) the filter was created for
+}
+
+/* Build a counting Bloom Filter with the same size parameters as BloomFilter.Create */
+func (filter *CountingBloomFilter) Create(hashes int, keywords int, scaling float64) {
+
+	sized := BloomFilter{Variant: filter.Variant}
+	sized.Create(hashes, keywords, scaling)
+
+	filter.Counters = make([]uint8, sized.Size)
+	filter.Hashes = hashes
+}
+
+/* Map a set of codewords to positions according to the filter's variant */
+func (filter *CountingBloomFilter) positions(codewords [][]byte) []uint64 {
+
+	if filter.Variant == BLOCKED {
+		return findBlockedPositions(codewords, len(filter.Counters))
+	}
+
+	return findPositions(codewords, len(filter.Counters))
+}
+
+/* Add a set of k codewords to a counting Bloom Filter */
+func (filter *CountingBloomFilter) Add(codewords [][]byte) {
+
+	for _, i := range filter.positions(codewords) {
+		if filter.Counters[i] < MAX_COUNT {
+			filter.Counters[i]++
+		}
+	}
+}
+
+/* Remove a set of k codewords previously added to a counting Bloom Filter. Returns an *
+ * error, leaving the filter unchanged, if the codewords aren't in the filter. Counters *
+ * that have saturated are left as they are, as their true count is unknown            */
+func (filter *CountingBloomFilter) Remove(codewords [][]byte) error {
+
+	// Codewords colliding on a counter decrement it once each, so it must count at least as
+	// many additions as there are collisions, or it would underflow
+	indexPositions := filter.positions(codewords)
+	occurrences := make(map[uint64]int)
+	for _, i := range indexPositions {
+		occurrences[i]++
+	}
+	for i, n := range occurrences {
+		if int(filter.Counters[i]) < n {
+			return errors.New("codewords are not in the filter")
+		}
+	}
+
+	for _, i := range indexPositions {
+		if filter.Counters[i] < MAX_COUNT {
+			filter.Counters[i]--
+		}
+	}
+
+	return nil
+}
+
+/* Check if a set of k codewords is held in the counting Bloom Filter */
+func (filter *CountingBloomFilter) Search(codewords [][]byte) bool {
+
+	for _, i := range filter.positions(codewords) {
+		if filter.Counters[i] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+/* Convert to a plain Bloom Filter with a bit set for each non-zero counter, e.g. to write *
+ * the secure index, which searches identically to the counting filter                   */
+func (filter *CountingBloomFilter) Filter() *BloomFilter {
+
+	plain := New(len(filter.Counters), filter.Variant)
+	plain.Hashes = filter.Hashes
+	for i, count := range filter.Counters {
+		if count > 0 {
+			plain.SetBit(i)
+		}
+	}
+
+	return plain
+}
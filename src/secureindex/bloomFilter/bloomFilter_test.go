@@ -0,0 +1,502 @@
+package bloomFilter
+
+import (
+	"bytes" // Standard packages
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+)
+
+/* Compare floating point results allowing for rounding */
+func near(a float64, b float64) bool {
+	return math.Abs(a-b) < 1e-12
+}
+
+/* Codewords mapping to the given positions, an 8 byte codeword's value being its big-endian value */
+func codewordsAt(positions ...uint64) [][]byte {
+
+	codewords := make([][]byte, 0, 0)
+	for _, p := range positions {
+		codeword := make([]byte, 8)
+		binary.BigEndian.PutUint64(codeword, p)
+		codewords = append(codewords, codeword)
+	}
+
+	return codewords
+}
+
+func TestMatchConfidenceFromPositions(t *testing.T) {
+
+	// Four blocks: the first saturated, the second holding only the codewords' own positions,
+	// the third half full
+	filter := New(4*BLOCK_BITS, STANDARD)
+	for i := 0; i < BLOCK_BITS; i++ {
+		filter.SetBit(i)
+	}
+	for i := 2 * BLOCK_BITS; i < 2*BLOCK_BITS+BLOCK_BITS/2; i++ {
+		filter.SetBit(i)
+	}
+	sparse := codewordsAt(BLOCK_BITS+10, BLOCK_BITS+20, BLOCK_BITS+30)
+	filter.Add(sparse)
+
+	saturated := codewordsAt(10, 20, 30)
+	halfFull := codewordsAt(2*BLOCK_BITS+1, 2*BLOCK_BITS+2, 2*BLOCK_BITS+3)
+	repeated := codewordsAt(BLOCK_BITS+10, BLOCK_BITS+10, BLOCK_BITS+10)
+	unset := codewordsAt(BLOCK_BITS+10, 3*BLOCK_BITS+1, BLOCK_BITS+30)
+
+	tests := []struct {
+		name      string
+		codewords [][]byte
+		chance    float64
+	}{
+		{"positions in a saturated block", saturated, 1},
+		{"positions in a sparse block", sparse, (3.0 / BLOCK_BITS) * (3.0 / BLOCK_BITS) * (3.0 / BLOCK_BITS)},
+		{"positions in a half full block", halfFull, 0.125},
+		{"one distinct position", repeated, 3.0 / BLOCK_BITS},
+		{"a position not set", unset, 1},
+	}
+	for _, test := range tests {
+		chance := filter.ChanceMatch(test.codewords)
+		if !near(chance, test.chance) {
+			t.Errorf("%s: ChanceMatch = %g, want %g", test.name, chance, test.chance)
+		}
+		if confidence := filter.MatchConfidence(test.codewords); confidence != 1-chance {
+			t.Errorf("%s: MatchConfidence = %g, want 1 - ChanceMatch = %g", test.name, confidence, 1-chance)
+		}
+	}
+
+	// Matches in the same filter differ with the positions they hit
+	if filter.MatchConfidence(sparse) <= filter.MatchConfidence(halfFull) || filter.MatchConfidence(halfFull) <= filter.MatchConfidence(saturated) {
+		t.Error("confidence doesn't fall as the matched positions' blocks fill")
+	}
+	if filter.MatchConfidence(repeated) >= filter.MatchConfidence(sparse) {
+		t.Error("a match on one distinct position is as confident as one on three")
+	}
+}
+
+func TestMatchConfidenceShortLastBlock(t *testing.T) {
+
+	// A filter shorter than a block is a single block of its own length
+	filter := New(100, STANDARD)
+	filter.Add(codewordsAt(1, 2, 3, 4, 5))
+	if chance := filter.ChanceMatch(codewordsAt(1, 2)); !near(chance, 0.05*0.05) {
+		t.Errorf("ChanceMatch = %g, want %g", chance, 0.05*0.05)
+	}
+}
+
+/* Random codewords the width of an HMAC-SHA-256 codeword, from a seeded source */
+func randomCodewords(r *rand.Rand, n int) [][]byte {
+
+	codewords := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		codeword := make([]byte, 32)
+		r.Read(codeword)
+		codewords = append(codewords, codeword)
+	}
+
+	return codewords
+}
+
+/* Count the pairs of codewords mapping to the same position */
+func collisions(codewords [][]byte, filterSize int) int {
+
+	slots := make(map[uint64]int)
+	pairs := 0
+	for _, position := range findPositions(codewords, filterSize) {
+		pairs += slots[position]
+		slots[position]++
+	}
+
+	return pairs
+}
+
+func TestFindPositionsCollisionRate(t *testing.T) {
+
+	// n codewords in m slots collide in about n^2 / 2m pairs
+	const n, m = 2000, 1000003
+	expected := float64(n) * n / (2 * m)
+
+	r := rand.New(rand.NewSource(251))
+	random := randomCodewords(r, n)
+
+	// Codewords differing only in their last bytes, which a mapping reading a prefix would collide
+	suffixed := randomCodewords(r, n)
+	for _, codeword := range suffixed {
+		copy(codeword, suffixed[0][:24])
+	}
+
+	for name, codewords := range map[string][][]byte{"random": random, "differing only in their last 8 bytes": suffixed} {
+		if got := collisions(codewords, m); float64(got) > 3*expected {
+			t.Errorf("%s codewords: %d colliding pairs in %d slots, expected about %.1f", name, got, m, expected)
+		}
+	}
+}
+
+func TestFalsePositiveRate(t *testing.T) {
+
+	r := rand.New(rand.NewSource(255))
+	for _, fp := range []float64{0.05, 0.01} {
+		k := OptimalHashes(fp)
+		filter := BloomFilter{}
+		filter.Create(k, 500, 1)
+		for i := 0; i < 500; i++ {
+			filter.Add(randomCodewords(r, k))
+		}
+
+		// Probe with codewords never added, counting those falsely reported present
+		const probes = 20000
+		falsePositives := 0
+		for i := 0; i < probes; i++ {
+			if filter.Search(randomCodewords(r, k)) {
+				falsePositives++
+			}
+		}
+		measured := float64(falsePositives) / probes
+
+		estimate := filter.FalsePositiveRate()
+		if math.Abs(estimate-measured) > 0.25*estimate {
+			t.Errorf("fp %g: FalsePositiveRate() = %.4f, measured %.4f", fp, estimate, measured)
+		}
+		if math.Abs(estimate-fp) > 0.5*fp {
+			t.Errorf("fp %g: FalsePositiveRate() = %.4f after Create, far from its target", fp, estimate)
+		}
+		if fill := filter.FillRatio(); math.Abs(fill-0.5) > 0.05 {
+			t.Errorf("fp %g: FillRatio() = %.3f, expected about 0.5 for an optimally sized filter", fp, fill)
+		}
+	}
+
+	// Without a known k any search may match
+	if rate := New(64, STANDARD).FalsePositiveRate(); rate != 1 {
+		t.Errorf("FalsePositiveRate() with unknown k = %g, want 1", rate)
+	}
+}
+
+func TestUnion(t *testing.T) {
+
+	r := rand.New(rand.NewSource(256))
+	for _, variant := range []string{STANDARD, BLOCKED} {
+		first, second := BloomFilter{Variant: variant}, BloomFilter{Variant: variant}
+		first.Create(7, 100, 1.5)
+		second.Create(7, 100, 1.5)
+
+		firstKeywords, secondKeywords := make([][][]byte, 0, 0), make([][][]byte, 0, 0)
+		for i := 0; i < 100; i++ {
+			firstKeywords = append(firstKeywords, randomCodewords(r, 7))
+			secondKeywords = append(secondKeywords, randomCodewords(r, 7))
+			first.Add(firstKeywords[i])
+			second.Add(secondKeywords[i])
+		}
+
+		if err := first.Union(&second); err != nil {
+			t.Fatalf("%s: Union failed: %v", variant, err)
+		}
+		for i := range firstKeywords {
+			if !first.Search(firstKeywords[i]) || !first.Search(secondKeywords[i]) {
+				t.Fatalf("%s: keyword from a source filter not found in the union", variant)
+			}
+		}
+	}
+
+	base := BloomFilter{}
+	base.Create(7, 100, 1.5)
+	longer, otherK, blocked := BloomFilter{}, BloomFilter{}, BloomFilter{Variant: BLOCKED}
+	longer.Create(7, 200, 1.5)
+	otherK.Create(7, 100, 1.5)
+	otherK.Hashes = 8
+	blocked.Create(7, 100, 1.5)
+	blocked.Size, blocked.Bits = base.Size, make([]byte, len(base.Bits))
+
+	tests := []struct {
+		name  string
+		other *BloomFilter
+	}{
+		{"different lengths", &longer},
+		{"different numbers of hashes", &otherK},
+		{"different variants", &blocked},
+	}
+	for _, test := range tests {
+		bits := append([]byte(nil), base.Bits...)
+		if err := base.Union(test.other); err == nil {
+			t.Errorf("Union of filters with %s succeeded", test.name)
+		}
+		if string(bits) != string(base.Bits) {
+			t.Errorf("failed Union of filters with %s changed the filter", test.name)
+		}
+	}
+}
+
+func TestSyncBloomFilterMatchesSerialBuild(t *testing.T) {
+
+	keywords := make([][][]byte, 0, 0)
+	r := rand.New(rand.NewSource(257))
+	for i := 0; i < 1000; i++ {
+		keywords = append(keywords, randomCodewords(r, 7))
+	}
+
+	serial := BloomFilter{}
+	serial.Create(7, len(keywords), 1.5)
+	for _, codewords := range keywords {
+		serial.Add(codewords)
+	}
+
+	// Run with -race to check concurrent additions are synchronised
+	parallel := BloomFilter{}
+	parallel.Create(7, len(keywords), 1.5)
+	filter := NewSync(&parallel)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(keywords); i += 8 {
+				filter.Add(keywords[i])
+				filter.Search(keywords[i])
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if string(filter.Filter().Bits) != string(serial.Bits) {
+		t.Error("parallel build set different bits from a serial build")
+	}
+}
+
+func TestCountingBloomFilter(t *testing.T) {
+
+	r := rand.New(rand.NewSource(254))
+	filter := CountingBloomFilter{}
+	filter.Create(7, 50, 1.5)
+
+	kept, removed := randomCodewords(r, 7), randomCodewords(r, 7)
+	filter.Add(kept)
+	filter.Add(removed)
+	if err := filter.Remove(removed); err != nil {
+		t.Fatalf("removing added codewords failed: %v", err)
+	}
+	if !filter.Search(kept) {
+		t.Error("codewords not removed are no longer found")
+	}
+	if filter.Search(removed) {
+		t.Error("removed codewords are still found")
+	}
+
+	// Removing codewords that aren't held mustn't underflow any counter
+	counters := append([]uint8(nil), filter.Counters...)
+	if err := filter.Remove(removed); err == nil {
+		t.Error("removing codewords not in the filter succeeded")
+	}
+	if string(counters) != string(filter.Counters) {
+		t.Error("failed Remove changed the filter's counters")
+	}
+
+	// Saturated counters stop counting, and are never decremented as their true count is unknown
+	for i := 0; i < MAX_COUNT+10; i++ {
+		filter.Add(kept)
+	}
+	for _, i := range filter.positions(kept) {
+		if filter.Counters[i] != MAX_COUNT {
+			t.Fatalf("counter %d = %d after repeated additions, want %d", i, filter.Counters[i], MAX_COUNT)
+		}
+	}
+	for i := 0; i < MAX_COUNT+20; i++ {
+		if err := filter.Remove(kept); err != nil {
+			t.Fatalf("removing saturated codewords failed: %v", err)
+		}
+	}
+	if !filter.Search(kept) {
+		t.Error("saturated codewords no longer found after removals")
+	}
+
+	// The plain filter written for the index searches as the counting filter does
+	plain := filter.Filter()
+	if plain.Hashes != 7 || !plain.Search(kept) || plain.Search(removed) {
+		t.Error("Filter() doesn't search as the counting filter does")
+	}
+}
+
+func TestCountingBloomFilterCollidingPositions(t *testing.T) {
+
+	filter := CountingBloomFilter{Counters: make([]uint8, 64)}
+
+	// Codewords colliding on a counter count once each, and are removed alike
+	colliding := codewordsAt(5, 5+64, 20)
+	filter.Add(colliding)
+	if filter.Counters[5] != 2 || filter.Counters[20] != 1 {
+		t.Fatalf("counters after adding colliding codewords = %d, %d, want 2, 1", filter.Counters[5], filter.Counters[20])
+	}
+	if err := filter.Remove(colliding); err != nil {
+		t.Fatalf("removing added colliding codewords failed: %v", err)
+	}
+	if filter.Counters[5] != 0 || filter.Counters[20] != 0 {
+		t.Errorf("counters after removing colliding codewords = %d, %d, want 0, 0", filter.Counters[5], filter.Counters[20])
+	}
+
+	// A counter holding one addition can't be decremented twice by codewords colliding on it
+	filter.Add(codewordsAt(3, 40))
+	counters := append([]uint8(nil), filter.Counters...)
+	if err := filter.Remove(codewordsAt(3, 3+64, 40)); err == nil {
+		t.Error("removing codewords colliding on a counter holding one addition succeeded")
+	}
+	if string(counters) != string(filter.Counters) {
+		t.Errorf("failed Remove changed the filter's counters, counter 3 = %d", filter.Counters[3])
+	}
+}
+
+func TestWriteToReadFromKeepsHashes(t *testing.T) {
+
+	r := rand.New(rand.NewSource(253))
+	for _, variant := range []string{STANDARD, BLOCKED} {
+		filter := BloomFilter{Variant: variant}
+		filter.Create(7, 20, 1.5)
+		keyword := randomCodewords(r, 7)
+		filter.Add(keyword)
+
+		// Data following the filter in the stream is left unread
+		var buf bytes.Buffer
+		written, err := filter.WriteTo(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.WriteString("trailing")
+
+		restored := new(BloomFilter)
+		read, err := restored.ReadFrom(&buf)
+		if err != nil {
+			t.Fatalf("%s: ReadFrom failed: %v", variant, err)
+		}
+		if read != written || buf.String() != "trailing" {
+			t.Errorf("%s: ReadFrom read %d bytes, WriteTo wrote %d", variant, read, written)
+		}
+		if restored.Hashes != 7 || restored.Size != filter.Size || restored.Variant != variant || !restored.Search(keyword) {
+			t.Errorf("%s: restored filter (k %d, %d bits, %s) differs from the original", variant, restored.Hashes, restored.Size, restored.Variant)
+		}
+		if restored.FalsePositiveRate() != filter.FalsePositiveRate() {
+			t.Errorf("%s: restored FalsePositiveRate() = %g, want %g", variant, restored.FalsePositiveRate(), filter.FalsePositiveRate())
+		}
+	}
+
+	if _, err := new(BloomFilter).ReadFrom(strings.NewReader("standard and more bytes")); err == nil {
+		t.Error("ReadFrom accepted data not in the binary format")
+	}
+}
+
+func TestUnmarshalBinaryRejectsUnsearchableFilters(t *testing.T) {
+
+	// Headers of filters with the given variant and length, followed by their bits
+	encode := func(variant byte, size uint64) []byte {
+		data := make([]byte, binaryHeader, binaryHeader+int((size+7)/8))
+		copy(data, BINARY_MAGIC)
+		data[4], data[5] = BINARY_VERSION, variant
+		binary.BigEndian.PutUint16(data[6:], 7)
+		binary.BigEndian.PutUint64(data[8:], size)
+		return append(data, make([]byte, (size+7)/8)...)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty standard filter", encode(0, 0)},
+		{"empty blocked filter", encode(1, 0)},
+		{"blocked filter shorter than a block", encode(1, BLOCK_BITS/2)},
+		{"blocked filter of part blocks", encode(1, BLOCK_BITS+8)},
+	}
+	for _, test := range tests {
+		filter := BloomFilter{Size: 8, Bits: []byte{1}}
+		if err := filter.UnmarshalBinary(test.data); err == nil {
+			t.Errorf("UnmarshalBinary accepted a %s", test.name)
+		}
+		if filter.Size != 8 || len(filter.Bits) != 1 {
+			t.Errorf("failed UnmarshalBinary of a %s changed the filter", test.name)
+		}
+		if _, err := new(BloomFilter).ReadFrom(bytes.NewReader(test.data)); err == nil {
+			t.Errorf("ReadFrom accepted a %s", test.name)
+		}
+	}
+
+	for _, data := range [][]byte{encode(0, 1), encode(1, 2*BLOCK_BITS)} {
+		filter := new(BloomFilter)
+		if err := filter.UnmarshalBinary(data); err != nil {
+			t.Errorf("UnmarshalBinary rejected a searchable %s filter of %d bits: %v", filter.Variant, binary.BigEndian.Uint64(data[8:]), err)
+		}
+	}
+
+	// A header claiming a huge filter is refused, or read only as far as the stream holds
+	for _, size := range []uint64{MAX_BITS + 1, MAX_BITS} {
+		data := encode(0, 0)
+		binary.BigEndian.PutUint64(data[8:], size)
+		if _, err := new(BloomFilter).ReadFrom(bytes.NewReader(append(data, 0, 0, 0))); err == nil {
+			t.Errorf("ReadFrom accepted a truncated filter claiming %d bits", size)
+		}
+	}
+}
+
+func TestBlockedFilter(t *testing.T) {
+
+	r := rand.New(rand.NewSource(211))
+	const k, n = 7, 2000
+	filter := BloomFilter{Variant: BLOCKED}
+	filter.Create(k, n, 1)
+	added := make([][][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		codewords := randomCodewords(r, k)
+		filter.Add(codewords)
+		added = append(added, codewords)
+	}
+
+	// Each element's positions fall within one block, and every element added is found
+	for _, codewords := range added {
+		positions := filter.positions(codewords)
+		for _, p := range positions {
+			if p/BLOCK_BITS != positions[0]/BLOCK_BITS {
+				t.Fatalf("positions %v span more than one block", positions)
+			}
+		}
+		if !filter.Search(codewords) {
+			t.Fatal("element added to a blocked filter not found")
+		}
+	}
+
+	// Confining positions to blocks costs a little accuracy, but not much
+	const probes = 20000
+	falsePositives := 0
+	for i := 0; i < probes; i++ {
+		if filter.Search(randomCodewords(r, k)) {
+			falsePositives++
+		}
+	}
+	if measured, target := float64(falsePositives)/probes, math.Pow(0.5, k); measured > 3*target {
+		t.Errorf("blocked filter's false positive rate %.4f, more than 3 times the standard filter's %.4f", measured, target)
+	}
+}
+
+/* Benchmark adding to and searching a large filter of each variant, whose standard *
+ * layout scatters each element's positions across far more memory than the cache  */
+func BenchmarkVariants(b *testing.B) {
+
+	const k, n = 7, 1000000
+	r := rand.New(rand.NewSource(211))
+	elements := make([][][]byte, 0, 1<<16)
+	for i := 0; i < 1<<16; i++ {
+		elements = append(elements, randomCodewords(r, k))
+	}
+
+	for _, variant := range []string{STANDARD, BLOCKED} {
+		filter := BloomFilter{Variant: variant}
+		filter.Create(k, n, 1)
+
+		b.Run(variant+"/Add", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				filter.Add(elements[i%len(elements)])
+			}
+		})
+		b.Run(variant+"/Search", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				filter.Search(elements[i%len(elements)])
+			}
+		})
+	}
+}
@@ -6,76 +6,919 @@ package cryptoUtils
  * Source ref: crypto.stanford.edu/~eujin/papers/secureindex/secureindex.pdf     */
 
 import (
-	"crypto/aes" // Standard packages
+	"bufio" // Standard packages
+	"bytes"
+	"context"
+	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"math"
+	"math/bits"
 	"os"
+	"strings"
 
 	"secureindex/bloomFilter" // Bloom Filter package
+	"secureindex/indexMeta"   // Secure index metadata package
+
+	"golang.org/x/crypto/blake2b"          // BLAKE2b package for the alternative HMAC hash
+	"golang.org/x/crypto/chacha20poly1305" // ChaCha20-Poly1305 package for the alternative file cipher
+	"golang.org/x/crypto/scrypt"           // Scrypt package for deriving keys from passphrases
 )
 
-/* Error handling */
-func errorCheck(msg string, err error) {
+/* Declare custom structure for components of secure indexes */
+type SecureIndex struct {
+	Trapdoors [][]byte
+	Codewords [][]byte
+	Index     *bloomFilter.BloomFilter
+	Meta      *indexMeta.Metadata
+	Hash      HMACHash // Hash function for the index's trapdoors and codewords, HMAC_SHA256 if empty
+}
+
+/* Serialise the secure index's metadata and Bloom Filter to bytes. Trapdoors and  *
+ * codewords are transient and sensitive, so they are never included.             */
+func (si *SecureIndex) MarshalBinary() ([]byte, error) {
+
+	if si.Index == nil {
+		return nil, errors.New("secure index has no Bloom Filter")
+	}
+
+	// The metadata records the index's hash, so the restored index is searched with it
+	meta := indexMeta.Metadata{}
+	if si.Meta != nil {
+		meta = *si.Meta
+	}
+	if len(si.Hash) > 0 && si.Hash != HMAC_SHA256 {
+		meta.HMAC = string(si.Hash)
+	}
+	metaJSON, err := json.Marshal(&meta)
+	if err != nil {
+		return nil, err
+	}
+
+	// Length prefixed metadata followed by the Bloom Filter
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(metaJSON)))
+	buf.Write(metaJSON)
+	if _, err := si.Index.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+/* Restore a secure index's metadata and Bloom Filter from bytes written by MarshalBinary */
+func (si *SecureIndex) UnmarshalBinary(data []byte) error {
+
+	r := bytes.NewReader(data)
+
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return err
+	}
+	if int64(length) > int64(r.Len()) {
+		return errors.New("secure index metadata is truncated")
+	}
+
+	metaJSON := make([]byte, length)
+	if _, err := io.ReadFull(r, metaJSON); err != nil {
+		return err
+	}
+	meta := new(indexMeta.Metadata)
+	if err := json.Unmarshal(metaJSON, meta); err != nil {
+		return err
+	}
+	hashFunc, err := ParseHMACHash(meta.HMAC)
+	if err != nil {
+		return err
+	}
+
+	filter := new(bloomFilter.BloomFilter)
+	if _, err := filter.ReadFrom(r); err != nil {
+		return err
+	}
+
+	si.Trapdoors = make([][]byte, 0, 0)
+	si.Codewords = make([][]byte, 0, 0)
+	si.Index = filter
+	si.Meta = meta
+	si.Hash = hashFunc
+
+	return nil
+}
+
+/* Encrypted files are streamed as a sequence of independently sealed chunks, so files of   *
+ * any size are encrypted and decrypted without being held in memory. The format is a header *
+ * of the magic "SIEF", a version byte, a cipher byte (0 AES-GCM, 1 ChaCha20-Poly1305, 2     *
+ * AES-CTR with HMAC-SHA-256), the key size in bytes (16 or 32), the chunk size as a         *
+ * big-endian uint32 and a random 7 byte nonce prefix, followed by                          *
+ * frames of a big-endian uint32 length and a sealed chunk. Each chunk's nonce is the prefix, *
+ * the chunk's counter as a big-endian uint32 and a byte set to 1 only for the final chunk,  *
+ * and the header is sealed with every chunk as additional data, so reordered, truncated or  *
+ * extended files fail to decrypt. Any associated data the file is bound to (the build binds *
+ * documents to the UTF-8 bytes of the identifier their secure index's codewords are built  *
+ * from, i.e. the file name or -stableid document ID) is appended to the header to form the  *
+ * additional data. Version 2 files have no key size byte and use 32 byte keys, version 1    *
+ * files have no cipher byte either and use AES-256-GCM                                     */
+const (
+	CHUNK_SIZE     = 64 * 1024 // Plaintext bytes sealed in each chunk
+	STREAM_MAGIC   = "SIEF"    // Marks a streamed encrypted file
+	STREAM_VERSION = 3         // Version of the streamed format written
+	streamHeader   = 18        // Length of the magic, version, cipher, key size, chunk size and nonce prefix
+	streamCounter  = 5         // Nonce bytes taken by a chunk's counter and final flag
+)
+
+/* Authenticated cipher files are encrypted with, recorded in their header */
+type Cipher byte
+
+const (
+	AES_GCM           Cipher = 0 // AES-256 in Galois-Counter Mode, fastest with AES hardware support
+	CHACHA20_POLY1305 Cipher = 1 // ChaCha20-Poly1305, faster and constant time without it
+	AES_CTR_HMAC      Cipher = 2 // AES-256-CTR then HMAC-SHA-256 (encrypt-then-MAC), for interoperability
+)
+
+/* Name of a cipher, as accepted by ParseCipher */
+func (c Cipher) String() string {
+
+	switch c {
+	case AES_GCM:
+		return "aes-gcm"
+	case CHACHA20_POLY1305:
+		return "chacha20-poly1305"
+	case AES_CTR_HMAC:
+		return "aes-ctr-hmac"
+	}
+	return fmt.Sprintf("cipher(%d)", byte(c))
+}
+
+/* Look up a cipher by name */
+func ParseCipher(name string) (Cipher, error) {
+
+	for _, c := range []Cipher{AES_GCM, CHACHA20_POLY1305, AES_CTR_HMAC} {
+		if strings.EqualFold(name, c.String()) {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher %q", name)
+}
+
+/* Create the AEAD for a cipher with a 16 or 32 byte key, ChaCha20-Poly1305 only taking 32 */
+func newAEAD(c Cipher, key []byte) (cipher.AEAD, error) {
+
+	switch c {
+	case AES_GCM:
+		return newGCM(key)
+	case CHACHA20_POLY1305:
+		return chacha20poly1305.New(key)
+	case AES_CTR_HMAC:
+		return newEtM(key)
+	}
+	return nil, fmt.Errorf("unsupported cipher %v", c)
+}
+
+/* Options for encrypting files, the zero value encrypts with AES-256-GCM */
+type EncryptOptions struct {
+	Cipher         Cipher
+	KeySize        int    // Key size in bytes, 16 (e.g. AES-128) or 32 (e.g. AES-256, the default if 0)
+	AssociatedData []byte // Authenticated but not encrypted, decryption must supply the same
+}
+
+/* Options for decrypting files */
+type DecryptOptions struct {
+	AssociatedData []byte // The associated data the file was encrypted with
+}
+
+/* Key size in bytes files are encrypted with, validated against the cipher */
+func (opts EncryptOptions) keySize() (int, error) {
+
+	switch {
+	case opts.KeySize == 0:
+		return 32, nil
+	case opts.KeySize != 16 && opts.KeySize != 32:
+		return 0, fmt.Errorf("key size must be 16 or 32 bytes, got %d", opts.KeySize)
+	case opts.KeySize != 32 && opts.Cipher == CHACHA20_POLY1305:
+		return 0, fmt.Errorf("%v requires a 32 byte key", opts.Cipher)
+	}
+	return opts.KeySize, nil
+}
+
+/* Symmetric file encryption using AES */
+func Encrypt(filepath string, keypath string) error {
+	return EncryptCtx(context.Background(), filepath, keypath)
+}
+
+/* Symmetric file encryption using AES, abandoned if ctx is cancelled. Files are streamed *
+ * in chunks with ctx checked between them, and any partially written output removed     */
+func EncryptCtx(ctx context.Context, filepath string, keypath string) error {
+	return EncryptWithOptions(ctx, filepath, keypath, EncryptOptions{})
+}
+
+/* Symmetric file encryption with a chosen cipher, abandoned if ctx is cancelled */
+func EncryptWithOptions(ctx context.Context, filepath string, keypath string, opts EncryptOptions) error {
+	return EncryptToWithOptions(ctx, filepath, filepath+".encrypted.data", keypath+".encrypted.private", opts)
+}
+
+/* Symmetric file encryption with a chosen cipher, writing the ciphertext and key to the *
+ * given paths (e.g. temporary files to move into place later), abandoned if ctx is     *
+ * cancelled                                                                            */
+func EncryptToWithOptions(ctx context.Context, filepath string, dataPath string, keyPath string, opts EncryptOptions) (err error) {
+
+	// Report cancellation as ctx's own error so callers can compare against it
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}()
+
+	size, err := opts.keySize()
+	if err != nil {
+		return err
+	}
+
+	// Generate random key of the chosen size
+	key, err := GenerateRandomBytes(size)
+	if err != nil {
+		return fmt.Errorf("unable to generate random bytes: %v", err)
+	}
+
+	if err = encryptFile(ctx, filepath, dataPath, key, nil, opts); err != nil {
+		return err
+	}
+
+	// Write key to file, without leaving ciphertext behind that no key can decrypt
+	if err = writeFileCtx(ctx, keyPath, key, 0700); err != nil {
+		os.Remove(dataPath)
+		return fmt.Errorf("unable to write private key: %v", err)
+	}
+
+	return nil
+}
+
+/* Encrypt a file with a key to dataPath, in the streamed format after any preamble *
+ * needed to recover the key                                                       */
+func encryptFile(ctx context.Context, filepath string, dataPath string, key []byte, preamble []byte, opts EncryptOptions) error {
+
+	// Open user's document
+	file, err := os.Open(filepath)
+	if err != nil {
+		return fmt.Errorf("unable to read file for encryption: %v", err)
+	}
+	defer file.Close()
+
+	// Generate new authenticated cipher using key
+	aead, err := newAEAD(opts.Cipher, key)
+	if err != nil {
+		return fmt.Errorf("unable to create %v cipher: %v", opts.Cipher, err)
+	}
+
+	// Populate the nonce prefix once with a cryptographically secure random sequence,
+	// leaving room for each chunk's counter
+	nonce := make([]byte, aead.NonceSize()-streamCounter)
+	if n, err := io.ReadFull(RandReader, nonce); err != nil || n != len(nonce) {
+		return fmt.Errorf("unable to generate a full length nonce: %v", err)
+	}
+
+	// Write cipertext to file
+	err = writeStreamCtx(ctx, dataPath, 0777, func(w io.Writer) error {
+		if _, err := w.Write(preamble); err != nil {
+			return err
+		}
+		return encryptStream(ctx, aead, opts.Cipher, len(key), nonce, opts.AssociatedData, file, w)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to write encrypted file: %v", err)
+	}
+
+	return nil
+}
+
+/* Parameters of the scrypt key derivation protecting files encrypted with a passphrase. *
+ * Memory used is 128 * N * R bytes, so the defaults take 32MB and well under a second  */
+type KDFParams struct {
+	N int // CPU and memory cost, a power of 2
+	R int // Block size
+	P int // Parallelisation
+}
+
+// Key derivation used by EncryptWithPassphrase, recorded in each file so it can be changed freely
+var PassphraseKDF = KDFParams{N: 1 << 15, R: 8, P: 1}
+
+/* Files encrypted with a passphrase are prefixed with the magic "SIEP", log2 of N as a byte, *
+ * R and P as big-endian uint32s and a random salt, followed by the streamed format           */
+const (
+	PASSPHRASE_MAGIC = "SIEP"  // Marks a file encrypted with a passphrase
+	SALT_SIZE        = 16      // Bytes of random salt for each file's key derivation
+	MAX_KDF_MEMORY   = 1 << 30 // Largest key derivation memory a file may ask decryption to use
+	passphraseHeader = 13 + SALT_SIZE
+)
+
+/* Derive a file encryption key of size bytes from a passphrase and salt with scrypt */
+func deriveKey(passphrase string, salt []byte, params KDFParams, size int) ([]byte, error) {
+
+	if params.N < 2 || params.N&(params.N-1) != 0 {
+		return nil, fmt.Errorf("kdf cost %d is not a power of 2", params.N)
+	}
+	if params.R < 1 || params.P < 1 {
+		return nil, errors.New("kdf block size and parallelisation must be positive")
+	}
+	if 128*int64(params.N)*int64(params.R) > MAX_KDF_MEMORY {
+		return nil, errors.New("kdf parameters exceed the memory limit")
+	}
+
+	return scrypt.Key([]byte(passphrase), salt, params.N, params.R, params.P, size)
+}
+
+/* Symmetric file encryption using AES with a key derived from a passphrase, *
+ * so no key file is written. The salt and KDF parameters prefix the output  */
+func EncryptWithPassphrase(filepath string, passphrase string) error {
+	return EncryptWithPassphraseCtx(context.Background(), filepath, passphrase)
+}
+
+/* EncryptWithPassphrase, abandoned if ctx is cancelled */
+func EncryptWithPassphraseCtx(ctx context.Context, filepath string, passphrase string) error {
+	return EncryptWithPassphraseOptions(ctx, filepath, passphrase, EncryptOptions{})
+}
+
+/* EncryptWithPassphrase with a chosen cipher, abandoned if ctx is cancelled */
+func EncryptWithPassphraseOptions(ctx context.Context, filepath string, passphrase string, opts EncryptOptions) (err error) {
+
+	// Report cancellation as ctx's own error so callers can compare against it
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}()
+
+	size, err := opts.keySize()
+	if err != nil {
+		return err
+	}
+
+	salt, err := GenerateRandomBytes(SALT_SIZE)
+	if err != nil {
+		return fmt.Errorf("unable to generate random bytes: %v", err)
+	}
+
+	params := PassphraseKDF
+	key, err := deriveKey(passphrase, salt, params, size)
+	if err != nil {
+		return fmt.Errorf("unable to derive key: %v", err)
+	}
+
+	preamble := make([]byte, passphraseHeader-SALT_SIZE, passphraseHeader)
+	copy(preamble, PASSPHRASE_MAGIC)
+	preamble[4] = byte(bits.Len(uint(params.N)) - 1)
+	binary.BigEndian.PutUint32(preamble[5:9], uint32(params.R))
+	binary.BigEndian.PutUint32(preamble[9:13], uint32(params.P))
+	preamble = append(preamble, salt...)
+
+	return encryptFile(ctx, filepath, filepath+".encrypted.data", key, preamble, opts)
+}
+
+/* Nonce for a streamed chunk, from the file's random prefix, the chunk's counter and whether it's the last */
+func streamNonce(prefix []byte, counter uint32, final bool) []byte {
+
+	nonce := make([]byte, len(prefix)+streamCounter)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[len(prefix):], counter)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+
+	return nonce
+}
+
+/* Seal plaintext read from r to w in the streamed format, chunk by chunk */
+func encryptStream(ctx context.Context, aead cipher.AEAD, c Cipher, keySize int, prefix []byte, associated []byte, r io.Reader, w io.Writer) error {
+
+	header := make([]byte, streamHeader-len(prefix), streamHeader)
+	copy(header, STREAM_MAGIC)
+	header[4] = STREAM_VERSION
+	header[5] = byte(c)
+	header[6] = byte(keySize)
+	binary.BigEndian.PutUint32(header[7:11], CHUNK_SIZE)
+	header = append(header, prefix...)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	additional := append(header, associated...)
+
+	// Read ahead a byte so the final chunk is known, even if the file is a whole number of chunks
+	in := bufio.NewReaderSize(r, CHUNK_SIZE)
+	chunk := make([]byte, CHUNK_SIZE)
+	frame := make([]byte, 4, 4+CHUNK_SIZE+aead.Overhead())
+	for counter := uint32(0); ; counter++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n, err := io.ReadFull(in, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		final := err != nil
+		if !final {
+			if _, err := in.Peek(1); err == io.EOF {
+				final = true
+			} else if err != nil {
+				return err
+			}
+		}
+
+		frame = aead.Seal(frame[:4], streamNonce(prefix, counter, final), chunk[:n], additional)
+		binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+		if _, err := w.Write(frame); err != nil {
+			return err
+		}
+
+		if final {
+			return nil
+		}
+		if counter == math.MaxUint32 {
+			return errors.New("file is too large to encrypt")
+		}
+	}
+}
+
+// Error decrypting a file whose ciphertext, nonce or key has been altered
+var ErrTampered = errors.New("encrypted file failed authentication, it may have been tampered with")
+
+/* Symmetric file decryption of a file encrypted by Encrypt, writing the plaintext to outPath */
+func Decrypt(cipherPath string, keyPath string, outPath string) error {
+	return DecryptCtx(context.Background(), cipherPath, keyPath, outPath)
+}
+
+/* Symmetric file decryption of a file encrypted by Encrypt, abandoned if ctx is cancelled.   *
+ * Streamed files are decrypted chunk by chunk, writing the plaintext to outPath and removing *
+ * any partially written output. Files encrypted whole, before streaming, are still accepted */
+func DecryptCtx(ctx context.Context, cipherPath string, keyPath string, outPath string) error {
+	return DecryptWithOptions(ctx, cipherPath, keyPath, outPath, DecryptOptions{})
+}
+
+/* Symmetric file decryption of a file encrypted with associated data, abandoned if ctx is cancelled */
+func DecryptWithOptions(ctx context.Context, cipherPath string, keyPath string, outPath string, opts DecryptOptions) (err error) {
+
+	// Report cancellation as ctx's own error so callers can compare against it
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}()
+
+	key, err := readFileCtx(ctx, keyPath)
+	if err != nil {
+		return fmt.Errorf("unable to read private key: %v", err)
+	}
+
+	file, err := os.Open(cipherPath)
+	if err != nil {
+		return fmt.Errorf("unable to read encrypted file: %v", err)
+	}
+	defer file.Close()
+
+	in := bufio.NewReaderSize(file, CHUNK_SIZE)
+	if magic, _ := in.Peek(len(STREAM_MAGIC)); string(magic) != STREAM_MAGIC {
+		// Files encrypted whole predate associated data, so can't satisfy a binding
+		if len(opts.AssociatedData) > 0 {
+			return ErrTampered
+		}
+		gcm, err := newGCM(key)
+		if err != nil {
+			return err
+		}
+		return decryptWhole(ctx, gcm, in, outPath)
+	}
+
+	return writeStreamCtx(ctx, outPath, 0600, func(w io.Writer) error {
+		return decryptStream(ctx, key, opts.AssociatedData, in, w)
+	})
+}
+
+/* Symmetric file decryption of a file encrypted by EncryptWithPassphrase, re-deriving *
+ * its key from the passphrase and writing the plaintext to outPath                    */
+func DecryptWithPassphrase(cipherPath string, passphrase string, outPath string) error {
+	return DecryptWithPassphraseCtx(context.Background(), cipherPath, passphrase, outPath)
+}
+
+/* DecryptWithPassphrase, abandoned if ctx is cancelled */
+func DecryptWithPassphraseCtx(ctx context.Context, cipherPath string, passphrase string, outPath string) error {
+	return DecryptWithPassphraseOptions(ctx, cipherPath, passphrase, outPath, DecryptOptions{})
+}
+
+/* DecryptWithPassphrase for a file encrypted with associated data, abandoned if ctx is cancelled */
+func DecryptWithPassphraseOptions(ctx context.Context, cipherPath string, passphrase string, outPath string, opts DecryptOptions) (err error) {
+
+	// Report cancellation as ctx's own error so callers can compare against it
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}()
+
+	file, err := os.Open(cipherPath)
+	if err != nil {
+		return fmt.Errorf("unable to read encrypted file: %v", err)
+	}
+	defer file.Close()
+
+	in := bufio.NewReaderSize(file, CHUNK_SIZE)
+	preamble := make([]byte, passphraseHeader)
+	if _, err := io.ReadFull(in, preamble); err != nil || string(preamble[:4]) != PASSPHRASE_MAGIC {
+		return errors.New("file is not encrypted with a passphrase")
+	}
+	if preamble[4] >= 63 {
+		return errors.New("kdf parameters exceed the memory limit")
+	}
+	params := KDFParams{
+		N: 1 << preamble[4],
+		R: int(binary.BigEndian.Uint32(preamble[5:9])),
+		P: int(binary.BigEndian.Uint32(preamble[9:13])),
+	}
+
+	size, err := streamKeySize(in)
+	if err != nil {
+		return err
+	}
+
+	// A wrong passphrase derives the wrong key, which fails authentication like tampering
+	key, err := deriveKey(passphrase, preamble[13:], params, size)
+	if err != nil {
+		return fmt.Errorf("unable to derive key: %v", err)
+	}
+	return writeStreamCtx(ctx, outPath, 0600, func(w io.Writer) error {
+		return decryptStream(ctx, key, opts.AssociatedData, in, w)
+	})
+}
+
+/* Open chunks read from r in the streamed format with the cipher named in its header, *
+ * writing their plaintext to w                                                         */
+func decryptStream(ctx context.Context, key []byte, associated []byte, r *bufio.Reader, w io.Writer) error {
+
+	header := make([]byte, streamHeader)
+	if _, err := io.ReadFull(r, header[:5]); err != nil {
+		return errors.New("encrypted file is truncated")
+	}
+
+	// Version 2 headers have no key size byte, version 1 headers no cipher byte either
+	c, size, offset := AES_GCM, 32, 7
+	switch header[4] {
+	case 1:
+		header, offset = header[:streamHeader-2], 5
+	case 2:
+		header, offset = header[:streamHeader-1], 6
+	case STREAM_VERSION:
+	default:
+		return fmt.Errorf("unsupported encrypted file version %d", header[4])
+	}
+	if _, err := io.ReadFull(r, header[5:]); err != nil {
+		return errors.New("encrypted file is truncated")
+	}
+	if offset > 5 {
+		c = Cipher(header[5])
+	}
+	if offset > 6 {
+		size = int(header[6])
+	}
+	if len(key) != size {
+		return fmt.Errorf("key is %d bytes, the file was encrypted with a %d byte key", len(key), size)
+	}
+
+	chunkSize := binary.BigEndian.Uint32(header[offset : offset+4])
+	if chunkSize > CHUNK_SIZE {
+		return fmt.Errorf("encrypted file chunk size %d is too large", chunkSize)
+	}
+	prefix := header[offset+4:]
+	additional := append(header, associated...)
+
+	aead, err := newAEAD(c, key)
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, int(chunkSize)+aead.Overhead())
+	plaintext := make([]byte, 0, chunkSize)
+	for counter := uint32(0); ; counter++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var length uint32
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return ErrTampered
+		}
+		if int(length) > len(frame) {
+			return ErrTampered
+		}
+		if _, err := io.ReadFull(r, frame[:length]); err != nil {
+			return ErrTampered
+		}
+
+		// The final chunk must be sealed as final, so trailing or missing chunks are detected
+		_, err := r.Peek(1)
+		final := err == io.EOF
+		if err != nil && !final {
+			return err
+		}
+
+		// GCM's tag fails to verify if anything was altered, reported as ErrTampered
+		plaintext, err = aead.Open(plaintext[:0], streamNonce(prefix, counter, final), frame[:length], additional)
+		if err != nil {
+			return ErrTampered
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			return err
+		}
+
+		if final {
+			return nil
+		}
+	}
+}
+
+/* Key size in bytes a streamed file was encrypted with, read from its header without consuming it */
+func streamKeySize(r *bufio.Reader) (int, error) {
+
+	header, err := r.Peek(7)
+	if err != nil || string(header[:4]) != STREAM_MAGIC {
+		return 0, errors.New("encrypted file is truncated")
+	}
+	if header[4] < 3 {
+		return 32, nil
+	}
+	return int(header[6]), nil
+}
+
+/* Decrypt a file sealed whole by earlier versions, its ciphertext prefixed with its nonce */
+func decryptWhole(ctx context.Context, aead cipher.AEAD, r io.Reader, outPath string) error {
+
+	ciphertext, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("unable to read encrypted file: %v", err)
+	}
+
+	if len(ciphertext) < aead.NonceSize() {
+		return errors.New("encrypted file is truncated")
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// GCM's tag fails to verify if anything was altered, reported as ErrTampered
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return ErrTampered
+	}
+
+	return writeFileCtx(ctx, outPath, plaintext, 0600)
+}
+
+/* Read a file in chunks, checking ctx for cancellation between them */
+func readFileCtx(ctx context.Context, path string) ([]byte, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var data bytes.Buffer
+	chunk := make([]byte, CHUNK_SIZE)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		n, err := file.Read(chunk)
+		data.Write(chunk[:n])
+		if err == io.EOF {
+			return data.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+/* Write a file in chunks, checking ctx for cancellation between them. *
+ * On any error the partially written file is removed                */
+func writeFileCtx(ctx context.Context, path string, data []byte, perm os.FileMode) error {
+
+	return writeStreamCtx(ctx, path, perm, func(w io.Writer) error {
+		for len(data) > 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			n := CHUNK_SIZE
+			if len(data) < n {
+				n = len(data)
+			}
+			if _, err := w.Write(data[:n]); err != nil {
+				return err
+			}
+			data = data[n:]
+		}
+		return nil
+	})
+}
+
+/* Create a file and write it with a function, removing the partially written file on any error */
+func writeStreamCtx(ctx context.Context, path string, perm os.FileMode, write func(w io.Writer) error) (err error) {
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	out := bufio.NewWriterSize(file, CHUNK_SIZE)
+	if err := write(out); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return out.Flush()
+}
+
+/* Prefix identifying data sealed at rest with Seal */
+const SEALED_MAGIC = "SINDEX-SEALED-1\n"
+
+/* Encrypt data at rest under a 32 byte key using AES-GCM, prefixing the magic and nonce */
+func Seal(key []byte, plaintext []byte) ([]byte, error) {
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := GenerateRandomBytes(gcm.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := append([]byte(SEALED_MAGIC), nonce...)
+	return gcm.Seal(sealed, nonce, plaintext, []byte(SEALED_MAGIC)), nil
+}
+
+/* Decrypt and authenticate data sealed at rest with Seal */
+func Open(key []byte, sealed []byte) ([]byte, error) {
+
+	if !IsSealed(sealed) {
+		return nil, errors.New("data is not sealed")
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data := sealed[len(SEALED_MAGIC):]
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("sealed data is truncated")
+	}
+
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(SEALED_MAGIC))
+}
+
+/* Check whether data was sealed at rest with Seal */
+func IsSealed(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(SEALED_MAGIC))
+}
+
+/* Create an AES-GCM cipher from a 16 or 32 byte key, for AES-128 or AES-256 */
+func newGCM(key []byte) (cipher.AEAD, error) {
+
+	if len(key) != 16 && len(key) != 32 {
+		return nil, fmt.Errorf("key must be 16 or 32 bytes, got %d", len(key))
+	}
+
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(c)
+}
+
+/* Encrypt-then-MAC construction of AES-256-CTR and HMAC-SHA-256, as an AEAD so it can seal *
+ * streamed chunks like the other ciphers. Separate encryption and MAC keys are derived from *
+ * the file key as HMAC-SHA-256(key, "secureindex etm enc") and (key, "secureindex etm mac"). *
+ * A chunk's 12 byte nonce followed by a zero block counter is its CTR IV, and its 32 byte   *
+ * tag is HMAC-SHA-256 over the additional data's length as a big-endian uint64, the         *
+ * additional data, the nonce and the ciphertext. Open verifies the tag before decrypting    */
+type etmAEAD struct {
+	block  cipher.Block
+	macKey []byte
+}
+
+/* Create the encrypt-then-MAC AEAD from a 16 or 32 byte key, for AES-128 or AES-256, *
+ * the encryption key being the derived key's first 16 or 32 bytes                    */
+func newEtM(key []byte) (cipher.AEAD, error) {
+
+	if len(key) != 16 && len(key) != 32 {
+		return nil, fmt.Errorf("key must be 16 or 32 bytes, got %d", len(key))
+	}
+
+	block, err := aes.NewCipher(createHMAC(HMAC_SHA256, "secureindex etm enc", key)[:len(key)])
 	if err != nil {
-		fmt.Fprintf(os.Stderr, msg+"\n")
-		os.Exit(1)
+		return nil, err
 	}
+
+	return &etmAEAD{block: block, macKey: createHMAC(HMAC_SHA256, "secureindex etm mac", key)}, nil
 }
 
-/* Declare custom structure for components of secure indexes */
-type SecureIndex struct {
-	Trapdoors [][]byte
-	Codewords [][]byte
-	Index     *bloomFilter.BloomFilter
+func (e *etmAEAD) NonceSize() int {
+	return 12
 }
 
-/* Symmetric file encryption using AES */
-func Encrypt(filepath string, keypath string) {
+func (e *etmAEAD) Overhead() int {
+	return sha256.Size
+}
 
-	// Read user's document
-	plaintext, err := ioutil.ReadFile(filepath)
-	errorCheck("ERROR: unable to read file for encryption.", err)
+/* Tag over the additional data, nonce and ciphertext */
+func (e *etmAEAD) tag(nonce []byte, ciphertext []byte, additionalData []byte) []byte {
 
-	// Generate 32 byte random key
-	key, err := GenerateRandomBytes(32)
-	errorCheck("ERROR: unable to generate random bytes.", err)
+	mac := hmac.New(sha256.New, e.macKey)
+	var length [8]byte
+	binary.BigEndian.PutUint64(length[:], uint64(len(additionalData)))
+	mac.Write(length[:])
+	mac.Write(additionalData)
+	mac.Write(nonce)
+	mac.Write(ciphertext)
 
-	// Generate new AES cipher using key
-	c, err := aes.NewCipher(key)
-	errorCheck("ERROR: unable create new AES cipher.", err)
+	return mac.Sum(nil)
+}
 
-	// Use Galois-Counter Mode (GCM) cipher block
-	gcm, err := cipher.NewGCM(c)
-	errorCheck("ERROR: unable to generate AES-GCM block cipher.", err)
+/* Apply the CTR keystream for a nonce from src to dst */
+func (e *etmAEAD) xor(dst []byte, src []byte, nonce []byte) {
 
-	// Creates a new byte array the size of the nonce
-	nonce, err := GenerateRandomBytes(gcm.NonceSize())
-	errorCheck("ERROR: unable to generate nounce vales.", err)
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, nonce)
+	cipher.NewCTR(e.block, iv).XORKeyStream(dst, src)
+}
+
+func (e *etmAEAD) Seal(dst []byte, nonce []byte, plaintext []byte, additionalData []byte) []byte {
 
-	// Populate nonce with cryptographically secure random sequence
-	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-		fmt.Println("ERROR: unable to populate nounce value.", err)
+	if len(nonce) != e.NonceSize() {
+		panic("cryptoUtils: incorrect nonce length given to encrypt-then-MAC")
 	}
 
-	// Write cipertext to file
-	err = ioutil.WriteFile(filepath+".encrypted.data", gcm.Seal(nonce, nonce, plaintext, nil), 0777)
-	errorCheck("ERROR: unable to write encrypted file.", err)
+	out := append(dst, make([]byte, len(plaintext))...)
+	ciphertext := out[len(dst):]
+	e.xor(ciphertext, plaintext, nonce)
+
+	return append(out, e.tag(nonce, ciphertext, additionalData)...)
+}
+
+func (e *etmAEAD) Open(dst []byte, nonce []byte, ciphertext []byte, additionalData []byte) ([]byte, error) {
+
+	if len(nonce) != e.NonceSize() || len(ciphertext) < e.Overhead() {
+		return nil, ErrTampered
+	}
 
-	// Write key to file
-	err = ioutil.WriteFile(keypath+".encrypted.private", key, 0700)
-	errorCheck("ERROR: unable to write private key.", err)
+	// Release no plaintext unless the tag verifies
+	sealed, tag := ciphertext[:len(ciphertext)-e.Overhead()], ciphertext[len(ciphertext)-e.Overhead():]
+	if !hmac.Equal(tag, e.tag(nonce, sealed, additionalData)) {
+		return nil, ErrTampered
+	}
+
+	out := append(dst, make([]byte, len(sealed))...)
+	e.xor(out[len(dst):], sealed, nonce)
+
+	return out, nil
 }
 
+// Source of randomness for keys, salts, nonces and blinding. Always crypto/rand in production,
+// tests may replace it with a seeded reader to reproduce exact outputs
+var RandReader io.Reader = rand.Reader
+
 /* Function to generate cyptographically secure array of random bytes */
 func GenerateRandomBytes(n int) ([]byte, error) {
 	byteArray := make([]byte, n)
-	_, err := rand.Read(byteArray)
+	_, err := io.ReadFull(RandReader, byteArray)
 
 	if err != nil {
 		return nil, err
@@ -84,28 +927,334 @@ func GenerateRandomBytes(n int) ([]byte, error) {
 	return byteArray, nil
 }
 
-/* Create k 128-bit randomly generated keys */
-func GenerateHashKeys(fp float64) [][]byte {
+/* Number of hash keys generated for a given probability of false positives. Earlier *
+ * versions generated one more key than this, and their keyfiles remain usable as all *
+ * indexes built and searches made with a keyfile use its own count of keys           */
+func NumHashKeys(fp float64) int {
+	return bloomFilter.OptimalHashes(fp)
+}
 
-	// Determine optimal number of k hashes for a bloom fitler
-	// k = -log2(p), where p is the probability of false positives
-	kHashes := math.Round(math.Abs(-(math.Log2(fp))))
+/* Create k 128-bit randomly generated keys */
+func GenerateHashKeys(fp float64) ([][]byte, error) {
 
 	// Create k 128-bit randomly generated keys
 	keys := make([][]byte, 0, 0)
-	for k := 0; k <= int(kHashes); k++ {
+	for k := 0; k < NumHashKeys(fp); k++ {
 		key, err := GenerateRandomBytes(16)
-		errorCheck("ERROR: unable to generate random bytes.", err)
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate random bytes: %v", err)
+		}
 		keys = append(keys, key)
 	}
 
-	return keys
+	return keys, nil
+}
+
+/* Compute a non-secret fingerprint identifying a set of k hash keys, allowing *
+ * builds and indexes to be matched to their keyfile without revealing keys   */
+func KeyFingerprint(keys [][]byte) string {
+
+	h := sha256.New()
+	h.Write([]byte("secureindex key fingerprint"))
+	for _, key := range keys {
+		h.Write([]byte{byte(len(key))})
+		h.Write(key)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+/* Compute a stable identifier for a document from its contents, so its index still *
+ * matches after the document is renamed or moved. The identifier is keyed, so it   *
+ * can't be used to confirm a guess of a document's contents without the keys       */
+func DocumentID(keys [][]byte, content []byte) string {
+
+	h := hmac.New(sha256.New, bytes.Join(keys, nil))
+	h.Write([]byte("secureindex document id"))
+	h.Write(content)
+
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// Prefix of the keyfile header record naming the keys' HMAC hash, absent for SHA-256
+const KEYFILE_HASH_PREFIX = "hmac:"
+
+/* Read a series of k pre-saved hash keys from a (hex encoded CSV) keyfile */
+func ReadKeyFile(filepath string) ([][]byte, error) {
+
+	keys, _, err := ReadKeyFileHash(filepath)
+	return keys, err
+}
+
+/* Read a keyfile's hash keys and the HMAC hash they're used with, given by an optional *
+ * header record "hmac:<hash>". Keyfiles without one are used with SHA-256              */
+func ReadKeyFileHash(filepath string) ([][]byte, HMACHash, error) {
+
+	// Store k private keys in array slice
+	keys := make([][]byte, 0, 0)
+	hashFunc := HMAC_SHA256
+
+	// Read k hash keys from CSV file
+	file, err := os.Open(filepath)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+
+	r := csv.NewReader(file)
+	r.FieldsPerRecord = -1 // The header record has a single field
+
+	for {
+		record, rErr := r.Read()
+		if rErr == io.EOF {
+			break
+		}
+		if rErr != nil {
+			return nil, "", rErr
+		}
+
+		// Header naming the keys' hash
+		if len(record) == 1 && strings.HasPrefix(record[0], KEYFILE_HASH_PREFIX) {
+			parsed, err := ParseHMACHash(strings.TrimPrefix(record[0], KEYFILE_HASH_PREFIX))
+			if err != nil {
+				return nil, "", err
+			}
+			hashFunc = parsed
+			continue
+		}
+
+		for r, _ := range record {
+			key, hErr := hex.DecodeString(record[r])
+			if hErr != nil {
+				return nil, "", hErr
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, hashFunc, nil
+}
+
+/* Write hash keys to a (hex encoded CSV) keyfile, with a header naming their HMAC hash *
+ * unless it's the default SHA-256, so keyfiles remain readable by earlier versions     */
+func WriteKeyFile(filepath string, keys [][]byte, hashFunc HMACHash) error {
+
+	file, err := os.Create(filepath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	if len(hashFunc) > 0 && hashFunc != HMAC_SHA256 {
+		w.Write([]string{KEYFILE_HASH_PREFIX + string(hashFunc)})
+	}
+
+	encoded := make([]string, 0, len(keys))
+	for _, key := range keys {
+		encoded = append(encoded, hex.EncodeToString(key))
+	}
+	w.Write(encoded)
+	w.Flush()
+
+	return w.Error()
+}
+
+// Errors verifying a secure index's signature
+var (
+	ErrUnsigned     = errors.New("secure index is not signed")
+	ErrBadSignature = errors.New("secure index signature is invalid")
+)
+
+/* Read an Ed25519 key for signing secure indexes from a hex encoded file, generating *
+ * a new keypair if the file doesn't exist. The public key, needed by servers to      *
+ * verify indexes, is written alongside it with a ".pub" suffix                       */
+func LoadSigningKey(filepath string) (ed25519.PrivateKey, error) {
+
+	data, err := ioutil.ReadFile(filepath)
+	if os.IsNotExist(err) {
+		public, private, err := ed25519.GenerateKey(RandReader)
+		if err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(filepath, []byte(hex.EncodeToString(private)), 0600); err != nil {
+			return nil, err
+		}
+		return private, ioutil.WriteFile(filepath+".pub", []byte(hex.EncodeToString(public)), 0644)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("%s is not a hex encoded Ed25519 private key", filepath)
+	}
+	return ed25519.PrivateKey(key), nil
+}
+
+/* Read an Ed25519 public key for verifying secure indexes from a hex encoded file */
+func ReadVerifyKey(filepath string) (ed25519.PublicKey, error) {
+
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%s is not a hex encoded Ed25519 public key", filepath)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+/* Sign a secure index's (plaintext) file contents together with its metadata, *
+ * recording the signature in the metadata                                      */
+func SignIndex(key ed25519.PrivateKey, index []byte, meta *indexMeta.Metadata) error {
+
+	digest, err := indexDigest(index, meta)
+	if err != nil {
+		return err
+	}
+
+	meta.Signature = hex.EncodeToString(ed25519.Sign(key, digest))
+	return nil
+}
+
+/* Verify the signature recorded in a secure index's metadata, returning ErrUnsigned *
+ * or ErrBadSignature if the index or its metadata can't be trusted                  */
+func VerifyIndex(key ed25519.PublicKey, index []byte, meta *indexMeta.Metadata) error {
+
+	if meta == nil || len(meta.Signature) == 0 {
+		return ErrUnsigned
+	}
+
+	signature, err := hex.DecodeString(meta.Signature)
+	if err != nil {
+		return ErrBadSignature
+	}
+
+	digest, err := indexDigest(index, meta)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(key, digest, signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+/* Digest of a secure index and its metadata (excluding the signature) for signing */
+func indexDigest(index []byte, meta *indexMeta.Metadata) ([]byte, error) {
+
+	unsigned := *meta
+	unsigned.Signature = ""
+	metaData, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, err
+	}
+
+	// Length-prefix the metadata so it can't be shifted into the index contents
+	h := sha256.New()
+	h.Write([]byte("secureindex index signature"))
+	binary.Write(h, binary.BigEndian, uint64(len(metaData)))
+	h.Write(metaData)
+	h.Write(index)
+
+	return h.Sum(nil), nil
+}
+
+/* Probe a secure index with random terms that were never indexed, returning the *
+ * fraction falsely reported as present (the empirical false positive rate)      */
+func MeasureFalsePositives(filter *bloomFilter.BloomFilter, filename string, keys [][]byte, probes int) (float64, error) {
+	return MeasureFalsePositivesWith(HMAC_SHA256, filter, filename, keys, probes)
+}
+
+/* Measure a secure index's false positive rate, probing with the HMAC hash it was built with */
+func MeasureFalsePositivesWith(hashFunc HMACHash, filter *bloomFilter.BloomFilter, filename string, keys [][]byte, probes int) (float64, error) {
+
+	falsePositives := 0
+	for i := 0; i < probes; i++ {
+		// Random hex terms won't collide with any real keyword extracted from the text
+		term, err := GenerateRandomBytes(16)
+		if err != nil {
+			return 0, err
+		}
+
+		trapdoors := BuildTrapdoorsWith(hashFunc, "calibrate:"+hex.EncodeToString(term), keys)
+		if filter.Search(BuildCodewordsWith(hashFunc, filename, trapdoors)) {
+			falsePositives++
+		}
+	}
+
+	return float64(falsePositives) / float64(probes), nil
+}
+
+/* Hash function the HMACs building trapdoors and codewords use. Longer digests give longer *
+ * codewords, but indexes must be searched with the hash they were built with or searches   *
+ * silently fail to match, so the hash is recorded in keyfiles and index metadata            */
+type HMACHash string
+
+const (
+	HMAC_SHA256  HMACHash = "sha256"  // SHA-256, 32 byte trapdoors and codewords (the default)
+	HMAC_SHA512  HMACHash = "sha512"  // SHA-512, 64 byte trapdoors and codewords
+	HMAC_BLAKE2B HMACHash = "blake2b" // BLAKE2b-512, 64 byte trapdoors and codewords
+)
+
+// Constructors for each supported HMAC hash function
+var hmacHashes = map[HMACHash]func() hash.Hash{
+	HMAC_SHA256: sha256.New,
+	HMAC_SHA512: sha512.New,
+	HMAC_BLAKE2B: func() hash.Hash {
+		h, _ := blake2b.New512(nil) // Only fails for keys over 64 bytes
+		return h
+	},
+}
+
+/* Look up an HMAC hash function by name, an empty name being the default SHA-256 */
+func ParseHMACHash(name string) (HMACHash, error) {
+
+	h := HMACHash(strings.ToLower(name))
+	if len(h) == 0 {
+		return HMAC_SHA256, nil
+	}
+	if _, ok := hmacHashes[h]; !ok {
+		return "", fmt.Errorf("unknown hmac hash %q", name)
+	}
+	return h, nil
+}
+
+/* Name of the HMAC construction, e.g. "HMAC-SHA-256", as recorded in build logs */
+func (h HMACHash) Algorithm() string {
+
+	switch h {
+	case HMAC_SHA512:
+		return "HMAC-SHA-512"
+	case HMAC_BLAKE2B:
+		return "HMAC-BLAKE2b-512"
+	}
+	return "HMAC-SHA-256"
+}
+
+/* Length of the trapdoors and codewords the hash function produces */
+func (h HMACHash) Size() int {
+	return h.new()().Size()
+}
+
+/* Constructor for the hash function, treating an empty (unset) hash as the default */
+func (h HMACHash) new() func() hash.Hash {
+
+	if len(h) == 0 {
+		return sha256.New
+	}
+	return hmacHashes[h]
 }
 
 /* Create and return HMAC for a given trapdoor or codeword */
-func createHMAC(m string, k []byte) []byte {
+func createHMAC(hashFunc HMACHash, m string, k []byte) []byte {
 
-	h := hmac.New(sha256.New, k)
+	h := hmac.New(hashFunc.new(), k)
 	h.Write([]byte(m))
 
 	return h.Sum(nil)
@@ -113,22 +1262,100 @@ func createHMAC(m string, k []byte) []byte {
 
 /* Create trapdoors for a given keyword and k hash keys */
 func BuildTrapdoors(keyword string, keys [][]byte) [][]byte {
+	return BuildTrapdoorsWith(HMAC_SHA256, keyword, keys)
+}
+
+/* Create trapdoors for a given keyword and k hash keys, using a chosen HMAC hash */
+func BuildTrapdoorsWith(hashFunc HMACHash, keyword string, keys [][]byte) [][]byte {
 
 	trapdoors := make([][]byte, 0, 0)
 	for _, key := range keys {
-		trapdoor := createHMAC(keyword, key)
+		trapdoor := createHMAC(hashFunc, keyword, key)
 		trapdoors = append(trapdoors, trapdoor)
 	}
 
 	return trapdoors
 }
 
-/* Create trapdoors for a given keyword and k hash keys */
+/* Create trapdoors for each of a list of keywords and k hash keys */
+func BuildTrapdoorsBatch(keywords []string, keys [][]byte) [][][]byte {
+	return BuildTrapdoorsBatchWith(HMAC_SHA256, keywords, keys)
+}
+
+/* Create trapdoors for each of a list of keywords and k hash keys, using a chosen HMAC *
+ * hash. Trapdoor sets match BuildTrapdoorsWith, but each key's HMAC state is created   *
+ * once and Reset between keywords, and each set shares a single backing array         */
+func BuildTrapdoorsBatchWith(hashFunc HMACHash, keywords []string, keys [][]byte) [][][]byte {
+
+	macs := make([]hash.Hash, 0, len(keys))
+	for _, key := range keys {
+		macs = append(macs, hmac.New(hashFunc.new(), key))
+	}
+
+	size := hashFunc.Size()
+	batch := make([][][]byte, 0, len(keywords))
+	for _, keyword := range keywords {
+		buf := make([]byte, len(keys)*size)
+		trapdoors := make([][]byte, 0, len(keys))
+		for i, mac := range macs {
+			mac.Reset()
+			io.WriteString(mac, keyword)
+			trapdoors = append(trapdoors, mac.Sum(buf[i*size:i*size:(i+1)*size]))
+		}
+		batch = append(batch, trapdoors)
+	}
+
+	return batch
+}
+
+/* Build trapdoors for each of a list of terms using the keys read from a keyfile, *
+ * e.g. to precompute queries offline. Terms are used as given, so callers should  *
+ * normalise them as the index build did (see keywordUtils.NormalizeKeyword)       */
+func BulkTrapdoors(terms []string, keyfile string) (map[string][][]byte, error) {
+
+	keys, hashFunc, err := ReadKeyFileHash(keyfile)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("keyfile contains no keys")
+	}
+
+	trapdoors := make(map[string][][]byte, len(terms))
+	for i, set := range BuildTrapdoorsBatchWith(hashFunc, terms, keys) {
+		trapdoors[terms[i]] = set
+	}
+
+	return trapdoors, nil
+}
+
+/* Read precomputed trapdoors written as JSON by siTrapdoors (see BulkTrapdoors) */
+func ReadTrapdoorFile(filepath string) (map[string][][]byte, error) {
+
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	trapdoors := make(map[string][][]byte)
+	if err := json.Unmarshal(data, &trapdoors); err != nil {
+		return nil, err
+	}
+
+	return trapdoors, nil
+}
+
+/* Create codewords for a given filename and k trapdoors */
 func BuildCodewords(filename string, trapdoors [][]byte) [][]byte {
+	return BuildCodewordsWith(HMAC_SHA256, filename, trapdoors)
+}
+
+/* Create codewords for a given filename and k trapdoors, using a chosen HMAC hash */
+func BuildCodewordsWith(hashFunc HMACHash, filename string, trapdoors [][]byte) [][]byte {
 
 	codewords := make([][]byte, 0, 0)
 	for _, t := range trapdoors {
-		codeword := createHMAC(filename, t)
+		codeword := createHMAC(hashFunc, filename, t)
 		codewords = append(codewords, codeword)
 	}
 
@@ -138,23 +1365,230 @@ func BuildCodewords(filename string, trapdoors [][]byte) [][]byte {
 /* Create trapdoors and codewords for a given keyword, k hash keys and filename */
 func (si *SecureIndex) Build(filename string, keyword string, keys [][]byte) {
 
-	si.Trapdoors = BuildTrapdoors(keyword, keys)
-	si.Codewords = BuildCodewords(filename, si.Trapdoors)
+	si.Trapdoors = BuildTrapdoorsWith(si.Hash, keyword, keys)
+	si.Codewords = BuildCodewordsWith(si.Hash, filename, si.Trapdoors)
 }
 
 /* Perform blinding of index for an IND-CKA secure index */
-func (si *SecureIndex) Blind(numKeywords int, docSize int, numKeys int) {
+func (si *SecureIndex) Blind(numKeywords int, docSize int, numKeys int) error {
+	return si.BlindFrom(RandReader, numKeywords, docSize, numKeys)
+}
+
+/* Perform blinding of index drawing the blinding randomness from a given source */
+func (si *SecureIndex) BlindFrom(source io.Reader, numKeywords int, docSize int, numKeys int) error {
 
 	// Calculate blinding factor
 	b_f := (docSize - numKeywords) * numKeys
 
-	blinding := make([][]byte, 0, 0)
+	// Never blind past the filter's design load, n * s * k positions in m = (n * s * k) / ln(2)
+	// bits, beyond which its false positive rate exceeds the target and it tends to saturate
+	if limit := int(float64(si.Index.Len())*math.Ln2) - numKeywords*numKeys; b_f > limit {
+		b_f = limit
+	}
+	if b_f <= 0 {
+		return nil
+	}
+
+	// Generate b_f random codewords, each the width of a real codeword
+	width := si.Hash.Size()
+	randomBytes := make([]byte, b_f*width)
+	if _, err := io.ReadFull(source, randomBytes); err != nil {
+		return fmt.Errorf("unable to generate random bytes: %v", err)
+	}
+
+	// Put each random codeword into the Bloom Filter on its own, so that each sets its own
+	// position (and in a blocked filter, selects its own block)
+	for i := 0; i < b_f; i++ {
+		si.Index.Add([][]byte{randomBytes[i*width : (i+1)*width]})
+	}
+
+	return nil
+}
+
+/* Keywords retained alongside a secure index so it can be rebuilt under new hash keys. *
+ * Trapdoors are one-way, so an index's keywords can't be recovered from it and without *
+ * this an index can only be rekeyed by extracting its document's keywords again        */
+type KeywordCache struct {
+	DocumentID string   `json:"documentid"` // Identifier the index's codewords are bound to
+	Keywords   []string `json:"keywords"`   // Normalised keywords added to the index
+	Capacity   int      `json:"capacity"`   // Number of keywords the filter was sized for
+	DocSize    int      `json:"docsize"`    // Length of the document's text, which sets the blinding
+	Scale      float64  `json:"scale"`      // Scaling factor the filter was sized with
+}
+
+// File suffix appended to a secure index path to locate its keyword cache
+const KEYWORD_CACHE_SUFFIX = ".keywords"
+
+/* Read a 32 byte key for sealing keyword caches, generating it if the file doesn't exist */
+func LoadKeywordKey(filepath string) ([]byte, error) {
+
+	key, err := ioutil.ReadFile(filepath)
+	if os.IsNotExist(err) {
+		key, err = GenerateRandomBytes(32)
+		if err != nil {
+			return nil, err
+		}
+		return key, ioutil.WriteFile(filepath, key, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key) != 32 {
+		return nil, fmt.Errorf("keyword key %s must be 32 bytes", filepath)
+	}
+	return key, nil
+}
+
+/* Write the keyword cache for the secure index at the given path, sealed under a key */
+func WriteKeywordCache(indexPath string, key []byte, cache *KeywordCache) error {
+
+	sealed, err := SealKeywordCache(key, cache)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(indexPath+KEYWORD_CACHE_SUFFIX, sealed, 0600)
+}
+
+/* Encode and seal a keyword cache under a key, as it is written to file */
+func SealKeywordCache(key []byte, cache *KeywordCache) ([]byte, error) {
+
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return nil, err
+	}
+
+	return Seal(key, data)
+}
+
+/* Read and decrypt the keyword cache for the secure index at the given path */
+func ReadKeywordCache(indexPath string, key []byte) (*KeywordCache, error) {
+
+	sealed, err := ioutil.ReadFile(indexPath + KEYWORD_CACHE_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
+	data, err := Open(key, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt keyword cache: %v", err)
+	}
+
+	cache := new(KeywordCache)
+	if err := json.Unmarshal(data, cache); err != nil {
+		return nil, err
+	}
+	return cache, nil
+}
+
+/* Rebuild a secure index under new hash keys from its keyword cache, replacing its Bloom *
+ * Filter with one of the same variant and sizing. The index must have been built with   *
+ * the old keys, checked against its recorded key fingerprint. Blinding is drawn afresh, *
+ * and any signature is removed as it no longer matches the index                        */
+func RekeyIndex(si *SecureIndex, cache *KeywordCache, oldKeys [][]byte, newKeys [][]byte) error {
+
+	if si.Meta == nil {
+		si.Meta = &indexMeta.Metadata{}
+	}
+	if len(si.Meta.KeyFingerprint) > 0 && si.Meta.KeyFingerprint != KeyFingerprint(oldKeys) {
+		return errors.New("secure index wasn't built with the old keys")
+	}
+
+	variant := si.Meta.Filter
+	if si.Index != nil {
+		variant = si.Index.Variant
+	}
+	if len(variant) == 0 {
+		variant = bloomFilter.STANDARD
+	}
+
+	filter := &bloomFilter.BloomFilter{Variant: variant}
+	filter.Create(len(newKeys), cache.Capacity, cache.Scale)
+	si.Index = filter
+
+	for _, keyword := range cache.Keywords {
+		si.Build(cache.DocumentID, keyword, newKeys)
+		si.Index.Add(si.Codewords)
+	}
+	if err := si.Blind(cache.Capacity, cache.DocSize, len(newKeys)); err != nil {
+		return err
+	}
+
+	si.Meta.Filter = variant
+	si.Meta.KeyFingerprint = KeyFingerprint(newKeys)
+	si.Meta.HMAC = ""
+	if len(si.Hash) > 0 && si.Hash != HMAC_SHA256 {
+		si.Meta.HMAC = string(si.Hash)
+	}
+	si.Meta.Signature = ""
+
+	return nil
+}
+
+/* Deterministic random bit generator based on HMAC-SHA-256 (NIST SP 800-90A HMAC_DRBG, *
+ * without reseeding). Output is reproducible for a given key and seed, but remains    *
+ * indistinguishable from random to an observer without the key.                       */
+type HMACDRBG struct {
+	k []byte
+	v []byte
+}
+
+/* Instantiate a new HMAC_DRBG from a secret key and a (non-secret) seed */
+func NewHMACDRBG(key []byte, seed []byte) *HMACDRBG {
+
+	drbg := &HMACDRBG{make([]byte, sha256.Size), make([]byte, sha256.Size)}
+	for i := range drbg.v {
+		drbg.v[i] = 0x01
+	}
+
+	drbg.update(append(append(make([]byte, 0, len(key)+len(seed)), key...), seed...))
 
-	// Generate slice array of random bytes
-	randomBytes, err := GenerateRandomBytes(b_f)
-	errorCheck("ERROR: unable to generate random bytes.", err)
+	return drbg
+}
+
+/* HMAC_DRBG update function, mixes provided data into the generator's state */
+func (drbg *HMACDRBG) update(data []byte) {
+
+	for _, b := range []byte{0x00, 0x01} {
+		h := hmac.New(sha256.New, drbg.k)
+		h.Write(drbg.v)
+		h.Write([]byte{b})
+		h.Write(data)
+		drbg.k = h.Sum(nil)
+
+		h = hmac.New(sha256.New, drbg.k)
+		h.Write(drbg.v)
+		drbg.v = h.Sum(nil)
+
+		if len(data) == 0 {
+			break
+		}
+	}
+}
+
+/* Fill p with deterministic pseudo-random bytes, implements io.Reader */
+func (drbg *HMACDRBG) Read(p []byte) (int, error) {
+
+	for n := 0; n < len(p); {
+		h := hmac.New(sha256.New, drbg.k)
+		h.Write(drbg.v)
+		drbg.v = h.Sum(nil)
+		n += copy(p[n:], drbg.v)
+	}
+	drbg.update(nil)
+
+	return len(p), nil
+}
+
+/* Create a deterministic blinding source for a document, derived from the k hash keys *
+ * and the document identifier, so identical inputs produce byte-identical indexes     */
+func DeterministicBlinding(keys [][]byte, docID string) io.Reader {
+
+	// Derive a dedicated blinding key so hash keys aren't used directly as DRBG input
+	h := hmac.New(sha256.New, []byte("secureindex blinding"))
+	for _, key := range keys {
+		h.Write(key)
+	}
 
-	// Put random entries into the Bloom Filter
-	blinding = append(blinding, randomBytes)
-	si.Index.Add(blinding)
+	return NewHMACDRBG(h.Sum(nil), []byte(docID))
 }
@@ -0,0 +1,714 @@
+package cryptoUtils
+
+import (
+	"bytes" // Standard packages
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"secureindex/bloomFilter" // Custom packages
+	"secureindex/indexMeta"
+)
+
+/* Build a secure index of keywords for a document with a given HMAC hash */
+func buildIndex(t *testing.T, hashFunc HMACHash, docID string, keywords []string) (*SecureIndex, [][]byte) {
+
+	keys, err := GenerateHashKeys(0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	si := &SecureIndex{Index: &bloomFilter.BloomFilter{}, Meta: &indexMeta.Metadata{Extension: ".txt", DocumentID: docID}, Hash: hashFunc}
+	si.Index.Create(len(keys), len(keywords), 1.5)
+	for _, keyword := range keywords {
+		si.Build(docID, keyword, keys)
+		si.Index.Add(si.Codewords)
+	}
+	if err := si.Blind(len(keywords), 10*len(keywords), len(keys)); err != nil {
+		t.Fatal(err)
+	}
+
+	return si, keys
+}
+
+func TestUnmarshalBinaryRestoresHash(t *testing.T) {
+
+	for _, hashFunc := range []HMACHash{HMAC_SHA256, HMAC_SHA512, HMAC_BLAKE2B} {
+		si, keys := buildIndex(t, hashFunc, "alice.txt", []string{"rabbit", "watch"})
+
+		// The caller's metadata needn't record the hash for it to be serialised
+		si.Meta.HMAC = ""
+		data, err := si.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored := new(SecureIndex)
+		if err := restored.UnmarshalBinary(data); err != nil {
+			t.Fatalf("%s: UnmarshalBinary failed: %v", hashFunc, err)
+		}
+
+		if restored.Hash != hashFunc {
+			t.Errorf("%s: restored index has hash %q", hashFunc, restored.Hash)
+		}
+		trapdoors := BuildTrapdoorsWith(restored.Hash, "rabbit", keys)
+		if !restored.Index.Search(BuildCodewordsWith(restored.Hash, "alice.txt", trapdoors)) {
+			t.Errorf("%s: restored index doesn't match its keyword under its own hash", hashFunc)
+		}
+	}
+
+	// Metadata naming an unknown hash can't be searched correctly, so isn't restored
+	si, _ := buildIndex(t, HMAC_SHA256, "alice.txt", []string{"rabbit"})
+	si.Meta.HMAC = "md5"
+	data, err := si.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := new(SecureIndex).UnmarshalBinary(data); err == nil {
+		t.Error("UnmarshalBinary accepted an unknown hmac hash")
+	}
+}
+
+func TestHMACHashAlgorithm(t *testing.T) {
+
+	tests := map[HMACHash]string{
+		"":           "HMAC-SHA-256",
+		HMAC_SHA256:  "HMAC-SHA-256",
+		HMAC_SHA512:  "HMAC-SHA-512",
+		HMAC_BLAKE2B: "HMAC-BLAKE2b-512",
+	}
+	for hashFunc, want := range tests {
+		if got := hashFunc.Algorithm(); got != want {
+			t.Errorf("HMACHash(%q).Algorithm() = %q, want %q", hashFunc, got, want)
+		}
+	}
+}
+
+func TestMeasureFalsePositivesWith(t *testing.T) {
+
+	// An index under SHA-512 measured with its own hash reports a rate near its target
+	si, keys := buildIndex(t, HMAC_SHA512, "alice.txt", []string{"rabbit", "watch", "waistcoat", "pocket", "sister"})
+	rate, err := MeasureFalsePositivesWith(HMAC_SHA512, si.Index, "alice.txt", keys, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate > 0.05 {
+		t.Errorf("measured false positive rate %.4f, expected about 0.01", rate)
+	}
+}
+
+func TestSecureIndexRoundTrip(t *testing.T) {
+
+	keywords := []string{"rabbit", "watch", "waistcoat", "pocket", "sister", "bank", "daisy-chain"}
+	for _, variant := range []string{bloomFilter.STANDARD, bloomFilter.BLOCKED} {
+		for _, hashFunc := range []HMACHash{HMAC_SHA256, HMAC_SHA512} {
+			keys, err := GenerateHashKeys(0.01)
+			if err != nil {
+				t.Fatal(err)
+			}
+			si := &SecureIndex{Index: &bloomFilter.BloomFilter{Variant: variant}, Meta: &indexMeta.Metadata{Extension: ".txt", Filter: variant, DocumentID: "books/alice.txt"}, Hash: hashFunc}
+			si.Index.Create(len(keys), len(keywords), 1.5)
+			for _, keyword := range keywords {
+				si.Build("books/alice.txt", keyword, keys)
+				si.Index.Add(si.Codewords)
+			}
+
+			data, err := si.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			restored := new(SecureIndex)
+			if err := restored.UnmarshalBinary(data); err != nil {
+				t.Fatalf("%s/%s: UnmarshalBinary failed: %v", variant, hashFunc, err)
+			}
+
+			// Trapdoors and codewords are never serialised
+			if len(restored.Trapdoors) != 0 || len(restored.Codewords) != 0 {
+				t.Errorf("%s/%s: restored index holds trapdoors or codewords", variant, hashFunc)
+			}
+			if restored.Meta.DocumentID != si.Meta.DocumentID || restored.Meta.Extension != ".txt" || restored.Meta.Filter != variant {
+				t.Errorf("%s/%s: restored metadata %+v differs from %+v", variant, hashFunc, *restored.Meta, *si.Meta)
+			}
+			filter := restored.Index
+			if filter.Hashes != len(keys) || filter.Size != si.Index.Size || filter.Variant != variant {
+				t.Errorf("%s/%s: restored filter has k %d, %d bits, variant %q", variant, hashFunc, filter.Hashes, filter.Size, filter.Variant)
+			}
+			if filter.FalsePositiveRate() != si.Index.FalsePositiveRate() {
+				t.Errorf("%s/%s: restored FalsePositiveRate() = %g, want %g", variant, hashFunc, filter.FalsePositiveRate(), si.Index.FalsePositiveRate())
+			}
+
+			// Every original keyword is found searching as a client would, with the restored hash
+			for _, keyword := range keywords {
+				trapdoors := BuildTrapdoorsWith(restored.Hash, keyword, keys)
+				if !filter.Search(BuildCodewordsWith(restored.Hash, restored.Meta.DocumentID, trapdoors)) {
+					t.Errorf("%s/%s: keyword %q not found in the restored index", variant, hashFunc, keyword)
+				}
+			}
+		}
+	}
+
+	if err := new(SecureIndex).UnmarshalBinary([]byte{0, 0, 0, 9, '{'}); err == nil {
+		t.Error("UnmarshalBinary accepted truncated metadata")
+	}
+}
+
+/* Write a document of some plaintext to a temporary directory and encrypt it, returning the *
+ * paths of its encrypted file and key                                                      */
+func encryptDocument(t *testing.T, plaintext []byte, opts EncryptOptions) (string, string) {
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "alice.txt")
+	if err := ioutil.WriteFile(file, plaintext, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := EncryptWithOptions(context.Background(), file, file, opts); err != nil {
+		t.Fatalf("%v: EncryptWithOptions failed: %v", opts.Cipher, err)
+	}
+
+	return file + ".encrypted.data", file + ".encrypted.private"
+}
+
+/* Decrypt an encrypted file, returning its plaintext */
+func decryptDocument(cipherPath string, keyPath string, opts DecryptOptions) ([]byte, error) {
+
+	outPath := filepath.Join(filepath.Dir(cipherPath), "decrypted.txt")
+	if err := DecryptWithOptions(context.Background(), cipherPath, keyPath, outPath, opts); err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadFile(outPath)
+}
+
+func TestBlindRaisesFillRatio(t *testing.T) {
+
+	for _, variant := range []string{bloomFilter.STANDARD, bloomFilter.BLOCKED} {
+		keywords := make([]string, 0, 200)
+		for i := 0; i < 200; i++ {
+			keywords = append(keywords, fmt.Sprintf("keyword%d", i))
+		}
+		keys, err := GenerateHashKeys(0.01)
+		if err != nil {
+			t.Fatal(err)
+		}
+		si := &SecureIndex{Index: &bloomFilter.BloomFilter{Variant: variant}}
+		si.Index.Create(len(keys), len(keywords), 1.5)
+		for _, keyword := range keywords {
+			si.Build("alice.txt", keyword, keys)
+			si.Index.Add(si.Codewords)
+		}
+		before := si.Index.FillRatio()
+
+		// Each of the b_f random codewords sets a position of its own, so the fill rises about
+		// as b_f random positions would raise it (b_f is capped at the filter's design load)
+		if err := si.Blind(len(keywords), 2*len(keywords), len(keys)); err != nil {
+			t.Fatal(err)
+		}
+		after := si.Index.FillRatio()
+		b_f := len(keywords) * len(keys) / 2
+		expected := 1 - (1-before)*math.Exp(-float64(b_f)/float64(si.Index.Len()))
+		if after-before < 0.8*(expected-before) {
+			t.Errorf("%s: Blind raised the fill ratio from %.3f to %.3f, expected about %.3f", variant, before, after, expected)
+		}
+	}
+}
+
+func TestEncryptDecryptRoundTrip(t *testing.T) {
+
+	// Sizes either side of the chunk boundary, including the empty file and whole numbers of chunks
+	sizes := []int{0, 1, CHUNK_SIZE - 1, CHUNK_SIZE, CHUNK_SIZE + 1, 2 * CHUNK_SIZE, 2*CHUNK_SIZE + 17}
+	r := rand.New(rand.NewSource(1))
+	for _, size := range sizes {
+		plaintext := make([]byte, size)
+		r.Read(plaintext)
+
+		cipherPath, keyPath := encryptDocument(t, plaintext, EncryptOptions{})
+		ciphertext, err := ioutil.ReadFile(cipherPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Only plaintexts long enough not to turn up in the ciphertext by chance
+		if size >= 16 && bytes.Contains(ciphertext, plaintext) {
+			t.Errorf("%d bytes: encrypted file contains its plaintext", size)
+		}
+
+		decrypted, err := decryptDocument(cipherPath, keyPath, DecryptOptions{})
+		if err != nil {
+			t.Errorf("%d bytes: Decrypt failed: %v", size, err)
+			continue
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("%d bytes: decrypted %d bytes differing from the plaintext", size, len(decrypted))
+		}
+	}
+}
+
+/* Run fn, sampling the heap in use meanwhile, returning its peak growth in bytes */
+func peakHeapGrowth(fn func()) uint64 {
+
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	base, peak := stats.HeapInuse, stats.HeapInuse
+
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				var stats runtime.MemStats
+				runtime.ReadMemStats(&stats)
+				if stats.HeapInuse > peak {
+					peak = stats.HeapInuse
+				}
+			}
+		}
+	}()
+	fn()
+	close(stop)
+	<-stopped
+
+	if peak < base {
+		return 0
+	}
+	return peak - base
+}
+
+/* Hash a file's contents without reading it all into memory */
+func hashFile(t *testing.T, path string) []byte {
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		t.Fatal(err)
+	}
+
+	return h.Sum(nil)
+}
+
+func TestEncryptDecryptLargeFile(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip("skipping a large file round trip in short mode")
+	}
+
+	// Just over 100MB, so not a whole number of chunks
+	const size = 100<<20 + 12345
+	file := filepath.Join(t.TempDir(), "large.bin")
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.CopyN(f, rand.New(rand.NewSource(260)), size); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := hashFile(t, file)
+
+	// Encrypting and decrypting hold a chunk or so at a time, never the whole file
+	const limit = 32 << 20
+	var encErr, decErr error
+	if growth := peakHeapGrowth(func() {
+		encErr = EncryptWithOptions(context.Background(), file, file, EncryptOptions{})
+	}); growth > limit {
+		t.Errorf("encrypting %d bytes grew the heap by %d bytes", size, growth)
+	}
+	if encErr != nil {
+		t.Fatalf("EncryptWithOptions failed: %v", encErr)
+	}
+	outPath := file + ".decrypted"
+	if growth := peakHeapGrowth(func() {
+		decErr = DecryptWithOptions(context.Background(), file+".encrypted.data", file+".encrypted.private", outPath, DecryptOptions{})
+	}); growth > limit {
+		t.Errorf("decrypting %d bytes grew the heap by %d bytes", size, growth)
+	}
+	if decErr != nil {
+		t.Fatalf("DecryptWithOptions failed: %v", decErr)
+	}
+
+	if !bytes.Equal(hashFile(t, outPath), want) {
+		t.Error("decrypted large file differs from the original")
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+
+	plaintext := bytes.Repeat([]byte("down the rabbit hole "), CHUNK_SIZE/10)
+	cipherPath, keyPath := encryptDocument(t, plaintext, EncryptOptions{})
+	ciphertext, err := ioutil.ReadFile(cipherPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flipping a byte of the nonce prefix, a chunk's ciphertext or the final tag fails authentication
+	for _, offset := range []int{streamHeader - 1, streamHeader + 4 + CHUNK_SIZE/2, len(ciphertext) - 1} {
+		tampered := append([]byte(nil), ciphertext...)
+		tampered[offset] ^= 0x01
+		if err := ioutil.WriteFile(cipherPath, tampered, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := decryptDocument(cipherPath, keyPath, DecryptOptions{}); !errors.Is(err, ErrTampered) {
+			t.Errorf("byte %d flipped: Decrypt returned %v, want ErrTampered", offset, err)
+		}
+	}
+
+	// Dropping the final chunk is detected, as the remaining chunk wasn't sealed as final
+	if err := ioutil.WriteFile(cipherPath, ciphertext[:streamHeader+4+CHUNK_SIZE+16], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decryptDocument(cipherPath, keyPath, DecryptOptions{}); !errors.Is(err, ErrTampered) {
+		t.Errorf("final chunk dropped: Decrypt returned %v, want ErrTampered", err)
+	}
+
+	// A file bound to associated data only decrypts with the same data
+	cipherPath, keyPath = encryptDocument(t, plaintext, EncryptOptions{AssociatedData: []byte("books/alice.txt")})
+	if _, err := decryptDocument(cipherPath, keyPath, DecryptOptions{AssociatedData: []byte("books/alice.txt")}); err != nil {
+		t.Errorf("Decrypt with the file's associated data failed: %v", err)
+	}
+	if _, err := decryptDocument(cipherPath, keyPath, DecryptOptions{AssociatedData: []byte("other/alice.txt")}); !errors.Is(err, ErrTampered) {
+		t.Errorf("Decrypt with other associated data returned %v, want ErrTampered", err)
+	}
+}
+
+func TestEncryptEmptyFile(t *testing.T) {
+
+	// An empty file is still sealed as a single, final, empty chunk so truncation is detected
+	cipherPath, keyPath := encryptDocument(t, nil, EncryptOptions{})
+	ciphertext, err := ioutil.ReadFile(cipherPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ciphertext) != streamHeader+4+16 {
+		t.Errorf("encrypted empty file is %d bytes, want %d", len(ciphertext), streamHeader+4+16)
+	}
+
+	decrypted, err := decryptDocument(cipherPath, keyPath, DecryptOptions{})
+	if err != nil {
+		t.Fatalf("Decrypt of an empty file failed: %v", err)
+	}
+	if len(decrypted) != 0 {
+		t.Errorf("decrypted empty file holds %d bytes", len(decrypted))
+	}
+
+	if err := ioutil.WriteFile(cipherPath, ciphertext[:streamHeader], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decryptDocument(cipherPath, keyPath, DecryptOptions{}); !errors.Is(err, ErrTampered) {
+		t.Errorf("Decrypt of an empty file without its chunk returned %v, want ErrTampered", err)
+	}
+}
+
+/* Replace RandReader with a seeded source for the rest of a test */
+func seedRandReader(t *testing.T, seed int64) {
+
+	saved := RandReader
+	RandReader = rand.New(rand.NewSource(seed))
+	t.Cleanup(func() { RandReader = saved })
+}
+
+func TestGenerateHashKeysCount(t *testing.T) {
+
+	// Earlier versions generated one key more than the filter's optimal number of hashes
+	for _, fp := range []float64{0.1, 0.05, 0.01, 0.001, 0.000001} {
+		keys, err := GenerateHashKeys(fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != NumHashKeys(fp) || len(keys) != bloomFilter.OptimalHashes(fp) {
+			t.Errorf("GenerateHashKeys(%g) made %d keys, want %d", fp, len(keys), NumHashKeys(fp))
+		}
+		seen := make(map[string]bool)
+		for _, key := range keys {
+			if len(key) != 16 || seen[string(key)] {
+				t.Errorf("GenerateHashKeys(%g) made a %d byte or repeated key", fp, len(key))
+			}
+			seen[string(key)] = true
+		}
+	}
+}
+
+func TestCiphersAndKeySizes(t *testing.T) {
+
+	plaintext := bytes.Repeat([]byte("curiouser and curiouser "), CHUNK_SIZE/8)
+	for _, c := range []Cipher{AES_GCM, CHACHA20_POLY1305, AES_CTR_HMAC} {
+		if parsed, err := ParseCipher(c.String()); err != nil || parsed != c {
+			t.Errorf("ParseCipher(%q) = %v, %v", c.String(), parsed, err)
+		}
+
+		for _, size := range []int{0, 16, 32} {
+			if c == CHACHA20_POLY1305 && size == 16 {
+				continue
+			}
+			want := size
+			if want == 0 {
+				want = 32
+			}
+
+			cipherPath, keyPath := encryptDocument(t, plaintext, EncryptOptions{Cipher: c, KeySize: size})
+			key, err := ioutil.ReadFile(keyPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(key) != want {
+				t.Errorf("%v/%d: key is %d bytes, want %d", c, size, len(key), want)
+			}
+
+			// The header records the cipher and key size decryption uses
+			ciphertext, err := ioutil.ReadFile(cipherPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ciphertext[4] != STREAM_VERSION || Cipher(ciphertext[5]) != c || int(ciphertext[6]) != want {
+				t.Errorf("%v/%d: header records version %d, %v, %d byte key", c, size, ciphertext[4], Cipher(ciphertext[5]), ciphertext[6])
+			}
+
+			decrypted, err := decryptDocument(cipherPath, keyPath, DecryptOptions{})
+			if err != nil {
+				t.Errorf("%v/%d: Decrypt failed: %v", c, size, err)
+			} else if !bytes.Equal(decrypted, plaintext) {
+				t.Errorf("%v/%d: decrypted plaintext differs", c, size)
+			}
+		}
+	}
+
+	// Unsupported key sizes, and ChaCha20-Poly1305 with a 16 byte key, are refused
+	for _, opts := range []EncryptOptions{{KeySize: 24}, {KeySize: 8}, {Cipher: CHACHA20_POLY1305, KeySize: 16}} {
+		file := filepath.Join(t.TempDir(), "alice.txt")
+		if err := ioutil.WriteFile(file, plaintext, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := EncryptWithOptions(context.Background(), file, file, opts); err == nil {
+			t.Errorf("%v with a %d byte key was accepted", opts.Cipher, opts.KeySize)
+		}
+	}
+	if _, err := ParseCipher("rot13"); err == nil {
+		t.Error("ParseCipher accepted an unknown cipher")
+	}
+}
+
+func TestStreamNonce(t *testing.T) {
+
+	// With a seeded RandReader the key is drawn first, then the nonce prefix
+	seedRandReader(t, 5)
+	plaintext := bytes.Repeat([]byte("off with her head "), CHUNK_SIZE/4)
+	cipherPath, _ := encryptDocument(t, plaintext, EncryptOptions{})
+	source := rand.New(rand.NewSource(5))
+	key, prefix := make([]byte, 32), make([]byte, 12-streamCounter)
+	source.Read(key)
+	source.Read(prefix)
+
+	ciphertext, err := ioutil.ReadFile(cipherPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ciphertext[streamHeader-len(prefix):streamHeader], prefix) {
+		t.Errorf("header nonce prefix %x, want %x", ciphertext[streamHeader-len(prefix):streamHeader], prefix)
+	}
+	if n := bytes.Count(ciphertext, prefix); n != 1 {
+		t.Errorf("nonce prefix appears %d times in the encrypted file, want once", n)
+	}
+
+	// Each chunk's nonce is the prefix, its counter and whether it's the last
+	if nonce := streamNonce(prefix, 2, false); !bytes.Equal(nonce[:len(prefix)], prefix) || !bytes.Equal(nonce[len(prefix):], []byte{0, 0, 0, 2, 0}) {
+		t.Errorf("streamNonce(prefix, 2, false) = %x", nonce)
+	}
+	if nonce := streamNonce(prefix, 2, true); nonce[len(nonce)-1] != 1 {
+		t.Errorf("streamNonce(prefix, 2, true) = %x, not marked final", nonce)
+	}
+}
+
+func TestRandReaderReproducesOutputs(t *testing.T) {
+
+	// The same seed gives the same keys and blinding, and so byte for byte identical indexes
+	build := func() ([][]byte, []byte) {
+		seedRandReader(t, 7)
+		si, keys := buildIndex(t, HMAC_SHA256, "alice.txt", []string{"rabbit", "watch", "waistcoat"})
+		return keys, si.Index.Bits
+	}
+	keys, bits := build()
+	keysAgain, bitsAgain := build()
+	if KeyFingerprint(keys) != KeyFingerprint(keysAgain) {
+		t.Error("GenerateHashKeys differs with the same seeded RandReader")
+	}
+	if !bytes.Equal(bits, bitsAgain) {
+		t.Error("blinded index differs with the same seeded RandReader")
+	}
+
+	// While another seed gives another index
+	seedRandReader(t, 8)
+	other, _ := buildIndex(t, HMAC_SHA256, "alice.txt", []string{"rabbit", "watch", "waistcoat"})
+	if bytes.Equal(bits, other.Index.Bits) {
+		t.Error("index built with another seed is identical")
+	}
+}
+
+func TestEncryptThenMAC(t *testing.T) {
+
+	aead, err := newEtM(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, additional := make([]byte, aead.NonceSize()), []byte("header")
+	sealed := aead.Seal(nil, nonce, []byte("drink me"), additional)
+	if len(sealed) != len("drink me")+aead.Overhead() {
+		t.Errorf("sealed %d bytes, want %d", len(sealed), len("drink me")+aead.Overhead())
+	}
+	if opened, err := aead.Open(nil, nonce, sealed, additional); err != nil || string(opened) != "drink me" {
+		t.Errorf("Open() = %q, %v", opened, err)
+	}
+
+	// Any change to the ciphertext, tag, nonce or additional data fails the MAC, releasing nothing
+	for i := range sealed {
+		tampered := append([]byte(nil), sealed...)
+		tampered[i] ^= 0x80
+		if opened, err := aead.Open(nil, nonce, tampered, additional); err != ErrTampered || opened != nil {
+			t.Errorf("byte %d flipped: Open() = %q, %v", i, opened, err)
+		}
+	}
+	otherNonce := append([]byte(nil), nonce...)
+	otherNonce[0] = 1
+	if _, err := aead.Open(nil, otherNonce, sealed, additional); err != ErrTampered {
+		t.Errorf("Open with another nonce returned %v", err)
+	}
+	if _, err := aead.Open(nil, nonce, sealed, []byte("headed")); err != ErrTampered {
+		t.Errorf("Open with other additional data returned %v", err)
+	}
+	if _, err := aead.Open(nil, nonce, sealed[:aead.Overhead()-1], additional); err != ErrTampered {
+		t.Errorf("Open of a truncated tag returned %v", err)
+	}
+
+	// A flipped byte of an encrypt-then-MAC file's chunk fails decryption like the AEADs
+	plaintext := bytes.Repeat([]byte("eat me "), CHUNK_SIZE/4)
+	cipherPath, keyPath := encryptDocument(t, plaintext, EncryptOptions{Cipher: AES_CTR_HMAC})
+	ciphertext, err := ioutil.ReadFile(cipherPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte(nil), ciphertext...)
+	tampered[streamHeader+4+100] ^= 0x01
+	if err := ioutil.WriteFile(cipherPath, tampered, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decryptDocument(cipherPath, keyPath, DecryptOptions{}); !errors.Is(err, ErrTampered) {
+		t.Errorf("flipped ciphertext byte: Decrypt returned %v, want ErrTampered", err)
+	}
+}
+
+func TestHeaderSelectsCipher(t *testing.T) {
+
+	// Each cipher's file decrypts by its header alone, and relabelling it as another cipher
+	// fails authentication rather than decrypting under the wrong construction
+	plaintext := []byte("who stole the tarts?")
+	ciphers := []Cipher{AES_GCM, CHACHA20_POLY1305, AES_CTR_HMAC}
+	for _, c := range ciphers {
+		cipherPath, keyPath := encryptDocument(t, plaintext, EncryptOptions{Cipher: c})
+		if decrypted, err := decryptDocument(cipherPath, keyPath, DecryptOptions{}); err != nil || !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("%v: Decrypt() = %q, %v", c, decrypted, err)
+		}
+
+		ciphertext, err := ioutil.ReadFile(cipherPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, other := range ciphers {
+			if other == c {
+				continue
+			}
+			relabelled := append([]byte(nil), ciphertext...)
+			relabelled[5] = byte(other)
+			if err := ioutil.WriteFile(cipherPath, relabelled, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := decryptDocument(cipherPath, keyPath, DecryptOptions{}); !errors.Is(err, ErrTampered) {
+				t.Errorf("%v file relabelled %v: Decrypt returned %v, want ErrTampered", c, other, err)
+			}
+		}
+
+		// An unknown cipher is reported as such
+		relabelled := append([]byte(nil), ciphertext...)
+		relabelled[5] = 9
+		if err := ioutil.WriteFile(cipherPath, relabelled, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := decryptDocument(cipherPath, keyPath, DecryptOptions{}); err == nil || errors.Is(err, ErrTampered) {
+			t.Errorf("%v file relabelled cipher(9): Decrypt returned %v, want an unsupported cipher error", c, err)
+		}
+	}
+}
+
+func TestBuildTrapdoorsBatch(t *testing.T) {
+
+	keys, err := GenerateHashKeys(0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keywords := []string{"rabbit", "watch", "", "rabbit", "queen of hearts"}
+
+	// Each keyword's trapdoors are those built for it alone
+	for _, hashFunc := range []HMACHash{HMAC_SHA256, HMAC_SHA512} {
+		batch := BuildTrapdoorsBatchWith(hashFunc, keywords, keys)
+		if len(batch) != len(keywords) {
+			t.Fatalf("%s: %d trapdoor sets for %d keywords", hashFunc, len(batch), len(keywords))
+		}
+		for i, keyword := range keywords {
+			single := BuildTrapdoorsWith(hashFunc, keyword, keys)
+			if len(batch[i]) != len(single) {
+				t.Errorf("%s: %q has %d trapdoors in a batch, %d alone", hashFunc, keyword, len(batch[i]), len(single))
+				continue
+			}
+			for j := range single {
+				if !bytes.Equal(batch[i][j], single[j]) {
+					t.Errorf("%s: %q trapdoor %d differs in a batch", hashFunc, keyword, j)
+				}
+			}
+		}
+	}
+}
+
+/* Benchmark building trapdoors for dozens of keywords one at a time and in a batch, *
+ * reporting allocations as a batch reuses each key's HMAC state                      */
+func BenchmarkBuildTrapdoors(b *testing.B) {
+
+	keys, err := GenerateHashKeys(0.001)
+	if err != nil {
+		b.Fatal(err)
+	}
+	keywords := make([]string, 0, 50)
+	for i := 0; i < 50; i++ {
+		keywords = append(keywords, fmt.Sprintf("keyword%d", i))
+	}
+
+	b.Run("loop", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, keyword := range keywords {
+				BuildTrapdoors(keyword, keys)
+			}
+		}
+	})
+	b.Run("batch", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			BuildTrapdoorsBatch(keywords, keys)
+		}
+	})
+}
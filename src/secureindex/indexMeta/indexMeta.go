@@ -0,0 +1,59 @@
+package indexMeta
+
+/* Non-secret metadata recorded alongside each secure index, allowing the search server *
+ * to learn about the source document (e.g. its original file type) without decrypting *
+ * it. Metadata is stored as JSON in a sidecar file next to the ".sindex" file.         *
+ * Source ref: crypto.stanford.edu/~eujin/papers/secureindex/secureindex.pdf            */
+
+import (
+	"encoding/json" // Standard packages
+	"io/ioutil"
+)
+
+// File suffix appended to a secure index path to locate its metadata
+const FILE_SUFFIX = ".meta"
+
+/* Declare custom structure for a secure index's metadata */
+type Metadata struct {
+	Extension string `json:"extension"`        // Source document's file extension, e.g. ".pdf"
+	Filter    string `json:"filter,omitempty"` // Bloom Filter variant used to build the index
+
+	KeyFingerprint string `json:"keyfingerprint,omitempty"` // Fingerprint of the keyfile the index was built with
+	DocumentID     string `json:"documentid,omitempty"`     // Identifier codewords are bound to, the document's path relative to the directory indexed (or with -stableid, its contents), the document name if empty
+	HMAC           string `json:"hmac,omitempty"`           // Hash function of the HMACs building trapdoors and codewords, SHA-256 if empty
+	BuildOptions   string `json:"buildoptions,omitempty"`   // Fingerprint of the options the index was built with (normalisation, filter size, etc.), so rebuilds can tell it apart
+
+	Signature string `json:"signature,omitempty"` // Ed25519 signature of the index and the metadata above (hex)
+}
+
+/* Write metadata for the secure index at the given path */
+func Write(indexPath string, meta *Metadata) error {
+
+	data, err := Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(indexPath+FILE_SUFFIX, data, 0644)
+}
+
+/* Encode metadata as it is written to file, for callers writing it themselves */
+func Marshal(meta *Metadata) ([]byte, error) {
+	return json.MarshalIndent(meta, "", "  ")
+}
+
+/* Read metadata for the secure index at the given path */
+func Read(indexPath string) (*Metadata, error) {
+
+	data, err := ioutil.ReadFile(indexPath + FILE_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := new(Metadata)
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
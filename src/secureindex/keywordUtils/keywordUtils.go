@@ -0,0 +1,248 @@
+package keywordUtils
+
+/* Lightweight keyword processing shared by the index build and the search client. Any *
+ * normalisation applied to keywords when building an index must be applied identically *
+ * to query keywords, otherwise their trapdoors (and so their codewords) won't match.   *
+ * Source ref: crypto.stanford.edu/~eujin/papers/secureindex/secureindex.pdf           */
+
+import (
+	"strings" // Standard packages
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/kljensen/snowball/english" // Snowball (Porter2) English stemmer
+	"golang.org/x/text/cases"              // Unicode case folding
+	"golang.org/x/text/unicode/norm"       // Unicode normalisation forms
+)
+
+// Handling of hyphenated and compound keywords, e.g. "state-of-the-art"
+const (
+	HYPHENS_WHOLE = "whole" // Keep hyphenated keywords whole (default)
+	HYPHENS_SPLIT = "split" // Split hyphenated keywords into their parts
+	HYPHENS_BOTH  = "both"  // Keep the whole keyword and also its parts
+)
+
+// Minimum length in characters of a hyphenated keyword's part to be kept as a keyword
+const MIN_PART_LENGTH = 3
+
+// Default keyword length limits in characters, applied to normalised keywords
+const (
+	MIN_LENGTH = 2  // Shortest keyword kept, dropping single characters
+	MAX_LENGTH = 30 // Longest word of a keyword kept, dropping e.g. PDF extraction artefacts
+)
+
+// Joins the words of a multi-word keyword (e.g. a named entity) into one keyword, e.g. "bank_of_england"
+const PHRASE_SEPARATOR = "_"
+
+/* Declare custom structure for keyword normalisation options */
+type Options struct {
+	FoldAccents bool   // Apply NFKD, strip combining marks and casefold, e.g. "Café" -> "cafe"
+	Hyphens     string // Hyphenated keyword handling, HYPHENS_WHOLE if empty
+	Stem        bool   // Reduce each word to its English (Snowball) stem, e.g. "runs" and "running" -> "run"
+	MinLength   int    // Shortest keyword kept, MIN_LENGTH if 0
+	MaxLength   int    // Longest word of a keyword kept (each word of a phrase counts alone), MAX_LENGTH if 0
+}
+
+/* Join the words of a multi-word keyword into a single keyword */
+func JoinPhrase(words []string) string {
+	return strings.Join(words, PHRASE_SEPARATOR)
+}
+
+/* Normalise a keyword for trapdoor generation, used at both build and query time. A *
+ * phrase, quoted or not (e.g. "machine learning"), is joined into a single keyword   */
+func NormalizeKeyword(keyword string, opts Options) string {
+
+	keyword = JoinPhrase(strings.Fields(strings.Trim(strings.TrimSpace(keyword), `"“”`)))
+
+	// Accent- and case-insensitive form, otherwise lowercasing in composed (NFC) form
+	if opts.FoldAccents {
+		keyword = cases.Fold().String(stripMarks(keyword))
+	} else {
+		keyword = NormalizeText(strings.ToLower(keyword))
+	}
+
+	// Stems aren't stable when stemmed again, so keywords must only be normalised once
+	if opts.Stem {
+		keyword = stemWords(keyword)
+	}
+
+	return keyword
+}
+
+/* Compose text (NFC) so precomposed and combining forms of a character, e.g. "é" and *
+ * "e" + U+0301, match. Accents are kept, folding them is left to NormalizeKeyword    */
+func NormalizeText(text string) string {
+	return norm.NFC.String(text)
+}
+
+/* Check a normalised keyword is within the length limits, so is indexed at build time and *
+ * worth searching for. Phrases and hyphenated keywords are limited by their longest word  */
+func KeepKeyword(keyword string, opts Options) bool {
+
+	minLength, maxLength := MIN_LENGTH, MAX_LENGTH
+	if opts.MinLength > 0 {
+		minLength = opts.MinLength
+	}
+	if opts.MaxLength > 0 {
+		maxLength = opts.MaxLength
+	}
+
+	if utf8.RuneCountInString(keyword) < minLength {
+		return false
+	}
+	for _, word := range strings.FieldsFunc(keyword, func(r rune) bool { return r == '-' || string(r) == PHRASE_SEPARATOR }) {
+		if utf8.RuneCountInString(word) > maxLength {
+			return false
+		}
+	}
+
+	return true
+}
+
+/* Stem each word of a keyword, keeping the hyphens and phrase separators between them */
+func stemWords(keyword string) string {
+
+	var b strings.Builder
+	start := 0
+	for i, r := range keyword {
+		if r == '-' || string(r) == PHRASE_SEPARATOR {
+			b.WriteString(english.Stem(keyword[start:i], false))
+			b.WriteRune(r)
+			start = i + 1
+		}
+	}
+	b.WriteString(english.Stem(keyword[start:], false))
+
+	return b.String()
+}
+
+/* Expand a normalised keyword into the terms indexed for it at build time */
+func IndexTerms(keyword string, opts Options) []string {
+
+	parts := hyphenParts(keyword)
+	if len(parts) == 0 {
+		return []string{keyword}
+	}
+
+	switch opts.Hyphens {
+	case HYPHENS_SPLIT:
+		return parts
+	case HYPHENS_BOTH:
+		return append([]string{keyword}, parts...)
+	default:
+		return []string{keyword}
+	}
+}
+
+/* Expand a normalised query keyword into the terms to search for, agreeing with the *
+ * terms IndexTerms produced at build time. When split, only the parts were indexed *
+ * so a hyphenated keyword is searched for by its parts. Callers search for each    *
+ * part as a term of its own, so a query matching all terms needs every part        */
+func QueryTerms(keyword string, opts Options) []string {
+
+	if opts.Hyphens == HYPHENS_SPLIT {
+		if parts := hyphenParts(keyword); len(parts) > 0 {
+			return parts
+		}
+	}
+
+	return []string{keyword}
+}
+
+/* Split a hyphenated keyword into its parts, dropping parts too short to be useful. *
+ * Returns nil if the keyword isn't hyphenated or has no useful parts               */
+func hyphenParts(keyword string) []string {
+
+	if !strings.Contains(keyword, "-") {
+		return nil
+	}
+
+	parts := make([]string, 0, 0)
+	for _, part := range strings.Split(keyword, "-") {
+		if len([]rune(part)) >= MIN_PART_LENGTH {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return nil
+	}
+
+	return parts
+}
+
+/* Check a hyphenated keyword handling mode is known (empty selects the default) */
+func ValidHyphens(mode string) bool {
+	return mode == "" || mode == HYPHENS_WHOLE || mode == HYPHENS_SPLIT || mode == HYPHENS_BOTH
+}
+
+/* Decompose text (NFKD) and remove combining marks such as accents */
+func stripMarks(s string) string {
+
+	var b strings.Builder
+	for _, r := range norm.NFKD.String(s) {
+		if !unicode.Is(unicode.Mn, r) {
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
+
+// Letters used to generate insertions and substitutions for fuzzy keyword variants
+const VARIANT_ALPHABET = "abcdefghijklmnopqrstuvwxyz"
+
+/* Expand a keyword into all variants within the given edit distance (insertions,   *
+ * deletions, substitutions and adjacent transpositions), the keyword itself first. *
+ * The number of variants grows rapidly, roughly 54n+25 for a distance of one.     */
+func Variants(keyword string, distance int) []string {
+
+	variants := []string{keyword}
+	seen := map[string]bool{keyword: true}
+
+	// Expand the previous round's new variants by one edit, distance times
+	frontier := []string{keyword}
+	for d := 0; d < distance; d++ {
+		next := make([]string, 0, 0)
+		for _, word := range frontier {
+			for _, v := range singleEdits(word) {
+				if !seen[v] {
+					seen[v] = true
+					variants = append(variants, v)
+					next = append(next, v)
+				}
+			}
+		}
+		frontier = next
+	}
+
+	return variants
+}
+
+/* Generate all strings exactly one edit away from a word */
+func singleEdits(word string) []string {
+
+	runes := []rune(word)
+	edits := make([]string, 0, 0)
+
+	for i := 0; i <= len(runes); i++ {
+		left, right := string(runes[:i]), runes[i:]
+
+		// Deletion and adjacent transposition
+		if len(right) > 0 {
+			edits = append(edits, left+string(right[1:]))
+		}
+		if len(right) > 1 {
+			edits = append(edits, left+string(right[1])+string(right[0])+string(right[2:]))
+		}
+
+		for _, c := range VARIANT_ALPHABET {
+			// Substitution and insertion
+			if len(right) > 0 && c != right[0] {
+				edits = append(edits, left+string(c)+string(right[1:]))
+			}
+			edits = append(edits, left+string(c)+string(right))
+		}
+	}
+
+	return edits
+}
@@ -0,0 +1,164 @@
+package keywordUtils
+
+import (
+	"strings" // Standard packages
+	"testing"
+)
+
+/* Terms indexed for a keyword extracted from a document, as the build does */
+func buildTerms(token string, opts Options) []string {
+
+	keyword := NormalizeKeyword(token, opts)
+	if !KeepKeyword(keyword, opts) {
+		return nil
+	}
+
+	return IndexTerms(keyword, opts)
+}
+
+/* Terms searched for a keyword entered by a user, as the search client does */
+func queryTerms(input string, opts Options) []string {
+
+	keyword := NormalizeKeyword(input, opts)
+	if len(keyword) == 0 || !KeepKeyword(keyword, opts) {
+		return nil
+	}
+
+	return QueryTerms(keyword, opts)
+}
+
+/* Check every term searched for a query is among the terms indexed */
+func agree(indexed []string, searched []string) bool {
+
+	if len(searched) == 0 {
+		return false
+	}
+	for _, term := range searched {
+		found := false
+		for _, candidate := range indexed {
+			found = found || candidate == term
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestBuildAndQueryNormalisationAgree(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		token string // As extracted from a document
+		query string // As entered by a user
+		opts  Options
+		match bool
+	}{
+		{"precomposed and combining accents", "Café", "Cafe\u0301", Options{}, true},
+		{"combining and precomposed accents", "cafe\u0301", "CAFÉ", Options{}, true},
+		{"accents kept without folding", "Café", "cafe", Options{}, false},
+		{"folded accents", "Café", "cafe", Options{FoldAccents: true}, true},
+		{"folded combining accents", "Cafe\u0301", "CAFE", Options{FoldAccents: true}, true},
+		{"folded compatibility forms", "ﬁancé", "fiance", Options{FoldAccents: true}, true},
+		{"case folding", "Straße", "STRASSE", Options{FoldAccents: true}, true},
+		{"stemmed plural", "rabbits", "rabbit", Options{Stem: true}, true},
+		{"stemmed verb forms", "running", "runs", Options{Stem: true}, true},
+		{"unstemmed verb forms", "running", "runs", Options{}, false},
+		{"quoted phrase", "machine learning", `"Machine Learning"`, Options{}, true},
+		{"curly quoted phrase", "machine learning", "“machine   learning”", Options{}, true},
+		{"stemmed phrase", "machine learning", `"machines learned"`, Options{Stem: true}, true},
+		{"stemmed accented phrase", "Cafés Parisiens", `"café parisien"`, Options{Stem: true, FoldAccents: true}, true},
+		{"entity phrase", "bank_of_england", "Bank of England", Options{}, true},
+		{"hyphens whole", "state-of-the-art", "State-of-the-Art", Options{}, true},
+		{"hyphens whole, part", "state-of-the-art", "state", Options{}, false},
+		{"hyphens split", "state-of-the-art", "state-of-the-art", Options{Hyphens: HYPHENS_SPLIT}, true},
+		{"hyphens split, part", "state-of-the-art", "art", Options{Hyphens: HYPHENS_SPLIT}, true},
+		{"hyphens both", "state-of-the-art", "state-of-the-art", Options{Hyphens: HYPHENS_BOTH}, true},
+		{"hyphens both, part", "state-of-the-art", "state", Options{Hyphens: HYPHENS_BOTH}, true},
+		{"stemmed hyphen parts", "well-funded", "well-funding", Options{Stem: true}, true},
+		{"stemmed split hyphen parts", "cross-referencing", "referenced", Options{Stem: true, Hyphens: HYPHENS_SPLIT}, true},
+		{"too short", "a", "a", Options{}, false},
+		{"minimum length", "ox", "ox", Options{}, true},
+		{"raised minimum length", "ox", "ox", Options{MinLength: 3}, false},
+		{"too long", strings.Repeat("x", MAX_LENGTH+1), strings.Repeat("x", MAX_LENGTH+1), Options{}, false},
+		{"raised maximum length", strings.Repeat("x", MAX_LENGTH+1), strings.Repeat("x", MAX_LENGTH+1), Options{MaxLength: 40}, true},
+		{"phrase of short words", "machine learning", "machine learning", Options{MaxLength: 8}, true},
+		{"phrase with a long word", "machine learning", "machine learning", Options{MaxLength: 7}, false},
+	}
+
+	for _, test := range tests {
+		indexed, searched := buildTerms(test.token, test.opts), queryTerms(test.query, test.opts)
+		if got := agree(indexed, searched); got != test.match {
+			t.Errorf("%s: indexed %q, searched %q, agree = %v, want %v", test.name, indexed, searched, got, test.match)
+		}
+	}
+}
+
+func TestNormalizeKeyword(t *testing.T) {
+
+	tests := []struct {
+		keyword string
+		opts    Options
+		want    string
+	}{
+		{"Cafe\u0301", Options{}, "café"},
+		{"Café", Options{FoldAccents: true}, "cafe"},
+		{"  Alice  ", Options{}, "alice"},
+		{`"white rabbit"`, Options{}, "white_rabbit"},
+		{"running rabbits", Options{Stem: true}, "run_rabbit"},
+		{"e-mailing", Options{Stem: true}, "e-mail"},
+		{`""`, Options{}, ""},
+	}
+
+	for _, test := range tests {
+		if got := NormalizeKeyword(test.keyword, test.opts); got != test.want {
+			t.Errorf("NormalizeKeyword(%q, %+v) = %q, want %q", test.keyword, test.opts, got, test.want)
+		}
+	}
+
+	// The search client folds keywords as they're entered and again when building the query,
+	// which must give the same keyword as normalising once
+	for _, keyword := range []string{"Café", "Cafe\u0301 Society", "ﬁancé", "state-of-the-art", "running"} {
+		full := Options{FoldAccents: true, Stem: true}
+		if once, twice := NormalizeKeyword(keyword, full), NormalizeKeyword(NormalizeKeyword(keyword, Options{FoldAccents: true}), full); once != twice {
+			t.Errorf("normalising %q once gave %q, folding it first %q", keyword, once, twice)
+		}
+	}
+}
+
+func TestIndexAndQueryTerms(t *testing.T) {
+
+	tests := []struct {
+		keyword string
+		hyphens string
+		index   []string
+		query   []string
+	}{
+		{"rabbit", HYPHENS_SPLIT, []string{"rabbit"}, []string{"rabbit"}},
+		{"state-of-the-art", "", []string{"state-of-the-art"}, []string{"state-of-the-art"}},
+		{"state-of-the-art", HYPHENS_WHOLE, []string{"state-of-the-art"}, []string{"state-of-the-art"}},
+		{"state-of-the-art", HYPHENS_SPLIT, []string{"state", "the", "art"}, []string{"state", "the", "art"}},
+		{"state-of-the-art", HYPHENS_BOTH, []string{"state-of-the-art", "state", "the", "art"}, []string{"state-of-the-art"}},
+		{"x-y", HYPHENS_SPLIT, []string{"x-y"}, []string{"x-y"}}, // No part long enough to keep
+	}
+
+	for _, test := range tests {
+		opts := Options{Hyphens: test.hyphens}
+		if got := IndexTerms(test.keyword, opts); strings.Join(got, ",") != strings.Join(test.index, ",") {
+			t.Errorf("IndexTerms(%q, %q) = %q, want %q", test.keyword, test.hyphens, got, test.index)
+		}
+		if got := QueryTerms(test.keyword, opts); strings.Join(got, ",") != strings.Join(test.query, ",") {
+			t.Errorf("QueryTerms(%q, %q) = %q, want %q", test.keyword, test.hyphens, got, test.query)
+		}
+	}
+
+	for _, mode := range []string{"", HYPHENS_WHOLE, HYPHENS_SPLIT, HYPHENS_BOTH} {
+		if !ValidHyphens(mode) {
+			t.Errorf("ValidHyphens(%q) = false", mode)
+		}
+	}
+	if ValidHyphens("join") {
+		t.Error("ValidHyphens accepted an unknown mode")
+	}
+}
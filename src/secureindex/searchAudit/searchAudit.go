@@ -0,0 +1,86 @@
+package searchAudit
+
+/* Structured audit log of the queries answered by the search server, one JSON object per  *
+ * line. Entries record who searched, when and how much was found, but never the query's   *
+ * trapdoors or the indexes searched, so the log itself leaks nothing about the keywords   *
+ * sought or the documents that didn't match.                                              *
+ * Source ref: crypto.stanford.edu/~eujin/papers/secureindex/secureindex.pdf               */
+
+import (
+	"encoding/json" // Standard packages
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Destination writing the audit log to standard output rather than a file
+const STDOUT = "-"
+
+/* Declare custom structure for the audit record of a single query */
+type Entry struct {
+	Time       string `json:"time"`                 // When the query was answered, RFC 3339 in UTC
+	Client     string `json:"client"`               // Client's network address
+	Identity   string `json:"identity,omitempty"`   // Common name of the client's certificate (mutual TLS)
+	Sets       int    `json:"sets"`                 // Trapdoor sets received, including any dummy sets
+	Scanned    int    `json:"scanned"`              // Secure indexes searched
+	Matches    int    `json:"matches"`              // Documents matched
+	Mismatched int    `json:"mismatched,omitempty"` // Indexes skipped as built with a different number of keys
+	Error      string `json:"error,omitempty"`      // Why the query couldn't be answered, if it failed
+}
+
+/* Declare custom structure for an audit log, safe for concurrent use */
+type Log struct {
+	mu     sync.Mutex
+	writer io.Writer
+	closer io.Closer
+}
+
+/* Open an audit log appending to a file, created if missing, or to standard output */
+func Open(path string) (*Log, error) {
+
+	if path == STDOUT {
+		return &Log{writer: os.Stdout}, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Log{writer: file, closer: file}, nil
+}
+
+/* Create an audit log writing to any writer */
+func New(w io.Writer) *Log {
+	return &Log{writer: w}
+}
+
+/* Record a query, timestamping the entry if it isn't already */
+func (l *Log) Record(entry Entry) error {
+
+	if len(entry.Time) == 0 {
+		entry.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	// Write each entry whole, so concurrent queries' entries never interleave
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, err = l.writer.Write(append(data, '\n'))
+	return err
+}
+
+/* Close the audit log's file, if it has one */
+func (l *Log) Close() error {
+
+	if l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
@@ -0,0 +1,345 @@
+package searchProtocol
+
+/* Message types exchanged between the search client and search server. Queries are *
+ * sent as JSON objects over the TLS connection, one object per search.             *
+ * Source ref: crypto.stanford.edu/~eujin/papers/secureindex/secureindex.pdf        */
+
+import (
+	"bufio" // Standard packages
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Response formats a client can request from the search server
+const (
+	FORMAT_TEXT   = "text"   // Human-readable text terminated by '>' (default)
+	FORMAT_JSON   = "json"   // A single JSON encoded Response per query
+	FORMAT_STREAM = "stream" // Newline-delimited JSON StreamMessages, one per match, ending with End set
+)
+
+// Orderings a client can request for a query's matches
+const SORT_MTIME = "mtime" // Most recently modified documents first (not applied to streamed responses)
+
+// Ways a query's keywords can be combined
+const (
+	MATCH_ANY = "any" // Documents containing any of the keywords (default)
+	MATCH_ALL = "all" // Documents containing every keyword
+)
+
+// Compression schemes that can be negotiated for the messages following a Hello
+const COMPRESSION_GZIP = "gzip"
+
+/* Declare custom structure for the handshake optionally sent as a client's first message.   *
+ * The client offers compression schemes; the server replies with a Hello naming the one    *
+ * it chose (or none). All later messages in both directions then use that compression.    *
+ * The client may also name the response format for the session's queries that don't name  *
+ * their own; the server replies with the format it will use, none meaning FORMAT_TEXT.     */
+type Hello struct {
+	Compression []string `json:"compression,omitempty"`
+	Format      string   `json:"format,omitempty"`
+}
+
+/* Check whether a response format is one the server can reply in */
+func ValidFormat(format string) bool {
+	return format == FORMAT_TEXT || format == FORMAT_JSON || format == FORMAT_STREAM
+}
+
+/* Choose the first compression scheme offered by a Hello that is supported (or none) */
+func (h *Hello) Choose() string {
+
+	for _, scheme := range h.Compression {
+		if scheme == COMPRESSION_GZIP {
+			return scheme
+		}
+	}
+
+	return ""
+}
+
+/* Writer compressing each write and flushing it immediately, so every message is *
+ * delivered to the peer as soon as it is written                                  */
+type compressedWriter struct {
+	gz *gzip.Writer
+}
+
+func (w *compressedWriter) Write(p []byte) (int, error) {
+
+	n, err := w.gz.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	return n, w.gz.Flush()
+}
+
+/* Wrap a connection's writer to gzip compress the messages written to it */
+func NewCompressedWriter(w io.Writer) io.Writer {
+	return &compressedWriter{gz: gzip.NewWriter(w)}
+}
+
+/* Reader decompressing a gzip stream, created lazily on the first read so that *
+ * wrapping a connection doesn't block waiting for the peer's first message     */
+type compressedReader struct {
+	r  *bufio.Reader
+	gz *gzip.Reader
+}
+
+func (r *compressedReader) Read(p []byte) (int, error) {
+
+	if r.gz == nil {
+		// Skip whitespace trailing the last uncompressed JSON message
+		for {
+			b, err := r.r.Peek(1)
+			if err != nil {
+				return 0, err
+			}
+			if b[0] != '\n' && b[0] != '\r' && b[0] != ' ' && b[0] != '\t' {
+				break
+			}
+			r.r.ReadByte()
+		}
+
+		gz, err := gzip.NewReader(r.r)
+		if err != nil {
+			return 0, err
+		}
+		gz.Multistream(false)
+		r.gz = gz
+	}
+
+	return r.gz.Read(p)
+}
+
+/* Wrap a connection's reader to decompress the gzip compressed messages read from it */
+func NewCompressedReader(r io.Reader) io.Reader {
+	return &compressedReader{r: bufio.NewReader(r)}
+}
+
+/* Declare custom structure for the trapdoors of a single keyword. Dummy is encoded as *
+ * 0 or 1 rather than a bool so real and dummy sets serialise to identical lengths.    *
+ * Term numbers the search term the keyword belongs to, a term's fuzzy variants        *
+ * sharing it, so MATCH_ALL queries need any one of them. The parts of a split        *
+ * hyphenated term are numbered as separate terms, so MATCH_ALL queries need them all */
+type TrapdoorSet struct {
+	Dummy     int      `json:"dummy"`
+	Term      int      `json:"term"`
+	Trapdoors [][]byte `json:"trapdoors"`
+}
+
+/* Declare custom structure for a keyword search sent from client to server */
+type Query struct {
+	Keywords []TrapdoorSet `json:"keywords"`
+	Keys     int           `json:"keys,omitempty"`   // Number of hash keys (k) the trapdoors were built with, one trapdoor each
+	Types    []string      `json:"types,omitempty"`  // Restrict search to these document types, e.g. "pdf"
+	Index    string        `json:"index,omitempty"`  // Search only this index file (relative to the index root)
+	Format   string        `json:"format,omitempty"` // Response format, FORMAT_TEXT if empty
+
+	Confidence bool `json:"confidence,omitempty"` // Report each match's approximate confidence
+
+	// Feedback: documents from earlier matches reported as false positives. A query with
+	// feedback and no keywords is a feedback message, answered with an empty Response
+	FalsePositives []string `json:"falsepositives,omitempty"`
+
+	// Handshake: a query carrying a Hello (and no keywords) negotiates the session's options
+	Hello *Hello `json:"hello,omitempty"`
+
+	Sort string `json:"sort,omitempty"` // Order of matches, server's walk order if empty
+
+	Match string `json:"match,omitempty"` // How keywords are combined, MATCH_ANY if empty
+}
+
+/* Declare custom structure for a single document matching a query */
+type Match struct {
+	Name       string  `json:"name"`
+	Confidence float64 `json:"confidence,omitempty"` // Approximate, from the positions matched, see BloomFilter.ChanceMatch (if requested)
+	Modified   string  `json:"modified,omitempty"`   // Document's modification time, RFC 3339 in UTC (if sorted by it)
+	Keywords   int     `json:"keywords,omitempty"`   // Number of the query's search terms matched (if it has several)
+
+	// Codeword positions set in the document's index, summed over the query's search terms
+	// (taking each term's best keyword), out of MaxScore = k * terms. Matches score k for
+	// every term they match, and partially for terms they don't
+	Score    int `json:"score,omitempty"`
+	MaxScore int `json:"maxscore,omitempty"`
+}
+
+/* Sort matches by score, highest first, keeping the server's order for equal scores */
+func SortByScore(matches []Match) {
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Score > matches[j].Score
+	})
+}
+
+/* Sort matches by their documents' modification times, most recent first */
+func SortByModified(matches []Match) {
+
+	// RFC 3339 times in UTC order correctly as strings
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Modified > matches[j].Modified
+	})
+}
+
+/* Declare custom structure for the search server's JSON response to a query */
+type Response struct {
+	Matches []Match `json:"matches"`
+	Scanned int     `json:"scanned"`         // Number of secure indexes searched
+	Error   string  `json:"error,omitempty"` // Set if the query could not be completed
+
+	// Indexes skipped for being built with a different number of hash keys than the query's
+	Mismatched int `json:"mismatched,omitempty"`
+}
+
+/* Declare custom structure for a single message in a streamed response. Each match is *
+ * sent as soon as it is found; the final message has End set and carries the totals  */
+type StreamMessage struct {
+	Match   *Match `json:"match,omitempty"`
+	End     bool   `json:"end,omitempty"`
+	Scanned int    `json:"scanned,omitempty"` // Number of secure indexes searched (final message only)
+	Error   string `json:"error,omitempty"`   // Set if the query could not be completed (final message only)
+
+	Mismatched int `json:"mismatched,omitempty"` // See Response.Mismatched (final message only)
+}
+
+/* Read a streamed response up to its end marker, calling onMatch as each match arrives. *
+ * Returns the complete response assembled from the stream                               */
+func ReadStream(decoder *json.Decoder, onMatch func(Match)) (Response, error) {
+
+	response := Response{Matches: make([]Match, 0, 0)}
+
+	for {
+		var message StreamMessage
+		if err := decoder.Decode(&message); err != nil {
+			return response, err
+		}
+
+		if message.Match != nil {
+			response.Matches = append(response.Matches, *message.Match)
+			if onMatch != nil {
+				onMatch(*message.Match)
+			}
+		}
+
+		if message.End {
+			response.Scanned = message.Scanned
+			response.Error = message.Error
+			response.Mismatched = message.Mismatched
+			return response, nil
+		}
+	}
+}
+
+/* Pad a query with dummy keyword sets up to a fixed number of sets, hiding the real *
+ * keyword count from traffic analysis. Dummies copy the shape of the real sets and  *
+ * are filled from the given random source, so they are indistinguishable in size.  */
+func (q *Query) Pad(size int, random io.Reader) error {
+
+	if len(q.Keywords) == 0 {
+		return errors.New("cannot pad a query without any keyword sets")
+	}
+	template := q.Keywords[0].Trapdoors
+
+	for len(q.Keywords) < size {
+		dummy := TrapdoorSet{Dummy: 1, Trapdoors: make([][]byte, 0, len(template))}
+		for _, t := range template {
+			trapdoor := make([]byte, len(t))
+			if _, err := io.ReadFull(random, trapdoor); err != nil {
+				return err
+			}
+			dummy.Trapdoors = append(dummy.Trapdoors, trapdoor)
+		}
+		q.Keywords = append(q.Keywords, dummy)
+	}
+
+	return nil
+}
+
+/* Number of hash keys (k) the query's trapdoors were built with. Queries from older *
+ * clients don't state it, so it is taken from the first keyword set. Every set must *
+ * hold exactly one trapdoor per key                                                  */
+func (q *Query) KeyCount() (int, error) {
+
+	keys := q.Keys
+	if keys == 0 && len(q.Keywords) > 0 {
+		keys = len(q.Keywords[0].Trapdoors)
+	}
+
+	for _, set := range q.Keywords {
+		if len(set.Trapdoors) != keys {
+			return 0, fmt.Errorf("keyword sets hold %d trapdoors, expected one for each of %d keys", len(set.Trapdoors), keys)
+		}
+	}
+
+	return keys, nil
+}
+
+/* Check whether a query only carries false positive feedback rather than a search */
+func (q *Query) IsFeedback() bool {
+	return len(q.Keywords) == 0 && len(q.FalsePositives) > 0
+}
+
+/* Return the query's real keyword sets, skipping any dummy padding */
+func (q *Query) RealKeywords() []TrapdoorSet {
+
+	keywords := make([]TrapdoorSet, 0, len(q.Keywords))
+	for _, set := range q.Keywords {
+		if set.Dummy == 0 {
+			keywords = append(keywords, set)
+		}
+	}
+
+	return keywords
+}
+
+/* Group the query's real keyword sets by the search term they belong to, in order */
+func (q *Query) Terms() [][]TrapdoorSet {
+
+	terms := make([][]TrapdoorSet, 0, 0)
+	positions := make(map[int]int)
+	for _, set := range q.RealKeywords() {
+		i, ok := positions[set.Term]
+		if !ok {
+			i = len(terms)
+			positions[set.Term] = i
+			terms = append(terms, make([]TrapdoorSet, 0, 1))
+		}
+		terms[i] = append(terms[i], set)
+	}
+
+	return terms
+}
+
+/* Check whether a document must contain every search term to match */
+func (q *Query) MatchAll() bool {
+	return q.Match == MATCH_ALL
+}
+
+/* Normalise a document type into a lowercase file extension with a leading dot */
+func NormaliseType(ext string) string {
+
+	ext = strings.ToLower(strings.TrimSpace(ext))
+	if len(ext) > 0 && !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+
+	return ext
+}
+
+/* Check if a document type passes the query's type filter (no filter accepts all) */
+func (q *Query) AcceptsType(ext string) bool {
+
+	if len(q.Types) == 0 {
+		return true
+	}
+
+	for _, t := range q.Types {
+		if NormaliseType(t) == NormaliseType(ext) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package searchProtocol
+
+import (
+	"bytes" // Standard packages
+	"math/rand"
+	"testing"
+
+	"secureindex/bloomFilter" // Custom packages
+	"secureindex/cryptoUtils"
+)
+
+/* Build a blinded secure index of some keywords for a document, returning its filter and keys */
+func testIndex(t *testing.T, docID string, keywords []string) (*bloomFilter.BloomFilter, [][]byte) {
+
+	keys, err := cryptoUtils.GenerateHashKeys(0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	si := cryptoUtils.SecureIndex{Index: new(bloomFilter.BloomFilter)}
+	si.Index.Create(len(keys), len(keywords), 1.5)
+	for _, keyword := range keywords {
+		si.Build(docID, keyword, keys)
+		si.Index.Add(si.Codewords)
+	}
+	if err := si.BlindFrom(rand.New(rand.NewSource(1)), len(keywords), 4*len(keywords), len(keys)); err != nil {
+		t.Fatal(err)
+	}
+
+	return si.Index, keys
+}
+
+/* Search a filter for a query's terms as the server does, one set of trapdoors per term *
+ * needing all k positions, every term required if all is set                           */
+func matches(filter *bloomFilter.BloomFilter, docID string, terms [][]TrapdoorSet, all bool) bool {
+
+	matched := 0
+	for _, keywords := range terms {
+		found := false
+		for _, set := range keywords {
+			if filter.Search(cryptoUtils.BuildCodewords(docID, set.Trapdoors)) {
+				found = true
+			}
+		}
+		if found {
+			matched++
+		} else if all {
+			return false
+		}
+	}
+
+	return matched > 0
+}
+
+/* Create a query for keywords, each its own search term */
+func testQuery(keys [][]byte, keywords ...string) *Query {
+
+	query := &Query{Keywords: make([]TrapdoorSet, 0, 0)}
+	for i, keyword := range keywords {
+		query.Keywords = append(query.Keywords, TrapdoorSet{Term: i, Trapdoors: cryptoUtils.BuildTrapdoors(keyword, keys)})
+	}
+
+	return query
+}
+
+func TestPadDummiesNeverMatch(t *testing.T) {
+
+	filter, keys := testIndex(t, "alice.txt", []string{"rabbit", "watch", "waistcoat"})
+
+	tests := []struct {
+		keyword string
+		want    bool
+	}{
+		{"rabbit", true},
+		{"hatter", false},
+	}
+	for _, test := range tests {
+		query := testQuery(keys, test.keyword)
+		if err := query.Pad(16, rand.New(rand.NewSource(2))); err != nil {
+			t.Fatal(err)
+		}
+		if len(query.Keywords) != 16 {
+			t.Fatalf("padded query has %d keyword sets, want 16", len(query.Keywords))
+		}
+
+		// Dummies have the shape of the real set so they can't be told apart on the wire
+		for _, set := range query.Keywords[1:] {
+			if set.Dummy != 1 || len(set.Trapdoors) != len(keys) || len(set.Trapdoors[0]) != len(query.Keywords[0].Trapdoors[0]) {
+				t.Fatalf("dummy set %+v doesn't match the real set's shape", set)
+			}
+		}
+
+		if terms := query.Terms(); len(terms) != 1 || len(terms[0]) != 1 {
+			t.Fatalf("Terms() of a padded single keyword query returned %d terms", len(terms))
+		}
+		if got := matches(filter, "alice.txt", query.Terms(), false); got != test.want {
+			t.Errorf("padded query for %q matched = %v, want %v", test.keyword, got, test.want)
+		}
+	}
+
+	// Even a dummy carrying an indexed keyword's trapdoors is never searched
+	query := testQuery(keys, "hatter")
+	query.Keywords = append(query.Keywords, TrapdoorSet{Dummy: 1, Trapdoors: cryptoUtils.BuildTrapdoors("rabbit", keys)})
+	if matches(filter, "alice.txt", query.Terms(), false) {
+		t.Error("a dummy keyword set produced a match")
+	}
+}
+
+func TestPadMatchAllIgnoresDummies(t *testing.T) {
+
+	filter, keys := testIndex(t, "alice.txt", []string{"rabbit", "watch", "waistcoat"})
+
+	query := testQuery(keys, "rabbit", "watch")
+	query.Match = MATCH_ALL
+	if err := query.Pad(8, rand.New(rand.NewSource(3))); err != nil {
+		t.Fatal(err)
+	}
+
+	// A dummy counted as a term would be an unmatched term, failing every MATCH_ALL query
+	if real := query.RealKeywords(); len(real) != 2 {
+		t.Fatalf("RealKeywords() returned %d sets, want 2", len(real))
+	}
+	terms := query.Terms()
+	if len(terms) != 2 {
+		t.Fatalf("Terms() returned %d terms, want 2", len(terms))
+	}
+	for _, term := range terms {
+		for _, set := range term {
+			if set.Dummy != 0 {
+				t.Fatal("Terms() includes a dummy keyword set")
+			}
+		}
+	}
+	if !matches(filter, "alice.txt", terms, query.MatchAll()) {
+		t.Error("padded MATCH_ALL query for indexed keywords didn't match")
+	}
+
+	query = testQuery(keys, "rabbit", "hatter")
+	query.Match = MATCH_ALL
+	if err := query.Pad(8, rand.New(rand.NewSource(3))); err != nil {
+		t.Fatal(err)
+	}
+	if matches(filter, "alice.txt", query.Terms(), query.MatchAll()) {
+		t.Error("padded MATCH_ALL query matched without every keyword indexed")
+	}
+}
+
+func TestPadErrors(t *testing.T) {
+
+	if err := new(Query).Pad(4, rand.New(rand.NewSource(4))); err == nil {
+		t.Error("padding a query without keyword sets succeeded")
+	}
+
+	keys := [][]byte{[]byte("key-one"), []byte("key-two")}
+	query := testQuery(keys, "rabbit")
+	if err := query.Pad(4, bytes.NewReader(make([]byte, 10))); err == nil {
+		t.Error("padding from a short random source succeeded")
+	}
+
+	// Queries already holding at least size sets are left as they are
+	query = testQuery(keys, "rabbit", "watch")
+	if err := query.Pad(1, rand.New(rand.NewSource(4))); err != nil || len(query.Keywords) != 2 {
+		t.Errorf("Pad(1) on a two term query gave %d sets, %v", len(query.Keywords), err)
+	}
+}
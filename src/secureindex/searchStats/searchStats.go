@@ -0,0 +1,98 @@
+package searchStats
+
+/* Concurrency-safe counters of search matches per document, kept by the search server  *
+ * to give operators visibility of index quality over time. Clients can report matches *
+ * they found to be false positives, approximating each index's false positive rate.   *
+ * Source ref: crypto.stanford.edu/~eujin/papers/secureindex/secureindex.pdf            */
+
+import (
+	"encoding/json" // Standard packages
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+/* Declare custom structure for the statistics of a single document */
+type DocumentStats struct {
+	Matches        int     `json:"matches"`        // Queries this document matched
+	FalsePositives int     `json:"falsepositives"` // Matches reported by clients as false positives
+	FirstMatch     string  `json:"firstmatch"`
+	LastMatch      string  `json:"lastmatch"`
+	FalsePositive  float64 `json:"fprate"` // Fraction of matches reported as false positives
+}
+
+/* Declare custom structure for the statistics of all documents, safe for concurrent use */
+type Stats struct {
+	mu        sync.Mutex
+	documents map[string]*DocumentStats
+}
+
+/* Create an empty set of statistics */
+func New() *Stats {
+	return &Stats{documents: make(map[string]*DocumentStats)}
+}
+
+/* Record a query matching a document */
+func (s *Stats) RecordMatch(name string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	doc, ok := s.documents[name]
+	if !ok {
+		doc = &DocumentStats{FirstMatch: now}
+		s.documents[name] = doc
+	}
+	doc.Matches++
+	doc.LastMatch = now
+}
+
+/* Record a client reporting a match on a document as a false positive. Reports for *
+ * documents without unreported matches are ignored, so they can't exceed matches   */
+func (s *Stats) RecordFalsePositive(name string) bool {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc, ok := s.documents[name]
+	if !ok || doc.FalsePositives >= doc.Matches {
+		return false
+	}
+	doc.FalsePositives++
+
+	return true
+}
+
+/* Return a copy of the current statistics for every document */
+func (s *Stats) Snapshot() map[string]DocumentStats {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := make(map[string]DocumentStats, len(s.documents))
+	for name, doc := range s.documents {
+		copied := *doc
+		copied.FalsePositive = float64(doc.FalsePositives) / float64(doc.Matches)
+		snapshot[name] = copied
+	}
+
+	return snapshot
+}
+
+/* Write a snapshot of the statistics to a JSON file, replacing it atomically */
+func (s *Stats) WriteFile(path string) error {
+
+	data, err := json.MarshalIndent(s.Snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,380 @@
+package siclient
+
+/* Client for searching secure indexes held by the search server. Builds trapdoors for *
+ * search terms locally from the user's private keys, sends them to the server over a *
+ * TLS connection and parses the server's response, so other Go programs can search   *
+ * secure indexes without the interactive search client.                              *
+ * Source ref: crypto.stanford.edu/~eujin/papers/secureindex/secureindex.pdf           */
+
+import (
+	"bufio" // Standard packages
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"secureindex/cryptoUtils"    // Cryptographic functions package
+	"secureindex/keywordUtils"   // Keyword normalisation shared with the index build
+	"secureindex/searchProtocol" // Client-server message types
+	"secureindex/tlsProfile"     // TLS security profiles shared with the server
+)
+
+/* Declare custom structure for the options used by a client */
+type Options struct {
+	Keys      [][]byte             // Private hash keys the searched indexes were built with
+	Hash      cryptoUtils.HMACHash // HMAC hash the keys are used with (see cryptoUtils.ReadKeyFileHash), SHA-256 if empty
+	Trapdoors map[string][][]byte  // Precomputed trapdoors by normalised term, used if Keys is empty (see cryptoUtils.BulkTrapdoors)
+
+	TLSProfile   string            // TLS security profile, tlsProfile.INTERMEDIATE if empty
+	Insecure     bool              // Skip verification of the server's certificate (testing only)
+	RootCAs      *x509.CertPool    // Verify the server's certificate against these CAs, the system's if nil
+	ServerName   string            // Host name to verify the server's certificate for (and send for SNI), the address's if empty
+	Certificates []tls.Certificate // Client certificates for servers requiring them (mutual TLS)
+	TLSConfig    *tls.Config       // Overrides the other TLS options if set
+
+	Index       string   // Search only this index file (relative to the server's index root)
+	Types       []string // Restrict searches to these document types, e.g. "pdf"
+	Fuzzy       int      // Also search variants of each term within this edit distance
+	Pad         int      // Pad queries with dummy keyword sets up to this many sets
+	FoldAccents bool     // Accent- and case-insensitive terms (must match the index build)
+	Hyphens     string   // Hyphenated term handling, see keywordUtils (must match the index build)
+	Stem        bool     // Search for the stems of terms (must match the index build)
+	MinLength   int      // Shortest term searched for, see keywordUtils (must match the index build)
+	MaxLength   int      // Longest word of a term searched for, see keywordUtils (must match the index build)
+	Confidence  bool     // Ask the server for each match's approximate confidence
+	Compress    bool     // Negotiate gzip compression of messages with the server
+	Sort        string   // Order of matches, e.g. searchProtocol.SORT_MTIME (server's order if empty)
+	MatchAll    bool     // Match documents containing every term rather than any of them
+}
+
+/* Declare custom structure for the results of a search */
+type Results struct {
+	Matches    []searchProtocol.Match
+	Scanned    int // Number of secure indexes searched
+	Mismatched int // Number of secure indexes skipped for being built with a different number of keys
+}
+
+/* Declare custom error type for searches the server was unable to complete */
+type ServerError struct {
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return "search server: " + e.Message
+}
+
+/* Declare custom error type for a search term with no precomputed trapdoors */
+type MissingTrapdoorsError struct {
+	Term string
+}
+
+func (e *MissingTrapdoorsError) Error() string {
+	return "no precomputed trapdoors for " + e.Term
+}
+
+/* Declare custom structure for a connection to the search server */
+type Client struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	encoder *json.Encoder
+	decoder *json.Decoder
+	opts    Options
+}
+
+/* Connect to the search server at addr ("host:port") over TLS */
+func New(addr string, opts Options) (*Client, error) {
+
+	config := opts.TLSConfig
+	if config == nil {
+		profile := opts.TLSProfile
+		if len(profile) == 0 {
+			profile = tlsProfile.INTERMEDIATE
+		}
+
+		var err error
+		config, err = tlsProfile.Config(profile)
+		if err != nil {
+			return nil, err
+		}
+		config.InsecureSkipVerify = opts.Insecure
+		config.RootCAs = opts.RootCAs
+		config.ServerName = opts.ServerName
+		config.Certificates = opts.Certificates
+	}
+
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := NewFromConn(conn, opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+/* Create a client using an existing connection to the search server, negotiating *
+ * compression with the server if requested                                        */
+func NewFromConn(conn net.Conn, opts Options) (*Client, error) {
+
+	reader := bufio.NewReader(conn)
+	c := &Client{conn: conn, reader: reader, encoder: json.NewEncoder(conn), decoder: json.NewDecoder(reader), opts: opts}
+
+	if opts.Compress {
+		if err := c.negotiateCompression(); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+/* Offer gzip compression to the server, switching to it if the server accepts */
+func (c *Client) negotiateCompression() error {
+
+	hello := searchProtocol.Query{Hello: &searchProtocol.Hello{Compression: []string{searchProtocol.COMPRESSION_GZIP}}}
+	if err := c.encoder.Encode(hello); err != nil {
+		return err
+	}
+
+	var reply searchProtocol.Hello
+	if err := c.decoder.Decode(&reply); err != nil {
+		return err
+	}
+	if reply.Choose() != searchProtocol.COMPRESSION_GZIP {
+		return nil
+	}
+
+	// Continue from any bytes already buffered after the server's reply
+	raw := io.MultiReader(c.decoder.Buffered(), c.reader)
+	c.reader = bufio.NewReader(searchProtocol.NewCompressedReader(raw))
+	c.decoder = json.NewDecoder(c.reader)
+	c.encoder = json.NewEncoder(searchProtocol.NewCompressedWriter(c.conn))
+
+	return nil
+}
+
+/* Replace the private keys used to build trapdoors for subsequent searches */
+func (c *Client) SetKeys(keys [][]byte) {
+	c.opts.Keys = keys
+}
+
+/* Replace the HMAC hash the private hash keys are used with */
+func (c *Client) SetHash(hashFunc cryptoUtils.HMACHash) {
+	c.opts.Hash = hashFunc
+}
+
+/* Replace the document types subsequent searches are restricted to (nil for all) */
+func (c *Client) SetTypes(types []string) {
+
+	c.opts.Types = nil
+	for _, t := range types {
+		if t = searchProtocol.NormaliseType(t); len(t) > 0 {
+			c.opts.Types = append(c.opts.Types, t)
+		}
+	}
+}
+
+/* Build a query for the given terms, matching documents containing any of them, or *
+ * with Options.MatchAll, all of them                                                */
+func (c *Client) Query(terms []string) (*searchProtocol.Query, error) {
+
+	if len(c.opts.Keys) == 0 && c.opts.Trapdoors == nil {
+		return nil, errors.New("no private keys or precomputed trapdoors to search with")
+	}
+
+	query := &searchProtocol.Query{Keywords: make([]searchProtocol.TrapdoorSet, 0, 0), Types: c.opts.Types, Index: c.opts.Index, Confidence: c.opts.Confidence, Sort: c.opts.Sort}
+	if c.opts.MatchAll {
+		query.Match = searchProtocol.MATCH_ALL
+	}
+
+	// Create search trapdoors for each term, plus any fuzzy variants (matched as OR). The
+	// parts of a split hyphenated term are searched for as terms of their own, so with
+	// MatchAll a document must contain every part
+	normalization := keywordUtils.Options{FoldAccents: c.opts.FoldAccents, Hyphens: c.opts.Hyphens, Stem: c.opts.Stem, MinLength: c.opts.MinLength, MaxLength: c.opts.MaxLength}
+	numTerms := 0
+	for _, term := range terms {
+		// Terms outside the length limits are never indexed, so aren't searched for
+		term = keywordUtils.NormalizeKeyword(term, normalization)
+		if len(term) == 0 || !keywordUtils.KeepKeyword(term, normalization) {
+			continue
+		}
+		for _, queryTerm := range keywordUtils.QueryTerms(term, normalization) {
+			found := len(query.Keywords)
+			for _, variant := range keywordUtils.Variants(queryTerm, c.opts.Fuzzy) {
+				if trapdoors, ok := c.trapdoors(variant); ok {
+					query.Keywords = append(query.Keywords, searchProtocol.TrapdoorSet{Term: numTerms, Trapdoors: trapdoors})
+				}
+			}
+			numTerms++
+
+			// Variants missing from precomputed trapdoors are skipped, but not the whole term
+			if len(query.Keywords) == found {
+				return nil, &MissingTrapdoorsError{Term: queryTerm}
+			}
+		}
+	}
+	if len(query.Keywords) == 0 {
+		return nil, errors.New("no search terms given")
+	}
+	query.Keys = len(query.Keywords[0].Trapdoors)
+
+	// Pad the query with dummy keyword sets to hide the number of real keywords
+	if err := query.Pad(c.opts.Pad, rand.Reader); err != nil {
+		return nil, err
+	}
+
+	return query, nil
+}
+
+/* Trapdoors for a normalised term, built from the private keys if the client has *
+ * them, else looked up in the precomputed trapdoors                               */
+func (c *Client) trapdoors(term string) ([][]byte, bool) {
+
+	if len(c.opts.Keys) > 0 {
+		return cryptoUtils.BuildTrapdoorsWith(c.opts.Hash, term, c.opts.Keys), true
+	}
+
+	trapdoors, ok := c.opts.Trapdoors[term]
+	return trapdoors, ok && len(trapdoors) > 0
+}
+
+/* Search the server's secure indexes for documents containing any of the terms */
+func (c *Client) Search(ctx context.Context, terms []string) (Results, error) {
+	return c.search(ctx, terms, searchProtocol.FORMAT_JSON, nil)
+}
+
+/* Search the server's secure indexes, calling onMatch as each match is found */
+func (c *Client) SearchStream(ctx context.Context, terms []string, onMatch func(searchProtocol.Match)) (Results, error) {
+	return c.search(ctx, terms, searchProtocol.FORMAT_STREAM, onMatch)
+}
+
+/* Search the server's secure indexes, returning the server's human-readable response */
+func (c *Client) SearchText(ctx context.Context, terms []string) (string, error) {
+
+	query, err := c.Query(terms)
+	if err != nil {
+		return "", err
+	}
+
+	var text string
+	err = c.exchange(ctx, func() error {
+		if err := c.encoder.Encode(query); err != nil {
+			return err
+		}
+
+		// Text responses are terminated by the server's '>' prompt
+		text, err = c.reader.ReadString('>')
+		return err
+	})
+
+	return text, err
+}
+
+/* Report matches from earlier searches found to be false positives */
+func (c *Client) Feedback(ctx context.Context, names []string) error {
+
+	if len(names) == 0 {
+		return nil
+	}
+
+	report := searchProtocol.Query{FalsePositives: names, Format: searchProtocol.FORMAT_JSON}
+	return c.exchange(ctx, func() error {
+		if err := c.encoder.Encode(report); err != nil {
+			return err
+		}
+
+		var ack searchProtocol.Response
+		if err := c.decoder.Decode(&ack); err != nil {
+			return err
+		}
+		if len(ack.Error) > 0 {
+			return &ServerError{Message: ack.Error}
+		}
+		return nil
+	})
+}
+
+/* Ask the server to end the session and close the connection */
+func (c *Client) Close() error {
+
+	// An empty query triggers the server to close its side of the connection
+	err := c.encoder.Encode(nil)
+	if cErr := c.conn.Close(); err == nil {
+		err = cErr
+	}
+
+	return err
+}
+
+/* Send a query in the given response format and parse the server's response */
+func (c *Client) search(ctx context.Context, terms []string, format string, onMatch func(searchProtocol.Match)) (Results, error) {
+
+	query, err := c.Query(terms)
+	if err != nil {
+		return Results{}, err
+	}
+	query.Format = format
+
+	var response searchProtocol.Response
+	err = c.exchange(ctx, func() error {
+		if err := c.encoder.Encode(query); err != nil {
+			return err
+		}
+
+		if format == searchProtocol.FORMAT_STREAM {
+			response, err = searchProtocol.ReadStream(c.decoder, onMatch)
+			return err
+		}
+		return c.decoder.Decode(&response)
+	})
+	if err != nil {
+		return Results{}, err
+	}
+
+	results := Results{Matches: response.Matches, Scanned: response.Scanned, Mismatched: response.Mismatched}
+	if len(response.Error) > 0 {
+		return results, &ServerError{Message: response.Error}
+	}
+
+	return results, nil
+}
+
+/* Run a request/response exchange with the server, abandoning it if the context is *
+ * cancelled or its deadline passes. An abandoned exchange leaves the connection in *
+ * an unknown state, so the client should be closed                                 */
+func (c *Client) exchange(ctx context.Context, fn func() error) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Unblock any pending read or write as soon as the context is done
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			c.conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	err := fn()
+	close(stop)
+	<-stopped
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
@@ -0,0 +1,392 @@
+package siclient
+
+import (
+	"bytes" // Standard packages
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"secureindex/cryptoUtils" // Custom packages
+	"secureindex/keywordUtils"
+	"secureindex/searchProtocol"
+)
+
+// Private key for building test trapdoors
+var testKeys = [][]byte{[]byte("0123456789abcdef0123456789abcdef")}
+
+func TestQueryNumbersTerms(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		opts  Options
+		terms []string
+		want  int // Number of distinct terms searched for
+	}{
+		{"single term", Options{}, []string{"rabbit"}, 1},
+		{"several terms", Options{MatchAll: true}, []string{"rabbit", "watch"}, 2},
+		{"fuzzy variants share a term", Options{Fuzzy: 1}, []string{"rabbit"}, 1},
+		{"whole hyphenated term", Options{MatchAll: true}, []string{"state-of-the-art"}, 1},
+		{"split parts are separate terms", Options{MatchAll: true, Hyphens: keywordUtils.HYPHENS_SPLIT}, []string{"state-of-the-art"}, 3},
+	}
+
+	for _, test := range tests {
+		test.opts.Keys = testKeys
+		query, err := (&Client{opts: test.opts}).Query(test.terms)
+		if err != nil {
+			t.Errorf("%s: Query failed: %v", test.name, err)
+			continue
+		}
+		terms := make(map[int]bool)
+		for _, set := range query.Keywords {
+			terms[set.Term] = true
+		}
+		if len(terms) != test.want {
+			t.Errorf("%s: %d terms searched for in %d sets, want %d", test.name, len(terms), len(query.Keywords), test.want)
+		}
+	}
+}
+
+/* Declare custom structure for an in-memory search server, matching queries' trapdoors *
+ * against the keywords of its documents as the search server matches secure indexes   */
+type fakeServer struct {
+	docs  map[string][]string // Keywords of each document
+	hang  bool                // Read queries without ever replying
+	error string              // Reply to searches with this error
+
+	mu         sync.Mutex
+	queries    int      // Number of searches received
+	feedback   []string // Names reported as false positives
+	compressed bool     // Whether compression was negotiated
+}
+
+/* Connect a client to the fake server over an in-memory connection, returning a channel *
+ * closed once the server has finished with the connection                               */
+func (s *fakeServer) connect(t *testing.T, opts Options) (*Client, chan struct{}) {
+
+	conn, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.serve(server)
+		close(done)
+	}()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	opts.Keys = testKeys
+	client, err := NewFromConn(conn, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client, done
+}
+
+/* Answer queries on a connection until the client ends the session */
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	decoder := json.NewDecoder(conn)
+	encoder := json.NewEncoder(conn)
+	for {
+		var query *searchProtocol.Query
+		if err := decoder.Decode(&query); err != nil || query == nil {
+			return
+		}
+
+		s.mu.Lock()
+		switch {
+		case query.Hello != nil:
+			scheme := query.Hello.Choose()
+			encoder.Encode(searchProtocol.Hello{Compression: []string{scheme}})
+			if len(scheme) > 0 {
+				s.compressed = true
+				decoder = json.NewDecoder(searchProtocol.NewCompressedReader(io.MultiReader(decoder.Buffered(), conn)))
+				encoder = json.NewEncoder(searchProtocol.NewCompressedWriter(conn))
+			}
+		case query.IsFeedback():
+			s.feedback = append(s.feedback, query.FalsePositives...)
+			encoder.Encode(searchProtocol.Response{})
+		case s.hang:
+			s.queries++
+		default:
+			s.queries++
+			response := s.search(query)
+			if query.Format == searchProtocol.FORMAT_STREAM {
+				for i := range response.Matches {
+					encoder.Encode(searchProtocol.StreamMessage{Match: &response.Matches[i]})
+				}
+				encoder.Encode(searchProtocol.StreamMessage{End: true, Scanned: response.Scanned, Error: response.Error})
+			} else {
+				encoder.Encode(response)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+/* Find the documents matching a query's terms, any of them or with MATCH_ALL all of them */
+func (s *fakeServer) search(query *searchProtocol.Query) searchProtocol.Response {
+
+	response := searchProtocol.Response{Matches: make([]searchProtocol.Match, 0, 0), Scanned: len(s.docs), Error: s.error}
+	if len(s.error) > 0 {
+		return response
+	}
+
+	terms := query.Terms()
+	for name, keywords := range s.docs {
+		matched := 0
+		for _, term := range terms {
+			if termMatches(term, keywords) {
+				matched++
+			}
+		}
+		if matched == 0 || (query.MatchAll() && matched < len(terms)) {
+			continue
+		}
+		match := searchProtocol.Match{Name: name}
+		if len(terms) > 1 {
+			match.Keywords = matched
+		}
+		response.Matches = append(response.Matches, match)
+	}
+	sort.Slice(response.Matches, func(i, j int) bool { return response.Matches[i].Name < response.Matches[j].Name })
+
+	return response
+}
+
+/* Check whether any of a term's keyword sets holds the trapdoors of one of the keywords */
+func termMatches(term []searchProtocol.TrapdoorSet, keywords []string) bool {
+
+	for _, set := range term {
+		for _, keyword := range keywords {
+			if bytes.Equal(set.Trapdoors[0], cryptoUtils.BuildTrapdoors(keyword, testKeys)[0]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/* List the names of matched documents */
+func matchNames(matches []searchProtocol.Match) string {
+
+	names := make([]string, 0, len(matches))
+	for _, match := range matches {
+		names = append(names, match.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestSearch(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		opts  Options
+		terms []string
+		want  string // Names of the documents matched
+	}{
+		{"single term", Options{}, []string{"rabbit"}, "alice.txt,wonderland.txt"},
+		{"any of several terms", Options{}, []string{"watch", "violin"}, "alice.txt,holmes.txt"},
+		{"all of several terms", Options{MatchAll: true}, []string{"rabbit", "watch"}, "alice.txt"},
+		{"normalised terms", Options{}, []string{"  Violin "}, "holmes.txt"},
+		{"fuzzy terms", Options{Fuzzy: 1}, []string{"violon"}, "holmes.txt"},
+		{"no matches", Options{}, []string{"teapot"}, ""},
+		{"compressed", Options{Compress: true}, []string{"rabbit"}, "alice.txt,wonderland.txt"},
+	}
+
+	for _, test := range tests {
+		for _, stream := range []bool{false, true} {
+			server := &fakeServer{docs: map[string][]string{"alice.txt": {"rabbit", "watch"}, "wonderland.txt": {"rabbit"}, "holmes.txt": {"violin"}}}
+			client, done := server.connect(t, test.opts)
+
+			var results Results
+			var err error
+			streamed := make([]searchProtocol.Match, 0, 0)
+			if stream {
+				results, err = client.SearchStream(context.Background(), test.terms, func(match searchProtocol.Match) {
+					streamed = append(streamed, match)
+				})
+			} else {
+				results, err = client.Search(context.Background(), test.terms)
+			}
+			client.Close()
+			<-done
+
+			if err != nil {
+				t.Errorf("%s (stream %v): search failed: %v", test.name, stream, err)
+				continue
+			}
+			if got := matchNames(results.Matches); got != test.want || results.Scanned != 3 {
+				t.Errorf("%s (stream %v): scanned %d, matched %q, want 3 and %q", test.name, stream, results.Scanned, got, test.want)
+			}
+			if stream && matchNames(streamed) != test.want {
+				t.Errorf("%s: streamed %q, want %q", test.name, matchNames(streamed), test.want)
+			}
+			if server.compressed != test.opts.Compress {
+				t.Errorf("%s (stream %v): compression negotiated %v, want %v", test.name, stream, server.compressed, test.opts.Compress)
+			}
+		}
+	}
+}
+
+func TestSearchServerError(t *testing.T) {
+
+	server := &fakeServer{docs: map[string][]string{"alice.txt": {"rabbit"}}, error: "index root unavailable"}
+	client, done := server.connect(t, Options{})
+	_, err := client.Search(context.Background(), []string{"rabbit"})
+	client.Close()
+	<-done
+
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) || serverErr.Message != "index root unavailable" {
+		t.Errorf("Search returned %v, want the server's error", err)
+	}
+}
+
+func TestFeedback(t *testing.T) {
+
+	for _, compress := range []bool{false, true} {
+		server := &fakeServer{docs: map[string][]string{}}
+		client, done := server.connect(t, Options{Compress: compress})
+		if err := client.Feedback(context.Background(), nil); err != nil {
+			t.Errorf("compress %v: empty Feedback failed: %v", compress, err)
+		}
+		if err := client.Feedback(context.Background(), []string{"alice.txt", "a/report.pdf"}); err != nil {
+			t.Errorf("compress %v: Feedback failed: %v", compress, err)
+		}
+		client.Close()
+		<-done
+
+		if got := strings.Join(server.feedback, ","); got != "alice.txt,a/report.pdf" {
+			t.Errorf("compress %v: server received feedback %q", compress, got)
+		}
+	}
+}
+
+func TestSearchCancelled(t *testing.T) {
+
+	// A cancelled search isn't sent
+	server := &fakeServer{docs: map[string][]string{"alice.txt": {"rabbit"}}}
+	client, done := server.connect(t, Options{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.Search(ctx, []string{"rabbit"}); err != context.Canceled {
+		t.Errorf("cancelled Search returned %v, want %v", err, context.Canceled)
+	}
+	client.Close()
+	<-done
+	if server.queries != 0 {
+		t.Errorf("cancelled search sent %d queries", server.queries)
+	}
+
+	// A search the server never answers is abandoned at the context's deadline
+	server = &fakeServer{docs: map[string][]string{"alice.txt": {"rabbit"}}, hang: true}
+	client, done = server.connect(t, Options{})
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := client.Search(ctx, []string{"rabbit"}); err != context.DeadlineExceeded {
+		t.Errorf("unanswered Search returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("unanswered Search took %v to be abandoned", elapsed)
+	}
+	client.Close()
+	<-done
+}
+
+/* Create a self-signed certificate for a test server */
+func selfSignedCertificate(t *testing.T) (tls.Certificate, *x509.Certificate) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, leaf
+}
+
+func TestNewVerifiesServer(t *testing.T) {
+
+	cer, leaf := selfSignedCertificate(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cer}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	server := &fakeServer{docs: map[string][]string{"alice.txt": {"rabbit"}}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	trusted := x509.NewCertPool()
+	trusted.AddCert(leaf)
+
+	// An untrusted (here self-signed) server is refused unless verification is explicitly skipped
+	tests := []struct {
+		name string
+		opts Options
+		ok   bool
+	}{
+		{"untrusted server", Options{}, false},
+		{"untrusted server, modern profile", Options{TLSProfile: "modern"}, false},
+		{"trusted server", Options{RootCAs: trusted}, true},
+		{"verification skipped", Options{Insecure: true}, true},
+	}
+	for _, test := range tests {
+		test.opts.Keys = testKeys
+		client, err := New(listener.Addr().String(), test.opts)
+		if !test.ok {
+			if err == nil {
+				client.Close()
+				t.Errorf("%s: New connected without verifying the server", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: New failed: %v", test.name, err)
+			continue
+		}
+		if results, err := client.Search(context.Background(), []string{"rabbit"}); err != nil || matchNames(results.Matches) != "alice.txt" {
+			t.Errorf("%s: search returned %q, %v", test.name, matchNames(results.Matches), err)
+		}
+		client.Close()
+	}
+}
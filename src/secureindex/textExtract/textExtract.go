@@ -1,106 +1,674 @@
-package textExtract
-
-/* Light NLP functions to perform text and keyword extractions enabling the building of Secure Indexes *
- * Source ref: crypto.stanford.edu/~eujin/papers/secureindex/secureindex.pdf                           */
-
-import (
-	"fmt" // Standard packages
-	"os"
-	"regexp"
-	"strings"
-
-	"github.com/lu4p/cat"      // Cat package for raw text extraction
-	"gopkg.in/jdkato/prose.v2" // Prose package for NLP and keyword extraction
-)
-
-// Regexp string of English language stopwords (source: NLTK)
-const STOP_WORDS = "\\b(ourselves|hers|between|yourself|but|again|there|about|once|during|out|very|having|with|they|own|an|be|some|for|do|its|yours|such|into|of|most|itself|other|off|is|s|am|or|who|as|from|him|each|the|themselves|until|below|are|we|these|your|his|through|don|nor|me|were|her|more|himself|this|down|should|our|their|while|above|both|up|to|ours|had|she|all|no|when|at|any|before|them|same|and|been|have|in|will|on|does|yourselves|then|that|because|what|over|why|so|can|did|not|now|under|he|you|herself|has|just|where|too|only|myself|which|those|i|after|few|whom|t|being|if|theirs|my|against|a|by|doing|it|how|further|was|here|than)\\b\\s"
-
-/* Error handling */
-func errorCheck(msg string, err error) {
-	if err != nil {
-		fmt.Fprintf(os.Stderr, msg+"\n")
-		os.Exit(1)
-	}
-}
-
-/* Define basic structure for text 'object' associated with a file */
-type Text struct {
-	Filepath string
-	RawText  string
-	Keywords []string
-}
-
-/* Extract text from various popular document formats */
-func (t *Text) ExtractText() {
-
-	// Extract text using CAT package (txt, csv, pdf, rtf, odt, docx etc...)
-	content, err := cat.Cat(t.Filepath)
-	if err != nil {
-		fmt.Println("INFO: unable to read ", t.Filepath, " (skipping file)")
-	}
-
-	if len(content) == 0 {
-		fmt.Println("INFO: unable to find text content in ", t.Filepath, " (skipping file)")
-	} else {
-		t.RawText = strings.ToLower(content)
-	}
-}
-
-/* Function to extract keywords from a document using light NLP */
-func (t *Text) ExtractKeywords() {
-
-	// Remove stopwords
-	cleanText := removeStopwords(t)
-
-	// Create a Prose document object ready for tokenising
-	doc, err := prose.NewDocument(cleanText)
-	errorCheck("ERROR: unable to initialise a Prose document object.", err)
-
-	// Create slice to hold extracted keywords
-	tokens := make([]string, 0, 0)
-
-	// Tokenise the Prose document object
-	for _, tok := range doc.Tokens() {
-
-		// Extract nouns from POS tags to use as keywords, convert to lowercase
-		if strings.Contains(tok.Tag, "NN") {
-			tokens = append(tokens, strings.ToLower(tok.Text))
-		}
-	}
-
-	// Dedupe list of keywords
-	t.Keywords = removeDuplicates(tokens)
-}
-
-/* Remove English language stopwords */
-func removeStopwords(t *Text) string {
-
-	// Build regex for matching stopwords
-	reg, err := regexp.Compile(STOP_WORDS)
-	errorCheck("ERROR: unable to remove stopwords.", err)
-
-	// Remove stopwords from the text, return cleaned text
-	return reg.ReplaceAllString(t.RawText, "")
-}
-
-/* Deduplicate keyword extracts from extracted text */
-func removeDuplicates(keywords []string) []string {
-
-	// Use map to record duplicates
-	encountered := make(map[string]bool)
-	result := make([]string, 0, 0)
-
-	for v := range keywords {
-		if encountered[keywords[v]] == true {
-			// Do not add duplicate.
-		} else {
-			// Record element as an encountered element.
-			encountered[keywords[v]] = true
-			// Append to result slice
-			result = append(result, keywords[v])
-		}
-	}
-	// Return the deduped slice array
-	return result
-}
+package textExtract
+
+/* Light NLP functions to perform text and keyword extractions enabling the building of Secure Indexes *
+ * Source ref: crypto.stanford.edu/~eujin/papers/secureindex/secureindex.pdf                           */
+
+import (
+	"fmt" // Standard packages
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"secureindex/keywordUtils" // Keyword normalisation shared with the search client
+
+	"github.com/lu4p/cat"      // Cat package for raw text extraction
+	"gopkg.in/jdkato/prose.v2" // Prose package for NLP and keyword extraction
+)
+
+// Regexp string of English language stopwords (source: NLTK)
+const STOP_WORDS = "\\b(ourselves|hers|between|yourself|but|again|there|about|once|during|out|very|having|with|they|own|an|be|some|for|do|its|yours|such|into|of|most|itself|other|off|is|s|am|or|who|as|from|him|each|the|themselves|until|below|are|we|these|your|his|through|don|nor|me|were|her|more|himself|this|down|should|our|their|while|above|both|up|to|ours|had|she|all|no|when|at|any|before|them|same|and|been|have|in|will|on|does|yourselves|then|that|because|what|over|why|so|can|did|not|now|under|he|you|herself|has|just|where|too|only|myself|which|those|i|after|few|whom|t|being|if|theirs|my|against|a|by|doing|it|how|further|was|here|than)\\b\\s"
+
+// Built-in stopword languages, selected with Text.Language
+const (
+	LANGUAGE_EN = "en" // English (default)
+	LANGUAGE_ES = "es" // Spanish
+	LANGUAGE_FR = "fr" // French
+	LANGUAGE_DE = "de" // German
+)
+
+// Spanish, French and German language stopwords (source: abridged from NLTK)
+const (
+	STOP_WORDS_ES = "de la que el en y a los del se las por un para con no una su al lo como más pero sus le ya o este sí porque esta entre cuando muy sin sobre también me hasta hay donde quien desde todo nos durante todos uno les ni contra otros ese eso ante ellos e esto mí antes algunos qué unos yo otro otras otra él tanto esa estos mucho quienes nada muchos cual poco ella estar estas algunas algo nosotros mi mis tú te ti tu tus ellas nosotras vosotros vosotras os mío mía míos mías tuyo tuya tuyos tuyas suyo suya suyos suyas nuestro nuestra nuestros nuestras vuestro vuestra vuestros vuestras esos esas estoy estás está estamos estáis están esté estés estemos estéis estén estaba estaban estado he has ha hemos habéis han haya había habían soy eres es somos sois son sea era eran fue fueron ser tengo tienes tiene tenemos tenéis tienen tenía tener hace hacer sido"
+	STOP_WORDS_FR = "au aux avec ce ces dans de des du elle en et eux il ils je la le les leur lui ma mais me même mes moi mon ne nos notre nous on ou par pas pour qu que qui sa se ses son sur ta te tes toi ton tu un une vos votre vous c d j l à m n s t y été étée étées étés étant suis es est sommes êtes sont serai sera serons seront serais serait étais était étions étiez étaient fus fut furent sois soit soient ai as avons avez ont aurai aura aurons auront aurais aurait avais avait avions aviez avaient eu eus eut eurent aie aies ait ayons ayez aient cette cet celle celui ceux dont où si comme plus tout tous toute toutes aussi très bien sans sous entre"
+	STOP_WORDS_DE = "aber alle allem allen aller alles als also am an ander andere anderem anderen anderer anderes auch auf aus bei bin bis bist da damit dann der den des dem die das dass daß derselbe derselben denselben desselben demselben dieselbe dieselben dasselbe dazu dein deine deinem deinen deiner deines denn derer dessen dich dir du dies diese diesem diesen dieser dieses doch dort durch ein eine einem einen einer eines einig einige einigem einigen einiger einiges einmal er ihn ihm es etwas euer eure eurem euren eurer eures für gegen gewesen hab habe haben hat hatte hatten hier hin hinter ich mich mir ihr ihre ihrem ihren ihrer ihres euch im in indem ins ist jede jedem jeden jeder jedes jene jenem jenen jener jenes jetzt kann kein keine keinem keinen keiner keines können könnte machen man manche manchem manchen mancher manches mein meine meinem meinen meiner meines mit muss musste nach nicht nichts noch nun nur ob oder ohne sehr sein seine seinem seinen seiner seines selbst sich sie ihnen sind so solche solchem solchen solcher solches soll sollte sondern sonst über um und uns unsere unserem unseren unser unseres unter viel vom von vor während war waren warst was weg weil weiter welche welchem welchen welcher welches wenn werde werden wie wieder will wir wird wirst wo wollen wollte würde würden zu zum zur zwar zwischen"
+)
+
+// Default part-of-speech tags of words kept as keywords: common nouns, singular and plural (proper nouns are NNP and NNPS)
+var NOUN_TAGS = []string{"NN", "NNS"}
+
+// Maximum number of words in a line detected as a heading
+const MAX_HEADING_WORDS = 8
+
+// Fraction of invalid UTF-8 or control bytes above which text is treated as binary noise and skipped
+const MAX_NON_TEXT = 0.1
+
+/* Error handling */
+func errorCheck(msg string, err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, msg)
+		os.Exit(1)
+	}
+}
+
+/* Interface for pluggable keyword extraction, allowing alternative NLP stacks *
+ * (e.g. spaCy via RPC or a custom extractor) to replace the Prose default     */
+type KeywordExtractor interface {
+	Extract(text string) ([]string, error)
+}
+
+/* Default keyword extractor, keeps words identified by Prose's POS tagging as nouns, *
+ * or as any of the given kinds of word. Tags match exactly, or by prefix if ending  *
+ * in "*", e.g. "VB*" matches every verb tag (VB, VBD, VBG, VBN, VBP and VBZ)         */
+type ProseExtractor struct {
+	Tags      []string // Penn Treebank tags of the words kept, e.g. "NNP" proper nouns, "VB*" verbs, "JJ*" adjectives (NOUN_TAGS if empty)
+	Compounds bool     // Also keep hyphenated compounds whatever their tag, e.g. "state-of-the-art" tagged as an adjective
+}
+
+/* Define basic structure for text 'object' associated with a file */
+type Text struct {
+	Filepath  string
+	RawText   string
+	Keywords  []string
+	Extractor KeywordExtractor // Defaults to ProseExtractor when nil
+	Tags      []string         // Tags of the words the default ProseExtractor keeps, see ProseExtractor (NOUN_TAGS if empty)
+
+	Normalization keywordUtils.Options // Must match the options used by the search client
+
+	TrackPositions bool             // Opt-in: record where each keyword occurs in RawText
+	Positions      map[string][]int // Byte offsets of each keyword's occurrences in RawText as composed by ExtractKeywords (if tracked)
+
+	IncludeHeadings bool     // Opt-in: detect headings in ExtractText, always keeping their terms as keywords
+	Headings        []string // Heading lines found in the text (lowercase), their terms are always keywords
+
+	IncludeEntities bool     // Opt-in: detect named entities in ExtractText, keeping each as a keyword
+	Entities        []string // Named entities found in the text (lowercase), e.g. "bank of england"
+
+	MaxKeywords int            // Opt-in: keep only this many of the most frequent keywords (0 keeps all)
+	Counts      map[string]int // Number of times each keyword was extracted from the text
+	NGrams      int            // Opt-in: also keep runs of 2 up to NGrams adjacent nouns as phrases, e.g. "machine learning"
+
+	Language     string // Built-in stopwords removed before extraction: LANGUAGE_EN (default), _ES, _FR or _DE
+	StopwordFile string // Opt-in: newline delimited stopwords to remove instead of a built-in language's
+}
+
+/* Set of stopwords removed from text before keyword extraction */
+type stopwordSet struct {
+	pattern *regexp.Regexp  // Matches the stopwords directly (the English set)
+	words   map[string]bool // Else lowercase stopwords, matched word by word
+}
+
+// Whole words, each with any spaces or the elision apostrophe (e.g. French "l'") following it
+var wordPattern = regexp.MustCompile(`[\p{L}\p{M}\p{N}]+('|’|\s*)`)
+
+// Stopword sets, compiled once per language or file
+var (
+	stopwordMu   sync.Mutex
+	stopwordSets = make(map[string]*stopwordSet)
+)
+
+/* Extract text from various popular document formats */
+func (t *Text) ExtractText() {
+
+	// Extract text using CAT package (txt, csv, pdf, rtf, odt, docx etc...)
+	content, err := cat.Cat(t.Filepath)
+	if err != nil {
+		fmt.Println("INFO: unable to read ", t.Filepath, " (skipping file)")
+	}
+
+	// Skip text that looks like binary noise (e.g. a misdetected binary file), else replace
+	// any invalid UTF-8 sequences so they can't produce garbage keywords
+	if nonTextRatio(content) > MAX_NON_TEXT {
+		fmt.Println("INFO: text in ", t.Filepath, " appears to be binary (skipping file)")
+		return
+	}
+	if !utf8.ValidString(content) {
+		fmt.Println("INFO: replacing invalid UTF-8 in ", t.Filepath)
+		content = strings.ToValidUTF8(content, " ")
+	}
+
+	if len(content) == 0 {
+		fmt.Println("INFO: unable to find text content in ", t.Filepath, " (skipping file)")
+	} else {
+		t.RawText = strings.ToLower(content)
+	}
+
+	// Headings are detected before lowercasing as capitalisation is one of their cues
+	if t.IncludeHeadings {
+		t.Headings = detectHeadings(content)
+	}
+
+	// As are named entities
+	if t.IncludeEntities && len(content) > 0 {
+		t.Entities = detectEntities(content)
+	}
+}
+
+/* Fraction of the bytes in a string that are invalid UTF-8 or non-whitespace control characters */
+func nonTextRatio(text string) float64 {
+
+	if len(text) == 0 {
+		return 0
+	}
+
+	nonText := 0
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		if (r == utf8.RuneError && size == 1) || (unicode.IsControl(r) && !unicode.IsSpace(r)) {
+			nonText += size
+		}
+		i += size
+	}
+
+	return float64(nonText) / float64(len(text))
+}
+
+/* Declare custom structure for a window of consecutive words taken from a text */
+type Window struct {
+	Start int // Index of the window's first word
+	End   int // Index one past the window's last word
+	Text  string
+}
+
+/* Split the raw text into windows of size words, starting a new window every stride *
+ * words. A stride smaller than the size overlaps adjacent windows, so words near a  *
+ * window boundary appear in both windows. The final window may be shorter           */
+func (t *Text) Windows(size int, stride int) []Window {
+
+	words := strings.Fields(t.RawText)
+	windows := make([]Window, 0, 0)
+	if size <= 0 || stride <= 0 {
+		return windows
+	}
+
+	for start := 0; start < len(words); start += stride {
+		end := start + size
+		if end > len(words) {
+			end = len(words)
+		}
+		windows = append(windows, Window{Start: start, End: end, Text: strings.Join(words[start:end], " ")})
+
+		// Stop once a window reaches the end of the text
+		if end == len(words) {
+			break
+		}
+	}
+
+	return windows
+}
+
+/* Function to extract keywords from a document using the configured extractor */
+func (t *Text) ExtractKeywords() error {
+
+	// Fall back to the Prose-based extractor if none has been set
+	extractor := t.Extractor
+	if extractor == nil {
+		extractor = ProseExtractor{Tags: t.Tags, Compounds: splitsHyphens(t.Normalization.Hyphens)}
+	}
+
+	// Compose the text before tokenising, so combining accents don't split or change words.
+	// Accents are folded (if enabled) per keyword, as POS tagging relies on them
+	t.RawText = keywordUtils.NormalizeText(t.RawText)
+
+	// Remove stopwords
+	stopwords, err := t.stopwords()
+	if err != nil {
+		return err
+	}
+	cleanText := stopwords.remove(t.RawText)
+
+	// Extract keywords from the cleaned text
+	tokens, err := extractor.Extract(cleanText)
+	if err != nil {
+		return err
+	}
+
+	// Heading terms are strong topic signals, keep them even if the extractor dropped them
+	tokens = append(tokens, headingTerms(t.Headings, stopwords)...)
+
+	// Named entities are kept whole, multi-word entities joined into a single keyword
+	tokens = append(tokens, entityTerms(t.Entities)...)
+
+	// Noun phrases are found in the original text, as removing stopwords would join unrelated nouns
+	if t.NGrams > 1 {
+		phrases, err := nounPhrases(t.RawText, t.NGrams)
+		if err != nil {
+			return err
+		}
+		tokens = append(tokens, phrases...)
+	}
+
+	// Keep the tokens as they appear in the text for locating them later
+	var rawTokens []string
+	if t.TrackPositions {
+		rawTokens = append(rawTokens, tokens...)
+	}
+
+	// Normalise keywords exactly as the search client does for query keywords, dropping any
+	// too short or too long to be useful (e.g. PDF extraction artefacts)
+	kept := 0
+	for i := range tokens {
+		if keyword := keywordUtils.NormalizeKeyword(tokens[i], t.Normalization); keywordUtils.KeepKeyword(keyword, t.Normalization) {
+			tokens[kept] = keyword
+			if t.TrackPositions {
+				rawTokens[kept] = rawTokens[i]
+			}
+			kept++
+		}
+	}
+	tokens = tokens[:kept]
+	if t.TrackPositions {
+		rawTokens = rawTokens[:kept]
+	}
+
+	// Record the offsets of every occurrence of each keyword in the original text
+	if t.TrackPositions {
+		t.Positions = keywordPositions(t.RawText, rawTokens, tokens)
+	}
+
+	// Expand hyphenated keywords into the terms indexed for them
+	terms := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		terms = append(terms, keywordUtils.IndexTerms(token, t.Normalization)...)
+	}
+	tokens = terms
+
+	// Count each keyword, then dedupe the list of keywords, keeping only the most frequent if limited
+	t.Counts = make(map[string]int)
+	for _, token := range tokens {
+		t.Counts[token]++
+	}
+	if t.MaxKeywords > 0 {
+		t.Keywords = t.TopKeywords(t.MaxKeywords)
+		for keyword := range t.Positions {
+			if !containsKeyword(t.Keywords, keyword) {
+				delete(t.Positions, keyword)
+			}
+		}
+		for keyword := range t.Counts {
+			if !containsKeyword(t.Keywords, keyword) {
+				delete(t.Counts, keyword)
+			}
+		}
+	} else {
+		t.Keywords = removeDuplicates(tokens)
+	}
+
+	return nil
+}
+
+/* Extract keywords from text using light NLP (Prose POS tagging) */
+func (p ProseExtractor) Extract(text string) ([]string, error) {
+
+	// Create a Prose document object ready for tokenising
+	doc, err := prose.NewDocument(text)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create slice to hold extracted keywords
+	tokens := make([]string, 0, 0)
+	tags := p.Tags
+	if len(tags) == 0 {
+		tags = NOUN_TAGS
+	}
+
+	// Tokenise the Prose document object
+	for _, tok := range doc.Tokens() {
+
+		// Extract the kinds of word wanted (by default nouns) from POS tags to use as keywords,
+		// convert to lowercase. Hyphenated compounds are often tagged as adjectives or verbs,
+		// so are kept as strong terms if wanted
+		if matchesTag(tok.Tag, tags) || (p.Compounds && isCompound(tok.Text)) {
+			tokens = append(tokens, strings.ToLower(tok.Text))
+		}
+	}
+
+	return tokens, nil
+}
+
+/* Check whether a POS tag is any of the given tags, those ending in "*" matching as prefixes */
+func matchesTag(tag string, tags []string) bool {
+	for _, want := range tags {
+		if prefix := strings.TrimSuffix(want, "*"); tag == want || (prefix != want && strings.HasPrefix(tag, prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Extract phrases of 2 up to n adjacent nouns (Prose POS tagging), in lowercase with *
+ * their words separated by spaces, e.g. "search engine" and "engine results". Nouns  *
+ * used as gerunds after a noun are tagged as verbs, so are also kept, e.g. "machine *
+ * learning" and "data processing"                                                    */
+func nounPhrases(text string, n int) ([]string, error) {
+
+	doc, err := prose.NewDocument(text, prose.WithExtraction(false))
+	if err != nil {
+		return nil, err
+	}
+
+	phrases := make([]string, 0, 0)
+	run := make([]string, 0, n)
+	for _, tok := range doc.Tokens() {
+
+		// Any other token ends the current run of nouns
+		noun := strings.Contains(tok.Tag, "NN") || (tok.Tag == "VBG" && len(run) > 0)
+		if !noun || strings.IndexFunc(tok.Text, unicode.IsLetter) < 0 {
+			run = run[:0]
+			continue
+		}
+
+		// Emit every phrase ending with this noun, up to n nouns long
+		run = append(run, strings.ToLower(tok.Text))
+		if len(run) > n {
+			run = run[1:]
+		}
+		for size := 2; size <= n && size <= len(run); size++ {
+			phrases = append(phrases, strings.Join(run[len(run)-size:], " "))
+		}
+	}
+
+	return phrases, nil
+}
+
+/* Detect heading lines using simple format cues: a short line without sentence-ending  *
+ * punctuation that is either all capitals, a markdown heading ("# Title") or numbered *
+ * ("2.1 Title"). Returns the heading text in lowercase                                */
+func detectHeadings(content string) []string {
+
+	headings := make([]string, 0, 0)
+	numbered := regexp.MustCompile(`^\d+(\.\d+)*\.?\s+\S`)
+
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		words := strings.Fields(line)
+		if len(words) == 0 || len(words) > MAX_HEADING_WORDS || strings.ContainsAny(line[len(line)-1:], ".,;?!") {
+			continue
+		}
+
+		markdown := strings.HasPrefix(line, "#")
+		if markdown || numbered.MatchString(line) || (strings.ToUpper(line) == line && strings.ToLower(line) != line) {
+			headings = append(headings, strings.ToLower(strings.TrimLeft(line, "# ")))
+		}
+	}
+
+	return headings
+}
+
+/* Detect named entities (people, organisations, places) using Prose's named-entity *
+ * recognition. Returns each distinct entity's words in lowercase, space separated  */
+func detectEntities(content string) []string {
+
+	doc, err := prose.NewDocument(content, prose.WithSegmentation(false))
+	if err != nil {
+		fmt.Println("INFO: unable to detect named entities (skipping entities)")
+		return nil
+	}
+
+	entities := make([]string, 0, 0)
+	for _, ent := range doc.Entities() {
+		words := strings.FieldsFunc(strings.ToLower(ent.Text), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		if len(words) > 0 {
+			entities = append(entities, strings.Join(words, " "))
+		}
+	}
+
+	return removeDuplicates(entities)
+}
+
+/* Join each entity's words into a single keyword, e.g. "bank_of_england" */
+func entityTerms(entities []string) []string {
+
+	terms := make([]string, 0, len(entities))
+	for _, entity := range entities {
+		terms = append(terms, keywordUtils.JoinPhrase(strings.Fields(entity)))
+	}
+
+	return terms
+}
+
+/* Split headings into their terms, dropping stopwords, numbering and single characters */
+func headingTerms(headings []string, stopwords *stopwordSet) []string {
+
+	terms := make([]string, 0, 0)
+
+	for _, heading := range headings {
+		words := strings.FieldsFunc(stopwords.remove(heading+" "), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, word := range words {
+			if utf8.RuneCountInString(word) > 1 && strings.IndexFunc(word, unicode.IsLetter) >= 0 {
+				terms = append(terms, word)
+			}
+		}
+	}
+
+	return terms
+}
+
+/* Map each normalised keyword to the byte offsets of its raw token's occurrences *
+ * in the text. Stopword removal shifts the text Prose sees, so the offsets are  *
+ * found by searching the text for whole-word matches of each token, ignoring   *
+ * case as extractors lowercase their tokens                                    */
+func keywordPositions(text string, rawTokens []string, keywords []string) map[string][]int {
+
+	positions := make(map[string][]int)
+	located := make(map[string]bool)
+
+	for i, raw := range rawTokens {
+		if len(raw) == 0 || located[raw] {
+			continue
+		}
+		located[raw] = true
+		positions[keywords[i]] = append(positions[keywords[i]], tokenOffsets(text, raw)...)
+	}
+
+	// Different raw tokens may normalise to the same keyword, keep offsets in text order
+	for keyword := range positions {
+		sort.Ints(positions[keyword])
+	}
+
+	return positions
+}
+
+/* Find the byte offsets of whole-word occurrences of a token in the text, ignoring case */
+func tokenOffsets(text string, token string) []int {
+
+	offsets := make([]int, 0, 0)
+
+	for i := range text {
+		end, ok := foldedPrefix(text[i:], token)
+		if !ok {
+			continue
+		}
+		end += i
+
+		// Only count matches not embedded within a longer word
+		before, _ := utf8.DecodeLastRuneInString(text[:i])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if !isWordRune(before) && !isWordRune(after) {
+			offsets = append(offsets, i)
+		}
+	}
+
+	return offsets
+}
+
+/* Check whether text starts with the token, ignoring case, returning the length in *
+ * bytes of the text matched (which may differ from the token's)                   */
+func foldedPrefix(text string, token string) (int, bool) {
+
+	n := 0
+	for _, want := range token {
+		r, size := utf8.DecodeRuneInString(text[n:])
+		if size == 0 || unicode.ToLower(r) != unicode.ToLower(want) {
+			return 0, false
+		}
+		n += size
+	}
+
+	return n, true
+}
+
+/* Check whether a rune forms part of a word (RuneError marks the text boundaries) */
+func isWordRune(r rune) bool {
+	return r != utf8.RuneError && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+/* Check whether a hyphenated keyword handling mode indexes compounds' parts, in which *
+ * case compounds are kept whatever their tag (by default extraction is unchanged)    */
+func splitsHyphens(mode string) bool {
+	return mode == keywordUtils.HYPHENS_SPLIT || mode == keywordUtils.HYPHENS_BOTH
+}
+
+/* Check whether a token is a hyphenated compound of words, e.g. "state-of-the-art" */
+func isCompound(token string) bool {
+
+	parts := strings.Split(token, "-")
+	if len(parts) < 2 {
+		return false
+	}
+
+	for _, part := range parts {
+		if len(part) == 0 || strings.IndexFunc(part, unicode.IsLetter) < 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+/* Get the text's stopword set, from its stopword file else its language, compiling *
+ * each set once and reusing it for every text                                     */
+func (t *Text) stopwords() (*stopwordSet, error) {
+
+	key := "language:" + t.Language
+	if len(t.StopwordFile) > 0 {
+		key = "file:" + t.StopwordFile
+	}
+
+	stopwordMu.Lock()
+	defer stopwordMu.Unlock()
+	if set, ok := stopwordSets[key]; ok {
+		return set, nil
+	}
+
+	var set *stopwordSet
+	if len(t.StopwordFile) > 0 {
+		data, err := ioutil.ReadFile(t.StopwordFile)
+		if err != nil {
+			return nil, err
+		}
+		set = newStopwordSet(strings.Split(string(data), "\n"))
+	} else {
+		switch t.Language {
+		case "", LANGUAGE_EN:
+			set = &stopwordSet{pattern: regexp.MustCompile(STOP_WORDS)}
+		case LANGUAGE_ES:
+			set = newStopwordSet(strings.Fields(STOP_WORDS_ES))
+		case LANGUAGE_FR:
+			set = newStopwordSet(strings.Fields(STOP_WORDS_FR))
+		case LANGUAGE_DE:
+			set = newStopwordSet(strings.Fields(STOP_WORDS_DE))
+		default:
+			return nil, fmt.Errorf("unknown stopword language %q", t.Language)
+		}
+	}
+
+	stopwordSets[key] = set
+	return set, nil
+}
+
+/* Check a built-in stopword language is known (empty selects English) */
+func ValidLanguage(language string) bool {
+	return language == "" || language == LANGUAGE_EN || language == LANGUAGE_ES || language == LANGUAGE_FR || language == LANGUAGE_DE
+}
+
+/* Create a stopword set from a list of words, ignoring case, blank lines and surrounding spaces */
+func newStopwordSet(words []string) *stopwordSet {
+
+	set := &stopwordSet{words: make(map[string]bool)}
+	for _, word := range words {
+		if word = strings.ToLower(strings.TrimSpace(word)); len(word) > 0 {
+			set.words[word] = true
+		}
+	}
+
+	return set
+}
+
+/* Remove stopwords from text, each with the spaces or apostrophe following it. Word lists *
+ * match any case, e.g. a sentence's first word, the English set lowercase words only      */
+func (s *stopwordSet) remove(text string) string {
+
+	if s.pattern != nil {
+		return s.pattern.ReplaceAllString(text, "")
+	}
+
+	return wordPattern.ReplaceAllStringFunc(text, func(match string) string {
+		word := strings.TrimRightFunc(strings.TrimRight(match, "'’"), unicode.IsSpace)
+		if s.words[strings.ToLower(word)] {
+			return ""
+		}
+		return match
+	})
+}
+
+/* Select up to n distinct keywords by how often they were extracted (their Counts), most *
+ * frequent first, breaking ties alphabetically so the same text always gives the same set */
+func (t *Text) TopKeywords(n int) []string {
+
+	result := make([]string, 0, len(t.Counts))
+	for keyword := range t.Counts {
+		result = append(result, keyword)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if t.Counts[result[i]] != t.Counts[result[j]] {
+			return t.Counts[result[i]] > t.Counts[result[j]]
+		}
+		return result[i] < result[j]
+	})
+
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+/* Check whether a keyword is in a list of keywords */
+func containsKeyword(keywords []string, keyword string) bool {
+	for _, k := range keywords {
+		if k == keyword {
+			return true
+		}
+	}
+	return false
+}
+
+/* Deduplicate keyword extracts from extracted text */
+func removeDuplicates(keywords []string) []string {
+
+	// Use map to record duplicates
+	encountered := make(map[string]bool)
+	result := make([]string, 0, 0)
+
+	for v := range keywords {
+		if encountered[keywords[v]] == true {
+			// Do not add duplicate.
+		} else {
+			// Record element as an encountered element.
+			encountered[keywords[v]] = true
+			// Append to result slice
+			result = append(result, keywords[v])
+		}
+	}
+	// Return the deduped slice array
+	return result
+}
@@ -0,0 +1,252 @@
+package textExtract
+
+import (
+	"io/ioutil" // Standard packages
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode"
+
+	"secureindex/keywordUtils" // Custom packages
+)
+
+/* Declare custom structure for a keyword extractor keeping every word, so tests don't depend *
+ * on Prose's tagging                                                                         */
+type wordExtractor struct{}
+
+func (wordExtractor) Extract(text string) ([]string, error) {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsMark(r) && !unicode.IsDigit(r) && r != '-'
+	}), nil
+}
+
+/* Check a keyword entered by a user is searched for with terms the text's index holds */
+func searchable(t *Text, query string) bool {
+
+	keyword := keywordUtils.NormalizeKeyword(query, t.Normalization)
+	if len(keyword) == 0 || !keywordUtils.KeepKeyword(keyword, t.Normalization) {
+		return false
+	}
+	for _, term := range keywordUtils.QueryTerms(keyword, t.Normalization) {
+		if !containsKeyword(t.Keywords, term) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestExtractKeywordsAgreesWithQueries(t *testing.T) {
+
+	stopwordFile := filepath.Join(t.TempDir(), "stopwords.txt")
+	if err := ioutil.WriteFile(stopwordFile, []byte("Rabbit\n\n  watch  \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		text    Text
+		found   []string // Queries matching the text's keywords
+		missing []string // Queries that don't
+	}{
+		{"combining accents composed", Text{RawText: "cafe\u0301 au lait"}, []string{"Café", "cafe\u0301"}, []string{"cafe"}},
+		{"accents folded", Text{RawText: "Cafe\u0301 au lait", Normalization: keywordUtils.Options{FoldAccents: true}}, []string{"Café", "cafe"}, nil},
+		{"english stopwords", Text{RawText: "rabbit and the watch"}, []string{"rabbit", "watch"}, []string{"and", "the"}},
+		{"french stopwords", Text{RawText: "le lapin et la montre", Language: LANGUAGE_FR}, []string{"lapin", "montre"}, []string{"le", "et", "la"}},
+		{"french elision", Text{RawText: "l'heure d'automne", Language: LANGUAGE_FR}, []string{"heure", "automne"}, []string{"l'heure", "d'automne"}},
+		{"spanish stopwords", Text{RawText: "el conejo y la reina", Language: LANGUAGE_ES}, []string{"conejo", "reina"}, []string{"el", "la"}},
+		{"german stopwords", Text{RawText: "Der Hase und die Uhr", Language: LANGUAGE_DE}, []string{"hase", "uhr"}, []string{"der", "und", "die"}},
+		{"stopword file", Text{RawText: "rabbit watch queen", StopwordFile: stopwordFile}, []string{"queen"}, []string{"rabbit", "watch"}},
+		{"stemmed", Text{RawText: "rabbits running", Normalization: keywordUtils.Options{Stem: true}}, []string{"rabbit", "runs", "Running"}, nil},
+		{"unstemmed", Text{RawText: "rabbits running"}, []string{"rabbits"}, []string{"rabbit", "runs"}},
+		{"hyphens whole", Text{RawText: "state-of-the-art engine"}, []string{"State-of-the-Art"}, []string{"state", "art"}},
+		{"hyphens split", Text{RawText: "state-of-the-art engine", Normalization: keywordUtils.Options{Hyphens: keywordUtils.HYPHENS_SPLIT}}, []string{"state-of-the-art", "state", "art"}, nil},
+		{"hyphens both", Text{RawText: "state-of-the-art engine", Normalization: keywordUtils.Options{Hyphens: keywordUtils.HYPHENS_BOTH}}, []string{"state-of-the-art", "state", "art"}, nil},
+		{"stemmed hyphens", Text{RawText: "well-funded", Normalization: keywordUtils.Options{Stem: true}}, []string{"well-funding"}, nil},
+		{"length limits", Text{RawText: "x ox " + strings.Repeat("z", keywordUtils.MAX_LENGTH+1)}, []string{"ox"}, []string{"x", strings.Repeat("z", keywordUtils.MAX_LENGTH+1)}},
+		{"raised minimum length", Text{RawText: "ox hare", Normalization: keywordUtils.Options{MinLength: 3}}, []string{"hare"}, []string{"ox"}},
+		{"entities", Text{RawText: "a letter", Entities: []string{"bank of england"}}, []string{"Bank of England", `"bank of england"`}, []string{"england"}},
+		{"stemmed entities", Text{RawText: "a letter", Entities: []string{"queens of hearts"}, Normalization: keywordUtils.Options{Stem: true}}, []string{"queen of heart"}, nil},
+		{"headings", Text{RawText: "a letter", Headings: []string{"1. down the rabbit-hole"}}, []string{"rabbit", "hole"}, []string{"the", "1"}},
+	}
+
+	for _, test := range tests {
+		text := test.text
+		text.Extractor = wordExtractor{}
+		if err := text.ExtractKeywords(); err != nil {
+			t.Errorf("%s: ExtractKeywords failed: %v", test.name, err)
+			continue
+		}
+		for _, query := range test.found {
+			if !searchable(&text, query) {
+				t.Errorf("%s: query %q doesn't match keywords %q", test.name, query, text.Keywords)
+			}
+		}
+		for _, query := range test.missing {
+			if searchable(&text, query) {
+				t.Errorf("%s: query %q matches keywords %q", test.name, query, text.Keywords)
+			}
+		}
+	}
+
+	text := Text{RawText: "rabbit", Language: "xx", Extractor: wordExtractor{}}
+	if err := text.ExtractKeywords(); err == nil {
+		t.Error("ExtractKeywords accepted an unknown language")
+	}
+}
+
+func TestExtractKeywordsNormalisesText(t *testing.T) {
+
+	// The raw text is composed, so keyword positions index the same text searches see
+	text := Text{RawText: "cafe\u0301 society, cafe\u0301 culture", Extractor: wordExtractor{}, TrackPositions: true}
+	if err := text.ExtractKeywords(); err != nil {
+		t.Fatal(err)
+	}
+	if text.RawText != "café society, café culture" {
+		t.Errorf("RawText = %q, not composed", text.RawText)
+	}
+	if got := text.Positions["café"]; len(got) != 2 || got[0] != 0 || got[1] != strings.LastIndex(text.RawText, "café") {
+		t.Errorf("positions of café = %v", got)
+	}
+	if text.Counts["café"] != 2 {
+		t.Errorf("café counted %d times, want 2", text.Counts["café"])
+	}
+}
+
+func TestKeywordPositions(t *testing.T) {
+
+	// Offsets point at each whole-word occurrence as written, whatever its case
+	raw := "Rabbit met the rabbit, the White RABBIT's watch. Rabbits everywhere."
+	text := Text{RawText: raw, Extractor: wordExtractor{}, TrackPositions: true}
+	if err := text.ExtractKeywords(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{"rabbit": {"Rabbit", "rabbit", "RABBIT"}, "watch": {"watch"}, "rabbits": {"Rabbits"}}
+	for keyword, occurrences := range want {
+		got := text.Positions[keyword]
+		if len(got) != len(occurrences) {
+			t.Errorf("positions of %q = %v, want %d", keyword, got, len(occurrences))
+			continue
+		}
+		for i, offset := range got {
+			if end := offset + len(occurrences[i]); end > len(text.RawText) || text.RawText[offset:end] != occurrences[i] {
+				t.Errorf("position %d of %q doesn't point at %q in %q", offset, keyword, occurrences[i], text.RawText)
+			}
+		}
+	}
+}
+
+func TestKeywordFrequencies(t *testing.T) {
+
+	text := Text{RawText: "rabbit watch rabbit hatter rabbit watch queen", Extractor: wordExtractor{}}
+	if err := text.ExtractKeywords(); err != nil {
+		t.Fatal(err)
+	}
+	if text.Counts["rabbit"] != 3 || text.Counts["watch"] != 2 || text.Counts["queen"] != 1 {
+		t.Errorf("Counts = %v", text.Counts)
+	}
+	if strings.Join(text.Keywords, ",") != "rabbit,watch,hatter,queen" {
+		t.Errorf("Keywords = %q, want each once in order of appearance", text.Keywords)
+	}
+
+	// Ties are broken alphabetically, so the same text always keeps the same keywords
+	if got := strings.Join(text.TopKeywords(3), ","); got != "rabbit,watch,hatter" {
+		t.Errorf("TopKeywords(3) = %q", got)
+	}
+	if got := text.TopKeywords(10); len(got) != 4 {
+		t.Errorf("TopKeywords(10) = %q, want all 4 keywords", got)
+	}
+
+	// Limiting the keywords also limits the counts and positions kept for them
+	text = Text{RawText: "rabbit watch rabbit hatter rabbit watch queen", Extractor: wordExtractor{}, MaxKeywords: 2, TrackPositions: true}
+	if err := text.ExtractKeywords(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(text.Keywords, ",") != "rabbit,watch" || len(text.Counts) != 2 || len(text.Positions) != 2 {
+		t.Errorf("MaxKeywords 2 kept %q, counts %v, positions %v", text.Keywords, text.Counts, text.Positions)
+	}
+}
+
+func TestProseTagsAndNGrams(t *testing.T) {
+
+	// By default only nouns are kept, other kinds of word when tagged for
+	nouns := Text{RawText: "The rabbit quickly checks the golden watch."}
+	if err := nouns.ExtractKeywords(); err != nil {
+		t.Fatal(err)
+	}
+	verbs := Text{RawText: "The rabbit quickly checks the golden watch.", Tags: []string{"NN*", "VB*", "JJ*"}}
+	if err := verbs.ExtractKeywords(); err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{"rabbit", "watch"} {
+		if !searchable(&nouns, query) || !searchable(&verbs, query) {
+			t.Errorf("noun %q not kept: %q, %q", query, nouns.Keywords, verbs.Keywords)
+		}
+	}
+	for _, query := range []string{"checks", "golden"} {
+		if searchable(&nouns, query) {
+			t.Errorf("%q kept with the default noun tags: %q", query, nouns.Keywords)
+		}
+		if !searchable(&verbs, query) {
+			t.Errorf("%q not kept when tagged for: %q", query, verbs.Keywords)
+		}
+	}
+
+	// Tags match exactly, so proper nouns are only kept when tagged for
+	for _, test := range []struct {
+		tags []string
+		kept bool
+	}{
+		{nil, false},
+		{[]string{"NN"}, false},
+		{[]string{"NN", "NNS", "NNP"}, true},
+		{[]string{"NN*"}, true},
+	} {
+		text := Text{RawText: "Alice followed the rabbit into the garden.", Tags: test.tags}
+		if err := text.ExtractKeywords(); err != nil {
+			t.Fatal(err)
+		}
+		if !searchable(&text, "garden") {
+			t.Errorf("tags %q: noun not kept: %q", test.tags, text.Keywords)
+		}
+		if kept := searchable(&text, "alice"); kept != test.kept {
+			t.Errorf("tags %q: proper noun kept %v, want %v: %q", test.tags, kept, test.kept, text.Keywords)
+		}
+	}
+
+	// Runs of nouns are kept as phrases a quoted query matches, stemmed alike
+	for _, normalization := range []keywordUtils.Options{{}, {Stem: true}} {
+		text := Text{RawText: "Research into machine learning grows.", NGrams: 2, Normalization: normalization}
+		if err := text.ExtractKeywords(); err != nil {
+			t.Fatal(err)
+		}
+		if !searchable(&text, `"machine learning"`) {
+			t.Errorf("stem %v: phrase not searchable in %q", normalization.Stem, text.Keywords)
+		}
+	}
+}
+
+func TestProseCompounds(t *testing.T) {
+
+	// Compounds tagged as adjectives are only kept when hyphens are split, extraction is unchanged otherwise
+	for _, test := range []struct {
+		hyphens string
+		kept    bool
+	}{
+		{"", false},
+		{keywordUtils.HYPHENS_WHOLE, false},
+		{keywordUtils.HYPHENS_SPLIT, true},
+		{keywordUtils.HYPHENS_BOTH, true},
+	} {
+		text := Text{RawText: "They built a state-of-the-art engine.", Normalization: keywordUtils.Options{Hyphens: test.hyphens}}
+		if err := text.ExtractKeywords(); err != nil {
+			t.Fatal(err)
+		}
+		if !searchable(&text, "engine") {
+			t.Errorf("hyphens %q: noun not kept: %q", test.hyphens, text.Keywords)
+		}
+		if kept := searchable(&text, "state-of-the-art"); kept != test.kept {
+			t.Errorf("hyphens %q: compound kept %v, want %v: %q", test.hyphens, kept, test.kept, text.Keywords)
+		}
+	}
+}
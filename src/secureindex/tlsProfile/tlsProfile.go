@@ -0,0 +1,89 @@
+package tlsProfile
+
+/* Named TLS security profiles shared by the search client and search server, so both *
+ * ends agree on protocol versions and cipher suites rather than each hardcoding them *
+ * Source ref: wiki.mozilla.org/Security/Server_Side_TLS                              */
+
+import (
+	"crypto/tls" // Standard packages
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Names of the available TLS security profiles
+const (
+	MODERN       = "modern"       // TLS 1.3 only
+	INTERMEDIATE = "intermediate" // TLS 1.2 with forward-secret AEAD suites, or TLS 1.3 (default)
+	LEGACY       = "legacy"       // Adds TLS 1.0/1.1 and CBC suites for old peers, avoid if possible
+)
+
+// Forward-secret AEAD cipher suites for TLS 1.2 (TLS 1.3 suites aren't configurable in Go)
+var aeadSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+}
+
+// Additional cipher suites only enabled by the legacy profile
+var legacySuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+}
+
+/* Return the names of the available profiles */
+func Names() []string {
+
+	return []string{MODERN, INTERMEDIATE, LEGACY}
+}
+
+/* Create a TLS configuration for the named profile. Callers add certificates and *
+ * any verification settings to the returned configuration                       */
+func Config(profile string) (*tls.Config, error) {
+
+	config := &tls.Config{
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521},
+	}
+
+	switch profile {
+	case MODERN:
+		config.MinVersion = tls.VersionTLS13
+	case INTERMEDIATE:
+		config.MinVersion = tls.VersionTLS12
+		config.CipherSuites = append([]uint16{}, aeadSuites...)
+	case LEGACY:
+		config.MinVersion = tls.VersionTLS10
+		config.CipherSuites = append(append([]uint16{}, aeadSuites...), legacySuites...)
+	default:
+		return nil, fmt.Errorf("unknown TLS profile %q, expected one of %v", profile, Names())
+	}
+
+	return config, nil
+}
+
+/* Read a PEM file of CA certificates into a pool, e.g. for the server to verify client *
+ * certificates against (mutual TLS) or the client to verify the server's               */
+func LoadCAPool(caFile string) (*x509.CertPool, error) {
+
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no PEM encoded certificates found in " + caFile)
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,139 @@
+package tlsProfile
+
+import (
+	"crypto/ecdsa" // Standard packages
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+/* Create a self-signed certificate for the test server */
+func testCertificate(t *testing.T) tls.Certificate {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+/* Handshake a client and server over an in-memory connection, returning the *
+ * version negotiated or the client's handshake error                       */
+func handshake(client *tls.Config, server *tls.Config) (uint16, error) {
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	deadline := time.Now().Add(10 * time.Second)
+	clientConn.SetDeadline(deadline)
+	serverConn.SetDeadline(deadline)
+
+	done := make(chan struct{})
+	go func() {
+		s := tls.Server(serverConn, server)
+		if s.Handshake() != nil {
+			serverConn.Close()
+		}
+		close(done)
+	}()
+
+	c := tls.Client(clientConn, client)
+	err := c.Handshake()
+	clientConn.Close()
+	<-done
+
+	return c.ConnectionState().Version, err
+}
+
+func TestProfilesHandshake(t *testing.T) {
+
+	// Peers sharing a profile agree on the highest version it allows
+	cer := testCertificate(t)
+	for _, profile := range Names() {
+		server, err := Config(profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.Certificates = []tls.Certificate{cer}
+		client, err := Config(profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.InsecureSkipVerify = true
+
+		version, err := handshake(client, server)
+		if err != nil {
+			t.Errorf("%s: handshake with a %s peer failed: %v", profile, profile, err)
+		} else if version != tls.VersionTLS13 {
+			t.Errorf("%s: negotiated version %x, want TLS 1.3", profile, version)
+		}
+	}
+}
+
+func TestProfileVersions(t *testing.T) {
+
+	cer := testCertificate(t)
+	tests := []struct {
+		profile string
+		max     uint16 // Highest version the peer supports
+		ok      bool
+	}{
+		{MODERN, tls.VersionTLS13, true},
+		{MODERN, tls.VersionTLS12, false},
+		{INTERMEDIATE, tls.VersionTLS12, true},
+		{INTERMEDIATE, tls.VersionTLS11, false},
+		{LEGACY, tls.VersionTLS12, true},
+	}
+
+	for _, test := range tests {
+		profile, err := Config(test.profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer := &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: test.max}
+
+		// The profile is enforced whichever end uses it
+		server := profile.Clone()
+		server.Certificates = []tls.Certificate{cer}
+		client := peer.Clone()
+		client.InsecureSkipVerify = true
+		if _, err := handshake(client, server); (err == nil) != test.ok {
+			t.Errorf("%s server, client up to TLS %x: handshake error %v, want success %v", test.profile, test.max, err, test.ok)
+		}
+
+		server = peer.Clone()
+		server.Certificates = []tls.Certificate{cer}
+		client = profile.Clone()
+		client.InsecureSkipVerify = true
+		if _, err := handshake(client, server); (err == nil) != test.ok {
+			t.Errorf("%s client, server up to TLS %x: handshake error %v, want success %v", test.profile, test.max, err, test.ok)
+		}
+	}
+}
+
+func TestUnknownProfile(t *testing.T) {
+
+	if _, err := Config("paranoid"); err == nil {
+		t.Error("Config accepted an unknown profile")
+	}
+}